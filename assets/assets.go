@@ -20,10 +20,20 @@ import (
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	"strings"
+	"sync"
 )
 
-//钱包管理器组
-var managers = make(map[string]interface{})
+//钱包管理器组，同时保存资产适配器及旧版钱包管理器
+var (
+	managersMu sync.RWMutex
+	managers   = make(map[string]interface{})
+)
+
+//旧版钱包管理器的适配器桥接缓存
+var (
+	legacyAdaptersMu sync.Mutex
+	legacyAdapters   = make(map[string]*LegacyAdapter)
+)
 
 // RegAssets 注册资产
 // @param name 资产别名
@@ -38,12 +48,14 @@ func RegAssets(name string, manager interface{}, config ...config.Configer) {
 	if manager == nil {
 		panic("assets: Register adapter is nil")
 	}
+	managersMu.Lock()
 	if _, ok := managers[name]; ok {
+		managersMu.Unlock()
 		log.Error("assets: Register called twice for adapter ", name)
 		return
 	}
-
 	managers[name] = manager
+	managersMu.Unlock()
 
 	//如果有配置则加载所有配置
 	if ac, ok := manager.(openwallet.AssetsConfig); ok && config != nil {
@@ -53,12 +65,60 @@ func RegAssets(name string, manager interface{}, config ...config.Configer) {
 	}
 }
 
+// UnregAssets 注销资产，注销后可以重新注册同名资产，用于测试替换适配器
+func UnregAssets(name string) {
+	name = strings.ToUpper(name)
+	managersMu.Lock()
+	delete(managers, name)
+	managersMu.Unlock()
+
+	legacyAdaptersMu.Lock()
+	delete(legacyAdapters, name)
+	legacyAdaptersMu.Unlock()
+}
+
 // GetAssets 根据币种类型获取已注册的管理者
 func GetAssets(symbol string) interface{} {
 	symbol = strings.ToUpper(symbol)
+	managersMu.RLock()
 	manager, ok := managers[symbol]
+	managersMu.RUnlock()
 	if !ok {
 		return nil
 	}
 	return manager
 }
+
+// GetAssetsAdapter 根据币种类型获取资产适配器
+// 旧版钱包管理器没有实现openwallet.AssetsAdapter，返回LegacyAdapter桥接
+func GetAssetsAdapter(symbol string) openwallet.AssetsAdapter {
+	manager := GetAssets(symbol)
+	if manager == nil {
+		return nil
+	}
+
+	if adapter, ok := manager.(openwallet.AssetsAdapter); ok {
+		return adapter
+	}
+
+	symbol = strings.ToUpper(symbol)
+
+	legacyAdaptersMu.Lock()
+	defer legacyAdaptersMu.Unlock()
+	adapter, ok := legacyAdapters[symbol]
+	if !ok {
+		adapter = NewLegacyAdapter(symbol, manager)
+		legacyAdapters[symbol] = adapter
+	}
+	return adapter
+}
+
+// IsLegacyAssets 已注册的是否旧版钱包管理器
+func IsLegacyAssets(symbol string) bool {
+	manager := GetAssets(symbol)
+	if manager == nil {
+		return false
+	}
+	_, ok := manager.(openwallet.AssetsAdapter)
+	return !ok
+}
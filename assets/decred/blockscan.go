@@ -23,6 +23,7 @@ import (
 	"github.com/asdine/storm/q"
 	"github.com/blocktree/openwallet/v2/crypto"
 	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	"github.com/blocktree/openwallet/v2/timer"
 	"github.com/tidwall/gjson"
@@ -258,6 +259,8 @@ func (bs *BTCBlockScanner) scanBlock() {
 
 		log.Std.Info("block scanner scanning height: %d ...", currentHeight)
 
+		start := time.Now()
+
 		hash, err := bs.wm.GetBlockHash(currentHeight)
 		if err != nil {
 			//下一个高度找不到会报异常
@@ -313,6 +316,7 @@ func (bs *BTCBlockScanner) scanBlock() {
 			if err != nil {
 				log.Std.Error("block scanner can not extractRechargeRecords; unexpected error: %v", err)
 			}
+			metrics.ObserveBlockExtract(Symbol, metrics.ExtractModeLive, start)
 
 			//重置当前区块的hash
 			currentHash = hash
@@ -1080,6 +1084,26 @@ func (wm *WalletManager) GetTransaction(txid string) (*gjson.Result, error) {
 
 }
 
+//GetTransactionPresence 查询交易单在全节点的状态，已上链时返回区块高度
+//全节点需要开启txindex，否则已上链的交易也会返回notFound
+func (wm *WalletManager) GetTransactionPresence(txid string) (string, uint64, error) {
+
+	trx, err := wm.GetTransaction(txid)
+	if err != nil {
+		//[-5]No information available about transaction
+		if strings.HasPrefix(err.Error(), "[-5]") {
+			return openwallet.TxPresenceNotFound, 0, nil
+		}
+		return "", 0, err
+	}
+
+	if trx.Get("confirmations").Int() > 0 {
+		return openwallet.TxPresenceMined, trx.Get("blockheight").Uint(), nil
+	}
+
+	return openwallet.TxPresencePending, 0, nil
+}
+
 //获取未扫记录
 func (wm *WalletManager) GetUnscanRecords() ([]*UnscanRecord, error) {
 	//获取本地区块高度
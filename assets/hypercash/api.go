@@ -21,9 +21,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
 	"github.com/imroc/req"
 	"github.com/tidwall/gjson"
 	"net/http"
+	"time"
 )
 
 // A Client is a Bitcoin RPC client. It performs RPCs over HTTP using JSON
@@ -62,6 +64,13 @@ func NewClient(url, token string, debug bool) *Client {
 
 // Call calls a remote procedure on another node, specified by the path.
 func (c *Client) Call(path string, request []interface{}) (*gjson.Result, error) {
+	start := time.Now()
+	result, err := c.call(path, request)
+	metrics.ObserveRPCCall(Symbol, path, start, err)
+	return result, err
+}
+
+func (c *Client) call(path string, request []interface{}) (*gjson.Result, error) {
 
 	var (
 		body = make(map[string]interface{}, 0)
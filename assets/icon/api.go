@@ -20,10 +20,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/imroc/req"
 	"github.com/shopspring/decimal"
 	"github.com/tidwall/gjson"
+	"time"
 )
 
 type Client struct {
@@ -47,6 +49,13 @@ func NewClient(url string, debug bool) *Client {
 
 // Call calls a remote procedure on another node, specified by the path.
 func (c *Client) Call(path string, request map[string]interface{}) (*gjson.Result, error) {
+	start := time.Now()
+	result, err := c.call(path, request)
+	metrics.ObserveRPCCall(Symbol, path, start, err)
+	return result, err
+}
+
+func (c *Client) call(path string, request map[string]interface{}) (*gjson.Result, error) {
 
 	var (
 		body = make(map[string]interface{}, 0)
@@ -365,7 +365,7 @@ func (wm *WalletManager) TransferFlow() error {
 
 	if haveEnoughBalance {
 		for _, send := range sends {
-			txid, _ := wm.Transfer(send.sednKeys.PrivateKey, send.sednKeys.Address, receiver, send.amount.String(), wm.Config.StepLimit, 100)
+			txid, _ := wm.transferWithNonce(send.sednKeys.PrivateKey, send.sednKeys.Address, receiver, send.amount.String(), wm.Config.StepLimit)
 
 			log.Printf("transfer from address:%s, to address:%s, amount:%s, txid:%s\n", send.sednKeys.Address, receiver, send.amount.String(), txid)
 		}
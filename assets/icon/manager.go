@@ -57,6 +57,7 @@ type WalletManager struct {
 	WalletClient *Client                       // 节点客户端
 	Config       *WalletConfig                 //钱包管理配置
 	WalletsInSum map[string]*openwallet.Wallet //参与汇总的钱包
+	Nonces       openwallet.NonceDAI           //nonce管理器，设置后并发转账预留nonce，避免同一地址重复
 	//Blockscanner *XTZBlockScanner             //区块扫描器
 	//Decoder      *openwallet.AddressDecoder     //地址编码器
 }
@@ -107,8 +108,9 @@ func (wm *WalletManager) CalculateTxHash(from, to, value string, stepLimit, nonc
 	tx_temp["from"] = from
 	tx_temp["nid"] = "0x1" //主网ID
 
-	//hnonce := fmt.Sprintf("%x", nonce)
-	//tx_temp["nonce"] = "0x" + hnonce
+	if nonce > 0 {
+		tx_temp["nonce"] = "0x" + strconv.FormatInt(nonce, 16)
+	}
 
 	hstepLimit := fmt.Sprintf("%x", stepLimit)
 	tx_temp["stepLimit"] = "0x" + hstepLimit
@@ -153,7 +155,44 @@ func (wm *WalletManager) CalculateTxHash(from, to, value string, stepLimit, nonc
 	return tx_temp, hash
 }
 
-//转账
+//SetNonceDAI 设置nonce管理器，实现openwallet.NonceDAISetter
+func (wm *WalletManager) SetNonceDAI(dai openwallet.NonceDAI) {
+	wm.Nonces = dai
+}
+
+//GetNonceSource 下一个可用的nonce，实现openwallet.NonceSourceProvider
+func (wm *WalletManager) GetNonceSource() openwallet.NonceSource {
+	return wm.nextNonce
+}
+
+//nextNonce ICON链上不校验nonce顺序，只用于区分同一地址的交易，以微秒时间戳作为下一个可用的nonce
+//预留的nonce单调递增，对账时清除之前的预留记录
+func (wm *WalletManager) nextNonce(address string) (uint64, error) {
+	return uint64(time.Now().UnixNano() / 1000), nil
+}
+
+//transferWithNonce 设置nonce管理器时预留nonce再转账，广播成功提交预留，失败释放
+func (wm *WalletManager) transferWithNonce(sk []byte, from, to, value string, stepLimit int64) (string, error) {
+	if wm.Nonces == nil {
+		return wm.Transfer(sk, from, to, value, stepLimit, 0)
+	}
+
+	r, err := wm.Nonces.ReserveNonce(Symbol, from, wm.nextNonce)
+	if err != nil {
+		return "", err
+	}
+
+	txid, err := wm.Transfer(sk, from, to, value, stepLimit, int64(r.Nonce))
+	if err != nil {
+		wm.Nonces.ReleaseNonce(r)
+		return "", err
+	}
+	wm.Nonces.CommitNonce(r, txid)
+
+	return txid, nil
+}
+
+//转账，nonce为0时不设置
 func (wm *WalletManager) Transfer(sk []byte, from, to, value string, stepLimit, nonce int64) (string, error) {
 	tx, hash := wm.CalculateTxHash(from, to, value, stepLimit, nonce)
 
@@ -619,7 +658,7 @@ func (wm *WalletManager) summaryWallet(wallet *openwallet.Wallet, password strin
 				// 将该地址的余额减去矿工费后，全部转到汇总地址
 				amount := decimal_balance.Sub(wm.Config.fees)
 				if amount.GreaterThan(decimal.Zero) {
-					txid, _ := wm.Transfer(k.PrivateKey, a.Address, wm.Config.SumAddress, amount.String(), wm.Config.StepLimit, 100)
+					txid, _ := wm.transferWithNonce(k.PrivateKey, a.Address, wm.Config.SumAddress, amount.String(), wm.Config.StepLimit)
 					log.Std.Info("summary from address:%s, to address:%s, amount:%s, txid:%s", k.Address, wm.Config.SumAddress, amount.String(), txid)
 				}
 			}
@@ -0,0 +1,322 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package assets
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/config"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+/*
+	旧版钱包管理器（decred、hypercash、tezos、icon、sia、cardano、bytom、obyte等）
+	只实现了wmd的交互流程，以下接口是它们已有的编程方法，桥接器按接口探测并映射到AssetsAdapter
+*/
+
+//LegacyBlockHeightGetter 查询全节点区块高度，decred、hypercash
+type LegacyBlockHeightGetter interface {
+	GetBlockHeight() (uint64, error)
+}
+
+//LegacyRawTransactionSender 广播原始交易，decred、hypercash
+type LegacyRawTransactionSender interface {
+	SendRawTransaction(txHex string) (string, error)
+}
+
+//LegacyTransactionPresenceGetter 查询交易单在全节点的状态，decred、hypercash
+type LegacyTransactionPresenceGetter interface {
+	GetTransactionPresence(txid string) (presence string, blockHeight uint64, err error)
+}
+
+//LegacyTransactionSender 钱包转账，decred、hypercash
+type LegacyTransactionSender interface {
+	SendTransaction(walletID, to string, amount decimal.Decimal, password string, feesInSender bool) ([]string, error)
+}
+
+//LegacyAddressCreator 批量创建地址，decred、hypercash、icon、tezos
+type LegacyAddressCreator interface {
+	CreateBatchAddress(walletID, password string, count uint64) (string, []*openwallet.Address, error)
+}
+
+//LegacyAddressBalancer 查询地址余额，decred、hypercash
+type LegacyAddressBalancer interface {
+	GetMerchantAddressBalance(walletID, address string) (string, error)
+}
+
+//LegacyWalletBalancer 查询钱包余额，decred、hypercash
+type LegacyWalletBalancer interface {
+	GetMerchantWalletBalance(walletID string) (string, error)
+}
+
+type (
+	legacySymbol    interface{ Symbol() string }
+	legacyFullName  interface{ FullName() string }
+	legacyCurveType interface{ CurveType() uint32 }
+	legacyDecimal   interface{ Decimal() int32 }
+	legacyLogger    interface{ GetAssetsLogger() *log.OWLogger }
+)
+
+//LegacyAdapter 旧版钱包管理器的资产适配器桥接
+//无法映射的功能沿用基类的not implement实现，并通过DeclareCapabilities声明不支持
+type LegacyAdapter struct {
+	openwallet.AssetsAdapterBase
+	symbol  string
+	manager interface{}
+	decoder openwallet.TransactionDecoder
+	scanner *legacyBlockScanner
+}
+
+//NewLegacyAdapter 桥接旧版钱包管理器
+func NewLegacyAdapter(symbol string, manager interface{}) *LegacyAdapter {
+	a := &LegacyAdapter{
+		symbol:  strings.ToUpper(symbol),
+		manager: manager,
+	}
+	if sender, ok := manager.(LegacyRawTransactionSender); ok {
+		decoder := &legacyTransactionDecoder{symbol: a.symbol, sender: sender}
+		a.decoder = decoder
+		if getter, ok := manager.(LegacyTransactionPresenceGetter); ok {
+			a.decoder = &legacyPresenceDecoder{legacyTransactionDecoder: decoder, getter: getter}
+		}
+	}
+	if getter, ok := manager.(LegacyBlockHeightGetter); ok {
+		a.scanner = &legacyBlockScanner{BlockScannerBase: openwallet.NewBlockScannerBase(), symbol: a.symbol, getter: getter}
+	}
+	return a
+}
+
+//Legacy 被桥接的旧版钱包管理器
+func (a *LegacyAdapter) Legacy() interface{} {
+	return a.manager
+}
+
+//Symbol 币种标识，旧版管理器没有实现时使用注册名
+func (a *LegacyAdapter) Symbol() string {
+	if m, ok := a.manager.(legacySymbol); ok {
+		return m.Symbol()
+	}
+	return a.symbol
+}
+
+//FullName 币种全名
+func (a *LegacyAdapter) FullName() string {
+	if m, ok := a.manager.(legacyFullName); ok {
+		return m.FullName()
+	}
+	return a.AssetsAdapterBase.FullName()
+}
+
+//CurveType 曲线类型
+func (a *LegacyAdapter) CurveType() uint32 {
+	if m, ok := a.manager.(legacyCurveType); ok {
+		return m.CurveType()
+	}
+	return a.AssetsAdapterBase.CurveType()
+}
+
+//Decimal 小数位精度
+func (a *LegacyAdapter) Decimal() int32 {
+	if m, ok := a.manager.(legacyDecimal); ok {
+		return m.Decimal()
+	}
+	return a.AssetsAdapterBase.Decimal()
+}
+
+//LoadAssetsConfig 加载外部配置
+func (a *LegacyAdapter) LoadAssetsConfig(c config.Configer) error {
+	if m, ok := a.manager.(openwallet.AssetsConfig); ok {
+		return m.LoadAssetsConfig(c)
+	}
+	return a.AssetsAdapterBase.LoadAssetsConfig(c)
+}
+
+//InitAssetsConfig 初始化默认配置
+func (a *LegacyAdapter) InitAssetsConfig() (config.Configer, error) {
+	if m, ok := a.manager.(openwallet.AssetsConfig); ok {
+		return m.InitAssetsConfig()
+	}
+	return a.AssetsAdapterBase.InitAssetsConfig()
+}
+
+//GetAssetsLogger 获取资产日志工具
+func (a *LegacyAdapter) GetAssetsLogger() *log.OWLogger {
+	if m, ok := a.manager.(legacyLogger); ok {
+		return m.GetAssetsLogger()
+	}
+	return nil
+}
+
+//GetTransactionDecoder 只支持广播交易单，旧版管理器可查询交易单状态时同时实现TransactionPresenceChecker
+func (a *LegacyAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	if a.decoder == nil {
+		return nil
+	}
+	return a.decoder
+}
+
+//GetBlockScanner 只支持查询区块高度，不支持扫块
+func (a *LegacyAdapter) GetBlockScanner() openwallet.BlockScanner {
+	if a.scanner == nil {
+		return nil
+	}
+	return a.scanner
+}
+
+//DeclareCapabilities 旧版管理器不支持的可选功能
+func (a *LegacyAdapter) DeclareCapabilities() openwallet.Capabilities {
+	return openwallet.Capabilities{
+		openwallet.CapabilityTransactionsByAddress: false,
+		openwallet.CapabilityEstimateFee:           false,
+		openwallet.CapabilitySummaryWithFee:        false,
+	}
+}
+
+//SetNonceDAI 旧版管理器实现openwallet.NonceDAISetter时设置nonce管理器，icon、tezos
+func (a *LegacyAdapter) SetNonceDAI(dai openwallet.NonceDAI) {
+	if m, ok := a.manager.(openwallet.NonceDAISetter); ok {
+		m.SetNonceDAI(dai)
+	}
+}
+
+//GetNonceSource 旧版管理器提供的链上nonce查询，没有实现openwallet.NonceSourceProvider返回nil
+func (a *LegacyAdapter) GetNonceSource() openwallet.NonceSource {
+	if m, ok := a.manager.(openwallet.NonceSourceProvider); ok {
+		return m.GetNonceSource()
+	}
+	return nil
+}
+
+//CreateAddress 通过旧版管理器的本地钱包创建地址
+func (a *LegacyAdapter) CreateAddress(walletID, password string, count uint64) ([]*openwallet.Address, error) {
+	m, ok := a.manager.(LegacyAddressCreator)
+	if !ok {
+		return nil, openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] legacy manager is not support creating address", a.symbol)
+	}
+	_, addrs, err := m.CreateBatchAddress(walletID, password, count)
+	return addrs, err
+}
+
+//GetAddressBalance 通过旧版管理器查询地址余额
+func (a *LegacyAdapter) GetAddressBalance(walletID, address string) (string, error) {
+	m, ok := a.manager.(LegacyAddressBalancer)
+	if !ok {
+		return "", openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] legacy manager is not support address balance", a.symbol)
+	}
+	return m.GetMerchantAddressBalance(walletID, address)
+}
+
+//GetWalletBalance 通过旧版管理器查询钱包余额
+func (a *LegacyAdapter) GetWalletBalance(walletID string) (string, error) {
+	m, ok := a.manager.(LegacyWalletBalancer)
+	if !ok {
+		return "", openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] legacy manager is not support wallet balance", a.symbol)
+	}
+	return m.GetMerchantWalletBalance(walletID)
+}
+
+//Transfer 通过旧版管理器的本地钱包转账，返回交易单ID
+func (a *LegacyAdapter) Transfer(walletID, to, amount, password string) ([]string, error) {
+	m, ok := a.manager.(LegacyTransactionSender)
+	if !ok {
+		return nil, openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] legacy manager is not support transfer", a.symbol)
+	}
+	amountDec, err := decimal.NewFromString(amount)
+	if err != nil {
+		return nil, fmt.Errorf("amount is invalid: %v", err)
+	}
+	return m.SendTransaction(walletID, to, amountDec, password, false)
+}
+
+//legacyTransactionDecoder 广播已签名的原始交易
+type legacyTransactionDecoder struct {
+	openwallet.TransactionDecoderBase
+	symbol string
+	sender LegacyRawTransactionSender
+}
+
+//SubmitRawTransaction 广播交易单
+func (decoder *legacyTransactionDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+
+	if len(rawTx.RawHex) == 0 {
+		return nil, openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "raw transaction hex is empty")
+	}
+
+	txid, err := decoder.sender.SendRawTransaction(rawTx.RawHex)
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "[%s] submit raw transaction failed: %v", decoder.symbol, err)
+	}
+
+	rawTx.TxID = txid
+	rawTx.IsSubmit = true
+
+	tx := &openwallet.Transaction{
+		TxID:       txid,
+		Coin:       rawTx.Coin,
+		SubmitTime: time.Now().Unix(),
+	}
+	if rawTx.Account != nil {
+		tx.AccountID = rawTx.Account.AccountID
+	}
+	tx.WxID = openwallet.GenTransactionWxID(tx)
+
+	return tx, nil
+}
+
+//legacyPresenceDecoder 广播交易单并查询交易单在全节点的状态
+type legacyPresenceDecoder struct {
+	*legacyTransactionDecoder
+	getter LegacyTransactionPresenceGetter
+}
+
+//GetTransactionPresence 查询交易单在全节点的状态
+func (decoder *legacyPresenceDecoder) GetTransactionPresence(wrapper openwallet.WalletDAI, txid string) (string, uint64, error) {
+	return decoder.getter.GetTransactionPresence(txid)
+}
+
+//legacyBlockScanner 旧版管理器没有可桥接的扫块流程，只提供区块高度查询
+type legacyBlockScanner struct {
+	*openwallet.BlockScannerBase
+	symbol string
+	getter LegacyBlockHeightGetter
+}
+
+//Run 旧版管理器不支持扫块
+func (bs *legacyBlockScanner) Run() error {
+	return fmt.Errorf("[%s] legacy manager is not support block scan", bs.symbol)
+}
+
+//GetCurrentBlockHeader 获取当前区块高度
+func (bs *legacyBlockScanner) GetCurrentBlockHeader() (*openwallet.BlockHeader, error) {
+	height, err := bs.getter.GetBlockHeight()
+	if err != nil {
+		return nil, err
+	}
+	return &openwallet.BlockHeader{Height: height, Symbol: bs.symbol}, nil
+}
+
+//GetGlobalMaxBlockHeight 获取区块链全网最大高度
+func (bs *legacyBlockScanner) GetGlobalMaxBlockHeight() uint64 {
+	height, err := bs.getter.GetBlockHeight()
+	if err != nil {
+		return 0
+	}
+	return height
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package assets
+
+import (
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type legacyTestManager struct {
+	sent []string
+}
+
+func (wm *legacyTestManager) InitConfigFlow() error {
+	return nil
+}
+
+func (wm *legacyTestManager) GetBlockHeight() (uint64, error) {
+	return 100, nil
+}
+
+func (wm *legacyTestManager) SendRawTransaction(txHex string) (string, error) {
+	wm.sent = append(wm.sent, txHex)
+	return "txid-" + txHex, nil
+}
+
+func (wm *legacyTestManager) GetMerchantAddressBalance(walletID, address string) (string, error) {
+	return "1.5", nil
+}
+
+func TestGetAssetsAdapter_Legacy(t *testing.T) {
+
+	manager := &legacyTestManager{}
+	RegAssets("lgcy", manager)
+
+	if !IsLegacyAssets("LGCY") {
+		t.Errorf("LGCY should be legacy assets")
+	}
+
+	adapter := GetAssetsAdapter("LGCY")
+	if adapter == nil {
+		t.Errorf("legacy adapter is nil")
+		return
+	}
+	if adapter != GetAssetsAdapter("lgcy") {
+		t.Errorf("legacy adapter should be cached")
+	}
+	if adapter.Symbol() != "LGCY" {
+		t.Errorf("symbol = %s, want LGCY", adapter.Symbol())
+	}
+
+	header, err := adapter.GetBlockScanner().GetCurrentBlockHeader()
+	if err != nil || header.Height != 100 {
+		t.Errorf("GetCurrentBlockHeader = %+v, %v", header, err)
+	}
+
+	rawTx := &openwallet.RawTransaction{Coin: openwallet.Coin{Symbol: "LGCY"}, RawHex: "abc"}
+	tx, err := adapter.GetTransactionDecoder().SubmitRawTransaction(nil, rawTx)
+	if err != nil {
+		t.Errorf("SubmitRawTransaction failed, unexpected error: %v", err)
+		return
+	}
+	if tx.TxID != "txid-abc" || !rawTx.IsSubmit || len(manager.sent) != 1 {
+		t.Errorf("tx = %+v, rawTx = %+v", tx, rawTx)
+	}
+
+	legacy := adapter.(*LegacyAdapter)
+	if balance, err := legacy.GetAddressBalance("w1", "a1"); err != nil || balance != "1.5" {
+		t.Errorf("GetAddressBalance = %s, %v", balance, err)
+	}
+	if _, err := legacy.Transfer("w1", "a2", "1", ""); openwallet.ConvertError(err).Code() != openwallet.ErrUnsupportedCapability {
+		t.Errorf("Transfer should be unsupported, got: %v", err)
+	}
+
+	caps := openwallet.GetAssetsCapabilities(adapter)
+	if supported, known := caps.Supports(openwallet.CapabilityEstimateFee); supported || !known {
+		t.Errorf("estimateFee should be declared unsupported")
+	}
+	if supported, _ := caps.Supports(openwallet.CapabilityTxPresence); supported {
+		t.Errorf("txPresence should be unsupported without GetTransactionPresence")
+	}
+}
+
+type legacyPresenceTestManager struct {
+	legacyTestManager
+}
+
+func (wm *legacyPresenceTestManager) GetTransactionPresence(txid string) (string, uint64, error) {
+	if txid == "mined_tx" {
+		return openwallet.TxPresenceMined, 99, nil
+	}
+	return openwallet.TxPresenceNotFound, 0, nil
+}
+
+func TestGetAssetsAdapter_LegacyPresence(t *testing.T) {
+
+	adapter := NewLegacyAdapter("lgcp", &legacyPresenceTestManager{})
+
+	caps := openwallet.GetAssetsCapabilities(adapter)
+	if supported, _ := caps.Supports(openwallet.CapabilityTxPresence); !supported {
+		t.Errorf("txPresence should be supported")
+		return
+	}
+
+	checker := adapter.GetTransactionDecoder().(openwallet.TransactionPresenceChecker)
+	presence, height, err := checker.GetTransactionPresence(nil, "mined_tx")
+	if err != nil || presence != openwallet.TxPresenceMined || height != 99 {
+		t.Errorf("GetTransactionPresence = %s, %d, %v", presence, height, err)
+	}
+	if presence, _, _ = checker.GetTransactionPresence(nil, "dropped_tx"); presence != openwallet.TxPresenceNotFound {
+		t.Errorf("presence = %s, want notFound", presence)
+	}
+
+	rawTx := &openwallet.RawTransaction{Coin: openwallet.Coin{Symbol: "LGCP"}, RawHex: "abc"}
+	if _, err = adapter.GetTransactionDecoder().SubmitRawTransaction(nil, rawTx); err != nil {
+		t.Errorf("SubmitRawTransaction failed, unexpected error: %v", err)
+	}
+}
+
+type legacyNonceTestManager struct {
+	legacyTestManager
+	nonces openwallet.NonceDAI
+}
+
+func (wm *legacyNonceTestManager) SetNonceDAI(dai openwallet.NonceDAI) {
+	wm.nonces = dai
+}
+
+func (wm *legacyNonceTestManager) GetNonceSource() openwallet.NonceSource {
+	return func(address string) (uint64, error) {
+		return 7, nil
+	}
+}
+
+func TestLegacyAdapter_NonceDAI(t *testing.T) {
+
+	manager := &legacyNonceTestManager{}
+	adapter := NewLegacyAdapter("lgcn", manager)
+
+	dai := openwallet.NewNonceManager(nil)
+	adapter.SetNonceDAI(dai)
+	if manager.nonces != dai {
+		t.Errorf("nonce manager should be set to legacy manager")
+	}
+
+	source := adapter.GetNonceSource()
+	if source == nil {
+		t.Errorf("nonce source should be bridged")
+		return
+	}
+	if nonce, err := source("addr1"); err != nil || nonce != 7 {
+		t.Errorf("nonce source = %d, %v", nonce, err)
+	}
+
+	if NewLegacyAdapter("lgcx", &legacyTestManager{}).GetNonceSource() != nil {
+		t.Errorf("nonce source should be nil without NonceSourceProvider")
+	}
+}
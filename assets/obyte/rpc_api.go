@@ -19,8 +19,10 @@ import (
 	"encoding/base64"
 	"fmt"
 	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
 	"github.com/imroc/req"
 	"github.com/tidwall/gjson"
+	"time"
 )
 
 type ClientInterface interface {
@@ -55,6 +57,13 @@ func NewClient(url, token string, debug bool) *Client {
 
 // Call calls a remote procedure on another node, specified by the path.
 func (c *Client) Call(path string, request interface{}) (*gjson.Result, error) {
+	start := time.Now()
+	result, err := c.call(path, request)
+	metrics.ObserveRPCCall(Symbol, path, start, err)
+	return result, err
+}
+
+func (c *Client) call(path string, request interface{}) (*gjson.Result, error) {
 
 	var (
 		body = make(map[string]interface{}, 0)
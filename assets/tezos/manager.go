@@ -69,6 +69,7 @@ type WalletManager struct {
 	WalletClient *Client                       // 节点客户端
 	Config       *WalletConfig                 //钱包管理配置
 	WalletsInSum map[string]*openwallet.Wallet //参与汇总的钱包
+	Nonces       openwallet.NonceDAI           //nonce管理器，设置后并发转账预留counter，避免同一地址重复
 	//Blockscanner *XTZBlockScanner             //区块扫描器
 	//Decoder      *openwallet.AddressDecoder     //地址编码器
 }
@@ -119,6 +120,38 @@ func (wm *WalletManager) isReverlKey(pubkey string) bool {
 	return false
 }
 
+//SetNonceDAI 设置nonce管理器，实现openwallet.NonceDAISetter
+func (wm *WalletManager) SetNonceDAI(dai openwallet.NonceDAI) {
+	wm.Nonces = dai
+}
+
+//GetNonceSource 链上下一个可用的counter，实现openwallet.NonceSourceProvider
+func (wm *WalletManager) GetNonceSource() openwallet.NonceSource {
+	return wm.nextCounter
+}
+
+//nextCounter 查询地址的counter，下一笔操作使用counter+1
+func (wm *WalletManager) nextCounter(address string) (uint64, error) {
+	counter := wm.WalletClient.CallGetCounter(address)
+	if counter == nil {
+		return 0, fmt.Errorf("get counter of address[%s] failed", address)
+	}
+	icounter, err := strconv.ParseUint(string(counter), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return icounter + 1, nil
+}
+
+//reserveCounters 通过nonce管理器预留count个连续的counter，返回第一个counter
+func (wm *WalletManager) reserveCounters(address string, count int) (int, []*openwallet.NonceReservation, error) {
+	reservations, err := wm.Nonces.ReserveNonces(Symbol, address, count, wm.nextCounter)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int(reservations[0].Nonce), reservations, nil
+}
+
 //转账
 func (wm *WalletManager) Transfer(keys Key, dst string, fee, gas_limit, storage_limit, amount string) (string, string) {
 	header := wm.WalletClient.CallGetHeader()
@@ -126,12 +159,29 @@ func (wm *WalletManager) Transfer(keys Key, dst string, fee, gas_limit, storage_
 	chain_id := gjson.GetBytes(header, "chain_id").Str
 	protocol := gjson.GetBytes(header, "protocol").Str
 
-	counter := wm.WalletClient.CallGetCounter(keys.Address)
-	icounter, _ := strconv.Atoi(string(counter))
-	icounter = icounter + 1
-
 	isReverlKey := wm.isReverlKey(keys.Address)
 
+	var (
+		icounter     int
+		reservations []*openwallet.NonceReservation
+	)
+	if wm.Nonces != nil {
+		count := 1
+		if isReverlKey {
+			count = 2
+		}
+		var err error
+		icounter, reservations, err = wm.reserveCounters(keys.Address, count)
+		if err != nil {
+			log.Error(err)
+			return "", ""
+		}
+	} else {
+		counter := wm.WalletClient.CallGetCounter(keys.Address)
+		icounter, _ = strconv.Atoi(string(counter))
+		icounter = icounter + 1
+	}
+
 	var ops []interface{}
 	reverl := map[string]string{
 		"kind":          "reveal",
@@ -176,6 +226,22 @@ func (wm *WalletManager) Transfer(keys Key, dst string, fee, gas_limit, storage_
 
 	//jnject aperations
 	inj := wm.WalletClient.CallInjectOps(sbyte)
+
+	if wm.Nonces != nil {
+		//注入成功返回操作哈希，失败时释放counter并与链上对账
+		opHash := gjson.ParseBytes(inj)
+		if opHash.Type == gjson.String {
+			for _, r := range reservations {
+				wm.Nonces.CommitNonce(r, opHash.Str)
+			}
+		} else {
+			for _, r := range reservations {
+				wm.Nonces.ReleaseNonce(r)
+			}
+			wm.Nonces.ReconcileNonce(Symbol, keys.Address, wm.nextCounter)
+		}
+	}
+
 	return string(inj), string(pre)
 }
 
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/blocktree/openwallet/v2/console"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openw"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	backupKeyDirFlag = cli.StringFlag{
+		Name:  "keydir",
+		Usage: "wallet key files directory",
+		Value: "./openw_data/key",
+	}
+
+	backupConfDirFlag = cli.StringFlag{
+		Name:  "confdir",
+		Usage: "assets config files directory",
+		Value: "./conf",
+	}
+
+	backupDirFlag = cli.StringFlag{
+		Name:  "backupdir",
+		Usage: "backup files directory",
+		Value: "./openw_data/backup",
+	}
+
+	backupFileFlag = cli.StringFlag{
+		Name:  "file, f",
+		Usage: "backup file path",
+	}
+
+	backupFlags = []cli.Flag{
+		storageDBPathFlag,
+		backupKeyDirFlag,
+		backupConfDirFlag,
+		backupDirFlag,
+	}
+
+	// 备份命令
+	CmdBackup = cli.Command{
+		Name:      "backup",
+		Usage:     "Backup, verify and restore openw data",
+		ArgsUsage: "",
+		Category:  "Application COMMANDS",
+		Subcommands: []cli.Command{
+			{
+				//创建备份
+				Name:     "new",
+				Usage:    "create an encrypted backup of all app databases, keys and configs",
+				Action:   newBackup,
+				Category: "BACKUP COMMANDS",
+				Flags:    backupFlags,
+			},
+			{
+				//校验备份
+				Name:     "verify",
+				Usage:    "verify the integrity of a backup file",
+				Action:   verifyBackup,
+				Category: "BACKUP COMMANDS",
+				Flags: []cli.Flag{
+					backupFileFlag,
+				},
+			},
+			{
+				//恢复备份
+				Name:     "restore",
+				Usage:    "verify and restore a backup file",
+				Action:   restoreBackup,
+				Category: "BACKUP COMMANDS",
+				Flags:    append([]cli.Flag{backupFileFlag}, backupFlags...),
+				Description: `
+	wmd backup restore -f <file>
+
+The backup file is fully verified before any existing file is overwritten.
+
+	`,
+			},
+		},
+	}
+)
+
+//newCmdWalletManager 根据命令参数创建钱包管理器，未设置的目录使用默认值
+func newCmdWalletManager(c *cli.Context) *openw.WalletManager {
+	cfg := openw.NewConfig()
+	if dir := c.String(storageDBPathFlag.Name); len(dir) > 0 {
+		cfg.DBPath = dir
+	}
+	if dir := c.String(backupKeyDirFlag.Name); len(dir) > 0 {
+		cfg.KeyDir = dir
+	}
+	if dir := c.String(backupConfDirFlag.Name); len(dir) > 0 {
+		cfg.ConfigDir = dir
+	}
+	if dir := c.String(backupDirFlag.Name); len(dir) > 0 {
+		cfg.BackupDir = dir
+	}
+	cfg.SupportAssets = nil
+	return openw.NewWalletManager(cfg)
+}
+
+//newBackup 创建备份
+func newBackup(c *cli.Context) error {
+
+	password, err := console.InputPassword(true, 8)
+	if err != nil {
+		return err
+	}
+
+	filename, _, err := newCmdWalletManager(c).Backup(password)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	fmt.Printf("backup file: %s\n", filename)
+	return nil
+}
+
+//verifyBackup 校验备份
+func verifyBackup(c *cli.Context) error {
+
+	filename := c.String(backupFileFlag.Name)
+	if len(filename) == 0 {
+		return fmt.Errorf("backup file is empty")
+	}
+
+	password, err := console.InputPassword(false, 0)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := openw.VerifyBackup(filename, password)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	fmt.Printf("backup is valid, apps: %d, files: %d\n", len(manifest.Apps), len(manifest.Files))
+	return nil
+}
+
+//restoreBackup 恢复备份
+func restoreBackup(c *cli.Context) error {
+
+	filename := c.String(backupFileFlag.Name)
+	if len(filename) == 0 {
+		return fmt.Errorf("backup file is empty")
+	}
+
+	password, err := console.InputPassword(false, 0)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := newCmdWalletManager(c).RestoreBackup(filename, password)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	fmt.Printf("restore successfully, apps: %d, files: %d\n", len(manifest.Apps), len(manifest.Files))
+	return nil
+}
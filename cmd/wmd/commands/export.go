@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/blocktree/openwallet/v2/cmd/utils"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openw"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	exportAccountFlag = cli.StringFlag{
+		Name:  "account",
+		Usage: "assets account ID, export all accounts of the app if empty",
+	}
+
+	exportFormatFlag = cli.StringFlag{
+		Name:  "format",
+		Usage: "output format, csv or jsonl",
+		Value: openw.ExportFormatCSV,
+	}
+
+	exportOutFlag = cli.StringFlag{
+		Name:  "out, o",
+		Usage: "output file, print to stdout if empty",
+	}
+
+	exportStartTimeFlag = cli.Int64Flag{
+		Name:  "start-time",
+		Usage: "confirm time from, unix seconds",
+	}
+
+	exportEndTimeFlag = cli.Int64Flag{
+		Name:  "end-time",
+		Usage: "confirm time to, unix seconds",
+	}
+
+	exportStartHeightFlag = cli.Uint64Flag{
+		Name:  "start-height",
+		Usage: "block height from",
+	}
+
+	exportEndHeightFlag = cli.Uint64Flag{
+		Name:  "end-height",
+		Usage: "block height to",
+	}
+
+	// 导出命令
+	CmdExport = cli.Command{
+		Name:      "export",
+		Usage:     "Export openw data for accounting",
+		ArgsUsage: "",
+		Category:  "Application COMMANDS",
+		Subcommands: []cli.Command{
+			{
+				//导出交易记录
+				Name:     "tx",
+				Usage:    "export transactions of an app or assets account",
+				Action:   exportTransactions,
+				Category: "EXPORT COMMANDS",
+				Flags: []cli.Flag{
+					storageDBPathFlag,
+					storageAppIDFlag,
+					exportAccountFlag,
+					utils.SymbolFlag,
+					exportFormatFlag,
+					exportOutFlag,
+					exportStartTimeFlag,
+					exportEndTimeFlag,
+					exportStartHeightFlag,
+					exportEndHeightFlag,
+				},
+				Description: `
+	wmd export tx --appid <appID> --account <accountID> --format csv -o tx.csv
+
+	`,
+			},
+		},
+	}
+)
+
+//exportTransactions 导出交易记录
+func exportTransactions(c *cli.Context) error {
+
+	appID := c.String(storageAppIDFlag.Name)
+	if len(appID) == 0 {
+		return fmt.Errorf("appid is empty")
+	}
+
+	filter := &openw.TxExportFilter{
+		AccountID:   c.String(exportAccountFlag.Name),
+		Symbol:      c.String("symbol"),
+		StartTime:   c.Int64(exportStartTimeFlag.Name),
+		EndTime:     c.Int64(exportEndTimeFlag.Name),
+		StartHeight: c.Uint64(exportStartHeightFlag.Name),
+		EndHeight:   c.Uint64(exportEndHeightFlag.Name),
+	}
+
+	var out io.Writer = os.Stdout
+	if path := c.String("out"); len(path) > 0 {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	bw := bufio.NewWriter(out)
+	n, err := newCmdWalletManager(c).ExportTransactions(appID, filter, c.String(exportFormatFlag.Name), bw)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	log.Infof("export %d transactions", n)
+	return nil
+}
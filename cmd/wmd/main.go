@@ -43,6 +43,8 @@ func init() {
 	app.Commands = []cli.Command{
 		commands.CmdWallet,
 		commands.CmdVersion,
+		commands.CmdBackup,
+		commands.CmdExport,
 		//commands.CmdNode,
 		//commands.CmdConfig,
 		//commands.CmdMerchant,
@@ -0,0 +1,424 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+//DefaultBuckets 默认的耗时分布区间，单位秒
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+//Sample 一个指标采样值
+type Sample struct {
+	Name        string
+	LabelNames  []string
+	LabelValues []string
+	Value       float64
+}
+
+//Collector 指标收集者
+type Collector interface {
+
+	//Describe 指标名称、说明及类型
+	Describe() (name, help, metricType string)
+
+	//Collect 收集当前的采样值
+	Collect() []Sample
+}
+
+//labelKey 标签值组合为map的键
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+//vec 带标签的指标集合
+type vec struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.RWMutex
+	children   map[string]interface{}
+	values     map[string][]string
+}
+
+func newVec(name, help string, labelNames []string) vec {
+	return vec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		children:   make(map[string]interface{}),
+		values:     make(map[string][]string),
+	}
+}
+
+//child 获取标签值对应的指标，不存在则创建
+func (v *vec) child(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labelNames), len(values)))
+	}
+	key := labelKey(values)
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.children[key]; ok {
+		return c
+	}
+	c = create()
+	v.children[key] = c
+	v.values[key] = append([]string{}, values...)
+	return c
+}
+
+//each 按标签值顺序遍历
+func (v *vec) each(f func(values []string, c interface{})) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f(v.values[key], v.children[key])
+	}
+}
+
+//Counter 只增不减的计数
+type Counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+//Inc 加1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+//Add 增加计数，不能为负数
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.value += delta
+	c.mu.Unlock()
+}
+
+//Value 当前值
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+//CounterVec 带标签的计数
+type CounterVec struct {
+	vec
+}
+
+//NewCounterVec 创建带标签的计数
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{vec: newVec(name, help, labelNames)}
+}
+
+//WithLabelValues 获取标签值对应的计数
+func (cv *CounterVec) WithLabelValues(values ...string) *Counter {
+	return cv.child(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+//Describe 实现Collector
+func (cv *CounterVec) Describe() (string, string, string) {
+	return cv.name, cv.help, TypeCounter
+}
+
+//Collect 实现Collector
+func (cv *CounterVec) Collect() []Sample {
+	samples := make([]Sample, 0)
+	cv.each(func(values []string, c interface{}) {
+		samples = append(samples, Sample{Name: cv.name, LabelNames: cv.labelNames, LabelValues: values, Value: c.(*Counter).Value()})
+	})
+	return samples
+}
+
+//Gauge 可增可减的瞬时值
+type Gauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+//Set 设置值
+func (g *Gauge) Set(value float64) {
+	g.mu.Lock()
+	g.value = value
+	g.mu.Unlock()
+}
+
+//Add 增加值，可为负数
+func (g *Gauge) Add(delta float64) {
+	g.mu.Lock()
+	g.value += delta
+	g.mu.Unlock()
+}
+
+//Inc 加1
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+//Dec 减1
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+//Value 当前值
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+//GaugeVec 带标签的瞬时值
+type GaugeVec struct {
+	vec
+}
+
+//NewGaugeVec 创建带标签的瞬时值
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{vec: newVec(name, help, labelNames)}
+}
+
+//WithLabelValues 获取标签值对应的瞬时值
+func (gv *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return gv.child(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+//Describe 实现Collector
+func (gv *GaugeVec) Describe() (string, string, string) {
+	return gv.name, gv.help, TypeGauge
+}
+
+//Collect 实现Collector
+func (gv *GaugeVec) Collect() []Sample {
+	samples := make([]Sample, 0)
+	gv.each(func(values []string, c interface{}) {
+		samples = append(samples, Sample{Name: gv.name, LabelNames: gv.labelNames, LabelValues: values, Value: c.(*Gauge).Value()})
+	})
+	return samples
+}
+
+//Histogram 分布统计
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+//Observe 记录一次观测值
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if value <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+//HistogramVec 带标签的分布统计
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+//NewHistogramVec 创建带标签的分布统计，buckets为空使用DefaultBuckets
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return &HistogramVec{vec: newVec(name, help, labelNames), buckets: sorted}
+}
+
+//WithLabelValues 获取标签值对应的分布统计
+func (hv *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return hv.child(values, func() interface{} {
+		return &Histogram{buckets: hv.buckets, counts: make([]uint64, len(hv.buckets))}
+	}).(*Histogram)
+}
+
+//Describe 实现Collector
+func (hv *HistogramVec) Describe() (string, string, string) {
+	return hv.name, hv.help, TypeHistogram
+}
+
+//Collect 实现Collector，输出_bucket、_sum及_count
+func (hv *HistogramVec) Collect() []Sample {
+	samples := make([]Sample, 0)
+	bucketLabels := append(append([]string{}, hv.labelNames...), "le")
+	hv.each(func(values []string, c interface{}) {
+		h := c.(*Histogram)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for i, upper := range h.buckets {
+			samples = append(samples, Sample{
+				Name:        hv.name + "_bucket",
+				LabelNames:  bucketLabels,
+				LabelValues: append(append([]string{}, values...), formatFloat(upper)),
+				Value:       float64(h.counts[i]),
+			})
+		}
+		samples = append(samples,
+			Sample{Name: hv.name + "_bucket", LabelNames: bucketLabels, LabelValues: append(append([]string{}, values...), "+Inf"), Value: float64(h.count)},
+			Sample{Name: hv.name + "_sum", LabelNames: hv.labelNames, LabelValues: values, Value: h.sum},
+			Sample{Name: hv.name + "_count", LabelNames: hv.labelNames, LabelValues: values, Value: float64(h.count)},
+		)
+	})
+	return samples
+}
+
+//CollectorFunc 在采集时才计算的指标，例如扫描高度
+type CollectorFunc struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	collect    func(emit func(value float64, labelValues ...string))
+}
+
+//NewCollectorFunc 创建采集时计算的指标
+func NewCollectorFunc(name, help, metricType string, labelNames []string, collect func(emit func(value float64, labelValues ...string))) *CollectorFunc {
+	return &CollectorFunc{name: name, help: help, metricType: metricType, labelNames: labelNames, collect: collect}
+}
+
+//Describe 实现Collector
+func (cf *CollectorFunc) Describe() (string, string, string) {
+	return cf.name, cf.help, cf.metricType
+}
+
+//Collect 实现Collector
+func (cf *CollectorFunc) Collect() []Sample {
+	samples := make([]Sample, 0)
+	cf.collect(func(value float64, labelValues ...string) {
+		samples = append(samples, Sample{Name: cf.name, LabelNames: cf.labelNames, LabelValues: labelValues, Value: value})
+	})
+	return samples
+}
+
+//Registry 指标注册表
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]Collector
+}
+
+//NewRegistry 创建指标注册表
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]Collector)}
+}
+
+//Register 注册指标，名称重复返回错误
+func (r *Registry) Register(c Collector) error {
+	name, _, _ := c.Describe()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exist := r.collectors[name]; exist {
+		return fmt.Errorf("metrics: %s has been registered", name)
+	}
+	r.collectors[name] = c
+	return nil
+}
+
+//MustRegister 注册指标，名称重复时panic
+func (r *Registry) MustRegister(cs ...Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+//Unregister 注销指标
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.collectors, name)
+}
+
+//Collectors 按名称排序的全部指标
+func (r *Registry) Collectors() []Collector {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cs := make([]Collector, 0, len(names))
+	for _, name := range names {
+		cs = append(cs, r.collectors[name])
+	}
+	return cs
+}
+
+//DefaultRegistry 默认的指标注册表，/metrics输出该注册表
+var DefaultRegistry = NewRegistry()
+
+//Register 注册指标到默认注册表
+func Register(c Collector) error {
+	return DefaultRegistry.Register(c)
+}
+
+//MustRegister 注册指标到默认注册表，名称重复时panic
+func MustRegister(cs ...Collector) {
+	DefaultRegistry.MustRegister(cs...)
+}
+
+//Unregister 从默认注册表注销指标
+func Unregister(name string) {
+	DefaultRegistry.Unregister(name)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", v)
+}
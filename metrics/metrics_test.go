@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry_WritePrometheus(t *testing.T) {
+
+	r := NewRegistry()
+
+	calls := NewCounterVec("test_calls_total", "Test calls.", "symbol", "result")
+	height := NewGaugeVec("test_height", "Test height.", "symbol")
+	latency := NewHistogramVec("test_latency_seconds", "Test latency.", []float64{0.1, 1}, "method")
+	lag := NewCollectorFunc("test_lag", "Test lag.", TypeGauge, []string{"symbol"}, func(emit func(float64, ...string)) {
+		emit(3, "BTC")
+	})
+	r.MustRegister(calls, height, latency, lag)
+
+	if err := r.Register(NewGaugeVec("test_height", "dup")); err == nil {
+		t.Errorf("duplicate register should fail")
+	}
+
+	calls.WithLabelValues("BTC", ResultSuccess).Inc()
+	calls.WithLabelValues("BTC", ResultError).Add(2)
+	height.WithLabelValues(`E"TH`).Set(100)
+	latency.WithLabelValues("getblock").Observe(0.05)
+	latency.WithLabelValues("getblock").Observe(0.5)
+
+	server := httptest.NewServer(r.Handler())
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Errorf("Get metrics failed, unexpected error: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	text := string(body)
+
+	if resp.Header.Get("Content-Type") != ContentType {
+		t.Errorf("content type = %s", resp.Header.Get("Content-Type"))
+	}
+
+	for _, want := range []string{
+		"# TYPE test_calls_total counter",
+		`test_calls_total{symbol="BTC",result="error"} 2`,
+		`test_height{symbol="E\"TH"} 100`,
+		`test_latency_seconds_bucket{method="getblock",le="0.1"} 1`,
+		`test_latency_seconds_bucket{method="getblock",le="+Inf"} 2`,
+		`test_latency_seconds_sum{method="getblock"} 0.55`,
+		`test_latency_seconds_count{method="getblock"} 2`,
+		`test_lag{symbol="BTC"} 3`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics output does not contain: %s", want)
+		}
+	}
+
+	ObserveRPCCall("btc", "getblockcount", time.Now(), fmt.Errorf("timeout"))
+	if RPCCalls.WithLabelValues("BTC", "getblockcount", ResultError).Value() != 1 {
+		t.Errorf("rpc call error is not counted")
+	}
+
+	//实时扫描及重扫的区块提取耗时按mode区分
+	ObserveBlockExtract("dcr", ExtractModeLive, time.Now())
+	ObserveBlockExtract("dcr", ExtractModeRescan, time.Now())
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`openwallet_block_extract_duration_seconds_count{symbol="DCR",mode="live"} 1`,
+		`openwallet_block_extract_duration_seconds_count{symbol="DCR",mode="rescan"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics output does not contain: %s", want)
+		}
+	}
+
+	fmt.Println(text)
+}
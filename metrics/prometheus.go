@@ -0,0 +1,79 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+)
+
+//ContentType Prometheus文本格式
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	helpEscaper  = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+)
+
+//WritePrometheus 以Prometheus文本格式输出注册表的全部指标
+func (r *Registry) WritePrometheus(w io.Writer) error {
+
+	bw := bufio.NewWriter(w)
+
+	for _, c := range r.Collectors() {
+		name, help, metricType := c.Describe()
+		samples := c.Collect()
+
+		bw.WriteString("# HELP " + name + " " + helpEscaper.Replace(help) + "\n")
+		bw.WriteString("# TYPE " + name + " " + metricType + "\n")
+
+		for _, s := range samples {
+			bw.WriteString(s.Name)
+			if len(s.LabelNames) > 0 {
+				bw.WriteByte('{')
+				for i, label := range s.LabelNames {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					value := ""
+					if i < len(s.LabelValues) {
+						value = s.LabelValues[i]
+					}
+					bw.WriteString(label + "=\"" + labelEscaper.Replace(value) + "\"")
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteString(" " + formatFloat(s.Value) + "\n")
+		}
+	}
+
+	return bw.Flush()
+}
+
+//Handler 输出注册表指标的HTTP处理器
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WritePrometheus(w)
+	})
+}
+
+//Handler 输出默认注册表指标的HTTP处理器
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
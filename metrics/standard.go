@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+
+	OWTPRoleClient = "client"
+	OWTPRoleServer = "server"
+
+	ExtractModeLive   = "live"
+	ExtractModeRescan = "rescan"
+)
+
+//openwallet各模块共用的指标
+var (
+	RPCCallDuration = NewHistogramVec("openwallet_rpc_call_duration_seconds",
+		"Latency of JSON-RPC calls to full nodes.", nil, "symbol", "method")
+	RPCCalls = NewCounterVec("openwallet_rpc_calls_total",
+		"JSON-RPC calls to full nodes by result.", "symbol", "method", "result")
+	BlockExtractDuration = NewHistogramVec("openwallet_block_extract_duration_seconds",
+		"Duration of fetching and extracting a block, mode is live or rescan.", nil, "symbol", "mode")
+	TxOperations = NewCounterVec("openw_tx_operations_total",
+		"Transaction create, sign and submit operations by result.", "symbol", "operation", "result")
+	OWTPPeers = NewGaugeVec("owtp_peers",
+		"Online peers of the OWTP node.", "node")
+	OWTPRequestDuration = NewHistogramVec("owtp_request_duration_seconds",
+		"Latency of OWTP requests, client role includes the round trip.", nil, "role", "method")
+	OWTPRequests = NewCounterVec("owtp_requests_total",
+		"OWTP requests by response status.", "role", "method", "status")
+)
+
+func init() {
+	MustRegister(
+		RPCCallDuration,
+		RPCCalls,
+		BlockExtractDuration,
+		TxOperations,
+		OWTPPeers,
+		OWTPRequestDuration,
+		OWTPRequests,
+	)
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultSuccess
+}
+
+//ObserveRPCCall 记录一次JSON-RPC调用的耗时及结果
+func ObserveRPCCall(symbol, method string, start time.Time, err error) {
+	symbol = strings.ToUpper(symbol)
+	RPCCallDuration.WithLabelValues(symbol, method).Observe(time.Since(start).Seconds())
+	RPCCalls.WithLabelValues(symbol, method, resultLabel(err)).Inc()
+}
+
+//ObserveBlockExtract 记录获取并提取一个区块的耗时，mode为live或rescan
+func ObserveBlockExtract(symbol, mode string, start time.Time) {
+	BlockExtractDuration.WithLabelValues(strings.ToUpper(symbol), mode).Observe(time.Since(start).Seconds())
+}
+
+//ObserveTxOperation 记录一次交易单操作，operation为create、sign或submit
+func ObserveTxOperation(symbol, operation string, err error) {
+	TxOperations.WithLabelValues(strings.ToUpper(symbol), operation, resultLabel(err)).Inc()
+}
+
+//SetOWTPPeers 设置OWTP节点的在线节点数
+func SetOWTPPeers(nodeID string, count int) {
+	OWTPPeers.WithLabelValues(nodeID).Set(float64(count))
+}
+
+//ObserveOWTPRequest 记录一次OWTP请求的耗时及响应状态
+func ObserveOWTPRequest(role, method string, status uint64, start time.Time) {
+	OWTPRequestDuration.WithLabelValues(role, method).Observe(time.Since(start).Seconds())
+	OWTPRequests.WithLabelValues(role, method, strconv.FormatUint(status, 10)).Inc()
+}
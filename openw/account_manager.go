@@ -282,6 +282,13 @@ func (wm *WalletManager) CreateAddress(appID, walletID string, accountID string,
 		return nil, err
 	}
 
+	//没有HD路径的账户只能由适配器自定义创建地址
+	if len(account.HDPath) == 0 {
+		if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilityCustomCreateAddress); capErr != nil {
+			return nil, capErr
+		}
+	}
+
 	addrs, err := openwallet.BatchCreateAddressByAccount(account, assetsMgr, int64(count), 20)
 	if err != nil {
 		return nil, err
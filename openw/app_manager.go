@@ -0,0 +1,330 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/v2/common/file"
+	"github.com/blocktree/openwallet/v2/log"
+)
+
+//appIDPattern 应用ID只允许字母、数字、下划线及中划线，作为数据库文件名
+var appIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+//AppInfo 应用信息，保存在应用自己的数据库中
+type AppInfo struct {
+	AppID      string   `json:"appID" storm:"id"`
+	Name       string   `json:"name"`
+	Owner      string   `json:"owner"`
+	Symbols    []string `json:"symbols"` //启用的币种，空值为全部币种
+	Disabled   bool     `json:"disabled"`
+	CreateTime int64    `json:"createTime"`
+	UpdateTime int64    `json:"updateTime"`
+	Legacy     bool     `json:"legacy"` //未通过CreateApp创建的旧应用，没有保存应用信息
+}
+
+//checkAppID 应用ID作为数据库文件名，必须符合appIDPattern，避免路径穿越到其他数据库
+func checkAppID(appID string) error {
+	if !appIDPattern.MatchString(appID) {
+		return fmt.Errorf("appID: %s is invalid", appID)
+	}
+	return nil
+}
+
+//IsSymbolEnabled 币种是否启用
+func (app *AppInfo) IsSymbolEnabled(symbol string) bool {
+	if app.Disabled {
+		return false
+	}
+	if len(app.Symbols) == 0 || len(symbol) == 0 {
+		return true
+	}
+	for _, s := range app.Symbols {
+		if strings.EqualFold(s, symbol) {
+			return true
+		}
+	}
+	return false
+}
+
+//CreateApp 创建应用，已存在应用信息时返回错误
+func (wm *WalletManager) CreateApp(app *AppInfo) (*AppInfo, error) {
+
+	if app == nil {
+		return nil, fmt.Errorf("app info is nil")
+	}
+
+	if err := checkAppID(app.AppID); err != nil {
+		return nil, err
+	}
+
+	db, err := wm.openAppDB(app.AppID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var exist AppInfo
+	if err = db.One("AppID", app.AppID, &exist); err == nil {
+		return nil, fmt.Errorf("app[%s] already exists", app.AppID)
+	}
+
+	now := time.Now().Unix()
+	info := *app
+	info.Disabled = false
+	info.Legacy = false
+	info.CreateTime = now
+	info.UpdateTime = now
+	//复制币种列表，不修改调用方的数据
+	info.Symbols = make([]string, len(app.Symbols))
+	for i, s := range app.Symbols {
+		info.Symbols[i] = strings.ToUpper(s)
+	}
+
+	if err = db.Save(&info); err != nil {
+		return nil, err
+	}
+
+	wm.cacheAppInfo(&info)
+
+	log.Infof("app[%s] created, owner: %s", info.AppID, info.Owner)
+
+	return &info, nil
+}
+
+//GetAppInfo 获取应用信息，旧应用返回默认的启用状态
+func (wm *WalletManager) GetAppInfo(appID string) (*AppInfo, error) {
+
+	if err := checkAppID(appID); err != nil {
+		return nil, err
+	}
+
+	if !file.Exists(wm.DBFile(appID)) {
+		return nil, fmt.Errorf("app[%s] not found", appID)
+	}
+
+	db, err := wm.OpenDB(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	var info AppInfo
+	err = db.One("AppID", appID, &info)
+	if err != nil {
+		if err != storm.ErrNotFound {
+			return nil, err
+		}
+		info = AppInfo{AppID: appID, Legacy: true}
+		if fi, err := os.Stat(wm.DBFile(appID)); err == nil {
+			info.CreateTime = fi.ModTime().Unix()
+		}
+	}
+
+	wm.cacheAppInfo(&info)
+
+	return &info, nil
+}
+
+//ListApps 获取全部应用信息
+func (wm *WalletManager) ListApps() ([]*AppInfo, error) {
+
+	appIDs, err := wm.loadAllAppIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make([]*AppInfo, 0, len(appIDs))
+	for _, appID := range appIDs {
+		info, err := wm.GetAppInfo(appID)
+		if err != nil {
+			log.Errorf("load app[%s] info failed, unexpected error: %v", appID, err)
+			continue
+		}
+		apps = append(apps, info)
+	}
+
+	return apps, nil
+}
+
+//setAppDisabled 修改应用的启用状态，旧应用会补充保存应用信息
+func (wm *WalletManager) setAppDisabled(appID string, disabled bool) (*AppInfo, error) {
+
+	info, err := wm.GetAppInfo(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := wm.OpenDB(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Disabled = disabled
+	info.Legacy = false
+	info.UpdateTime = time.Now().Unix()
+	if err = db.Save(info); err != nil {
+		return nil, err
+	}
+
+	wm.cacheAppInfo(info)
+
+	return info, nil
+}
+
+//DisableApp 停用应用，停用后不再接收区块扫描的通知，地址移出扫描列表
+func (wm *WalletManager) DisableApp(appID string) (*AppInfo, error) {
+
+	if err := checkAppID(appID); err != nil {
+		return nil, err
+	}
+
+	info, err := wm.setAppDisabled(appID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	wm.removeAppAddressForBlockScan(appID)
+
+	log.Infof("app[%s] disabled", appID)
+
+	return info, nil
+}
+
+//EnableApp 启用应用，地址重新加入扫描列表
+func (wm *WalletManager) EnableApp(appID string) (*AppInfo, error) {
+
+	if err := checkAppID(appID); err != nil {
+		return nil, err
+	}
+
+	info, err := wm.setAppDisabled(appID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	wm.loadAppAddressForBlockScan(appID)
+
+	log.Infof("app[%s] enabled", appID)
+
+	return info, nil
+}
+
+//DeleteApp 删除应用数据库文件，应用必须先停用，钥匙文件不会被删除
+func (wm *WalletManager) DeleteApp(appID string) error {
+
+	if err := checkAppID(appID); err != nil {
+		return err
+	}
+
+	info, err := wm.GetAppInfo(appID)
+	if err != nil {
+		return err
+	}
+
+	if !info.Disabled {
+		return fmt.Errorf("app[%s] must be disabled before delete", appID)
+	}
+
+	wm.removeAppAddressForBlockScan(appID)
+
+	wm.mu.Lock()
+	if db, ok := wm.appDB[appID]; ok {
+		if db.Opened {
+			db.Close()
+		}
+		delete(wm.appDB, appID)
+	}
+	err = os.Remove(wm.DBFile(appID))
+	wm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	wm.appMu.Lock()
+	delete(wm.appInfos, appID)
+	wm.appMu.Unlock()
+
+	log.Infof("app[%s] deleted", appID)
+
+	return nil
+}
+
+//cacheAppInfo 缓存应用信息，区块扫描通知时使用
+func (wm *WalletManager) cacheAppInfo(info *AppInfo) {
+	wm.appMu.Lock()
+	defer wm.appMu.Unlock()
+	cached := *info
+	wm.appInfos[info.AppID] = &cached
+}
+
+//isAppScanEnabled 应用是否接收该币种的区块扫描通知
+func (wm *WalletManager) isAppScanEnabled(appID, symbol string) bool {
+
+	wm.appMu.RLock()
+	info, ok := wm.appInfos[appID]
+	wm.appMu.RUnlock()
+
+	if !ok {
+		var err error
+		info, err = wm.GetAppInfo(appID)
+		if err != nil {
+			return false
+		}
+	}
+
+	return info.IsSymbolEnabled(symbol)
+}
+
+//loadAppAddressForBlockScan 把应用的全部地址加入扫描列表
+func (wm *WalletManager) loadAppAddressForBlockScan(appID string) error {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return err
+	}
+
+	addrs, err := wrapper.GetAddressList(0, -1)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addrs {
+		if !wm.isAppScanEnabled(appID, address.Symbol) {
+			continue
+		}
+		key := wm.encodeSourceKey(appID, address.AccountID)
+		wm.AddAddressForBlockScan(address.Address, key)
+	}
+
+	return nil
+}
+
+//removeAppAddressForBlockScan 把应用的全部地址移出扫描列表
+func (wm *WalletManager) removeAppAddressForBlockScan(appID string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	prefix := wm.encodeSourceKey(appID, "")
+	for address, key := range wm.AddressInScanning {
+		if strings.HasPrefix(key, prefix) {
+			delete(wm.AddressInScanning, address)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/common/file"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestWalletManager_AppLifecycle(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_app")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.SupportAssets = nil
+	cfg.StrictAppRegistration = true
+	wm := NewWalletManager(cfg)
+
+	observer := &rollbackTestObserver{}
+	wm.AddObserver(observer)
+
+	if _, err = wm.CreateApp(&AppInfo{AppID: "../app"}); err == nil {
+		t.Errorf("CreateApp with invalid appID should fail")
+	}
+
+	//生命周期接口不接受可以穿越到其他数据库的应用ID
+	if _, err = wm.GetAppInfo("../jobs"); err == nil {
+		t.Errorf("GetAppInfo with invalid appID should fail")
+	}
+	if _, err = wm.DisableApp("../jobs"); err == nil {
+		t.Errorf("DisableApp with invalid appID should fail")
+	}
+	if _, err = wm.EnableApp("../jobs"); err == nil {
+		t.Errorf("EnableApp with invalid appID should fail")
+	}
+	if err = wm.DeleteApp("../jobs"); err == nil {
+		t.Errorf("DeleteApp with invalid appID should fail")
+	}
+	if _, err = wm.OpenDB("../jobs"); err == nil {
+		t.Errorf("OpenDB with invalid appID should fail")
+	}
+
+	symbols := []string{"eth"}
+	app, err := wm.CreateApp(&AppInfo{AppID: "app1", Name: "test", Owner: "ops", Symbols: symbols})
+	if err != nil {
+		t.Errorf("CreateApp failed, unexpected error: %v", err)
+		return
+	}
+	if app.CreateTime == 0 || app.Symbols[0] != "ETH" {
+		t.Errorf("CreateApp app info = %+v", app)
+	}
+	if symbols[0] != "eth" {
+		t.Errorf("CreateApp modified caller symbols: %v", symbols)
+	}
+
+	if _, err = wm.CreateApp(&AppInfo{AppID: "app1"}); err == nil {
+		t.Errorf("CreateApp duplicate app should fail")
+	}
+
+	//未注册的应用不允许隐式创建数据库
+	if _, err = wm.OpenDB("app2"); err == nil {
+		t.Errorf("OpenDB unregistered app should fail")
+	}
+	if file.Exists(wm.DBFile("app2")) {
+		t.Errorf("unregistered app database is created")
+	}
+	if _, err = wm.NewWalletWrapper("app2", ""); err == nil {
+		t.Errorf("NewWalletWrapper unregistered app should fail")
+	}
+
+	//已有数据库文件的旧应用可以打开
+	legacy, err := OpenStormDB(wm.DBFile("legacy"), appDBOptions()...)
+	if err != nil {
+		t.Errorf("OpenStormDB failed, unexpected error: %v", err)
+		return
+	}
+	legacy.Close()
+	if _, err = wm.OpenDB("legacy"); err != nil {
+		t.Errorf("OpenDB legacy app failed, unexpected error: %v", err)
+	}
+	wm.CloseDB("legacy")
+	os.Remove(wm.DBFile("legacy"))
+
+	apps, err := wm.ListApps()
+	if err != nil || len(apps) != 1 || apps[0].Name != "test" {
+		t.Errorf("ListApps = %v, err: %v", apps, err)
+	}
+
+	db, _ := wm.OpenDB("app1")
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", Symbol: "ETH"})
+	db.Save(&openwallet.Address{Address: "addr1", AccountID: "account1", Symbol: "ETH"})
+	wm.loadAppAddressForBlockScan("app1")
+	if _, ok := wm.AddressInScanning["addr1"]; !ok {
+		t.Errorf("app address is not in scanning")
+	}
+
+	newExtractData := func(symbol string, height uint64) *openwallet.TxExtractData {
+		tx := &openwallet.Transaction{
+			TxID:        "tx1",
+			Coin:        openwallet.Coin{Symbol: symbol},
+			BlockHash:   "hash",
+			BlockHeight: height,
+		}
+		tx.WxID = openwallet.GenTransactionWxID(tx)
+		return &openwallet.TxExtractData{Transaction: tx}
+	}
+
+	sourceKey := wm.encodeSourceKey("app1", "account1")
+	wm.BlockExtractDataNotify(sourceKey, newExtractData("ETH", 1))
+	if len(observer.extracted) != 1 {
+		t.Errorf("extracted = %d, want 1", len(observer.extracted))
+	}
+
+	//未启用的币种不推送
+	wm.BlockExtractDataNotify(sourceKey, newExtractData("BTC", 1))
+	if len(observer.extracted) != 1 {
+		t.Errorf("disabled symbol is notified")
+	}
+
+	if err = wm.DeleteApp("app1"); err == nil {
+		t.Errorf("DeleteApp enabled app should fail")
+	}
+
+	if _, err = wm.DisableApp("app1"); err != nil {
+		t.Errorf("DisableApp failed, unexpected error: %v", err)
+		return
+	}
+	if _, ok := wm.AddressInScanning["addr1"]; ok {
+		t.Errorf("disabled app address is still in scanning")
+	}
+
+	wm.BlockExtractDataNotify(sourceKey, newExtractData("ETH", 2))
+	if len(observer.extracted) != 1 {
+		t.Errorf("disabled app is notified")
+	}
+
+	info, _ := wm.GetAppInfo("app1")
+	if !info.Disabled {
+		t.Errorf("app is not disabled")
+	}
+
+	if err = wm.DeleteApp("app1"); err != nil {
+		t.Errorf("DeleteApp failed, unexpected error: %v", err)
+		return
+	}
+	if file.Exists(wm.DBFile("app1")) {
+		t.Errorf("app database is not deleted")
+	}
+
+	log.Infof("app: %+v", info)
+}
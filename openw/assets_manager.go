@@ -18,9 +18,9 @@ package openw
 import (
 	"fmt"
 	"github.com/astaxie/beego/config"
+	"github.com/blocktree/openwallet/v2/assets"
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
-	"strings"
 )
 
 //type AssetsManager interface {
@@ -44,74 +44,41 @@ func initAssetAdapter() {
 	//RegAssets(eosio.Symbol, eosio.NewWalletManager())
 }
 
-//区块链适配器注册组
-var assetsAdapterManagers = make(map[string]interface{})
-
-// RegAssets 注册资产
+// RegAssets 注册资产，与assets.RegAssets共用同一个注册组
 // @param name 资产别名
-// @param manager 资产适配器或管理器
+// @param manager 资产适配器或旧版钱包管理器
 // @param config 加载配置
 // 资产适配器实现了openwallet.AssetsConfig，可以传入配置接口完成预加载配置
+// 旧版钱包管理器通过assets.LegacyAdapter桥接为资产适配器
 // usage:
 // RegAssets(cardano.Symbol, &cardano.WalletManager{}, c)
 // RegAssets(bytom.Symbol, &bytom.WalletManager{}, c)
 func RegAssets(name string, manager interface{}, config ...config.Configer) {
-	name = strings.ToUpper(name)
-	if manager == nil {
-		panic("assets: Register adapter is nil")
-	}
-	if _, ok := assetsAdapterManagers[name]; ok {
-		log.Error("assets: Register called twice for adapter ", name)
-		return
-	}
-
-	assetsAdapterManagers[name] = manager
-
-	//如果有配置则加载所有配置
-	if ac, ok := manager.(openwallet.AssetsConfig); ok && config != nil {
-		for _, c := range config {
-			ac.LoadAssetsConfig(c)
-		}
-	}
+	assets.RegAssets(name, manager, config...)
 }
 
 // GetAssets 根据币种类型获取已注册的管理者
 func GetAssets(symbol string) interface{} {
-	symbol = strings.ToUpper(symbol)
-	manager, ok := assetsAdapterManagers[symbol]
-	if !ok {
-		return nil
-	}
-	return manager
+	return assets.GetAssets(symbol)
 }
 
 // GetSymbolInfo 获取资产的币种信息
 func GetSymbolInfo(symbol string) (openwallet.SymbolInfo, error) {
-	adapter := GetAssets(symbol)
+	adapter := assets.GetAssetsAdapter(symbol)
 	if adapter == nil {
 		return nil, fmt.Errorf("assets: %s is not support", symbol)
 	}
 
-	manager, ok := adapter.(openwallet.SymbolInfo)
-	if !ok {
-		return nil, fmt.Errorf("assets: %s is not support", symbol)
-	}
-
-	return manager, nil
+	return adapter, nil
 }
 
-// GetAssetsAdapter 获取资产控制器
+// GetAssetsAdapter 获取资产控制器，旧版钱包管理器返回桥接的适配器
 func GetAssetsAdapter(symbol string) (openwallet.AssetsAdapter, error) {
 
-	adapter := GetAssets(symbol)
+	adapter := assets.GetAssetsAdapter(symbol)
 	if adapter == nil {
 		return nil, fmt.Errorf("assets: %s is not support", symbol)
 	}
 
-	manager, ok := adapter.(openwallet.AssetsAdapter)
-	if !ok {
-		return nil, fmt.Errorf("assets: %s is not support", symbol)
-	}
-
-	return manager, nil
+	return adapter, nil
 }
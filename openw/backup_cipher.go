@@ -0,0 +1,289 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/blocktree/openwallet/v2/hdkeystore"
+	"golang.org/x/crypto/scrypt"
+)
+
+//备份文件格式：
+//	magic(8) | version(1) | scryptN(4) | scryptR(4) | scryptP(4) | salt(32) | nonce(12)
+//	之后为若干数据块：flag|length(4) | ciphertext
+//每个数据块使用AES-256-GCM独立加密，块序号及结束标记作为附加数据，防止数据块被调换或截断
+const (
+	backupMagic        = "OWBACKUP"
+	backupVersion      = 1
+	backupChunkSize    = 1 << 20
+	backupSaltLen      = 32
+	backupScryptR      = 8
+	backupKeyLen       = 32
+	backupFinalFlag    = uint32(1 << 31)
+	backupMaxChunkSize = backupChunkSize + 1024
+)
+
+var (
+	//BackupScryptN 备份密钥派生的scrypt参数，不能超过backupMaxScryptN及backupMaxScryptCost
+	BackupScryptN = hdkeystore.StandardScryptN
+	BackupScryptP = hdkeystore.StandardScryptP
+)
+
+//备份文件头中scrypt参数的上限，防止构造的备份文件耗尽内存或CPU
+//内存由N*r决定，N=2^18、r=8时约256MB，计算量由N*r*p决定，不超过标准参数
+const (
+	backupMaxScryptN    = hdkeystore.StandardScryptN
+	backupMaxScryptCost = hdkeystore.StandardScryptN * hdkeystore.StandardScryptP
+)
+
+//checkBackupScryptParams 检查scrypt参数不超过上限
+func checkBackupScryptParams(n, r, p int) error {
+	if n <= 0 || n > backupMaxScryptN || r <= 0 || r > backupScryptR || p <= 0 || p > backupMaxScryptCost/n {
+		return fmt.Errorf("backup scrypt params N=%d, r=%d, p=%d exceed the limit N<=%d, r<=%d, N*p<=%d", n, r, p, backupMaxScryptN, backupScryptR, backupMaxScryptCost)
+	}
+	return nil
+}
+
+//backupChunkAD 数据块的附加数据
+func backupChunkAD(index uint64, final bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, index)
+	if final {
+		ad[8] = 1
+	}
+	return ad
+}
+
+//backupChunkNonce 数据块的nonce，基础nonce的后8字节与块序号异或
+func backupChunkNonce(base []byte, index uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	n := len(nonce)
+	counter := binary.BigEndian.Uint64(nonce[n-8:])
+	binary.BigEndian.PutUint64(nonce[n-8:], counter^index)
+	return nonce
+}
+
+//newBackupAEAD 使用密码派生密钥
+func newBackupAEAD(password string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(password), salt, n, r, p, backupKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//backupWriter 加密写入备份数据
+type backupWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	index uint64
+}
+
+func newBackupWriter(w io.Writer, password string) (*backupWriter, error) {
+
+	salt := make([]byte, backupSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	if err := checkBackupScryptParams(BackupScryptN, backupScryptR, BackupScryptP); err != nil {
+		return nil, err
+	}
+
+	aead, err := newBackupAEAD(password, salt, BackupScryptN, backupScryptR, BackupScryptP)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := bytes.NewBufferString(backupMagic)
+	header.WriteByte(backupVersion)
+	binary.Write(header, binary.BigEndian, uint32(BackupScryptN))
+	binary.Write(header, binary.BigEndian, uint32(backupScryptR))
+	binary.Write(header, binary.BigEndian, uint32(BackupScryptP))
+	header.Write(salt)
+	header.Write(nonce)
+
+	if _, err = w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &backupWriter{
+		w:     w,
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, 0, backupChunkSize),
+	}, nil
+}
+
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		//缓存已满，且还有后续数据时才写出，保证最后一块由Close写出
+		if len(bw.buf) == backupChunkSize {
+			if err := bw.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		free := backupChunkSize - len(bw.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		bw.buf = append(bw.buf, p[:free]...)
+		p = p[free:]
+	}
+	return n, nil
+}
+
+func (bw *backupWriter) flush(final bool) error {
+
+	sealed := bw.aead.Seal(nil, backupChunkNonce(bw.nonce, bw.index), bw.buf, backupChunkAD(bw.index, final))
+
+	head := uint32(len(sealed))
+	if final {
+		head |= backupFinalFlag
+	}
+
+	if err := binary.Write(bw.w, binary.BigEndian, head); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(sealed); err != nil {
+		return err
+	}
+
+	bw.index++
+	bw.buf = bw.buf[:0]
+	return nil
+}
+
+//Close 写出最后一个数据块
+func (bw *backupWriter) Close() error {
+	return bw.flush(true)
+}
+
+//backupReader 解密读取备份数据
+type backupReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	index uint64
+	final bool
+}
+
+func newBackupReader(r io.Reader, password string) (*backupReader, error) {
+
+	header := make([]byte, len(backupMagic)+1+12+backupSaltLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read backup header failed, unexpected error: %v", err)
+	}
+
+	if string(header[:len(backupMagic)]) != backupMagic {
+		return nil, fmt.Errorf("file is not an openw backup")
+	}
+
+	pos := len(backupMagic)
+	if header[pos] != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version: %d", header[pos])
+	}
+	pos++
+
+	n := int(binary.BigEndian.Uint32(header[pos:]))
+	r2 := int(binary.BigEndian.Uint32(header[pos+4:]))
+	p := int(binary.BigEndian.Uint32(header[pos+8:]))
+	salt := header[pos+12:]
+
+	if err := checkBackupScryptParams(n, r2, p); err != nil {
+		return nil, err
+	}
+
+	aead, err := newBackupAEAD(password, salt, n, r2, p)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(r, nonce); err != nil {
+		return nil, fmt.Errorf("read backup header failed, unexpected error: %v", err)
+	}
+
+	return &backupReader{r: r, aead: aead, nonce: nonce}, nil
+}
+
+func (br *backupReader) Read(p []byte) (int, error) {
+	for len(br.buf) == 0 {
+		if br.final {
+			return 0, io.EOF
+		}
+		if err := br.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.buf)
+	br.buf = br.buf[n:]
+	return n, nil
+}
+
+//next 读取并解密下一个数据块
+func (br *backupReader) next() error {
+
+	var head uint32
+	if err := binary.Read(br.r, binary.BigEndian, &head); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("backup file is truncated")
+		}
+		return err
+	}
+
+	final := head&backupFinalFlag != 0
+	size := head &^ backupFinalFlag
+	if size > backupMaxChunkSize {
+		return fmt.Errorf("backup file is corrupted")
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(br.r, sealed); err != nil {
+		return fmt.Errorf("backup file is truncated")
+	}
+
+	plain, err := br.aead.Open(nil, backupChunkNonce(br.nonce, br.index), sealed, backupChunkAD(br.index, final))
+	if err != nil {
+		return fmt.Errorf("backup password is incorrect or file is corrupted")
+	}
+
+	br.index++
+	br.buf = plain
+	br.final = final
+	return nil
+}
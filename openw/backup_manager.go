@@ -0,0 +1,618 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/common/file"
+	"github.com/blocktree/openwallet/v2/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	//备份文件扩展名
+	BackupFileExt = ".owbak"
+
+	//备份包内的目录
+	backupDBDir       = "db"
+	backupKeyDir      = "keys"
+	backupConfDir     = "conf"
+	backupSysDir      = "system"
+	backupManifestTar = "manifest.json"
+
+	//系统数据库在备份包内的文件名
+	backupJobDBFile   = "jobs.db"
+	backupTokenDBFile = "tokens.db"
+)
+
+//BackupFile 备份包内的文件
+type BackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+//BackupManifest 备份清单，记录全部文件的校验值
+type BackupManifest struct {
+	Version    int           `json:"version"`
+	CreateTime int64         `json:"createTime"`
+	Apps       []string      `json:"apps"`
+	Files      []*BackupFile `json:"files"`
+}
+
+//backupArchive 写入备份包，记录每个文件的校验值
+type backupArchive struct {
+	tw       *tar.Writer
+	manifest *BackupManifest
+}
+
+//add 写入一个文件，size必须与写入数据长度一致
+func (a *backupArchive) add(name string, size int64, write func(w io.Writer) error) error {
+
+	err := a.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(a.tw, h)}
+	if err = write(cw); err != nil {
+		return err
+	}
+	if cw.n != size {
+		return fmt.Errorf("backup file %s size changed while writing", name)
+	}
+
+	a.manifest.Files = append(a.manifest.Files, &BackupFile{
+		Path:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	})
+	return nil
+}
+
+//addDB 复制只读事务中的数据库快照
+func (a *backupArchive) addDB(name string, tx *bolt.Tx) error {
+	return a.add(name, tx.Size(), func(w io.Writer) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+//backupDBSnapshot 备份的数据库及其只读事务
+type backupDBSnapshot struct {
+	name string
+	db   *StormDB
+	tx   *bolt.Tx
+}
+
+//addDir 写入目录下的全部文件
+func (a *backupArchive) addDir(prefix, dir string) error {
+
+	if len(dir) == 0 || !file.Exists(dir) {
+		return nil
+	}
+
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return a.add(path.Join(prefix, filepath.ToSlash(rel)), info.Size(), func(w io.Writer) error {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		})
+	})
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+//Backup 备份全部应用数据库、钥匙文件及资产配置到Config.BackupDir，返回备份文件路径
+//数据库在只读事务中复制，区块扫描可以继续写入
+func (wm *WalletManager) Backup(password string) (string, *BackupManifest, error) {
+
+	if len(password) == 0 {
+		return "", nil, fmt.Errorf("backup password is empty")
+	}
+
+	if ok := file.MkdirAll(wm.cfg.BackupDir); !ok {
+		return "", nil, fmt.Errorf("can not create backup dir: %s", wm.cfg.BackupDir)
+	}
+
+	appIDs, err := wm.loadAllAppIDs()
+	if err != nil {
+		return "", nil, err
+	}
+	sort.Strings(appIDs)
+
+	filename := filepath.Join(wm.cfg.BackupDir, "openw-"+time.Now().Format("20060102150405")+BackupFileExt)
+	tmpFile := filename + ".tmp"
+
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(tmpFile)
+
+	manifest, err := wm.writeBackup(f, password, appIDs)
+	f.Close()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err = os.Rename(tmpFile, filename); err != nil {
+		return "", nil, err
+	}
+
+	log.Infof("backup %d apps, %d files to %s", len(manifest.Apps), len(manifest.Files), filename)
+
+	return filename, manifest, nil
+}
+
+func (wm *WalletManager) writeBackup(w io.Writer, password string, appIDs []string) (*BackupManifest, error) {
+
+	bw, err := newBackupWriter(w, password)
+	if err != nil {
+		return nil, err
+	}
+	gw := gzip.NewWriter(bw)
+	tw := tar.NewWriter(gw)
+
+	archive := &backupArchive{
+		tw: tw,
+		manifest: &BackupManifest{
+			Version:    backupVersion,
+			CreateTime: time.Now().Unix(),
+			Apps:       appIDs,
+			Files:      make([]*BackupFile, 0),
+		},
+	}
+
+	snapshots := make([]*backupDBSnapshot, 0, len(appIDs)+2)
+	for _, appID := range appIDs {
+		db, err := wm.OpenDB(appID)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, &backupDBSnapshot{name: path.Join(backupDBDir, appID+".db"), db: db})
+	}
+
+	//后台任务数据库及代币注册表，文件不存在时跳过
+	if file.Exists(wm.JobDBFile()) {
+		db, err := wm.openJobDB()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, &backupDBSnapshot{name: path.Join(backupSysDir, backupJobDBFile), db: db})
+	}
+
+	if file.Exists(wm.TokenDBFile()) {
+		wm.tokenMu.Lock()
+		db, err := wm.openTokenDB()
+		wm.tokenMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, &backupDBSnapshot{name: path.Join(backupSysDir, backupTokenDBFile), db: db})
+	}
+
+	//先开启全部数据库的只读事务再复制，各数据库的快照时间点一致
+	defer func() {
+		for _, snapshot := range snapshots {
+			if snapshot.tx != nil {
+				snapshot.tx.Rollback()
+			}
+		}
+	}()
+	for _, snapshot := range snapshots {
+		if snapshot.tx, err = snapshot.db.Bolt.Begin(false); err != nil {
+			return nil, fmt.Errorf("backup %s failed, unexpected error: %v", snapshot.name, err)
+		}
+	}
+	for _, snapshot := range snapshots {
+		if err = archive.addDB(snapshot.name, snapshot.tx); err != nil {
+			return nil, fmt.Errorf("backup %s failed, unexpected error: %v", snapshot.name, err)
+		}
+	}
+
+	if err = archive.addDir(backupKeyDir, wm.cfg.KeyDir); err != nil {
+		return nil, fmt.Errorf("backup keys failed, unexpected error: %v", err)
+	}
+
+	if err = archive.addDir(backupConfDir, wm.cfg.ConfigDir); err != nil {
+		return nil, fmt.Errorf("backup configs failed, unexpected error: %v", err)
+	}
+
+	//清单放在最后，读取时可以边解压边校验
+	manifestJSON, err := json.MarshalIndent(archive.manifest, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    backupManifestTar,
+		Mode:    0600,
+		Size:    int64(len(manifestJSON)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tw.Write(manifestJSON); err != nil {
+		return nil, err
+	}
+
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gw.Close(); err != nil {
+		return nil, err
+	}
+	if err = bw.Close(); err != nil {
+		return nil, err
+	}
+
+	return archive.manifest, nil
+}
+
+//readBackup 读取备份包并校验清单，dir不为空时解压文件到该目录
+func readBackup(filename, password, dir string) (*BackupManifest, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br, err := newBackupReader(f, password)
+	if err != nil {
+		return nil, err
+	}
+
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("backup file is corrupted: %v", err)
+	}
+	defer gr.Close()
+
+	var (
+		tr       = tar.NewReader(gr)
+		manifest *BackupManifest
+		files    = make(map[string]*BackupFile)
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("backup file is corrupted: %v", err)
+		}
+
+		if manifest != nil {
+			return nil, fmt.Errorf("backup file is corrupted: unexpected file after manifest")
+		}
+
+		if hdr.Name == backupManifestTar {
+			manifest = &BackupManifest{}
+			if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("backup manifest is invalid: %v", err)
+			}
+			continue
+		}
+
+		name, err := cleanBackupPath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		var out io.Writer = ioutil.Discard
+		var fw *os.File
+		if len(dir) > 0 {
+			target := filepath.Join(dir, filepath.FromSlash(name))
+			if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return nil, err
+			}
+			fw, err = os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return nil, err
+			}
+			out = fw
+		}
+
+		h := sha256.New()
+		size, err := io.Copy(io.MultiWriter(out, h), tr)
+		if fw != nil {
+			fw.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("backup file is corrupted: %v", err)
+		}
+
+		files[name] = &BackupFile{Path: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("backup manifest not found")
+	}
+
+	if len(manifest.Files) != len(files) {
+		return nil, fmt.Errorf("backup files count is %d, manifest expects %d", len(files), len(manifest.Files))
+	}
+
+	for _, expect := range manifest.Files {
+		got, ok := files[expect.Path]
+		if !ok {
+			return nil, fmt.Errorf("backup file %s is missing", expect.Path)
+		}
+		if got.Size != expect.Size || got.SHA256 != expect.SHA256 {
+			return nil, fmt.Errorf("backup file %s checksum mismatch", expect.Path)
+		}
+	}
+
+	return manifest, nil
+}
+
+//cleanBackupPath 检查备份包内的路径，防止解压到目标目录之外
+func cleanBackupPath(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("backup file path is invalid: %s", name)
+	}
+	dir := strings.SplitN(clean, "/", 2)[0]
+	if dir != backupDBDir && dir != backupKeyDir && dir != backupConfDir && dir != backupSysDir {
+		return "", fmt.Errorf("backup file path is invalid: %s", name)
+	}
+	return clean, nil
+}
+
+//VerifyBackup 解密备份文件并校验全部文件的校验值
+func VerifyBackup(filename, password string) (*BackupManifest, error) {
+	return readBackup(filename, password, "")
+}
+
+//RestoreBackup 恢复备份，先在临时目录解压并完成校验，校验通过后才覆盖现有文件
+func (wm *WalletManager) RestoreBackup(filename, password string) (*BackupManifest, error) {
+
+	if ok := file.MkdirAll(wm.cfg.BackupDir); !ok {
+		return nil, fmt.Errorf("can not create backup dir: %s", wm.cfg.BackupDir)
+	}
+
+	staging, err := ioutil.TempDir(wm.cfg.BackupDir, "restore")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := readBackup(filename, password, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := map[string]string{
+		backupDBDir:   wm.cfg.DBPath,
+		backupKeyDir:  wm.cfg.KeyDir,
+		backupConfDir: wm.cfg.ConfigDir,
+	}
+
+	//系统数据库按文件名恢复到配置的路径
+	sysFiles := map[string]string{
+		backupJobDBFile:   wm.JobDBFile(),
+		backupTokenDBFile: wm.TokenDBFile(),
+	}
+
+	//运行中的重扫任务会写入任务数据库，恢复前必须先停止
+	wm.rescanMu.Lock()
+	if n := len(wm.rescanJobs); n > 0 {
+		wm.rescanMu.Unlock()
+		return nil, fmt.Errorf("%d rescan jobs are running, stop them before restore", n)
+	}
+
+	//关闭全部已打开的数据库，防止恢复过程中被写入
+	wm.tokenMu.Lock()
+	wm.mu.Lock()
+	for appID, db := range wm.appDB {
+		if db.Opened {
+			db.Close()
+		}
+		delete(wm.appDB, appID)
+	}
+	if wm.jobDB != nil && wm.jobDB.Opened {
+		wm.jobDB.Close()
+	}
+	wm.jobDB = nil
+	if wm.tokenDB != nil && wm.tokenDB.Opened {
+		wm.tokenDB.Close()
+	}
+	wm.tokenDB = nil
+
+	installs := make([]*backupInstall, 0, len(manifest.Files))
+	for _, bf := range manifest.Files {
+		parts := strings.SplitN(bf.Path, "/", 2)
+		var dst string
+		if parts[0] == backupSysDir {
+			dst = sysFiles[parts[1]]
+		} else if targetDir := targets[parts[0]]; len(targetDir) > 0 {
+			dst = filepath.Join(targetDir, filepath.FromSlash(parts[1]))
+		}
+		if len(dst) == 0 {
+			log.Warningf("restore skip %s, target path is not configured", bf.Path)
+			continue
+		}
+		installs = append(installs, &backupInstall{
+			path: bf.Path,
+			src:  filepath.Join(staging, filepath.FromSlash(bf.Path)),
+			dst:  dst,
+		})
+	}
+	err = installBackupFiles(installs)
+	wm.mu.Unlock()
+	wm.tokenMu.Unlock()
+	wm.rescanMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	//只重新加载扫描地址，运行中的区块扫描器保持不变
+	if err = wm.reloadAddressForBlockScan(); err != nil {
+		return nil, err
+	}
+
+	log.Infof("restore %d apps, %d files from %s", len(manifest.Apps), len(manifest.Files), filename)
+
+	return manifest, nil
+}
+
+//backupInstall 待恢复的文件
+type backupInstall struct {
+	path     string
+	src      string
+	dst      string
+	tmp      string //复制到目标目录的临时文件
+	original string //替换前原文件移到的位置
+}
+
+//installBackupFiles 先把全部文件复制到目标目录的临时文件，全部成功后才替换原文件
+//替换失败时恢复已替换的原文件
+func installBackupFiles(installs []*backupInstall) error {
+
+	defer func() {
+		for _, in := range installs {
+			if len(in.tmp) > 0 {
+				os.Remove(in.tmp)
+			}
+		}
+	}()
+
+	for _, in := range installs {
+		tmp, err := stageBackupFile(in.src, in.dst)
+		if err != nil {
+			return fmt.Errorf("restore %s failed, unexpected error: %v", in.path, err)
+		}
+		in.tmp = tmp
+	}
+
+	replaced := make([]*backupInstall, 0, len(installs))
+	rollback := func() {
+		for i := len(replaced) - 1; i >= 0; i-- {
+			in := replaced[i]
+			if len(in.original) > 0 {
+				os.Rename(in.original, in.dst)
+			} else {
+				os.Remove(in.dst)
+			}
+		}
+	}
+
+	for _, in := range installs {
+		if file.Exists(in.dst) {
+			in.original = in.dst + ".replaced"
+			if err := os.Rename(in.dst, in.original); err != nil {
+				rollback()
+				return fmt.Errorf("restore %s failed, unexpected error: %v", in.path, err)
+			}
+		}
+		if err := os.Rename(in.tmp, in.dst); err != nil {
+			if len(in.original) > 0 {
+				os.Rename(in.original, in.dst)
+			}
+			rollback()
+			return fmt.Errorf("restore %s failed, unexpected error: %v", in.path, err)
+		}
+		in.tmp = ""
+		replaced = append(replaced, in)
+	}
+
+	for _, in := range replaced {
+		if len(in.original) > 0 {
+			os.Remove(in.original)
+		}
+	}
+
+	return nil
+}
+
+//stageBackupFile 复制到目标目录的临时文件，返回临时文件路径
+func stageBackupFile(src, dst string) (string, error) {
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return "", err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp := dst + ".restoring"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	out.Close()
+
+	return tmp, nil
+}
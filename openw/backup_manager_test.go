@@ -0,0 +1,188 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/hdkeystore"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestWalletManager_Backup(t *testing.T) {
+
+	BackupScryptN, BackupScryptP = hdkeystore.LightScryptN, hdkeystore.LightScryptP
+	defer func() {
+		BackupScryptN, BackupScryptP = hdkeystore.StandardScryptN, hdkeystore.StandardScryptP
+	}()
+
+	dir, err := ioutil.TempDir("", "openw_backup")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.BackupDir = filepath.Join(dir, "backup")
+	cfg.ConfigDir = filepath.Join(dir, "conf")
+	cfg.JobDBFile = filepath.Join(dir, "jobs.db")
+	cfg.TokenDBFile = filepath.Join(dir, "tokens.db")
+	cfg.SupportAssets = nil
+	wm := NewWalletManager(cfg)
+
+	os.MkdirAll(cfg.ConfigDir, 0700)
+	ioutil.WriteFile(filepath.Join(cfg.KeyDir, "wallet1.key"), []byte("key data"), 0600)
+	ioutil.WriteFile(filepath.Join(cfg.ConfigDir, "BTC.ini"), []byte("serverAPI = x"), 0600)
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.Address{Address: "addr1", AccountID: "account1", Symbol: "BTC"})
+
+	wm.RegisterToken(&openwallet.SmartContract{Symbol: "ETH", Address: "0x01", Token: "T1"})
+	if _, err = wm.openJobDB(); err != nil {
+		t.Errorf("openJobDB failed, unexpected error: %v", err)
+		return
+	}
+
+	filename, manifest, err := wm.Backup("backup123")
+	if err != nil {
+		t.Errorf("Backup failed, unexpected error: %v", err)
+		return
+	}
+	if len(manifest.Files) != 5 {
+		t.Errorf("backup files = %d, want 5", len(manifest.Files))
+	}
+
+	if _, err = VerifyBackup(filename, "backup123"); err != nil {
+		t.Errorf("VerifyBackup failed, unexpected error: %v", err)
+		return
+	}
+
+	if _, err = VerifyBackup(filename, "wrong"); err == nil {
+		t.Errorf("VerifyBackup with wrong password should failed")
+	}
+
+	//篡改备份文件
+	data, _ := ioutil.ReadFile(filename)
+	data[len(data)-20] ^= 0xff
+	tampered := filename + ".bad"
+	ioutil.WriteFile(tampered, data, 0600)
+	if _, err = VerifyBackup(tampered, "backup123"); err == nil {
+		t.Errorf("VerifyBackup with tampered file should failed")
+	}
+
+	//文件头的scrypt参数超过上限
+	data, _ = ioutil.ReadFile(filename)
+	binary.BigEndian.PutUint32(data[len(backupMagic)+1:], 1<<30)
+	oversized := filename + ".scrypt"
+	ioutil.WriteFile(oversized, data, 0600)
+	if _, err = VerifyBackup(oversized, "backup123"); err == nil {
+		t.Errorf("VerifyBackup with oversized scrypt params should failed")
+	}
+
+	//损坏的备份不能覆盖现有数据
+	if _, err = wm.RestoreBackup(tampered, "backup123"); err == nil {
+		t.Errorf("RestoreBackup with tampered file should failed")
+	}
+
+	db.Save(&openwallet.Address{Address: "addr2", AccountID: "account1", Symbol: "BTC"})
+	ioutil.WriteFile(filepath.Join(cfg.KeyDir, "wallet1.key"), []byte("changed"), 0600)
+	wm.RegisterToken(&openwallet.SmartContract{Symbol: "ETH", Address: "0x02", Token: "T2"})
+
+	if _, err = wm.RestoreBackup(filename, "backup123"); err != nil {
+		t.Errorf("RestoreBackup failed, unexpected error: %v", err)
+		return
+	}
+
+	key, _ := ioutil.ReadFile(filepath.Join(cfg.KeyDir, "wallet1.key"))
+	if string(key) != "key data" {
+		t.Errorf("restored key = %s, want key data", string(key))
+	}
+
+	wrapper, err := wm.NewWalletWrapper("app1", "")
+	if err != nil {
+		t.Errorf("NewWalletWrapper failed, unexpected error: %v", err)
+		return
+	}
+	addrs, _ := wrapper.GetAddressList(0, -1)
+	if len(addrs) != 1 {
+		t.Errorf("restored addresses = %d, want 1", len(addrs))
+	}
+
+	tokens, _ := wm.ListTokens("ETH")
+	if len(tokens) != 1 {
+		t.Errorf("restored tokens = %d, want 1", len(tokens))
+	}
+
+	log.Infof("backup manifest: %+v", manifest)
+}
+
+func TestInstallBackupFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_restore")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.src"), []byte("new a"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "b.src"), []byte("new b"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("old a"), 0600)
+
+	//任一文件失败时不替换任何原文件
+	err = installBackupFiles([]*backupInstall{
+		{path: "a", src: filepath.Join(dir, "a.src"), dst: filepath.Join(dir, "a")},
+		{path: "missing", src: filepath.Join(dir, "missing.src"), dst: filepath.Join(dir, "missing")},
+	})
+	if err == nil {
+		t.Errorf("installBackupFiles with missing file should failed")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "a")); string(data) != "old a" {
+		t.Errorf("file a = %s, want old a", string(data))
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "a.restoring")); !os.IsNotExist(statErr) {
+		t.Errorf("staged file is not removed")
+	}
+
+	err = installBackupFiles([]*backupInstall{
+		{path: "a", src: filepath.Join(dir, "a.src"), dst: filepath.Join(dir, "a")},
+		{path: "b", src: filepath.Join(dir, "b.src"), dst: filepath.Join(dir, "sub", "b")},
+	})
+	if err != nil {
+		t.Errorf("installBackupFiles failed, unexpected error: %v", err)
+		return
+	}
+	a, _ := ioutil.ReadFile(filepath.Join(dir, "a"))
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "b"))
+	if string(a) != "new a" || string(b) != "new b" {
+		t.Errorf("installed files = %s, %s, want new a, new b", string(a), string(b))
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "a.replaced")); !os.IsNotExist(statErr) {
+		t.Errorf("replaced file is not removed")
+	}
+}
@@ -17,6 +17,10 @@ package openw
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/metrics"
+	"github.com/blocktree/openwallet/v2/openwallet"
 )
 
 //AddAddressForBlockScan 添加订阅地址
@@ -60,6 +64,7 @@ func (wm *WalletManager) GetSourceKeyByAddressForBlockScan(address string) (stri
 	return sourceKey, ok
 }
 
+//RescanBlockHeight 同步重扫区块范围，长时间的重扫使用StartRescanJob在后台运行
 func (wm *WalletManager) RescanBlockHeight(symbol string, startHeight uint64, endHeight uint64) error {
 
 	assetsMgr, err := GetAssetsAdapter(symbol)
@@ -75,7 +80,11 @@ func (wm *WalletManager) RescanBlockHeight(symbol string, startHeight uint64, en
 
 	if startHeight <= endHeight {
 		for i := startHeight; i <= endHeight; i++ {
+			start := time.Now()
+			wm.beginRescanBlock(symbol, i, "")
 			err := scanner.ScanBlock(i)
+			wm.endRescanBlock(symbol, i, "")
+			metrics.ObserveBlockExtract(symbol, metrics.ExtractModeRescan, start)
 			if err != nil {
 				continue
 			}
@@ -87,6 +96,27 @@ func (wm *WalletManager) RescanBlockHeight(symbol string, startHeight uint64, en
 	return nil
 }
 
+//GetTransactionsByAddress 通过全节点查询地址的交易记录，适配器不支持时返回ErrUnsupportedCapability
+func (wm *WalletManager) GetTransactionsByAddress(coin openwallet.Coin, offset, limit int, address ...string) ([]*openwallet.TxExtractData, error) {
+
+	assetsMgr, err := GetAssetsAdapter(coin.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	if capErr := checkCapability(coin.Symbol, assetsMgr, openwallet.CapabilityTransactionsByAddress); capErr != nil {
+		return nil, capErr
+	}
+
+	scanner := assetsMgr.GetBlockScanner()
+
+	if scanner == nil {
+		return nil, fmt.Errorf("%s is not support block scan", coin.Symbol)
+	}
+
+	return scanner.GetTransactionsByAddress(offset, limit, coin, address...)
+}
+
 //SetRescanBlockHeight 重置区块高度起扫描
 func (wm *WalletManager) SetRescanBlockHeight(symbol string, height uint64) error {
 
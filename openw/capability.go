@@ -0,0 +1,53 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//GetAssetsCapabilities 获取币种资产适配器的功能描述
+func (wm *WalletManager) GetAssetsCapabilities(symbol string) (openwallet.Capabilities, error) {
+	assetsMgr, err := GetAssetsAdapter(symbol)
+	if err != nil {
+		return nil, err
+	}
+	return openwallet.GetAssetsCapabilities(assetsMgr), nil
+}
+
+//ListAssetsCapabilities 列出支持的资产的功能描述，key为大写币种
+func (wm *WalletManager) ListAssetsCapabilities() map[string]openwallet.Capabilities {
+	list := make(map[string]openwallet.Capabilities)
+	for _, symbol := range wm.cfg.SupportAssets {
+		caps, err := wm.GetAssetsCapabilities(symbol)
+		if err != nil {
+			continue
+		}
+		list[strings.ToUpper(symbol)] = caps
+	}
+	return list
+}
+
+//checkCapability 资产适配器明确不支持该功能时返回ErrUnsupportedCapability，未知的功能放行
+func checkCapability(symbol string, assetsMgr openwallet.AssetsAdapter, capability openwallet.Capability) *openwallet.Error {
+	supported, known := openwallet.GetAssetsCapabilities(assetsMgr).Supports(capability)
+	if known && !supported {
+		return openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] is not support %s", symbol, capability)
+	}
+	return nil
+}
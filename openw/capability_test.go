@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type capabilityTestAdapter struct {
+	openwallet.AssetsAdapterBase
+}
+
+func (a *capabilityTestAdapter) GetBlockScanner() openwallet.BlockScanner {
+	return openwallet.NewBlockScannerBase()
+}
+
+func (a *capabilityTestAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	return &openwallet.TransactionDecoderBase{}
+}
+
+func (a *capabilityTestAdapter) DeclareCapabilities() openwallet.Capabilities {
+	return openwallet.Capabilities{
+		openwallet.CapabilityTransactionsByAddress: true,
+		openwallet.CapabilitySummaryWithFee:        false,
+	}
+}
+
+func TestWalletManager_ListAssetsCapabilities(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_capability")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	RegAssets("CAPB", &capabilityTestAdapter{})
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.SupportAssets = []string{"CAPB"}
+	wm := NewWalletManager(cfg)
+
+	list := wm.ListAssetsCapabilities()
+	caps, ok := list["CAPB"]
+	if !ok {
+		t.Errorf("capabilities of CAPB not found")
+		return
+	}
+
+	tests := []struct {
+		capability openwallet.Capability
+		supported  bool
+		known      bool
+	}{
+		{openwallet.CapabilitySmartContract, false, true},
+		{openwallet.CapabilityBlockchainDAI, false, true},
+		{openwallet.CapabilityTransactionsByAddress, true, true},
+		{openwallet.CapabilitySummaryWithFee, false, true},
+		{openwallet.CapabilityEstimateFee, false, false},
+	}
+	for _, test := range tests {
+		supported, known := caps.Supports(test.capability)
+		if supported != test.supported || known != test.known {
+			t.Errorf("%s: supported = %v, known = %v, want %v, %v", test.capability, supported, known, test.supported, test.known)
+		}
+	}
+
+	assetsMgr, _ := GetAssetsAdapter("CAPB")
+	capErr := checkCapability("CAPB", assetsMgr, openwallet.CapabilitySmartContract)
+	if capErr == nil || capErr.Code() != openwallet.ErrUnsupportedCapability {
+		t.Errorf("smart contract should be refused, got: %v", capErr)
+	}
+	if capErr := checkCapability("CAPB", assetsMgr, openwallet.CapabilityEstimateFee); capErr != nil {
+		t.Errorf("unknown capability should pass, got: %v", capErr)
+	}
+
+	log.Infof("capabilities: %v", caps.Supported())
+}
+
+//declaredContractAdapter 声明支持智能合约，但没有实现合约解析器
+type declaredContractAdapter struct {
+	openwallet.AssetsAdapterBase
+}
+
+func (a *declaredContractAdapter) DeclareCapabilities() openwallet.Capabilities {
+	return openwallet.Capabilities{openwallet.CapabilitySmartContract: true}
+}
+
+func TestWalletManager_SmartContractWithoutDecoder(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_capability")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	RegAssets("CAPD", &declaredContractAdapter{})
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.TokenDBFile = filepath.Join(dir, "tokens.db")
+	cfg.SupportAssets = nil
+	wm := NewWalletManager(cfg)
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", WalletID: "wallet1", Symbol: "CAPD"})
+
+	contract := &openwallet.SmartContract{Symbol: "CAPD", Address: "0x01"}
+	_, err = wm.CallSmartContractABI("app1", "wallet1", "account1", contract, nil)
+	if owErr, ok := err.(*openwallet.Error); !ok || owErr.Code() != openwallet.ErrUnsupportedCapability {
+		t.Errorf("CallSmartContractABI error = %v, want unsupported capability", err)
+	}
+
+	_, owErr := wm.CreateSmartContractTransaction("app1", "wallet1", "account1", "0", "", contract, nil)
+	if owErr == nil || owErr.Code() != openwallet.ErrUnsupportedCapability {
+		t.Errorf("CreateSmartContractTransaction error = %v, want unsupported capability", owErr)
+	}
+
+	rawTx := &openwallet.SmartContractRawTransaction{Coin: openwallet.Coin{Symbol: "CAPD", Contract: *contract}}
+	_, owErr = wm.SubmitSmartContractTransaction("app1", "wallet1", "account1", rawTx)
+	if owErr == nil || owErr.Code() != openwallet.ErrUnsupportedCapability {
+		t.Errorf("SubmitSmartContractTransaction error = %v, want unsupported capability", owErr)
+	}
+}
+
+//undeclaredFeeAdapter 声明不支持手续费预估及地址交易查询
+type undeclaredFeeAdapter struct {
+	openwallet.AssetsAdapterBase
+}
+
+func (a *undeclaredFeeAdapter) GetBlockScanner() openwallet.BlockScanner {
+	return openwallet.NewBlockScannerBase()
+}
+
+func (a *undeclaredFeeAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	return &openwallet.TransactionDecoderBase{}
+}
+
+func (a *undeclaredFeeAdapter) DeclareCapabilities() openwallet.Capabilities {
+	return openwallet.Capabilities{
+		openwallet.CapabilityEstimateFee:           false,
+		openwallet.CapabilityTransactionsByAddress: false,
+	}
+}
+
+func TestWalletManager_UnsupportedCapabilityEntries(t *testing.T) {
+
+	wm, cleanup := newTestManager(t, map[string]interface{}{"CAPF": &undeclaredFeeAdapter{}})
+	defer cleanup()
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", WalletID: "wallet1", Symbol: "CAPF"})
+
+	isUnsupported := func(err error) bool {
+		owErr, ok := err.(*openwallet.Error)
+		return ok && owErr.Code() == openwallet.ErrUnsupportedCapability
+	}
+
+	if _, _, err = wm.GetEstimateFeeRate(openwallet.Coin{Symbol: "CAPF"}); !isUnsupported(err) {
+		t.Errorf("GetEstimateFeeRate error = %v, want unsupported capability", err)
+	}
+	if _, err = wm.EstimateTransactionFee("app1", "wallet1", "account1", &openwallet.RawTransaction{}); !isUnsupported(err) {
+		t.Errorf("EstimateTransactionFee error = %v, want unsupported capability", err)
+	}
+	if _, err = wm.GetTransactionsByAddress(openwallet.Coin{Symbol: "CAPF"}, 0, -1, "addr1"); !isUnsupported(err) {
+		t.Errorf("GetTransactionsByAddress error = %v, want unsupported capability", err)
+	}
+
+	//没有HD路径的账户需要适配器自定义创建地址
+	if _, err = wm.CreateAddress("app1", "wallet1", "account1", 1); !isUnsupported(err) {
+		t.Errorf("CreateAddress error = %v, want unsupported capability", err)
+	}
+}
@@ -15,19 +15,115 @@
 
 package openw
 
-import "path/filepath"
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/config"
+)
 
 var (
 	defaultDataDir = filepath.Join(".", "openw_data")
 )
 
+const (
+	defaultHealthNodeTimeout    = 10 * time.Second
+	defaultHealthScanStaleAfter = 10 * time.Minute
+
+	defaultTokenBalanceCacheTTL    = 30 * time.Second
+	defaultTokenBalanceConcurrency = 4
+	defaultTokenBalanceBatchSize   = 100
+
+	defaultReconcileRescanMaxBlocks = 10000
+
+	defaultRebroadcastInterval    = 10 * time.Minute
+	defaultRebroadcastExpireAfter = 24 * time.Hour
+)
+
 type Config struct {
 	KeyDir          string   //钥匙备份路径
 	DBPath          string   //本地数据库文件路径
 	BackupDir       string   //备份路径
+	JobDBFile       string   //后台任务数据库文件，例如重扫任务
+	TokenDBFile     string   //代币合约注册表及合约交易回执数据库文件
 	SupportAssets   []string //支持的资产类型
 	EnableBlockScan bool
 	ConfigDir       string
+	ScanSymbols     map[string]bool            //按币种开关区块扫描，未配置的币种跟随EnableBlockScan
+	AssetsConfigs   map[string]config.Configer //资产适配器配置，以ConfigDir下的<symbol>.ini为基础覆盖配置文件及环境变量的值，未配置的币种直接读取<symbol>.ini
+
+	StrictAppRegistration bool //只允许打开通过CreateApp创建的应用，防止错误的appID创建多余的数据库
+
+	MetricsAddr string //指标及健康检查服务监听地址，例如:9100，空值不启动
+
+	HealthNodeTimeout      time.Duration            //健康检查请求全节点及开启数据库事务的超时时间
+	HealthScanStaleAfter   time.Duration            //超过该时间没有新区块通知视为扫描停滞，0为不检查
+	HealthScanStaleSymbols map[string]time.Duration //按币种设置扫描停滞时间，出块慢的链需要更长
+
+	RetentionPolicies []*RetentionPolicy //区块提取数据的保留策略
+	PruneTaskPeriod   time.Duration      //定时清理过期数据的周期，0为不启动
+	CompactFreeRatio  float64            //清理后空闲空间占数据库文件的比例超过该值时压缩，0为不压缩
+
+	ReconcileTaskPeriod      time.Duration //定时对账的周期，0为不启动，只能手动调用ReconcileApp
+	ReconcileRescan          bool          //定时对账存在偏差时是否创建后台重扫任务
+	ReconcileRescanMaxBlocks uint64        //对账触发重扫最多重扫已扫描高度之前的区块数，0为不限制
+
+	SnapshotBlockInterval uint64 //每隔多少个区块记录一次账户余额快照，0为不记录
+	SnapshotDaily         bool   //每天(UTC)第一个扫描的区块记录一次账户余额快照
+
+	TokenBalanceCacheTTL    time.Duration //代币余额查询结果的缓存时间，0为不缓存
+	TokenBalanceConcurrency int           //汇总代币余额时并发请求全节点的数量
+	TokenBalanceBatchSize   int           //每次调用GetTokenBalanceByAddress查询的地址数量
+
+	RebroadcastTaskPeriod    time.Duration            //未确认交易检查服务的周期，0为不启动
+	RebroadcastInterval      time.Duration            //未确认交易重新广播的最小间隔
+	RebroadcastExpireAfter   time.Duration            //广播后超过该时间未上链标记为过期或丢弃，0为不过期
+	RebroadcastExpireSymbols map[string]time.Duration //按币种设置未确认交易的过期时间，出块慢的链需要更长
+	RebroadcastBlindSymbols  []string                 //不支持查询交易状态的币种默认不重新广播，列出的币种按间隔直接重新广播
+}
+
+//RetentionPolicy 区块提取数据的保留策略，保留数量以区块计算，0为永久保留
+type RetentionPolicy struct {
+	AppID                 string //应用ID，空值匹配全部应用
+	Symbol                string //主链币种，空值匹配全部币种
+	KeepTxInputBlocks     uint64 //出账记录保留的区块数
+	KeepTxOutputBlocks    uint64 //入账记录保留的区块数
+	KeepTransactionBlocks uint64 //交易记录保留的区块数
+}
+
+//GetRetentionPolicy 获取应用及币种适用的保留策略，匹配越精确优先级越高
+func (c *Config) GetRetentionPolicy(appID, symbol string) *RetentionPolicy {
+
+	var (
+		matched *RetentionPolicy
+		weight  = -1
+	)
+
+	for _, p := range c.RetentionPolicies {
+		if p == nil {
+			continue
+		}
+		w := 0
+		if len(p.AppID) > 0 {
+			if p.AppID != appID {
+				continue
+			}
+			w += 2
+		}
+		if len(p.Symbol) > 0 {
+			if !strings.EqualFold(p.Symbol, symbol) {
+				continue
+			}
+			w += 1
+		}
+		if w > weight {
+			matched = p
+			weight = w
+		}
+	}
+
+	return matched
 }
 
 func NewConfig() *Config {
@@ -40,16 +136,72 @@ func NewConfig() *Config {
 	c.DBPath = filepath.Join(defaultDataDir, "db")
 	//备份路径
 	c.BackupDir = filepath.Join(defaultDataDir, "backup")
+	//后台任务数据库文件
+	c.JobDBFile = filepath.Join(defaultDataDir, "jobs.db")
+	//代币合约注册表数据库文件
+	c.TokenDBFile = filepath.Join(defaultDataDir, "tokens.db")
 	//支持资产
 	c.SupportAssets = []string{"BTC", "ETH", "QTUM", "NAS", "TRX"}
 	//开启区块扫描
 	c.EnableBlockScan = true
+	//健康检查
+	c.HealthNodeTimeout = defaultHealthNodeTimeout
+	c.HealthScanStaleAfter = defaultHealthScanStaleAfter
+	//对账重扫范围
+	c.ReconcileRescanMaxBlocks = defaultReconcileRescanMaxBlocks
+	//代币余额汇总
+	c.TokenBalanceCacheTTL = defaultTokenBalanceCacheTTL
+	c.TokenBalanceConcurrency = defaultTokenBalanceConcurrency
+	c.TokenBalanceBatchSize = defaultTokenBalanceBatchSize
+	//未确认交易重新广播
+	c.RebroadcastInterval = defaultRebroadcastInterval
+	c.RebroadcastExpireAfter = defaultRebroadcastExpireAfter
 
 	return &c
 }
 
-//loadConfig 加载配置文件
-//@param path 配置文件路径
-func loadConfig(path string) *Config {
-	return nil
+//HealthScanStaleThreshold 币种的扫描停滞时间，未单独配置使用HealthScanStaleAfter
+func (c *Config) HealthScanStaleThreshold(symbol string) time.Duration {
+	if d, ok := c.HealthScanStaleSymbols[strings.ToUpper(symbol)]; ok {
+		return d
+	}
+	return c.HealthScanStaleAfter
+}
+
+//IsBlockScanEnabled 币种是否开启区块扫描，未单独配置的币种跟随EnableBlockScan
+func (c *Config) IsBlockScanEnabled(symbol string) bool {
+	if !c.EnableBlockScan {
+		return false
+	}
+	if enabled, ok := c.ScanSymbols[strings.ToUpper(symbol)]; ok {
+		return enabled
+	}
+	return true
+}
+
+//assetsConfig 获取资产适配器配置，没有内嵌配置时读取ConfigDir下的<symbol>.ini
+func (c *Config) assetsConfig(symbol string) (config.Configer, error) {
+	if ac, ok := c.AssetsConfigs[strings.ToUpper(symbol)]; ok {
+		return ac, nil
+	}
+	absFile := filepath.Join(c.ConfigDir, symbol+".ini")
+	return config.NewConfig("ini", absFile)
+}
+
+//RebroadcastBlind 不支持查询交易状态的币种是否按间隔直接重新广播
+func (c *Config) RebroadcastBlind(symbol string) bool {
+	for _, s := range c.RebroadcastBlindSymbols {
+		if strings.EqualFold(s, symbol) {
+			return true
+		}
+	}
+	return false
+}
+
+//RebroadcastExpireThreshold 币种未确认交易的过期时间，未单独配置使用RebroadcastExpireAfter
+func (c *Config) RebroadcastExpireThreshold(symbol string) time.Duration {
+	if d, ok := c.RebroadcastExpireSymbols[strings.ToUpper(symbol)]; ok {
+		return d
+	}
+	return c.RebroadcastExpireAfter
 }
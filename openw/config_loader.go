@@ -0,0 +1,670 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/config"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ConfigFormatINI  = "ini"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatJSON = "json"
+)
+
+//ConfigEnvPrefix 环境变量前缀
+//openw配置为OPENW_<KEY>，例如OPENW_DB_PATH
+//扫描开关为OPENW_SCAN_<SYMBOL>，资产配置为OPENW_<SYMBOL>_<KEY>
+const ConfigEnvPrefix = "OPENW_"
+
+const (
+	configSectionOpenw       = "openw"
+	configSectionScan        = "scan"
+	configSectionHealth      = "health"      //按币种设置扫描停滞时间
+	configSectionRebroadcast = "rebroadcast" //按币种设置未确认交易过期时间
+	configSectionDefault     = "default"     //不在任何节点下的配置
+)
+
+//configSections 配置文件按节点解析后的内容，节点名及键名均为小写
+type configSections map[string]map[string]string
+
+//configOption openw配置项
+type configOption struct {
+	key string
+	env string
+	set func(c *Config, value string) error
+}
+
+func stringOption(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func boolOption(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool value %q", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func durationOption(field func(c *Config) *time.Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration value %q", value)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func intOption(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer value %q", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func floatOption(field func(c *Config) *float64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid float value %q", value)
+		}
+		*field(c) = f
+		return nil
+	}
+}
+
+func uintOption(field func(c *Config) *uint64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer value %q", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+var configOptions = []configOption{
+	{"keyDir", "KEY_DIR", stringOption(func(c *Config) *string { return &c.KeyDir })},
+	{"dbPath", "DB_PATH", stringOption(func(c *Config) *string { return &c.DBPath })},
+	{"backupDir", "BACKUP_DIR", stringOption(func(c *Config) *string { return &c.BackupDir })},
+	{"jobDBFile", "JOB_DB_FILE", stringOption(func(c *Config) *string { return &c.JobDBFile })},
+	{"tokenDBFile", "TOKEN_DB_FILE", stringOption(func(c *Config) *string { return &c.TokenDBFile })},
+	{"configDir", "CONFIG_DIR", stringOption(func(c *Config) *string { return &c.ConfigDir })},
+	{"metricsAddr", "METRICS_ADDR", stringOption(func(c *Config) *string { return &c.MetricsAddr })},
+	{"enableBlockScan", "ENABLE_BLOCK_SCAN", boolOption(func(c *Config) *bool { return &c.EnableBlockScan })},
+	{"strictAppRegistration", "STRICT_APP_REGISTRATION", boolOption(func(c *Config) *bool { return &c.StrictAppRegistration })},
+	{"snapshotDaily", "SNAPSHOT_DAILY", boolOption(func(c *Config) *bool { return &c.SnapshotDaily })},
+	{"supportAssets", "SUPPORT_ASSETS", func(c *Config, value string) error {
+		c.SupportAssets = splitConfigList(value)
+		return nil
+	}},
+	{"pruneTaskPeriod", "PRUNE_TASK_PERIOD", durationOption(func(c *Config) *time.Duration { return &c.PruneTaskPeriod })},
+	{"compactFreeRatio", "COMPACT_FREE_RATIO", floatOption(func(c *Config) *float64 { return &c.CompactFreeRatio })},
+	{"healthNodeTimeout", "HEALTH_NODE_TIMEOUT", durationOption(func(c *Config) *time.Duration { return &c.HealthNodeTimeout })},
+	{"healthScanStaleAfter", "HEALTH_SCAN_STALE_AFTER", durationOption(func(c *Config) *time.Duration { return &c.HealthScanStaleAfter })},
+	{"snapshotBlockInterval", "SNAPSHOT_BLOCK_INTERVAL", uintOption(func(c *Config) *uint64 { return &c.SnapshotBlockInterval })},
+	{"reconcileTaskPeriod", "RECONCILE_TASK_PERIOD", durationOption(func(c *Config) *time.Duration { return &c.ReconcileTaskPeriod })},
+	{"reconcileRescan", "RECONCILE_RESCAN", boolOption(func(c *Config) *bool { return &c.ReconcileRescan })},
+	{"reconcileRescanMaxBlocks", "RECONCILE_RESCAN_MAX_BLOCKS", uintOption(func(c *Config) *uint64 { return &c.ReconcileRescanMaxBlocks })},
+	{"tokenBalanceCacheTTL", "TOKEN_BALANCE_CACHE_TTL", durationOption(func(c *Config) *time.Duration { return &c.TokenBalanceCacheTTL })},
+	{"tokenBalanceConcurrency", "TOKEN_BALANCE_CONCURRENCY", intOption(func(c *Config) *int { return &c.TokenBalanceConcurrency })},
+	{"tokenBalanceBatchSize", "TOKEN_BALANCE_BATCH_SIZE", intOption(func(c *Config) *int { return &c.TokenBalanceBatchSize })},
+	{"rebroadcastTaskPeriod", "REBROADCAST_TASK_PERIOD", durationOption(func(c *Config) *time.Duration { return &c.RebroadcastTaskPeriod })},
+	{"rebroadcastInterval", "REBROADCAST_INTERVAL", durationOption(func(c *Config) *time.Duration { return &c.RebroadcastInterval })},
+	{"rebroadcastExpireAfter", "REBROADCAST_EXPIRE_AFTER", durationOption(func(c *Config) *time.Duration { return &c.RebroadcastExpireAfter })},
+	{"rebroadcastBlindSymbols", "REBROADCAST_BLIND_SYMBOLS", func(c *Config, value string) error {
+		c.RebroadcastBlindSymbols = splitConfigList(value)
+		return nil
+	}},
+}
+
+//splitConfigList 解析逗号分隔的列表
+func splitConfigList(value string) []string {
+	list := make([]string, 0)
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) > 0 {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+//configFormat 根据文件扩展名判断配置文件格式
+func configFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ini", ".conf":
+		return ConfigFormatINI, nil
+	case ".yaml", ".yml":
+		return ConfigFormatYAML, nil
+	case ".json":
+		return ConfigFormatJSON, nil
+	default:
+		return "", fmt.Errorf("unsupported config file: %s, use .ini, .yaml or .json", path)
+	}
+}
+
+//LoadConfig 加载配置文件，再使用环境变量覆盖，最后校验配置
+//@param path 配置文件路径，支持ini、yaml及json，空值只使用默认配置及环境变量
+func LoadConfig(path string) (*Config, error) {
+
+	sections := configSections{}
+
+	if len(path) > 0 {
+		format, err := configFormat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config file failed, unexpected error: %v", err)
+		}
+
+		sections, err = parseConfigSections(format, data)
+		if err != nil {
+			return nil, fmt.Errorf("parse config file %s failed, unexpected error: %v", path, err)
+		}
+	}
+
+	return newConfigFromSections(sections, os.Environ())
+}
+
+//newConfigFromSections 在默认配置上应用配置文件及环境变量
+func newConfigFromSections(sections configSections, environ []string) (*Config, error) {
+
+	c := NewConfig()
+	env := parseConfigEnv(environ)
+	errs := make([]string, 0)
+
+	//openw配置，[openw]节点优先于未分节点的配置
+	for _, opt := range configOptions {
+		key := strings.ToLower(opt.key)
+		value, ok := sections[configSectionOpenw][key]
+		if !ok {
+			value, ok = sections[configSectionDefault][key]
+		}
+		source := opt.key
+		if v, exist := env[opt.env]; exist {
+			value, ok = v, true
+			source = ConfigEnvPrefix + opt.env
+		}
+		if !ok {
+			continue
+		}
+		if err := opt.set(c, strings.TrimSpace(value)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", source, err))
+		}
+	}
+
+	//拼写错误的配置项会被忽略，需要报错
+	known := make(map[string]bool)
+	for _, opt := range configOptions {
+		known[strings.ToLower(opt.key)] = true
+	}
+	for _, section := range []string{configSectionOpenw, configSectionDefault} {
+		for key := range sections[section] {
+			if !known[key] {
+				errs = append(errs, fmt.Sprintf("%s.%s: unknown config key", section, key))
+			}
+		}
+	}
+
+	for i, symbol := range c.SupportAssets {
+		c.SupportAssets[i] = strings.ToUpper(symbol)
+	}
+
+	//扫描开关
+	scan := make(map[string]string)
+	for symbol, value := range sections[configSectionScan] {
+		scan[strings.ToUpper(symbol)] = value
+	}
+	for key, value := range env {
+		if strings.HasPrefix(key, "SCAN_") {
+			scan[strings.TrimPrefix(key, "SCAN_")] = value
+		}
+	}
+	if len(scan) > 0 {
+		c.ScanSymbols = make(map[string]bool)
+	}
+	for symbol, value := range scan {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s.%s: invalid bool value %q", configSectionScan, symbol, value))
+			continue
+		}
+		c.ScanSymbols[symbol] = enabled
+	}
+
+	//扫描停滞时间
+	health, healthErrs := parseSymbolDurations(sections, env, configSectionHealth, "HEALTH_SCAN_STALE_")
+	errs = append(errs, healthErrs...)
+	if len(health) > 0 {
+		c.HealthScanStaleSymbols = health
+	}
+
+	//未确认交易过期时间
+	expire, expireErrs := parseSymbolDurations(sections, env, configSectionRebroadcast, "REBROADCAST_EXPIRE_")
+	errs = append(errs, expireErrs...)
+	if len(expire) > 0 {
+		c.RebroadcastExpireSymbols = expire
+	}
+
+	//资产适配器配置
+	for _, symbol := range c.SupportAssets {
+		values := make(map[string]string)
+		for key, value := range sections[strings.ToLower(symbol)] {
+			values[key] = value
+		}
+		prefix := symbol + "_"
+		for key, value := range env {
+			if strings.HasPrefix(key, prefix) {
+				values[strings.ToLower(strings.TrimPrefix(key, prefix))] = value
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		//<symbol>.ini作为基础配置，配置文件节点及环境变量只覆盖各自的键
+		base, err := loadAssetsConfigSections(c.ConfigDir, symbol)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", symbol, err))
+			continue
+		}
+		if base[configSectionDefault] == nil {
+			base[configSectionDefault] = make(map[string]string)
+		}
+		for key, value := range values {
+			base[configSectionDefault][key] = value
+		}
+		ac, err := newAssetsConfiger(base)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", symbol, err))
+			continue
+		}
+		if c.AssetsConfigs == nil {
+			c.AssetsConfigs = make(map[string]config.Configer)
+		}
+		c.AssetsConfigs[symbol] = ac
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+//parseSymbolDurations 解析按币种配置的时间，配置文件节点的键为币种，环境变量为<envPrefix><SYMBOL>
+//<envPrefix>AFTER是全局配置，不作为币种解析
+func parseSymbolDurations(sections configSections, env map[string]string, section, envPrefix string) (map[string]time.Duration, []string) {
+
+	values := make(map[string]string)
+	for symbol, value := range sections[section] {
+		values[strings.ToUpper(symbol)] = value
+	}
+	for key, value := range env {
+		if strings.HasPrefix(key, envPrefix) {
+			values[strings.TrimPrefix(key, envPrefix)] = value
+		}
+	}
+
+	result := make(map[string]time.Duration)
+	errs := make([]string, 0)
+	for symbol, value := range values {
+		if symbol == "AFTER" {
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s.%s: invalid duration value %q", section, symbol, value))
+			continue
+		}
+		result[symbol] = d
+	}
+
+	return result, errs
+}
+
+//parseConfigEnv 提取OPENW_前缀的环境变量，返回去掉前缀的大写键
+func parseConfigEnv(environ []string) map[string]string {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 || !strings.HasPrefix(pair[0], ConfigEnvPrefix) {
+			continue
+		}
+		env[strings.ToUpper(strings.TrimPrefix(pair[0], ConfigEnvPrefix))] = pair[1]
+	}
+	return env
+}
+
+//loadAssetsConfigSections 读取ConfigDir下的<symbol>.ini，文件不存在时返回空的节点
+func loadAssetsConfigSections(configDir, symbol string) (configSections, error) {
+
+	absFile := filepath.Join(configDir, symbol+".ini")
+	data, err := ioutil.ReadFile(absFile)
+	if os.IsNotExist(err) {
+		return configSections{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseINIConfigSections(data)
+}
+
+//newAssetsConfiger 把资产配置转为ini格式的Configer，与ConfigDir下的<symbol>.ini读取方式一致
+func newAssetsConfiger(sections configSections) (config.Configer, error) {
+
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		if name != configSectionDefault {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	//默认节点的配置写在最前面
+	names = append([]string{configSectionDefault}, names...)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		values := sections[name]
+		if len(values) == 0 {
+			continue
+		}
+		if name != configSectionDefault {
+			fmt.Fprintf(&buf, "[%s]\n", name)
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := values[key]
+			if strings.ContainsAny(value, "\r\n") {
+				return nil, fmt.Errorf("value of %s must be single line", key)
+			}
+			fmt.Fprintf(&buf, "%s = %s\n", key, value)
+		}
+	}
+
+	return config.NewConfigData(ConfigFormatINI, buf.Bytes())
+}
+
+//parseConfigSections 解析配置文件为节点
+func parseConfigSections(format string, data []byte) (configSections, error) {
+
+	switch format {
+	case ConfigFormatINI:
+		return parseINIConfigSections(data)
+	case ConfigFormatJSON:
+		var root map[string]interface{}
+		if err := json.Unmarshal(data, &root); err != nil {
+			return nil, err
+		}
+		return newConfigSections(root)
+	case ConfigFormatYAML:
+		var root map[string]interface{}
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return nil, err
+		}
+		return newConfigSections(root)
+	default:
+		return nil, fmt.Errorf("unsupported config format: %s", format)
+	}
+}
+
+//parseINIConfigSections 解析ini配置，[section]为节点，节点外的配置属于默认节点
+func parseINIConfigSections(data []byte) (configSections, error) {
+
+	//使用beego解析以保持与资产ini配置相同的语法，节点名通过扫描原文获取
+	c, err := config.NewConfigData(ConfigFormatINI, data)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := configSections{}
+	names := []string{configSectionDefault}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			names = append(names, strings.ToLower(line[1:len(line)-1]))
+		}
+	}
+
+	for _, name := range names {
+		values, err := c.GetSection(name)
+		if err != nil {
+			continue
+		}
+		section := make(map[string]string)
+		for key, value := range values {
+			section[key] = value
+		}
+		sections[name] = section
+	}
+
+	return sections, nil
+}
+
+//newConfigSections 把json或yaml的内容转为节点，对象为节点，其余为默认节点的配置
+func newConfigSections(root map[string]interface{}) (configSections, error) {
+
+	sections := configSections{}
+
+	setValue := func(section, key, path string, value interface{}) error {
+		v, err := configValueString(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if sections[section] == nil {
+			sections[section] = make(map[string]string)
+		}
+		sections[section][strings.ToLower(key)] = v
+		return nil
+	}
+
+	for name, value := range root {
+		var children map[string]interface{}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			children = v
+		case map[interface{}]interface{}:
+			children = make(map[string]interface{})
+			for k, child := range v {
+				children[fmt.Sprint(k)] = child
+			}
+		default:
+			if err := setValue(configSectionDefault, name, name, value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		section := strings.ToLower(name)
+		if sections[section] == nil {
+			sections[section] = make(map[string]string)
+		}
+		for key, child := range children {
+			if err := setValue(section, key, name+"."+key, child); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return sections, nil
+}
+
+//configValueString 配置值转为字符串，列表使用逗号连接
+func configValueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValueString(item)
+			if err != nil {
+				return "", err
+			}
+			list = append(list, s)
+		}
+		return strings.Join(list, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", value)
+	}
+}
+
+//Validate 校验配置
+func (c *Config) Validate() error {
+
+	errs := make([]string, 0)
+
+	if len(c.KeyDir) == 0 {
+		errs = append(errs, "keyDir is empty")
+	}
+	if len(c.DBPath) == 0 {
+		errs = append(errs, "dbPath is empty")
+	}
+
+	assets := make(map[string]bool)
+	for _, symbol := range c.SupportAssets {
+		symbol = strings.ToUpper(symbol)
+		if len(symbol) == 0 {
+			errs = append(errs, "supportAssets contains empty symbol")
+			continue
+		}
+		if assets[symbol] {
+			errs = append(errs, fmt.Sprintf("supportAssets contains duplicate symbol %s", symbol))
+		}
+		assets[symbol] = true
+	}
+
+	for symbol := range c.ScanSymbols {
+		if !assets[strings.ToUpper(symbol)] {
+			errs = append(errs, fmt.Sprintf("scan toggle of %s is not in supportAssets", symbol))
+		}
+	}
+
+	for symbol := range c.AssetsConfigs {
+		if !assets[strings.ToUpper(symbol)] {
+			errs = append(errs, fmt.Sprintf("assets config of %s is not in supportAssets", symbol))
+		}
+	}
+
+	if c.PruneTaskPeriod < 0 {
+		errs = append(errs, "pruneTaskPeriod is negative")
+	}
+
+	if c.CompactFreeRatio < 0 || c.CompactFreeRatio > 1 {
+		errs = append(errs, "compactFreeRatio must be between 0 and 1")
+	}
+
+	if c.ReconcileTaskPeriod < 0 {
+		errs = append(errs, "reconcileTaskPeriod is negative")
+	}
+
+	if c.HealthNodeTimeout < 0 {
+		errs = append(errs, "healthNodeTimeout is negative")
+	}
+
+	for symbol, d := range c.HealthScanStaleSymbols {
+		if !assets[strings.ToUpper(symbol)] {
+			errs = append(errs, fmt.Sprintf("health threshold of %s is not in supportAssets", symbol))
+		}
+		if d < 0 {
+			errs = append(errs, fmt.Sprintf("health threshold of %s is negative", symbol))
+		}
+	}
+
+	if c.RebroadcastTaskPeriod < 0 {
+		errs = append(errs, "rebroadcastTaskPeriod is negative")
+	}
+
+	if c.RebroadcastInterval < 0 {
+		errs = append(errs, "rebroadcastInterval is negative")
+	}
+
+	if c.RebroadcastExpireAfter < 0 {
+		errs = append(errs, "rebroadcastExpireAfter is negative")
+	}
+
+	for symbol, d := range c.RebroadcastExpireSymbols {
+		if !assets[strings.ToUpper(symbol)] {
+			errs = append(errs, fmt.Sprintf("rebroadcast expire of %s is not in supportAssets", symbol))
+		}
+		if d < 0 {
+			errs = append(errs, fmt.Sprintf("rebroadcast expire of %s is negative", symbol))
+		}
+	}
+
+	for _, symbol := range c.RebroadcastBlindSymbols {
+		if !assets[strings.ToUpper(symbol)] {
+			errs = append(errs, fmt.Sprintf("rebroadcast blind symbol %s is not in supportAssets", symbol))
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/log"
+)
+
+func TestNewConfigFromSections(t *testing.T) {
+
+	files := map[string]string{
+		ConfigFormatINI: `
+[openw]
+dbPath = /data/db
+supportAssets = btc, eth
+pruneTaskPeriod = 1h
+
+[scan]
+eth = false
+
+[rebroadcast]
+btc = 2h
+
+[BTC]
+serverAPI = http://127.0.0.1:8332
+`,
+		ConfigFormatYAML: `
+openw:
+  dbPath: /data/db
+  supportAssets: [btc, eth]
+  pruneTaskPeriod: 1h
+scan:
+  ETH: false
+rebroadcast:
+  BTC: 2h
+BTC:
+  serverAPI: http://127.0.0.1:8332
+`,
+		ConfigFormatJSON: `{
+  "dbPath": "/data/db",
+  "supportAssets": ["btc", "eth"],
+  "pruneTaskPeriod": "1h",
+  "scan": {"ETH": false},
+  "rebroadcast": {"BTC": "2h"},
+  "BTC": {"serverAPI": "http://127.0.0.1:8332"}
+}`,
+	}
+
+	environ := []string{"OPENW_KEY_DIR=/data/key", "OPENW_BTC_SERVERAPI=http://10.0.0.1:8332", "OPENW_REBROADCAST_EXPIRE_AFTER=12h", "OPENW_REBROADCAST_TASK_PERIOD=5m", "OPENW_REBROADCAST_BLIND_SYMBOLS=eth", "PATH=/bin"}
+
+	for format, data := range files {
+		sections, err := parseConfigSections(format, []byte(data))
+		if err != nil {
+			t.Errorf("%s parseConfigSections failed, unexpected error: %v", format, err)
+			continue
+		}
+		c, err := newConfigFromSections(sections, environ)
+		if err != nil {
+			t.Errorf("%s newConfigFromSections failed, unexpected error: %v", format, err)
+			continue
+		}
+		if c.DBPath != "/data/db" || c.KeyDir != "/data/key" || c.PruneTaskPeriod != time.Hour {
+			t.Errorf("%s paths = %s %s %v", format, c.DBPath, c.KeyDir, c.PruneTaskPeriod)
+		}
+		if strings.Join(c.SupportAssets, ",") != "BTC,ETH" {
+			t.Errorf("%s supportAssets = %v", format, c.SupportAssets)
+		}
+		if !c.IsBlockScanEnabled("BTC") || c.IsBlockScanEnabled("eth") {
+			t.Errorf("%s scan toggles = %v", format, c.ScanSymbols)
+		}
+		if c.RebroadcastExpireThreshold("btc") != 2*time.Hour || c.RebroadcastExpireThreshold("ETH") != 12*time.Hour {
+			t.Errorf("%s rebroadcast expire = %v, %v", format, c.RebroadcastExpireSymbols, c.RebroadcastExpireAfter)
+		}
+		if c.RebroadcastTaskPeriod != 5*time.Minute || !c.RebroadcastBlind("ETH") || c.RebroadcastBlind("BTC") {
+			t.Errorf("%s rebroadcast task = %v, blind symbols = %v", format, c.RebroadcastTaskPeriod, c.RebroadcastBlindSymbols)
+		}
+		ac, err := c.assetsConfig("BTC")
+		if err != nil || ac.String("serverAPI") != "http://10.0.0.1:8332" {
+			t.Errorf("%s assets config is not loaded, err: %v", format, err)
+		}
+	}
+
+	invalid := `
+[openw]
+dbPath =
+supportAssets = BTC,BTC
+snapshotDaily = yes
+snapshotInterval = 10
+`
+	sections, _ := parseConfigSections(ConfigFormatINI, []byte(invalid))
+	_, err := newConfigFromSections(sections, nil)
+	if err == nil {
+		t.Errorf("invalid config should fail")
+		return
+	}
+	for _, want := range []string{"snapshotDaily", "snapshotinterval"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %s", err, want)
+		}
+	}
+
+	sections, _ = parseConfigSections(ConfigFormatINI, []byte("[openw]\ndbPath =\nsupportAssets = BTC,BTC\n[scan]\nTRX = true\n"))
+	_, err = newConfigFromSections(sections, nil)
+	if err == nil || !strings.Contains(err.Error(), "dbPath is empty") || !strings.Contains(err.Error(), "duplicate") || !strings.Contains(err.Error(), "TRX") {
+		t.Errorf("validate error = %v", err)
+	}
+
+	sections, _ = parseConfigSections(ConfigFormatINI, []byte("[openw]\ndbPath = /data/db\nsupportAssets = BTC\nrebroadcastTaskPeriod = -1m\nrebroadcastBlindSymbols = TRX\n[rebroadcast]\nBTC = -1h\nTRX = 1h\n"))
+	_, err = newConfigFromSections(sections, nil)
+	if err == nil || !strings.Contains(err.Error(), "rebroadcast expire of BTC is negative") || !strings.Contains(err.Error(), "rebroadcast expire of TRX") ||
+		!strings.Contains(err.Error(), "rebroadcastTaskPeriod is negative") || !strings.Contains(err.Error(), "rebroadcast blind symbol TRX") {
+		t.Errorf("validate rebroadcast error = %v", err)
+	}
+
+	log.Infof("config error: %v", err)
+}
+
+func TestNewConfigFromSections_AssetsConfigFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_config")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "BTC.ini"), []byte("serverAPI = http://127.0.0.1:8332\nminFees = 0.0001\n[rpc]\nuser = btc\n"), 0600)
+
+	data := "[openw]\ndbPath = /data/db\nconfigDir = " + dir + "\nsupportAssets = BTC\n"
+	sections, _ := parseConfigSections(ConfigFormatINI, []byte(data))
+	c, err := newConfigFromSections(sections, []string{"OPENW_BTC_SERVERAPI=http://10.0.0.1:8332"})
+	if err != nil {
+		t.Errorf("newConfigFromSections failed, unexpected error: %v", err)
+		return
+	}
+
+	//环境变量只覆盖serverAPI，其余配置来自BTC.ini
+	ac, err := c.assetsConfig("BTC")
+	if err != nil {
+		t.Errorf("assetsConfig failed, unexpected error: %v", err)
+		return
+	}
+	if ac.String("serverAPI") != "http://10.0.0.1:8332" || ac.String("minFees") != "0.0001" || ac.String("rpc::user") != "btc" {
+		t.Errorf("assets config = %s, %s, %s", ac.String("serverAPI"), ac.String("minFees"), ac.String("rpc::user"))
+	}
+}
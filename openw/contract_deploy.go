@@ -0,0 +1,459 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/blocktree/openwallet/v2/openwallet/abi"
+	"github.com/pborman/uuid"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	ContractDeployStatusCreated   = "created"   //已创建交易单
+	ContractDeployStatusPending   = "pending"   //已广播，等待回执
+	ContractDeployStatusConfirmed = "confirmed" //已确认，合约已登记到注册表
+	ContractDeployStatusFailed    = "failed"    //链上执行失败或超时没有回执
+)
+
+//ContractDeployment 合约部署记录
+type ContractDeployment struct {
+	ID              string `json:"id" storm:"id"` //与交易单Sid一致
+	AppID           string `json:"appID" storm:"index"`
+	AccountID       string `json:"accountID"`
+	Symbol          string `json:"symbol"`
+	TxID            string `json:"txid" storm:"index"`
+	Status          string `json:"status" storm:"index"`
+	ContractAddress string `json:"contractAddress"`
+	ContractID      string `json:"contractID"`
+	Token           string `json:"token"`
+	Protocol        string `json:"protocol"`
+	Name            string `json:"name"`
+	Decimals        uint64 `json:"decimals"`
+	ABI             string `json:"abi"`
+	Fees            string `json:"fees"`
+	Reason          string `json:"reason"`
+	CreateTime      int64  `json:"createTime"`
+	SubmitTime      int64  `json:"submitTime"`
+	ConfirmTime     int64  `json:"confirmTime"`
+}
+
+//newContractDeployRawTx 编码字节码及构造参数，创建部署合约的原始交易单
+func (wm *WalletManager) newContractDeployRawTx(appID, accountID, amount, feeRate string, contract *openwallet.SmartContract, bytecode string, constructorArgs []string) (*WalletWrapper, openwallet.SmartContractDeployer, *openwallet.SmartContractRawTransaction, *openwallet.Error) {
+
+	if contract == nil {
+		return nil, nil, nil, openwallet.Errorf(openwallet.ErrContractCallMsgInvalid, "contract is nil")
+	}
+
+	code, err := abi.HexToBytes(bytecode)
+	if err != nil || len(code) == 0 {
+		return nil, nil, nil, openwallet.Errorf(openwallet.ErrContractCallMsgInvalid, "bytecode is invalid")
+	}
+
+	if len(contract.GetABI()) > 0 {
+		contractABI, abiErr := abi.FromSmartContract(contract)
+		if abiErr != nil {
+			return nil, nil, nil, openwallet.Errorf(openwallet.ErrContractCallMsgInvalid, "%v", abiErr)
+		}
+		args, packErr := contractABI.PackConstructor(constructorArgs...)
+		if packErr != nil {
+			return nil, nil, nil, openwallet.Errorf(openwallet.ErrContractCallMsgInvalid, "%v", packErr)
+		}
+		code = append(code, args...)
+	} else if len(constructorArgs) > 0 {
+		return nil, nil, nil, openwallet.Errorf(openwallet.ErrContractCallMsgInvalid, "constructor args need contract abi")
+	}
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, nil, nil, openwallet.ConvertError(err)
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, nil, nil, openwallet.ConvertError(err)
+	}
+
+	assetsMgr, err := GetAssetsAdapter(account.Symbol)
+	if err != nil {
+		return nil, nil, nil, openwallet.ConvertError(err)
+	}
+
+	if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilityContractDeploy); capErr != nil {
+		return nil, nil, nil, capErr
+	}
+
+	deployer, ok := assetsMgr.GetSmartContractDecoder().(openwallet.SmartContractDeployer)
+	if !ok {
+		return nil, nil, nil, openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] is not support %s", account.Symbol, openwallet.CapabilityContractDeploy)
+	}
+
+	deployContract := *contract
+	deployContract.Symbol = account.Symbol
+	deployContract.Address = ""
+	deployContract.ContractID = ""
+
+	rawTx := &openwallet.SmartContractRawTransaction{
+		Coin: openwallet.Coin{
+			Symbol:     account.Symbol,
+			IsContract: true,
+			Contract:   deployContract,
+		},
+		Sid:     uuid.New(),
+		Account: account,
+		Raw:     hex.EncodeToString(code),
+		RawType: openwallet.TxRawTypeHex,
+		Value:   amount,
+		FeeRate: feeRate,
+	}
+
+	return wrapper, deployer, rawTx, nil
+}
+
+//EstimateSmartContractDeployFee 预估部署合约的手续费，返回填充了Fees及FeeRate的原始交易单，不保存部署记录
+func (wm *WalletManager) EstimateSmartContractDeployFee(appID, walletID, accountID, amount, feeRate string, contract *openwallet.SmartContract, bytecode string, constructorArgs []string) (*openwallet.SmartContractRawTransaction, *openwallet.Error) {
+
+	wrapper, deployer, rawTx, rawErr := wm.newContractDeployRawTx(appID, accountID, amount, feeRate, contract, bytecode, constructorArgs)
+	if rawErr != nil {
+		return nil, rawErr
+	}
+
+	if estimateErr := deployer.EstimateSmartContractDeployFee(wrapper, rawTx); estimateErr != nil {
+		return nil, estimateErr
+	}
+
+	return rawTx, nil
+}
+
+//CreateSmartContractDeployTransaction 创建部署合约的交易单
+//@param contract 合约信息，包括ABI及代币属性，地址在部署确认后回填
+//@param bytecode 十六进制的合约字节码
+//@param constructorArgs 构造函数参数，按ABI编码后追加在字节码后面
+func (wm *WalletManager) CreateSmartContractDeployTransaction(appID, walletID, accountID, amount, feeRate string, contract *openwallet.SmartContract, bytecode string, constructorArgs []string) (*openwallet.SmartContractRawTransaction, *openwallet.Error) {
+
+	wrapper, deployer, rawTx, rawErr := wm.newContractDeployRawTx(appID, accountID, amount, feeRate, contract, bytecode, constructorArgs)
+	if rawErr != nil {
+		return nil, rawErr
+	}
+
+	createErr := deployer.CreateSmartContractDeployTransaction(wrapper, rawTx)
+	metrics.ObserveTxOperation(rawTx.Account.Symbol, txOperationCreate, createErr)
+	if createErr != nil {
+		return nil, createErr
+	}
+
+	deployment := &ContractDeployment{
+		ID:         rawTx.Sid,
+		AppID:      appID,
+		AccountID:  accountID,
+		Symbol:     strings.ToUpper(rawTx.Account.Symbol),
+		Status:     ContractDeployStatusCreated,
+		Token:      contract.Token,
+		Protocol:   contract.Protocol,
+		Name:       contract.Name,
+		Decimals:   contract.Decimals,
+		ABI:        contract.GetABI(),
+		Fees:       rawTx.Fees,
+		CreateTime: time.Now().Unix(),
+	}
+	if err := wm.saveContractDeployment(deployment); err != nil {
+		return nil, openwallet.ConvertError(err)
+	}
+
+	log.Debug("contract deploy transaction has been created successfully")
+
+	return rawTx, nil
+}
+
+//SubmitSmartContractDeployTransaction 广播部署合约的交易单，记录交易单ID等待回执确认
+func (wm *WalletManager) SubmitSmartContractDeployTransaction(appID, walletID, accountID string, rawTx *openwallet.SmartContractRawTransaction) (*ContractDeployment, *openwallet.Error) {
+
+	deployment, err := wm.GetContractDeployment(rawTx.Sid)
+	if err != nil {
+		return nil, openwallet.ConvertError(err)
+	}
+	if deployment.AppID != appID {
+		return nil, openwallet.Errorf(openwallet.ErrContractCallMsgInvalid, "deployment[%s] does not belong to app[%s]", rawTx.Sid, appID)
+	}
+
+	receipt, submitErr := wm.SubmitSmartContractTransaction(appID, walletID, accountID, rawTx)
+	if submitErr != nil {
+		return nil, submitErr
+	}
+
+	deployment.TxID = rawTx.TxID
+	if receipt != nil && len(receipt.TxID) > 0 {
+		deployment.TxID = receipt.TxID
+	}
+	deployment.Status = ContractDeployStatusPending
+	deployment.SubmitTime = time.Now().Unix()
+	if len(rawTx.Fees) > 0 {
+		deployment.Fees = rawTx.Fees
+	}
+	if err = wm.saveContractDeployment(deployment); err != nil {
+		return nil, openwallet.ConvertError(err)
+	}
+
+	//部分链广播后即可得到回执
+	if receipt != nil && receipt.BlockHeight > 0 {
+		if confirmed, _ := wm.confirmContractDeployment(receipt); confirmed != nil {
+			deployment = confirmed
+		}
+	}
+
+	return deployment, nil
+}
+
+//GetContractDeployment 获取合约部署记录
+func (wm *WalletManager) GetContractDeployment(id string) (*ContractDeployment, error) {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var deployment ContractDeployment
+	if err = db.One("ID", id, &deployment); err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrContractNotFound, "deployment[%s] is not found", id)
+	}
+
+	return &deployment, nil
+}
+
+//GetContractDeployments 获取应用的合约部署记录，status为空时返回全部
+func (wm *WalletManager) GetContractDeployments(appID, status string) ([]*ContractDeployment, error) {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var deployments []*ContractDeployment
+	err = db.Find("AppID", appID, &deployments)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	if len(status) == 0 {
+		return deployments, nil
+	}
+
+	filtered := make([]*ContractDeployment, 0, len(deployments))
+	for _, d := range deployments {
+		if d.Status == status {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered, nil
+}
+
+func (wm *WalletManager) saveContractDeployment(deployment *ContractDeployment) error {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return err
+	}
+
+	return db.Save(deployment)
+}
+
+//deployedContractAddress 部署回执中的合约地址，优先读取ExtParam的contractAddress
+func deployedContractAddress(receipt *openwallet.SmartContractReceipt) string {
+	if len(receipt.ExtParam) > 0 {
+		if address := gjson.Get(receipt.ExtParam, "contractAddress").String(); len(address) > 0 {
+			return address
+		}
+	}
+	return receipt.To
+}
+
+//confirmContractDeployment 收到部署交易的回执后，成功则登记合约地址到注册表
+//不是等待确认的部署交易返回nil
+func (wm *WalletManager) confirmContractDeployment(receipt *openwallet.SmartContractReceipt) (*ContractDeployment, error) {
+
+	if receipt == nil || len(receipt.TxID) == 0 {
+		return nil, nil
+	}
+
+	wm.tokenMu.Lock()
+	db, err := wm.openTokenDB()
+	if err != nil {
+		wm.tokenMu.Unlock()
+		return nil, err
+	}
+	var deployment ContractDeployment
+	err = db.One("TxID", receipt.TxID, &deployment)
+	wm.tokenMu.Unlock()
+	if err != nil || deployment.Status != ContractDeployStatusPending ||
+		!strings.EqualFold(deployment.Symbol, receipt.Coin.Symbol) {
+		return nil, nil
+	}
+
+	if receipt.Status != "1" {
+		deployment.Status = ContractDeployStatusFailed
+		deployment.Reason = receipt.Reason
+		deployment.ConfirmTime = time.Now().Unix()
+		log.Warningf("[%s] contract deploy transaction[%s] failed: %s", deployment.Symbol, receipt.TxID, receipt.Reason)
+		return &deployment, wm.saveContractDeployment(&deployment)
+	}
+
+	address := deployedContractAddress(receipt)
+	if len(address) == 0 {
+		log.Warningf("[%s] contract deploy receipt[%s] has no contract address", deployment.Symbol, receipt.TxID)
+		return nil, nil
+	}
+
+	contract := &openwallet.SmartContract{
+		Symbol:   deployment.Symbol,
+		Address:  address,
+		Token:    deployment.Token,
+		Protocol: deployment.Protocol,
+		Name:     deployment.Name,
+		Decimals: deployment.Decimals,
+	}
+	contract.SetABI(deployment.ABI)
+
+	token, err := wm.RegisterToken(contract)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment.Status = ContractDeployStatusConfirmed
+	deployment.ContractAddress = address
+	deployment.ContractID = token.ContractID
+	if len(receipt.Fees) > 0 {
+		deployment.Fees = receipt.Fees
+	}
+	deployment.ConfirmTime = time.Now().Unix()
+
+	log.Infof("[%s] contract has been deployed at %s", deployment.Symbol, address)
+
+	return &deployment, wm.saveContractDeployment(&deployment)
+}
+
+//CheckPendingContractDeployments 通过扫描器查询等待回执的部署交易，补充区块扫描漏掉的回执
+//超过Config.RebroadcastExpireThreshold仍没有回执的部署标记为失败，返回状态变更的部署记录
+func (wm *WalletManager) CheckPendingContractDeployments() ([]*ContractDeployment, error) {
+
+	wm.tokenMu.Lock()
+	db, err := wm.openTokenDB()
+	if err != nil {
+		wm.tokenMu.Unlock()
+		return nil, err
+	}
+	var pending []*ContractDeployment
+	err = db.Find("Status", ContractDeployStatusPending, &pending)
+	wm.tokenMu.Unlock()
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	changed := make([]*ContractDeployment, 0)
+	now := time.Now()
+	for _, deployment := range pending {
+
+		receipt, fetchErr := wm.fetchContractDeployReceipt(deployment)
+		if fetchErr != nil {
+			log.Warningf("[%s] query contract deploy receipt[%s] failed, unexpected error: %v", deployment.Symbol, deployment.TxID, fetchErr)
+		}
+		if receipt != nil {
+			confirmed, confirmErr := wm.confirmContractDeployment(receipt)
+			if confirmErr != nil {
+				log.Errorf("[%s] confirm contract deployment[%s] failed, unexpected error: %v", deployment.Symbol, deployment.ID, confirmErr)
+				continue
+			}
+			if confirmed != nil {
+				changed = append(changed, confirmed)
+				continue
+			}
+		}
+
+		expire := wm.cfg.RebroadcastExpireThreshold(deployment.Symbol)
+		submitTime := deployment.SubmitTime
+		if submitTime == 0 {
+			submitTime = deployment.CreateTime
+		}
+		if expire <= 0 || now.Sub(time.Unix(submitTime, 0)) <= expire {
+			continue
+		}
+
+		deployment.Status = ContractDeployStatusFailed
+		deployment.Reason = fmt.Sprintf("receipt not found in %v", expire)
+		deployment.ConfirmTime = now.Unix()
+		if err = wm.saveContractDeployment(deployment); err != nil {
+			log.Errorf("[%s] save contract deployment[%s] failed, unexpected error: %v", deployment.Symbol, deployment.ID, err)
+			continue
+		}
+		log.Warningf("[%s] contract deploy transaction[%s] expired without receipt", deployment.Symbol, deployment.TxID)
+		changed = append(changed, deployment)
+	}
+
+	return changed, nil
+}
+
+//fetchContractDeployReceipt 通过扫描器提取部署交易的回执，未上链返回nil
+func (wm *WalletManager) fetchContractDeployReceipt(deployment *ContractDeployment) (*openwallet.SmartContractReceipt, error) {
+
+	if len(deployment.TxID) == 0 {
+		return nil, nil
+	}
+
+	assetsMgr, err := GetAssetsAdapter(deployment.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := assetsMgr.GetBlockScanner()
+	if scanner == nil {
+		return nil, fmt.Errorf("%s is not support block scan", deployment.Symbol)
+	}
+
+	//部署前合约地址未知，接受交易涉及的全部对象
+	_, receipts, err := scanner.ExtractTransactionAndReceiptData(deployment.TxID, func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		return openwallet.ScanTargetResult{SourceKey: target.ScanTarget, Exist: true}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, receipt := range receipts {
+		if receipt != nil && receipt.TxID == deployment.TxID && receipt.BlockHeight > 0 {
+			if len(receipt.Coin.Symbol) == 0 {
+				receipt.Coin.Symbol = deployment.Symbol
+			}
+			return receipt, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type deployTestDecoder struct {
+	openwallet.SmartContractDecoderBase
+	raw string
+}
+
+func (d *deployTestDecoder) CreateSmartContractDeployTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.SmartContractRawTransaction) *openwallet.Error {
+	d.raw = rawTx.Raw
+	rawTx.Fees = "0.01"
+	rawTx.TxFrom = "0xdeployer"
+	return nil
+}
+
+func (d *deployTestDecoder) SubmitSmartContractRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.SmartContractRawTransaction) (*openwallet.SmartContractReceipt, *openwallet.Error) {
+	rawTx.TxID = "0xdeploytx"
+	rawTx.IsSubmit = true
+	return &openwallet.SmartContractReceipt{Coin: rawTx.Coin, TxID: rawTx.TxID}, nil
+}
+
+func (d *deployTestDecoder) EstimateSmartContractDeployFee(wrapper openwallet.WalletDAI, rawTx *openwallet.SmartContractRawTransaction) *openwallet.Error {
+	rawTx.FeeRate = "0.000001"
+	rawTx.Fees = "0.02"
+	return nil
+}
+
+type deployTestScanner struct {
+	openwallet.BlockScannerBase
+	receipts map[string]*openwallet.SmartContractReceipt
+}
+
+func (bs *deployTestScanner) ExtractTransactionAndReceiptData(txid string, scanTargetFunc openwallet.BlockScanTargetFuncV2) (map[string][]*openwallet.TxExtractData, map[string]*openwallet.SmartContractReceipt, error) {
+	receipts := make(map[string]*openwallet.SmartContractReceipt)
+	if receipt, ok := bs.receipts[txid]; ok {
+		receipts[receipt.From] = receipt
+	}
+	return nil, receipts, nil
+}
+
+type deployTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	decoder *deployTestDecoder
+	scanner *deployTestScanner
+}
+
+func (a *deployTestAdapter) GetSmartContractDecoder() openwallet.SmartContractDecoder {
+	return a.decoder
+}
+
+func (a *deployTestAdapter) GetBlockScanner() openwallet.BlockScanner {
+	if a.scanner == nil {
+		return nil
+	}
+	return a.scanner
+}
+
+func TestWalletManager_CreateSmartContractDeployTransaction(t *testing.T) {
+
+	adapter := &deployTestAdapter{decoder: &deployTestDecoder{}}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"DPLY": adapter})
+	defer cleanup()
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", Symbol: "DPLY"})
+
+	contract := &openwallet.SmartContract{Token: "TT", Protocol: "erc20", Name: "Test Token", Decimals: 18}
+	contract.SetABI(`[{"type":"constructor","inputs":[{"name":"supply","type":"uint256"}]}]`)
+
+	rawTx, createErr := wm.CreateSmartContractDeployTransaction("app1", "", "account1", "0", "", contract, "0x6080", []string{"1"})
+	if createErr != nil {
+		t.Errorf("CreateSmartContractDeployTransaction failed, unexpected error: %v", createErr)
+		return
+	}
+
+	wantRaw := "6080" + "0000000000000000000000000000000000000000000000000000000000000001"
+	if adapter.decoder.raw != wantRaw {
+		t.Errorf("deploy raw = %s, want %s", adapter.decoder.raw, wantRaw)
+	}
+
+	deployment, submitErr := wm.SubmitSmartContractDeployTransaction("app1", "", "account1", rawTx)
+	if submitErr != nil {
+		t.Errorf("SubmitSmartContractDeployTransaction failed, unexpected error: %v", submitErr)
+		return
+	}
+	if deployment.Status != ContractDeployStatusPending || deployment.TxID != "0xdeploytx" {
+		t.Errorf("deployment status = %s, txid = %s", deployment.Status, deployment.TxID)
+		return
+	}
+
+	receipt := &openwallet.SmartContractReceipt{
+		Coin:        openwallet.Coin{Symbol: "DPLY"},
+		TxID:        "0xdeploytx",
+		From:        "0xdeployer",
+		BlockHeight: 100,
+		Status:      "1",
+		ExtParam:    `{"contractAddress":"0xNewContract"}`,
+	}
+	receipt.GenWxID()
+	if err = wm.BlockExtractSmartContractDataNotify("", receipt); err != nil {
+		t.Errorf("BlockExtractSmartContractDataNotify failed, unexpected error: %v", err)
+		return
+	}
+
+	deployment, err = wm.GetContractDeployment(rawTx.Sid)
+	if err != nil {
+		t.Errorf("GetContractDeployment failed, unexpected error: %v", err)
+		return
+	}
+	if deployment.Status != ContractDeployStatusConfirmed || deployment.ContractAddress != "0xNewContract" {
+		t.Errorf("deployment status = %s, address = %s", deployment.Status, deployment.ContractAddress)
+		return
+	}
+
+	token, err := wm.GetTokenByAddress("DPLY", "0xnewcontract")
+	if err != nil {
+		t.Errorf("GetTokenByAddress failed, unexpected error: %v", err)
+		return
+	}
+	if !token.IsVerified() || token.Token != "TT" || len(token.ABI) == 0 {
+		t.Errorf("registered token = %+v", token)
+	}
+}
+
+func TestWalletManager_ContractDeploymentFailed(t *testing.T) {
+
+	wm, cleanup := newTestManager(t, nil)
+	defer cleanup()
+
+	wm.saveContractDeployment(&ContractDeployment{
+		ID:     "sid1",
+		AppID:  "app1",
+		Symbol: "DPLY",
+		TxID:   "0xfailtx",
+		Status: ContractDeployStatusPending,
+	})
+
+	receipt := &openwallet.SmartContractReceipt{
+		Coin:   openwallet.Coin{Symbol: "DPLY"},
+		TxID:   "0xfailtx",
+		Status: "0",
+		Reason: "out of gas",
+	}
+	if _, err := wm.confirmContractDeployment(receipt); err != nil {
+		t.Errorf("confirmContractDeployment failed, unexpected error: %v", err)
+		return
+	}
+
+	list, err := wm.GetContractDeployments("app1", ContractDeployStatusFailed)
+	if err != nil {
+		t.Errorf("GetContractDeployments failed, unexpected error: %v", err)
+		return
+	}
+	if len(list) != 1 || list[0].Reason != "out of gas" {
+		t.Errorf("failed deployments = %+v", list)
+	}
+}
+
+func TestWalletManager_EstimateSmartContractDeployFee(t *testing.T) {
+
+	wm, cleanup := newTestManager(t, map[string]interface{}{"DPLY": &deployTestAdapter{decoder: &deployTestDecoder{}}})
+	defer cleanup()
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", Symbol: "DPLY"})
+
+	contract := &openwallet.SmartContract{Token: "TT", Protocol: "erc20", Decimals: 18}
+	rawTx, estimateErr := wm.EstimateSmartContractDeployFee("app1", "", "account1", "0", "", contract, "0x6080", nil)
+	if estimateErr != nil {
+		t.Errorf("EstimateSmartContractDeployFee failed, unexpected error: %v", estimateErr)
+		return
+	}
+	if rawTx.Fees != "0.02" || rawTx.FeeRate != "0.000001" {
+		t.Errorf("estimated fees = %s, fee rate = %s", rawTx.Fees, rawTx.FeeRate)
+	}
+
+	//预估不保存部署记录
+	if _, err = wm.GetContractDeployment(rawTx.Sid); err == nil {
+		t.Errorf("estimate should not save deployment")
+	}
+}
+
+func TestWalletManager_CheckPendingContractDeployments(t *testing.T) {
+
+	scanner := &deployTestScanner{receipts: map[string]*openwallet.SmartContractReceipt{
+		"0xminedtx": {
+			Coin:        openwallet.Coin{Symbol: "DPLY"},
+			TxID:        "0xminedtx",
+			From:        "0xdeployer",
+			BlockHeight: 100,
+			Status:      "1",
+			ExtParam:    `{"contractAddress":"0xPolledContract"}`,
+		},
+	}}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"DPLY": &deployTestAdapter{decoder: &deployTestDecoder{}, scanner: scanner}})
+	defer cleanup()
+
+	wm.cfg.RebroadcastExpireAfter = time.Hour
+	now := time.Now().Unix()
+	wm.saveContractDeployment(&ContractDeployment{ID: "mined", AppID: "app1", Symbol: "DPLY", TxID: "0xminedtx", Status: ContractDeployStatusPending, SubmitTime: now})
+	wm.saveContractDeployment(&ContractDeployment{ID: "waiting", AppID: "app1", Symbol: "DPLY", TxID: "0xwaitingtx", Status: ContractDeployStatusPending, SubmitTime: now})
+	wm.saveContractDeployment(&ContractDeployment{ID: "lost", AppID: "app1", Symbol: "DPLY", TxID: "0xlosttx", Status: ContractDeployStatusPending, SubmitTime: now - 2*3600})
+
+	changed, err := wm.CheckPendingContractDeployments()
+	if err != nil {
+		t.Errorf("CheckPendingContractDeployments failed, unexpected error: %v", err)
+		return
+	}
+	if len(changed) != 2 {
+		t.Errorf("changed deployments = %d, want 2", len(changed))
+	}
+
+	want := map[string]string{
+		"mined":   ContractDeployStatusConfirmed,
+		"waiting": ContractDeployStatusPending,
+		"lost":    ContractDeployStatusFailed,
+	}
+	for id, status := range want {
+		deployment, err := wm.GetContractDeployment(id)
+		if err != nil {
+			t.Errorf("GetContractDeployment failed, unexpected error: %v", err)
+			continue
+		}
+		if deployment.Status != status {
+			t.Errorf("deployment[%s] status = %s, want %s", id, deployment.Status, status)
+		}
+	}
+
+	if _, err = wm.GetTokenByAddress("DPLY", "0xpolledcontract"); err != nil {
+		t.Errorf("polled contract should be registered, unexpected error: %v", err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"github.com/blocktree/go-owcrypt"
 	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	"time"
 )
@@ -50,6 +51,7 @@ func (wm *WalletManager) CallSmartContractABI(appID, walletID, accountID string,
 		return nil, err
 	}
 	//fmt.Println("contract:", contract)
+	wm.fillSmartContract(account.Symbol, contract)
 
 	coin = openwallet.Coin{
 		Symbol:     account.Symbol,
@@ -64,9 +66,13 @@ func (wm *WalletManager) CallSmartContractABI(appID, walletID, accountID string,
 		ABIParam: abiParam,
 	}
 
+	if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilitySmartContract); capErr != nil {
+		return nil, capErr
+	}
+
 	scDecoder := assetsMgr.GetSmartContractDecoder()
 	if scDecoder == nil {
-		return nil, fmt.Errorf("[%s] is not support smart contract transaction. ", account.Symbol)
+		return nil, openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] is not support %s", account.Symbol, openwallet.CapabilitySmartContract)
 	}
 
 	result, callErr := scDecoder.CallSmartContractABI(wrapper, &rawTx)
@@ -103,6 +109,7 @@ func (wm *WalletManager) CreateSmartContractTransaction(appID, walletID, account
 		return nil, openwallet.ConvertError(err)
 	}
 	//fmt.Println("contract:", contract)
+	wm.fillSmartContract(account.Symbol, contract)
 
 	coin = openwallet.Coin{
 		Symbol:     account.Symbol,
@@ -119,15 +126,21 @@ func (wm *WalletManager) CreateSmartContractTransaction(appID, walletID, account
 		ABIParam: abiParam,
 	}
 
+	if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilitySmartContract); capErr != nil {
+		return nil, capErr
+	}
+
 	scDecoder := assetsMgr.GetSmartContractDecoder()
 	if scDecoder == nil {
-		return nil, openwallet.Errorf(openwallet.ErrSystemException, "[%s] is not support smart contract transaction. ", account.Symbol)
+		return nil, openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] is not support %s", account.Symbol, openwallet.CapabilitySmartContract)
 	}
 
 	createErr := scDecoder.CreateSmartContractRawTransaction(wrapper, &rawTx)
 	if createErr != nil {
+		metrics.ObserveTxOperation(account.Symbol, txOperationCreate, createErr)
 		return nil, createErr
 	}
+	metrics.ObserveTxOperation(account.Symbol, txOperationCreate, nil)
 
 	log.Debug("transaction has been created successfully")
 
@@ -152,15 +165,21 @@ func (wm *WalletManager) SubmitSmartContractTransaction(appID, walletID, account
 		return nil, openwallet.ConvertError(err)
 	}
 
+	if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilitySmartContract); capErr != nil {
+		return nil, capErr
+	}
+
 	scdecoder := assetsMgr.GetSmartContractDecoder()
 	if scdecoder == nil {
-		return nil, openwallet.Errorf(openwallet.ErrSystemException, "[%s] is not support smart contract transaction. ", account.Symbol)
+		return nil, openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] is not support %s", account.Symbol, openwallet.CapabilitySmartContract)
 	}
 
 	tx, submitErr := scdecoder.SubmitSmartContractRawTransaction(wrapper, rawTx)
 	if submitErr != nil {
+		metrics.ObserveTxOperation(account.Symbol, txOperationSubmit, submitErr)
 		return nil, submitErr
 	}
+	metrics.ObserveTxOperation(account.Symbol, txOperationSubmit, nil)
 
 	log.Debug("smart contract transaction has been submitted successfully")
 
@@ -16,8 +16,12 @@
 package openw
 
 import (
-	"github.com/asdine/storm"
 	"fmt"
+	"os"
+	"time"
+
+	"github.com/asdine/storm"
+	bolt "go.etcd.io/bbolt"
 )
 
 type StormDB struct {
@@ -55,3 +59,209 @@ func (db *StormDB) Close() error {
 	return nil
 }
 
+//compactWalkFunc 遍历数据库的回调方法，keys为上级桶路径，v为nil时表示桶
+type compactWalkFunc func(keys [][]byte, k, v []byte, seq uint64) error
+
+//compactBolt 把源数据库的全部桶和键值复制到目标数据库，txMaxSize为每个写事务的最大字节数
+func compactBolt(dst *bolt.DB, src *bolt.Tx, txMaxSize int64) error {
+
+	var size int64
+
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tx.Rollback()
+	}()
+
+	err = compactWalk(src, func(keys [][]byte, k, v []byte, seq uint64) error {
+
+		//超过事务大小，先提交
+		sz := int64(len(k) + len(v))
+		if txMaxSize != 0 && size+sz > txMaxSize {
+			if commitErr := tx.Commit(); commitErr != nil {
+				return commitErr
+			}
+			var beginErr error
+			tx, beginErr = dst.Begin(true)
+			if beginErr != nil {
+				return beginErr
+			}
+			size = 0
+		}
+		size += sz
+
+		//顶层桶
+		if len(keys) == 0 {
+			bkt, createErr := tx.CreateBucket(k)
+			if createErr != nil {
+				return createErr
+			}
+			return bkt.SetSequence(seq)
+		}
+
+		b := tx.Bucket(keys[0])
+		for _, key := range keys[1:] {
+			b = b.Bucket(key)
+		}
+		if b == nil {
+			return fmt.Errorf("can not find bucket: %s", keys[len(keys)-1])
+		}
+
+		//顺序写入，页面填满以减少空间
+		b.FillPercent = 1.0
+
+		if v == nil {
+			bkt, createErr := b.CreateBucket(k)
+			if createErr != nil {
+				return createErr
+			}
+			return bkt.SetSequence(seq)
+		}
+
+		return b.Put(k, v)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//compactWalk 遍历数据库所有桶
+func compactWalk(tx *bolt.Tx, fn compactWalkFunc) error {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return compactWalkBucket(b, nil, name, nil, b.Sequence(), fn)
+	})
+}
+
+//compactWalkBucket 递归遍历桶
+func compactWalkBucket(b *bolt.Bucket, keys [][]byte, k, v []byte, seq uint64, fn compactWalkFunc) error {
+
+	if err := fn(keys, k, v, seq); err != nil {
+		return err
+	}
+
+	//键值，不再递归
+	if v != nil {
+		return nil
+	}
+
+	keys = append(keys, k)
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			bkt := b.Bucket(k)
+			return compactWalkBucket(bkt, keys, k, nil, bkt.Sequence(), fn)
+		}
+		return compactWalkBucket(b, keys, k, v, b.Sequence(), fn)
+	})
+}
+
+//CompactStormDB 压缩已关闭的数据库文件，压缩期间数据库文件被独占打开
+//复制后到替换前有写入提交则放弃替换
+//@return 压缩前文件大小，压缩后文件大小
+func CompactStormDB(filename string) (int64, int64, error) {
+
+	before, err := fileSize(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmpFile := filename + ".compact"
+	os.Remove(tmpFile)
+
+	src, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return 0, 0, fmt.Errorf("can not open dbfile: '%s', unexpected error: %v", filename, err)
+	}
+
+	dst, err := bolt.Open(tmpFile, 0600, nil)
+	if err != nil {
+		src.Close()
+		return 0, 0, err
+	}
+
+	srcTx, err := src.Begin(false)
+	if err != nil {
+		dst.Close()
+		src.Close()
+		os.Remove(tmpFile)
+		return 0, 0, err
+	}
+
+	//读事务的ID是当前数据版本
+	copiedTxID := srcTx.ID()
+
+	err = compactBolt(dst, srcTx, 64*1024*1024)
+	srcTx.Rollback()
+	dst.Close()
+	src.Close()
+	if err != nil {
+		os.Remove(tmpFile)
+		return 0, 0, fmt.Errorf("compact dbfile: '%s' failed, unexpected error: %v", filename, err)
+	}
+
+	//关闭源文件到替换之间可能有其他写入提交，压缩文件已过期，不能替换
+	modified, err := boltModifiedSince(filename, copiedTxID)
+	if err == nil && modified {
+		err = fmt.Errorf("dbfile: '%s' was modified during compaction, skip replacing", filename)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return 0, 0, err
+	}
+
+	after, err := fileSize(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return before, after, nil
+}
+
+//boltModifiedSince 已关闭的数据库文件的数据版本是否不同于txid
+func boltModifiedSince(filename string, txid int) (bool, error) {
+	bdb, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 3 * time.Second, ReadOnly: true})
+	if err != nil {
+		return false, err
+	}
+	defer bdb.Close()
+
+	modified := false
+	err = bdb.View(func(tx *bolt.Tx) error {
+		modified = tx.ID() != txid
+		return nil
+	})
+	return modified, err
+}
+
+//BoltFreeRatio 数据库文件中空闲页占文件大小的比例，用于判断是否需要压缩
+func BoltFreeRatio(db *StormDB) (float64, error) {
+
+	if db == nil || !db.Opened {
+		return 0, fmt.Errorf("db is not opened")
+	}
+
+	size, err := fileSize(db.FileName)
+	if err != nil || size == 0 {
+		return 0, err
+	}
+
+	stats := db.Bolt.Stats()
+	free := int64(stats.FreePageN+stats.PendingPageN) * int64(db.Bolt.Info().PageSize)
+
+	return float64(free) / float64(size), nil
+}
+
+//fileSize 文件大小
+func fileSize(filename string) (int64, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	//ExportFormatCSV 导出CSV格式
+	ExportFormatCSV = "csv"
+	//ExportFormatJSONL 导出JSON Lines格式，每行一条记录
+	ExportFormatJSONL = "jsonl"
+)
+
+const (
+	//TxDirectionIn 入账
+	TxDirectionIn = "in"
+	//TxDirectionOut 出账
+	TxDirectionOut = "out"
+	//TxDirectionNone 金额为0，例如只支付手续费的合约调用
+	TxDirectionNone = "none"
+)
+
+//TxExportFilter 交易导出条件，范围值为0表示不限制
+type TxExportFilter struct {
+	AccountID   string //资产账户ID，空值导出应用全部账户
+	Symbol      string //主链币种，空值导出全部币种
+	StartTime   int64  //确认时间起始，包含
+	EndTime     int64  //确认时间结束，包含
+	StartHeight uint64 //区块高度起始，包含
+	EndHeight   uint64 //区块高度结束，包含
+}
+
+//TxCounterparty 交易对手，由From/To的"地址:数量"解析
+type TxCounterparty struct {
+	Address string `json:"address"`
+	Amount  string `json:"amount"`
+}
+
+//TxExportRecord 导出的交易记录
+type TxExportRecord struct {
+	WxID            string            `json:"wxid"`
+	TxID            string            `json:"txid"`
+	AccountID       string            `json:"accountID"`
+	Symbol          string            `json:"symbol"`
+	IsContract      bool              `json:"isContract"`
+	ContractID      string            `json:"contractID"`
+	ContractAddress string            `json:"contractAddress"`
+	Token           string            `json:"token"`
+	Decimals        int32             `json:"decimals"`
+	Direction       string            `json:"direction"`
+	Amount          string            `json:"amount"` //不带符号的数量
+	Fees            string            `json:"fees"`
+	From            []*TxCounterparty `json:"from"`
+	To              []*TxCounterparty `json:"to"`
+	BlockHeight     uint64            `json:"blockHeight"`
+	BlockHash       string            `json:"blockHash"`
+	ConfirmTime     int64             `json:"confirmTime"`
+	ConfirmDate     string            `json:"confirmDate"` //UTC时间，RFC3339格式
+	Status          string            `json:"status"`
+	Memo            string            `json:"memo"`
+}
+
+//txExportCSVHeader CSV表头，与TxExportRecord.csvRow对应
+var txExportCSVHeader = []string{
+	"wxid", "txid", "accountID", "symbol", "isContract", "contractID", "contractAddress", "token", "decimals",
+	"direction", "amount", "fees", "from", "to", "blockHeight", "blockHash", "confirmTime", "confirmDate", "status", "memo",
+}
+
+func (r *TxExportRecord) csvRow() []string {
+	return []string{
+		r.WxID, r.TxID, r.AccountID, r.Symbol, strconv.FormatBool(r.IsContract), r.ContractID, r.ContractAddress, r.Token,
+		strconv.FormatInt(int64(r.Decimals), 10), r.Direction, r.Amount, r.Fees,
+		formatCounterparties(r.From), formatCounterparties(r.To),
+		strconv.FormatUint(r.BlockHeight, 10), r.BlockHash, strconv.FormatInt(r.ConfirmTime, 10), r.ConfirmDate,
+		r.Status, r.Memo,
+	}
+}
+
+//parseCounterparties 解析"地址:数量"格式，地址中可能包含冒号，以最后一个冒号分隔
+func parseCounterparties(list []string) []*TxCounterparty {
+	parties := make([]*TxCounterparty, 0, len(list))
+	for _, s := range list {
+		party := &TxCounterparty{Address: s}
+		if i := strings.LastIndex(s, ":"); i >= 0 {
+			party.Address = s[:i]
+			party.Amount = normalizeAmount(s[i+1:])
+		}
+		parties = append(parties, party)
+	}
+	return parties
+}
+
+//formatCounterparties CSV单元格中以分号分隔多个交易对手
+func formatCounterparties(parties []*TxCounterparty) string {
+	list := make([]string, 0, len(parties))
+	for _, p := range parties {
+		list = append(list, p.Address+":"+p.Amount)
+	}
+	return strings.Join(list, ";")
+}
+
+//normalizeAmount 统一数量格式，去掉多余的0，无法解析时保留原值
+func normalizeAmount(amount string) string {
+	amount = strings.TrimSpace(amount)
+	if len(amount) == 0 {
+		return "0"
+	}
+	d, err := decimal.NewFromString(amount)
+	if err != nil {
+		return amount
+	}
+	return d.String()
+}
+
+//NewTxExportRecord 把交易单转为导出记录
+func NewTxExportRecord(tx *openwallet.Transaction) *TxExportRecord {
+
+	r := &TxExportRecord{
+		WxID:            tx.WxID,
+		TxID:            tx.TxID,
+		AccountID:       tx.AccountID,
+		Symbol:          tx.Coin.Symbol,
+		IsContract:      tx.Coin.IsContract,
+		ContractID:      tx.Coin.ContractID,
+		ContractAddress: tx.Coin.Contract.Address,
+		Token:           tx.Coin.Contract.Token,
+		Decimals:        tx.Decimal,
+		Fees:            normalizeAmount(tx.Fees),
+		From:            parseCounterparties(tx.From),
+		To:              parseCounterparties(tx.To),
+		BlockHeight:     tx.BlockHeight,
+		BlockHash:       tx.BlockHash,
+		ConfirmTime:     tx.ConfirmTime,
+		Status:          tx.Status,
+		Memo:            tx.Memo,
+	}
+
+	if tx.ConfirmTime > 0 {
+		r.ConfirmDate = time.Unix(tx.ConfirmTime, 0).UTC().Format(time.RFC3339)
+	}
+
+	//交易单数量为账户的净变化，负数为出账
+	amount, err := decimal.NewFromString(strings.TrimSpace(tx.Amount))
+	if err != nil {
+		r.Amount = tx.Amount
+		r.Direction = TxDirectionIn
+		if !tx.Received {
+			r.Direction = TxDirectionOut
+		}
+		return r
+	}
+
+	switch amount.Sign() {
+	case -1:
+		r.Direction = TxDirectionOut
+	case 1:
+		r.Direction = TxDirectionIn
+	default:
+		r.Direction = TxDirectionNone
+	}
+	r.Amount = amount.Abs().String()
+
+	return r
+}
+
+//txExportWriter 导出记录写入器
+type txExportWriter interface {
+	Write(r *TxExportRecord) error
+	Flush() error
+}
+
+type txCSVWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (cw *txCSVWriter) Write(r *TxExportRecord) error {
+	if !cw.wroteHeader {
+		if err := cw.w.Write(txExportCSVHeader); err != nil {
+			return err
+		}
+		cw.wroteHeader = true
+	}
+	return cw.w.Write(r.csvRow())
+}
+
+func (cw *txCSVWriter) Flush() error {
+	//没有记录时也输出表头
+	if !cw.wroteHeader {
+		if err := cw.w.Write(txExportCSVHeader); err != nil {
+			return err
+		}
+		cw.wroteHeader = true
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type txJSONLWriter struct {
+	enc *json.Encoder
+}
+
+func (jw *txJSONLWriter) Write(r *TxExportRecord) error {
+	return jw.enc.Encode(r)
+}
+
+func (jw *txJSONLWriter) Flush() error {
+	return nil
+}
+
+func newTxExportWriter(format string, w io.Writer) (txExportWriter, error) {
+	switch strings.ToLower(format) {
+	case ExportFormatCSV:
+		return &txCSVWriter{w: csv.NewWriter(w)}, nil
+	case ExportFormatJSONL:
+		return &txJSONLWriter{enc: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported export format: %s", format)
+	}
+}
+
+//txExportMatcher 导出条件的查询语句
+func txExportMatcher(filter *TxExportFilter) q.Matcher {
+
+	matchers := make([]q.Matcher, 0)
+	if len(filter.AccountID) > 0 {
+		matchers = append(matchers, q.Eq("AccountID", filter.AccountID))
+	}
+	if len(filter.Symbol) > 0 {
+		matchers = append(matchers, q.NewFieldMatcher("Coin", coinSymbolMatcher(filter.Symbol)))
+	}
+	if filter.StartTime > 0 {
+		matchers = append(matchers, q.Gte("ConfirmTime", filter.StartTime))
+	}
+	if filter.EndTime > 0 {
+		matchers = append(matchers, q.Lte("ConfirmTime", filter.EndTime))
+	}
+	if filter.StartHeight > 0 {
+		matchers = append(matchers, q.Gte("BlockHeight", filter.StartHeight))
+	}
+	if filter.EndHeight > 0 {
+		matchers = append(matchers, q.Lte("BlockHeight", filter.EndHeight))
+	}
+
+	return q.And(matchers...)
+}
+
+//ExportTransactions 按条件导出交易记录，逐条读取并写出，不会把全部记录加载到内存
+//记录按WxID顺序输出，返回导出的记录数
+func (wrapper *WalletWrapper) ExportTransactions(filter *TxExportFilter, format string, w io.Writer) (int, error) {
+
+	if filter == nil {
+		filter = &TxExportFilter{}
+	}
+
+	writer, err := newTxExportWriter(format, w)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return 0, err
+	}
+	defer wrapper.CloseDB()
+
+	count := 0
+	err = db.Select(txExportMatcher(filter)).Each(new(openwallet.Transaction), func(record interface{}) error {
+		tx := record.(*openwallet.Transaction)
+		if err := writer.Write(NewTxExportRecord(tx)); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return count, err
+	}
+
+	return count, writer.Flush()
+}
+
+//ExportTransactions 导出应用或资产账户的交易记录
+func (wm *WalletManager) ExportTransactions(appID string, filter *TxExportFilter, format string, w io.Writer) (int, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	return wrapper.ExportTransactions(filter, format, w)
+}
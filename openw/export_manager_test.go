@@ -0,0 +1,106 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestWalletWrapper_ExportTransactions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_export")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenStormDB(filepath.Join(dir, "export.db"), appDBOptions()...)
+	if err != nil {
+		t.Errorf("OpenStormDB failed, unexpected error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	for i := 1; i <= 5; i++ {
+		tx := &openwallet.Transaction{
+			TxID:        fmt.Sprintf("tx%d", i),
+			AccountID:   "account1",
+			Coin:        openwallet.Coin{Symbol: "ETH"},
+			From:        []string{"0xfrom:1.500"},
+			To:          []string{"0xto1:1.0", "0xto2:0.5"},
+			Amount:      "1.500",
+			Fees:        "0.00100",
+			BlockHeight: uint64(100 + i),
+			ConfirmTime: int64(1500000000 + i),
+		}
+		if i%2 == 0 {
+			tx.Amount = "-1.5"
+		}
+		tx.WxID = openwallet.GenTransactionWxID(tx)
+		db.Save(tx)
+	}
+
+	wrapper := NewWalletWrapper(NewAppWrapper(db))
+
+	var buf bytes.Buffer
+	n, err := wrapper.ExportTransactions(&TxExportFilter{AccountID: "account1", StartHeight: 102, EndHeight: 104}, ExportFormatCSV, &buf)
+	if err != nil {
+		t.Errorf("ExportTransactions failed, unexpected error: %v", err)
+		return
+	}
+	if n != 3 {
+		t.Errorf("exported = %d, want 3", n)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(rows) != 4 {
+		t.Errorf("csv rows = %d, want 4, err: %v", len(rows), err)
+		return
+	}
+
+	buf.Reset()
+	n, err = wrapper.ExportTransactions(&TxExportFilter{StartTime: 1500000002, EndTime: 1500000002}, ExportFormatJSONL, &buf)
+	if err != nil || n != 1 {
+		t.Errorf("ExportTransactions jsonl = %d, err: %v", n, err)
+		return
+	}
+
+	var record TxExportRecord
+	if err = json.Unmarshal([]byte(strings.TrimSpace(buf.String())), &record); err != nil {
+		t.Errorf("decode jsonl failed, unexpected error: %v", err)
+		return
+	}
+	if record.Direction != TxDirectionOut || record.Amount != "1.5" || record.Fees != "0.001" {
+		t.Errorf("record = %+v, want out 1.5 with fees 0.001", record)
+	}
+	if len(record.To) != 2 || record.To[1].Address != "0xto2" || record.To[1].Amount != "0.5" {
+		t.Errorf("counterparties not parsed: %+v", record.To)
+	}
+
+	log.Infof("export record: %+v", record)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	//加速交易单ExtParam中记录的原交易及加速方式
+	feeBumpTxIDKey   = "feeBumpTxID"
+	feeBumpMethodKey = "feeBumpMethod"
+)
+
+//CreateFeeBumpTransaction 为已广播未确认的交易创建加速交易单
+//加速交易单通过SignTransaction签名，SubmitTransaction广播后与原交易关联
+func (wm *WalletManager) CreateFeeBumpTransaction(appID, walletID, accountID, txid, feeRate string) (*openwallet.RawTransaction, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	assetsMgr, err := GetAssetsAdapter(account.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilityFeeBump); capErr != nil {
+		return nil, capErr
+	}
+
+	bumper, ok := assetsMgr.GetTransactionDecoder().(openwallet.TransactionFeeBumper)
+	if !ok {
+		return nil, openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] is not support %s", account.Symbol, openwallet.CapabilityFeeBump)
+	}
+
+	original, err := wm.findSubmittedTransaction(appID, account.Symbol, txid)
+	if err != nil {
+		return nil, err
+	}
+
+	lifecycle, err := wm.GetTxLifecycle(appID, account.Symbol, txid)
+	if err == nil {
+		if lifecycle.Status != TxLifecycleStatusSubmitted {
+			return nil, fmt.Errorf("transaction[%s] is %s, can not bump fee", txid, lifecycle.Status)
+		}
+		if len(lifecycle.BumpedByTxID) > 0 {
+			return nil, fmt.Errorf("transaction[%s] has been bumped by [%s], bump the latest one", txid, lifecycle.BumpedByTxID)
+		}
+	} else if original.BlockHeight > 0 {
+		return nil, fmt.Errorf("transaction[%s] has been confirmed, can not bump fee", txid)
+	}
+
+	rawTx := openwallet.RawTransaction{
+		Coin:     original.Coin,
+		Account:  account,
+		FeeRate:  feeRate,
+		Required: 1,
+	}
+
+	method, err := bumper.CreateFeeBumpRawTransaction(wrapper, original, &rawTx)
+	metrics.ObserveTxOperation(account.Symbol, txOperationCreate, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if method != openwallet.FeeBumpMethodReplace && method != openwallet.FeeBumpMethodCPFP {
+		return nil, fmt.Errorf("fee bump method[%s] is not support", method)
+	}
+
+	rawTx.SetExtParam(feeBumpTxIDKey, txid)
+	rawTx.SetExtParam(feeBumpMethodKey, method)
+
+	//替换交易沿用原交易的nonce，广播后预留记录更新为新的交易单ID
+	if method == openwallet.FeeBumpMethodReplace && rawTx.GetNonceReservation() == nil {
+		if reservation := wm.findNonceReservationByTxID(account.Symbol, txid); reservation != nil {
+			rawTx.SetNonceReservation(reservation)
+		}
+	}
+
+	log.Debugf("fee bump transaction of [%s] has been created successfully, method: %s", txid, method)
+
+	return &rawTx, nil
+}
+
+//findSubmittedTransaction 查找通过SubmitTransaction保存的交易记录
+func (wm *WalletManager) findSubmittedTransaction(appID, symbol, txid string) (*openwallet.Transaction, error) {
+
+	txs, err := wm.GetTransactions(appID, 0, -1, "TxID", txid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range txs {
+		if strings.EqualFold(tx.Coin.Symbol, symbol) {
+			return tx, nil
+		}
+	}
+
+	return nil, fmt.Errorf("transaction[%s] is not found", txid)
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type feeBumpTestTxDecoder struct {
+	openwallet.TransactionDecoderBase
+	method    string
+	submitted int
+}
+
+func (d *feeBumpTestTxDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	rawTx.RawHex = "aabb"
+	return nil
+}
+
+func (d *feeBumpTestTxDecoder) CreateFeeBumpRawTransaction(wrapper openwallet.WalletDAI, original *openwallet.Transaction, rawTx *openwallet.RawTransaction) (string, error) {
+	rawTx.RawHex = "ccdd"
+	rawTx.To = map[string]string{"addr1": "1"}
+	return d.method, nil
+}
+
+func (d *feeBumpTestTxDecoder) SignRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	rawTx.IsCompleted = true
+	return nil
+}
+
+func (d *feeBumpTestTxDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+	d.submitted++
+	tx := &openwallet.Transaction{TxID: fmt.Sprintf("bump_tx%d", d.submitted), Coin: rawTx.Coin}
+	tx.WxID = openwallet.GenTransactionWxID(tx)
+	return tx, nil
+}
+
+type feeBumpTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	txDecoder *feeBumpTestTxDecoder
+}
+
+func (a *feeBumpTestAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	return a.txDecoder
+}
+
+type feeBumpTestObserver struct {
+	rollbackTestObserver
+	replaced []string
+}
+
+func (o *feeBumpTestObserver) BlockTxReplacedNotify(account *openwallet.AssetsAccount, lifecycle *TxLifecycle) error {
+	o.replaced = append(o.replaced, lifecycle.TxID)
+	return nil
+}
+
+func TestWalletManager_CreateFeeBumpTransaction(t *testing.T) {
+
+	adapter := &feeBumpTestAdapter{txDecoder: &feeBumpTestTxDecoder{method: openwallet.FeeBumpMethodReplace}}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"BUMP": adapter})
+	defer cleanup()
+
+	observer := &feeBumpTestObserver{}
+	wm.AddObserver(observer)
+
+	wallet := newTestAccount(t, wm, "BUMP", "account1")
+
+	send := func(rawTx *openwallet.RawTransaction) *openwallet.Transaction {
+		rawTx, signErr := wm.SignTransaction("app1", wallet.WalletID, "account1", testWalletPassword, rawTx)
+		if signErr != nil {
+			t.Fatalf("SignTransaction failed, unexpected error: %v", signErr)
+		}
+		tx, subErr := wm.SubmitTransaction("app1", wallet.WalletID, "account1", rawTx)
+		if subErr != nil {
+			t.Fatalf("SubmitTransaction failed, unexpected error: %v", subErr)
+		}
+		return tx
+	}
+
+	transfer := func() *openwallet.Transaction {
+		rawTx, createErr := wm.CreateTransaction("app1", wallet.WalletID, "account1", "1", "addr1", "0.001", "", nil)
+		if createErr != nil {
+			t.Fatalf("CreateTransaction failed, unexpected error: %v", createErr)
+		}
+		return send(rawTx)
+	}
+
+	bump := func(txid string) *openwallet.Transaction {
+		rawTx, bumpErr := wm.CreateFeeBumpTransaction("app1", wallet.WalletID, "account1", txid, "0.01")
+		if bumpErr != nil {
+			t.Fatalf("CreateFeeBumpTransaction failed, unexpected error: %v", bumpErr)
+		}
+		return send(rawTx)
+	}
+
+	confirm := func(txid string) {
+		tx := &openwallet.Transaction{TxID: txid, Coin: openwallet.Coin{Symbol: "BUMP"}, BlockHash: "hash_" + txid, BlockHeight: 1}
+		tx.WxID = openwallet.GenTransactionWxID(tx)
+		wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "account1"), &openwallet.TxExtractData{Transaction: tx})
+	}
+
+	status := func(txid string) string {
+		lifecycle, getErr := wm.GetTxLifecycle("app1", "BUMP", txid)
+		if getErr != nil {
+			return ""
+		}
+		return lifecycle.Status
+	}
+
+	//原交易上链，替换交易被标记为replaced
+	tx1 := transfer()
+	tx2 := bump(tx1.TxID)
+	lifecycle, _ := wm.GetTxLifecycle("app1", "BUMP", tx2.TxID)
+	if lifecycle == nil || lifecycle.OriginalTxID != tx1.TxID || lifecycle.BumpMethod != openwallet.FeeBumpMethodReplace {
+		t.Errorf("replacement is not linked to original: %+v", lifecycle)
+		return
+	}
+	if _, err := wm.CreateFeeBumpTransaction("app1", wallet.WalletID, "account1", tx1.TxID, "0.02"); err == nil {
+		t.Errorf("bumped transaction should bump the latest replacement")
+	}
+
+	//内存池中的交易不标记为已上链
+	wm.confirmTxLifecycle("app1", &openwallet.Transaction{TxID: tx1.TxID, Coin: openwallet.Coin{Symbol: "BUMP"}})
+	if status(tx1.TxID) != TxLifecycleStatusSubmitted || status(tx2.TxID) != TxLifecycleStatusSubmitted {
+		t.Errorf("status after mempool extraction = %s, %s, want submitted", status(tx1.TxID), status(tx2.TxID))
+	}
+
+	confirm(tx1.TxID)
+	if status(tx1.TxID) != TxLifecycleStatusConfirmed || status(tx2.TxID) != TxLifecycleStatusReplaced {
+		t.Errorf("status = %s, %s, want confirmed, replaced", status(tx1.TxID), status(tx2.TxID))
+	}
+	if len(observer.replaced) != 1 || observer.replaced[0] != tx2.TxID {
+		t.Errorf("replaced notify = %v, want [%s]", observer.replaced, tx2.TxID)
+	}
+	if _, err := wm.CreateFeeBumpTransaction("app1", wallet.WalletID, "account1", tx1.TxID, "0.02"); err == nil {
+		t.Errorf("confirmed transaction should not be bumped")
+	}
+
+	//多次替换后最新的交易上链，之前的交易全部被标记为replaced
+	tx3 := transfer()
+	tx4 := bump(tx3.TxID)
+	tx5 := bump(tx4.TxID)
+	confirm(tx5.TxID)
+	if status(tx3.TxID) != TxLifecycleStatusReplaced || status(tx4.TxID) != TxLifecycleStatusReplaced || status(tx5.TxID) != TxLifecycleStatusConfirmed {
+		t.Errorf("status = %s, %s, %s, want replaced, replaced, confirmed", status(tx3.TxID), status(tx4.TxID), status(tx5.TxID))
+	}
+
+	//CPFP的子交易与原交易同时有效，不会被标记为replaced
+	adapter.txDecoder.method = openwallet.FeeBumpMethodCPFP
+	tx6 := transfer()
+	tx7 := bump(tx6.TxID)
+	confirm(tx7.TxID)
+	if status(tx6.TxID) != TxLifecycleStatusSubmitted || status(tx7.TxID) != TxLifecycleStatusConfirmed {
+		t.Errorf("status = %s, %s, want submitted, confirmed", status(tx6.TxID), status(tx7.TxID))
+	}
+
+	//区块分叉回滚，已上链的交易及被替换的交易恢复为submitted
+	if err := wm.RollbackBlockData("BUMP", 1); err != nil {
+		t.Errorf("RollbackBlockData failed, unexpected error: %v", err)
+		return
+	}
+	for _, tx := range []*openwallet.Transaction{tx1, tx2, tx3, tx4, tx5, tx7} {
+		if status(tx.TxID) != TxLifecycleStatusSubmitted {
+			t.Errorf("transaction[%s] status = %s after rollback, want submitted", tx.TxID, status(tx.TxID))
+		}
+	}
+
+	//新分支上替换交易上链
+	confirm(tx2.TxID)
+	if status(tx1.TxID) != TxLifecycleStatusReplaced || status(tx2.TxID) != TxLifecycleStatusConfirmed {
+		t.Errorf("status = %s, %s, want replaced, confirmed", status(tx1.TxID), status(tx2.TxID))
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/assets"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//testWalletPassword newTestAccount创建的钱包密码
+const testWalletPassword = "12345678"
+
+//newTestManager 创建数据都保存在临时目录的管理器，并按币种注册测试适配器
+//cleanup注销注册的适配器并删除临时目录，同一币种可以在不同测试中重复注册
+func newTestManager(t *testing.T, adapters map[string]interface{}) (*WalletManager, func()) {
+	dir, err := ioutil.TempDir("", "openw_test")
+	if err != nil {
+		t.Fatalf("TempDir failed, unexpected error: %v", err)
+	}
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.TokenDBFile = filepath.Join(dir, "tokens.db")
+	cfg.JobDBFile = filepath.Join(dir, "jobs.db")
+	cfg.SupportAssets = nil
+
+	for symbol, adapter := range adapters {
+		RegAssets(symbol, adapter)
+	}
+
+	cleanup := func() {
+		for symbol := range adapters {
+			assets.UnregAssets(symbol)
+		}
+		os.RemoveAll(dir)
+	}
+
+	return NewWalletManager(cfg), cleanup
+}
+
+//newTestAccount 在app1中创建托管钱包及其资产账户
+func newTestAccount(t *testing.T, wm *WalletManager, symbol, accountID string) *openwallet.Wallet {
+	wallet, _, err := wm.CreateWallet("app1", &openwallet.Wallet{Alias: accountID, IsTrust: true, Password: testWalletPassword})
+	if err != nil {
+		t.Fatalf("CreateWallet failed, unexpected error: %v", err)
+	}
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Fatalf("OpenDB failed, unexpected error: %v", err)
+	}
+	err = db.Save(&openwallet.AssetsAccount{AccountID: accountID, WalletID: wallet.WalletID, Symbol: symbol})
+	if err != nil {
+		t.Fatalf("save account failed, unexpected error: %v", err)
+	}
+
+	return wallet
+}
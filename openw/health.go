@@ -0,0 +1,368 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/blocktree/openwallet/v2/owtp"
+)
+
+const (
+	HealthStatusUp   = "up"
+	HealthStatusDown = "down"
+)
+
+const (
+	HealthComponentDB       = "db"
+	HealthComponentKeystore = "keystore"
+	HealthComponentNode     = "node"
+	HealthComponentScanner  = "scanner"
+)
+
+const (
+	//HealthPath 就绪检查，包括全节点及扫描器
+	HealthPath = "/health"
+	//LivenessPath 存活检查，只检查本地数据库及钥匙目录
+	LivenessPath = "/health/live"
+	//HealthOWTPMethod OWTP健康检查方法，参数live为true时只做存活检查
+	HealthOWTPMethod = "health"
+)
+
+//HealthCheck 单个组件的检查结果
+type HealthCheck struct {
+	Component string `json:"component"`
+	Name      string `json:"name"` //appID、币种或目录
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+	Duration  int64  `json:"duration"` //检查耗时，毫秒
+}
+
+//HealthReport 健康检查汇总，任一组件异常则为down
+type HealthReport struct {
+	Status string         `json:"status"`
+	Time   int64          `json:"time"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+//IsHealthy 是否健康
+func (r *HealthReport) IsHealthy() bool {
+	return r.Status == HealthStatusUp
+}
+
+func newHealthReport(checks []*HealthCheck) *HealthReport {
+	report := &HealthReport{Status: HealthStatusUp, Time: time.Now().Unix(), Checks: checks}
+	for _, c := range checks {
+		if c.Status != HealthStatusUp {
+			report.Status = HealthStatusDown
+			break
+		}
+	}
+	return report
+}
+
+//runHealthCheck 执行检查，记录耗时
+func runHealthCheck(component, name string, check func() error) *HealthCheck {
+	start := time.Now()
+	err := check()
+	result := &HealthCheck{
+		Component: component,
+		Name:      name,
+		Status:    HealthStatusUp,
+		Duration:  time.Since(start).Nanoseconds() / int64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = HealthStatusDown
+		result.Message = err.Error()
+	}
+	return result
+}
+
+//CheckLiveness 存活检查，检查数据库可读写及钥匙目录可读
+func (wm *WalletManager) CheckLiveness() *HealthReport {
+	checks := wm.checkDBHealth()
+	checks = append(checks, wm.checkKeystoreHealth())
+	return newHealthReport(checks)
+}
+
+//CheckHealth 就绪检查，在存活检查的基础上检查全节点连通及扫描器是否停滞
+func (wm *WalletManager) CheckHealth() *HealthReport {
+	checks := wm.checkDBHealth()
+	checks = append(checks, wm.checkKeystoreHealth())
+	checks = append(checks, wm.checkNodeHealth()...)
+	checks = append(checks, wm.checkScannerHealth()...)
+	return newHealthReport(checks)
+}
+
+//checkDBHealth 数据目录可写，已打开的数据库在超时时间内可以开启只读事务
+//不使用写事务，检查不会与区块扫描的写入争用锁
+func (wm *WalletManager) checkDBHealth() []*HealthCheck {
+
+	checks := []*HealthCheck{
+		runHealthCheck(HealthComponentDB, wm.cfg.DBPath, func() error {
+			f, err := ioutil.TempFile(wm.cfg.DBPath, ".health")
+			if err != nil {
+				return fmt.Errorf("db path is not writable: %v", err)
+			}
+			f.Close()
+			return os.Remove(f.Name())
+		}),
+	}
+
+	wm.mu.RLock()
+	dbs := make(map[string]*StormDB)
+	for appID, db := range wm.appDB {
+		if db.Opened {
+			dbs[appID] = db
+		}
+	}
+	wm.mu.RUnlock()
+
+	wm.rescanMu.Lock()
+	if wm.jobDB != nil && wm.jobDB.Opened {
+		dbs[wm.JobDBFile()] = wm.jobDB
+	}
+	wm.rescanMu.Unlock()
+
+	wm.tokenMu.Lock()
+	if wm.tokenDB != nil && wm.tokenDB.Opened {
+		dbs[wm.TokenDBFile()] = wm.tokenDB
+	}
+	wm.tokenMu.Unlock()
+
+	for name, db := range dbs {
+		db := db
+		checks = append(checks, runHealthCheck(HealthComponentDB, name, func() error {
+			timeout := wm.healthTimeout()
+			done, err := callWithTimeout(timeout, func() error {
+				tx, err := db.Bolt.Begin(false)
+				if err != nil {
+					return err
+				}
+				return tx.Rollback()
+			})
+			if !done {
+				return fmt.Errorf("db does not respond in %v", timeout)
+			}
+			if err != nil {
+				return fmt.Errorf("db is not readable: %v", err)
+			}
+			return nil
+		}))
+	}
+
+	sortHealthChecks(checks[1:])
+
+	return checks
+}
+
+//checkKeystoreHealth 钥匙目录可读
+func (wm *WalletManager) checkKeystoreHealth() *HealthCheck {
+	return runHealthCheck(HealthComponentKeystore, wm.cfg.KeyDir, func() error {
+		dir, err := os.Open(wm.cfg.KeyDir)
+		if err != nil {
+			return fmt.Errorf("keystore is not readable: %v", err)
+		}
+		defer dir.Close()
+		if _, err = dir.Readdirnames(1); err != nil && err != io.EOF {
+			return fmt.Errorf("keystore is not readable: %v", err)
+		}
+		return nil
+	})
+}
+
+//healthScanners 支持的资产中可以获取扫描器的币种
+func (wm *WalletManager) healthScanners() map[string]openwallet.BlockScanner {
+	scanners := make(map[string]openwallet.BlockScanner)
+	for _, symbol := range wm.cfg.SupportAssets {
+		assetsMgr, err := GetAssetsAdapter(symbol)
+		if err != nil {
+			continue
+		}
+		scanner := assetsMgr.GetBlockScanner()
+		if scanner == nil {
+			continue
+		}
+		scanners[strings.ToUpper(symbol)] = scanner
+	}
+	return scanners
+}
+
+//checkNodeHealth 并发请求各全节点的当前区块头，超时视为不可达
+func (wm *WalletManager) checkNodeHealth() []*HealthCheck {
+
+	scanners := wm.healthScanners()
+	checks := make([]*HealthCheck, 0, len(scanners))
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+
+	for symbol, scanner := range scanners {
+		wg.Add(1)
+		go func(symbol string, scanner openwallet.BlockScanner) {
+			defer wg.Done()
+			check := runHealthCheck(HealthComponentNode, symbol, func() error {
+				return wm.getCurrentBlockHeaderWithTimeout(scanner)
+			})
+			mu.Lock()
+			checks = append(checks, check)
+			mu.Unlock()
+		}(symbol, scanner)
+	}
+
+	wg.Wait()
+
+	sortHealthChecks(checks)
+
+	return checks
+}
+
+func (wm *WalletManager) getCurrentBlockHeaderWithTimeout(scanner openwallet.BlockScanner) error {
+
+	timeout := wm.healthTimeout()
+	done, err := callWithTimeout(timeout, func() error {
+		_, err := scanner.GetCurrentBlockHeader()
+		return err
+	})
+	if !done {
+		return fmt.Errorf("full node does not respond in %v", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("full node is unreachable: %v", err)
+	}
+	return nil
+}
+
+//healthTimeout 单项检查的超时时间
+func (wm *WalletManager) healthTimeout() time.Duration {
+	if wm.cfg.HealthNodeTimeout <= 0 {
+		return defaultHealthNodeTimeout
+	}
+	return wm.cfg.HealthNodeTimeout
+}
+
+//callWithTimeout 在超时时间内等待检查完成，超时返回false，检查在后台继续运行直到结束
+func callWithTimeout(timeout time.Duration, check func() error) (bool, error) {
+
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+
+	select {
+	case err := <-done:
+		return true, err
+	case <-time.After(timeout):
+		return false, nil
+	}
+}
+
+//checkScannerHealth 开启扫描的币种，超过阈值没有新区块通知视为停滞，没有运行的扫描器不检查
+func (wm *WalletManager) checkScannerHealth() []*HealthCheck {
+
+	checks := make([]*HealthCheck, 0)
+
+	for symbol := range wm.healthScanners() {
+		if !wm.cfg.IsBlockScanEnabled(symbol) || !isScannerTracked(symbol) {
+			continue
+		}
+		threshold := wm.cfg.HealthScanStaleThreshold(symbol)
+		if threshold <= 0 {
+			continue
+		}
+		checks = append(checks, runHealthCheck(HealthComponentScanner, symbol, func() error {
+			last, notified := wm.LastBlockScanTime(symbol)
+			if !notified {
+				last = wm.startTime
+			}
+			if elapsed := time.Since(last); elapsed > threshold {
+				if !notified {
+					return fmt.Errorf("no block has been scanned in %v", elapsed.Truncate(time.Second))
+				}
+				return fmt.Errorf("last block was scanned %v ago", elapsed.Truncate(time.Second))
+			}
+			return nil
+		}))
+	}
+
+	sortHealthChecks(checks)
+
+	return checks
+}
+
+func sortHealthChecks(checks []*HealthCheck) {
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].Name < checks[j].Name
+	})
+}
+
+//recordBlockScanTime 记录币种最近一次新区块通知的时间
+func (wm *WalletManager) recordBlockScanTime(symbol string) {
+	wm.scanTimeMu.Lock()
+	wm.lastScanTime[strings.ToUpper(symbol)] = time.Now()
+	wm.scanTimeMu.Unlock()
+}
+
+//LastBlockScanTime 币种最近一次新区块通知的时间
+func (wm *WalletManager) LastBlockScanTime(symbol string) (time.Time, bool) {
+	wm.scanTimeMu.Lock()
+	defer wm.scanTimeMu.Unlock()
+	t, ok := wm.lastScanTime[strings.ToUpper(symbol)]
+	return t, ok
+}
+
+//healthHandler 输出JSON格式的检查结果，不健康时返回503
+func healthHandler(check func() *HealthReport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		report := check()
+		w.Header().Set("Content-Type", "application/json")
+		if report.IsHealthy() {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+//ServeHealthOWTP 在OWTP节点上注册健康检查方法
+func (wm *WalletManager) ServeHealthOWTP(node *owtp.OWTPNode) {
+	node.HandleFunc(HealthOWTPMethod, func(ctx *owtp.Context) {
+		var report *HealthReport
+		if ctx.Params().Get("live").Bool() {
+			report = wm.CheckLiveness()
+		} else {
+			report = wm.CheckHealth()
+		}
+		if report.IsHealthy() {
+			ctx.Response(report, owtp.StatusSuccess, "success")
+		} else {
+			ctx.Response(report, owtp.ErrDenialOfService, "unhealthy")
+		}
+	})
+}
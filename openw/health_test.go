@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type healthTestScanner struct {
+	*openwallet.BlockScannerBase
+	delay time.Duration
+}
+
+func (bs *healthTestScanner) GetCurrentBlockHeader() (*openwallet.BlockHeader, error) {
+	time.Sleep(bs.delay)
+	return &openwallet.BlockHeader{Height: 1, Symbol: "HLTH"}, nil
+}
+
+type healthTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	scanner *healthTestScanner
+}
+
+func (a *healthTestAdapter) GetBlockScanner() openwallet.BlockScanner {
+	return a.scanner
+}
+
+func findHealthCheck(report *HealthReport, component string) *HealthCheck {
+	for _, c := range report.Checks {
+		if c.Component == component {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestWalletManager_CheckHealth(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_health")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	scanner := &healthTestScanner{BlockScannerBase: openwallet.NewBlockScannerBase()}
+	scanner.SetTask(func() {})
+	defer scanner.Stop()
+	RegAssets("HLTH", &healthTestAdapter{scanner: scanner})
+
+	//没有设置扫描任务的扫描器不能运行，只检查全节点
+	RegAssets("HLTN", &healthTestAdapter{scanner: &healthTestScanner{BlockScannerBase: openwallet.NewBlockScannerBase()}})
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.ConfigDir = filepath.Join(dir, "conf")
+	cfg.JobDBFile = filepath.Join(dir, "jobs.db")
+	cfg.SupportAssets = []string{"HLTH", "HLTN"}
+	cfg.HealthNodeTimeout = 50 * time.Millisecond
+	cfg.HealthScanStaleAfter = 100 * time.Millisecond
+	cfg.MetricsAddr = "127.0.0.1:0"
+	os.MkdirAll(cfg.ConfigDir, 0700)
+	for _, symbol := range cfg.SupportAssets {
+		ioutil.WriteFile(filepath.Join(cfg.ConfigDir, symbol+".ini"), []byte("serverAPI = x"), 0600)
+	}
+	wm := NewWalletManager(cfg)
+	defer wm.StopMetricsServer()
+
+	wm.OpenDB("app1")
+
+	report := wm.CheckHealth()
+	if !report.IsHealthy() {
+		t.Errorf("report = %+v, want healthy", report)
+	}
+	if len(report.Checks) != 6 {
+		t.Errorf("checks = %d, want 6", len(report.Checks))
+	}
+	if isScannerTracked("HLTN") {
+		t.Errorf("scanner which can not run is tracked")
+	}
+
+	//扫描停滞及全节点超时
+	scanner.delay = 100 * time.Millisecond
+	time.Sleep(150 * time.Millisecond)
+	report = wm.CheckHealth()
+	if report.IsHealthy() {
+		t.Errorf("report should be unhealthy")
+	}
+	if c := findHealthCheck(report, HealthComponentNode); c == nil || c.Status != HealthStatusDown {
+		t.Errorf("node check = %+v, want down", c)
+	}
+	if c := findHealthCheck(report, HealthComponentScanner); c == nil || c.Status != HealthStatusDown {
+		t.Errorf("scanner check = %+v, want down", c)
+	}
+
+	resp, err := http.Get("http://" + wm.MetricsAddr() + HealthPath)
+	if err != nil {
+		t.Errorf("Get health failed, unexpected error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("health status code = %d, want 503", resp.StatusCode)
+	}
+
+	resp, err = http.Get("http://" + wm.MetricsAddr() + LivenessPath)
+	if err != nil {
+		t.Errorf("Get liveness failed, unexpected error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("liveness status code = %d, want 200", resp.StatusCode)
+	}
+
+	//收到新区块后恢复
+	scanner.delay = 0
+	wm.BlockScanNotify(&openwallet.BlockHeader{Height: 2, Symbol: "HLTH"})
+	report = wm.CheckHealth()
+	if !report.IsHealthy() {
+		t.Errorf("report = %+v, want healthy", report)
+	}
+
+	log.Infof("health: %+v", report)
+}
@@ -0,0 +1,351 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	TxLifecycleStatusSubmitted = "submitted" //已广播，未确认
+	TxLifecycleStatusConfirmed = "confirmed" //已上链
+	TxLifecycleStatusReplaced  = "replaced"  //被替换交易取代，不会再上链
+	TxLifecycleStatusExpired   = "expired"   //超时未上链，全节点仍有该交易
+	TxLifecycleStatusDropped   = "dropped"   //超时未上链，全节点已没有该交易
+)
+
+//TxReplacedNotificationObject 可选的观察者接口，接收被替换交易取代的交易
+type TxReplacedNotificationObject interface {
+
+	//BlockTxReplacedNotify 原交易或替换交易其中一笔上链后，另一笔被标记为replaced
+	BlockTxReplacedNotify(account *openwallet.AssetsAccount, lifecycle *TxLifecycle) error
+}
+
+//TxLifecycle 通过openw广播的交易的生命周期
+type TxLifecycle struct {
+	ID                string                     `json:"id" storm:"id"` //币种:交易单ID
+	Symbol            string                     `json:"symbol"`
+	WalletID          string                     `json:"walletID"`
+	AccountID         string                     `json:"accountID" storm:"index"`
+	TxID              string                     `json:"txid" storm:"index"`
+	Status            string                     `json:"status" storm:"index"`
+	FeeRate           string                     `json:"feeRate"`
+	Fees              string                     `json:"fees"`
+	BumpMethod        string                     `json:"bumpMethod"`        //本交易的加速方式，空值为普通交易
+	OriginalTxID      string                     `json:"originalTxID"`      //本交易加速的原交易
+	BumpedByTxID      string                     `json:"bumpedByTxID"`      //最近一次加速本交易的交易
+	RawTx             *openwallet.RawTransaction `json:"rawTx"`             //已签名的交易单，用于重新广播
+	Rebroadcasts      int                        `json:"rebroadcasts"`      //重新广播次数
+	LastBroadcastTime int64                      `json:"lastBroadcastTime"` //最近一次广播时间
+	Reason            string                     `json:"reason"`            //最近一次重新广播失败或过期的原因
+	BlockHeight       uint64                     `json:"blockHeight"`
+	SubmitTime        int64                      `json:"submitTime"`
+	UpdateTime        int64                      `json:"updateTime"`
+}
+
+func txLifecycleID(symbol, txid string) string {
+	return strings.ToUpper(symbol) + ":" + txid
+}
+
+//recordTxLifecycle 记录已广播的交易，加速交易同时关联原交易
+func (wm *WalletManager) recordTxLifecycle(appID string, account *openwallet.AssetsAccount, rawTx *openwallet.RawTransaction, tx *openwallet.Transaction) error {
+
+	wm.lifecycleMu.Lock()
+	defer wm.lifecycleMu.Unlock()
+
+	now := time.Now().Unix()
+	lifecycle := &TxLifecycle{
+		ID:                txLifecycleID(account.Symbol, tx.TxID),
+		Symbol:            strings.ToUpper(account.Symbol),
+		WalletID:          account.WalletID,
+		AccountID:         account.AccountID,
+		TxID:              tx.TxID,
+		Status:            TxLifecycleStatusSubmitted,
+		FeeRate:           rawTx.FeeRate,
+		Fees:              rawTx.Fees,
+		RawTx:             rawTx,
+		LastBroadcastTime: now,
+		SubmitTime:        now,
+		UpdateTime:        now,
+	}
+
+	ext := rawTx.GetExtParam()
+	originalTxID := ext.Get(feeBumpTxIDKey).String()
+	if len(originalTxID) > 0 {
+		lifecycle.BumpMethod = ext.Get(feeBumpMethodKey).String()
+		lifecycle.OriginalTxID = originalTxID
+
+		original, err := wm.GetTxLifecycle(appID, account.Symbol, originalTxID)
+		if err == nil {
+			original.BumpedByTxID = tx.TxID
+			original.UpdateTime = now
+			if err = wm.saveTxLifecycle(appID, original); err != nil {
+				return err
+			}
+		}
+	}
+
+	return wm.saveTxLifecycle(appID, lifecycle)
+}
+
+//GetTxLifecycle 获取交易的生命周期
+func (wm *WalletManager) GetTxLifecycle(appID, symbol, txid string) (*TxLifecycle, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	var lifecycle TxLifecycle
+	err = db.One("ID", txLifecycleID(symbol, txid), &lifecycle)
+	if err != nil {
+		return nil, fmt.Errorf("transaction[%s] lifecycle is not found", txid)
+	}
+
+	return &lifecycle, nil
+}
+
+//GetTxLifecycles 获取账户的交易生命周期，status为空时返回全部
+func (wm *WalletManager) GetTxLifecycles(appID, accountID, status string) ([]*TxLifecycle, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	lifecycles := make([]*TxLifecycle, 0)
+	cols := []interface{}{"AccountID", accountID}
+	if len(status) > 0 {
+		cols = append(cols, "Status", status)
+	}
+	err = wrapper.findRecords(&lifecycles, 0, -1, cols...)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return lifecycles, nil
+}
+
+func (wm *WalletManager) saveTxLifecycle(appID string, lifecycle *TxLifecycle) error {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return err
+	}
+	defer wrapper.CloseDB()
+
+	return db.Save(lifecycle)
+}
+
+//confirmTxLifecycle 区块提取到已广播的交易，标记为已上链
+//通过替换方式加速的交易只有一笔能上链，其余的标记为replaced
+func (wm *WalletManager) confirmTxLifecycle(appID string, tx *openwallet.Transaction) {
+
+	//内存池中的交易未上链，不标记为已上链
+	if tx == nil || len(tx.TxID) == 0 || tx.BlockHeight == 0 {
+		return
+	}
+
+	wm.lifecycleMu.Lock()
+	defer wm.lifecycleMu.Unlock()
+
+	lifecycle, err := wm.GetTxLifecycle(appID, tx.Coin.Symbol, tx.TxID)
+	if err != nil {
+		return
+	}
+
+	//过期或丢弃的交易仍可能上链，以区块数据为准
+	if lifecycle.Status != TxLifecycleStatusConfirmed {
+		lifecycle.Status = TxLifecycleStatusConfirmed
+		lifecycle.BlockHeight = tx.BlockHeight
+		lifecycle.UpdateTime = time.Now().Unix()
+		if err = wm.saveTxLifecycle(appID, lifecycle); err != nil {
+			log.Errorf("save transaction[%s] lifecycle failed, unexpected error: %v", tx.TxID, err)
+			return
+		}
+	}
+
+	//被本交易替换的原交易
+	current := lifecycle
+	for current.BumpMethod == openwallet.FeeBumpMethodReplace && len(current.OriginalTxID) > 0 {
+		original, getErr := wm.GetTxLifecycle(appID, current.Symbol, current.OriginalTxID)
+		if getErr != nil {
+			break
+		}
+		wm.markTxReplaced(appID, original)
+		current = original
+	}
+
+	//替换本交易的加速交易
+	current = lifecycle
+	for len(current.BumpedByTxID) > 0 {
+		bump, getErr := wm.GetTxLifecycle(appID, current.Symbol, current.BumpedByTxID)
+		if getErr != nil || bump.BumpMethod != openwallet.FeeBumpMethodReplace {
+			break
+		}
+		wm.markTxReplaced(appID, bump)
+		current = bump
+	}
+}
+
+func (wm *WalletManager) markTxReplaced(appID string, lifecycle *TxLifecycle) {
+
+	if lifecycle.Status != TxLifecycleStatusSubmitted {
+		return
+	}
+
+	lifecycle.Status = TxLifecycleStatusReplaced
+	lifecycle.UpdateTime = time.Now().Unix()
+	if err := wm.saveTxLifecycle(appID, lifecycle); err != nil {
+		log.Errorf("save transaction[%s] lifecycle failed, unexpected error: %v", lifecycle.TxID, err)
+		return
+	}
+
+	log.Infof("[%s] transaction[%s] has been replaced", lifecycle.Symbol, lifecycle.TxID)
+
+	account, err := wm.GetAssetsAccountInfo(appID, "", lifecycle.AccountID)
+	if err != nil {
+		return
+	}
+
+	for o, _ := range wm.observers {
+		if ro, ok := o.(TxReplacedNotificationObject); ok {
+			ro.BlockTxReplacedNotify(account, lifecycle)
+		}
+	}
+}
+
+//revertTxLifecycles 区块分叉回滚时，回滚高度及以上已上链的交易恢复为submitted
+//同一组替换交易中被标记为replaced的交易也恢复为submitted，新分支重扫后以区块数据为准
+func (wm *WalletManager) revertTxLifecycles(appID, symbol string, height uint64) ([]*TxLifecycle, error) {
+
+	wm.lifecycleMu.Lock()
+	defer wm.lifecycleMu.Unlock()
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+
+	matchers := []q.Matcher{q.Eq("Status", TxLifecycleStatusConfirmed), q.Gte("BlockHeight", height)}
+	if len(symbol) > 0 {
+		matchers = append(matchers, q.Eq("Symbol", strings.ToUpper(symbol)))
+	}
+
+	var confirmed []*TxLifecycle
+	err = db.Select(matchers...).Find(&confirmed)
+	wrapper.CloseDB()
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	reverted := make([]*TxLifecycle, 0, len(confirmed))
+	now := time.Now().Unix()
+	revert := func(lifecycle *TxLifecycle) {
+		lifecycle.Status = TxLifecycleStatusSubmitted
+		lifecycle.BlockHeight = 0
+		lifecycle.Reason = fmt.Sprintf("block is rolled back from height %d", height)
+		lifecycle.UpdateTime = now
+		if saveErr := wm.saveTxLifecycle(appID, lifecycle); saveErr != nil {
+			log.Errorf("save transaction[%s] lifecycle failed, unexpected error: %v", lifecycle.TxID, saveErr)
+			return
+		}
+		reverted = append(reverted, lifecycle)
+	}
+
+	for _, lifecycle := range confirmed {
+		revert(lifecycle)
+
+		//被本交易替换的原交易
+		current := lifecycle
+		for current.BumpMethod == openwallet.FeeBumpMethodReplace && len(current.OriginalTxID) > 0 {
+			original, getErr := wm.GetTxLifecycle(appID, current.Symbol, current.OriginalTxID)
+			if getErr != nil {
+				break
+			}
+			if original.Status == TxLifecycleStatusReplaced {
+				revert(original)
+			}
+			current = original
+		}
+
+		//替换本交易的加速交易
+		current = lifecycle
+		for len(current.BumpedByTxID) > 0 {
+			bump, getErr := wm.GetTxLifecycle(appID, current.Symbol, current.BumpedByTxID)
+			if getErr != nil || bump.BumpMethod != openwallet.FeeBumpMethodReplace {
+				break
+			}
+			if bump.Status == TxLifecycleStatusReplaced {
+				revert(bump)
+			}
+			current = bump
+		}
+	}
+
+	if len(reverted) > 0 {
+		log.Infof("app[%s] revert %d transaction lifecycles of %s from height %d", appID, len(reverted), symbol, height)
+	}
+
+	return reverted, nil
+}
+
+//updateSubmittedTxLifecycle 交易仍未上链时才更新生命周期，避免覆盖区块扫描同时写入的状态
+func (wm *WalletManager) updateSubmittedTxLifecycle(appID string, lifecycle *TxLifecycle, update func(lifecycle *TxLifecycle)) (*TxLifecycle, bool, error) {
+
+	wm.lifecycleMu.Lock()
+	defer wm.lifecycleMu.Unlock()
+
+	current, err := wm.GetTxLifecycle(appID, lifecycle.Symbol, lifecycle.TxID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if current.Status != TxLifecycleStatusSubmitted {
+		return current, false, nil
+	}
+
+	update(current)
+	current.UpdateTime = time.Now().Unix()
+	if err = wm.saveTxLifecycle(appID, current); err != nil {
+		return nil, false, err
+	}
+
+	return current, true, nil
+}
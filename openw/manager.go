@@ -18,13 +18,14 @@ package openw
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/asdine/storm"
-	"github.com/astaxie/beego/config"
 	"github.com/blocktree/openwallet/v2/common/file"
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
@@ -47,6 +48,13 @@ type NotificationObject interface {
 	BlockTxExtractDataNotify(account *openwallet.AssetsAccount, data *openwallet.TxExtractData) error
 }
 
+//TxRevertedNotificationObject 可选的观察者接口，区块分叉回滚时接收被撤销的交易
+type TxRevertedNotificationObject interface {
+
+	//BlockTxRevertedNotify 交易所在区块因分叉被回滚，新分支重扫后会重新推送提取结果
+	BlockTxRevertedNotify(account *openwallet.AssetsAccount, tx *openwallet.Transaction) error
+}
+
 //WalletManager OpenWallet钱包管理器
 type WalletManager struct {
 	appDB             map[string]*StormDB
@@ -55,6 +63,37 @@ type WalletManager struct {
 	mu                sync.RWMutex
 	observers         map[NotificationObject]bool //观察者
 	importAddressTask *timer.TaskTimer
+	reconcileTask     *timer.TaskTimer         //定时对账任务
+	pruneTask         *timer.TaskTimer         //定时清理过期数据任务
+	sweepTask         *timer.TaskTimer         //定时汇总任务
+	rebroadcastTask   *timer.TaskTimer         //未确认交易重新广播任务
+	lifecycleMu       sync.Mutex               //交易生命周期状态变更
+	nonceManager      *openwallet.NonceManager //账户模型链的nonce管理器，预留记录保存在后台任务数据库
+	sweepMu           sync.Mutex
+	sweepPasswords    map[string]string //汇总时解锁钱包的密码
+	sweepRunning      map[string]bool   //执行中的汇总规则
+	payoutMu          sync.Mutex
+	payoutRunning     map[string]bool //执行中的批量转账批次
+	snapshotMu        sync.Mutex
+	snapshotDays      map[string]string                 //各币种最近一次每日快照的日期
+	snapshotQueue     map[string][]*balanceSnapshotTask //各币种待执行的快照任务
+	snapshotRunning   map[string]bool                   //执行快照任务的币种
+	snapshotWG        sync.WaitGroup
+	rescanMu          sync.Mutex
+	rescanJobs        map[string]*rescanJobRunner //运行中的重扫任务
+	rescanBlocks      map[string][]string         //正在重扫的区块，key为币种及高度，value为重扫任务ID，同步重扫为空值
+	jobDB             *StormDB                    //后台任务数据库
+	tokenMu           sync.Mutex
+	tokenDB           *StormDB //代币合约注册表及合约交易回执数据库
+	tokenBalanceMu    sync.Mutex
+	tokenBalances     map[string]*cachedTokenBalance //代币余额查询缓存
+	appMu             sync.RWMutex
+	appInfos          map[string]*AppInfo //应用信息缓存
+	metricsServer     *http.Server        //指标服务
+	metricsListener   net.Listener
+	scanTimeMu        sync.Mutex
+	lastScanTime      map[string]time.Time //各币种最近一次新区块通知的时间
+	startTime         time.Time
 	AddressInScanning map[string]string //加入扫描的地址
 }
 
@@ -84,6 +123,19 @@ func (wm *WalletManager) Init() {
 	wm.observers = make(map[NotificationObject]bool)
 	wm.appDB = make(map[string]*StormDB)
 	wm.AddressInScanning = make(map[string]string)
+	wm.snapshotDays = make(map[string]string)
+	wm.snapshotQueue = make(map[string][]*balanceSnapshotTask)
+	wm.snapshotRunning = make(map[string]bool)
+	wm.rescanJobs = make(map[string]*rescanJobRunner)
+	wm.rescanBlocks = make(map[string][]string)
+	wm.appInfos = make(map[string]*AppInfo)
+	wm.lastScanTime = make(map[string]time.Time)
+	wm.tokenBalances = make(map[string]*cachedTokenBalance)
+	wm.sweepPasswords = make(map[string]string)
+	wm.sweepRunning = make(map[string]bool)
+	wm.payoutRunning = make(map[string]bool)
+	wm.nonceManager = openwallet.NewNonceManager(&jobNonceStore{wm: wm})
+	wm.startTime = time.Now()
 
 	wm.initialized = true
 
@@ -91,6 +143,31 @@ func (wm *WalletManager) Init() {
 
 	wm.initSupportAssetsAdapter()
 
+	//与链上nonce对账，清除已上链及上次运行未广播的预留记录
+	wm.reconcileNonceReservations()
+
+	//启动定时清理过期数据
+	if wm.cfg.PruneTaskPeriod > 0 {
+		wm.StartPruneTask(wm.cfg.PruneTaskPeriod)
+	}
+
+	//启动定时对账
+	if wm.cfg.ReconcileTaskPeriod > 0 {
+		wm.StartReconcileTask(wm.cfg.ReconcileTaskPeriod, wm.cfg.ReconcileRescan)
+	}
+
+	//启动未确认交易检查
+	if wm.cfg.RebroadcastTaskPeriod > 0 {
+		wm.StartRebroadcastService(wm.cfg.RebroadcastTaskPeriod)
+	}
+
+	//启动指标服务
+	if len(wm.cfg.MetricsAddr) > 0 {
+		if err := wm.StartMetricsServer(wm.cfg.MetricsAddr); err != nil {
+			log.Error(err)
+		}
+	}
+
 	//启动定时导入地址到核心钱包
 	//task := timer.NewTask(PeriodOfTask, wm.importNewAddressToCoreWallet)
 	//wm.importAddressTask = task
@@ -131,6 +208,11 @@ func (wm *WalletManager) DBFile(appID string) string {
 
 //OpenDB 打开应用数据库文件
 func (wm *WalletManager) OpenDB(appID string) (*StormDB, error) {
+	return wm.openAppDB(appID, false)
+}
+
+//openAppDB 打开应用数据库文件，create为false时，数据库文件不存在需要检查是否允许隐式创建
+func (wm *WalletManager) openAppDB(appID string, create bool) (*StormDB, error) {
 
 	var (
 		db  *StormDB
@@ -138,8 +220,14 @@ func (wm *WalletManager) OpenDB(appID string) (*StormDB, error) {
 		ok  bool
 	)
 
-	//数据库文件
+	if err = checkAppID(appID); err != nil {
+		return nil, err
+	}
+
+	//数据库文件，压缩数据库期间持有写锁
+	wm.mu.RLock()
 	db, ok = wm.appDB[appID]
+	wm.mu.RUnlock()
 
 	if ok && db.Opened {
 		return db, nil
@@ -156,10 +244,16 @@ func (wm *WalletManager) OpenDB(appID string) (*StormDB, error) {
 
 	}
 
+	if !create && !file.Exists(wm.DBFile(appID)) {
+		if wm.cfg.StrictAppRegistration {
+			return nil, fmt.Errorf("app[%s] is not registered", appID)
+		}
+		log.Warningf("app[%s] database does not exist, it will be created implicitly, use CreateApp instead", appID)
+	}
+
 	db, err = OpenStormDB(
 		wm.DBFile(appID),
-		storm.Batch(),
-		storm.BoltOptions(0600, &bolt.Options{Timeout: 3 * time.Second}),
+		appDBOptions()...,
 	)
 	log.Debug("open storm db appID:", appID)
 	if err != nil {
@@ -172,6 +266,14 @@ func (wm *WalletManager) OpenDB(appID string) (*StormDB, error) {
 	return db, nil
 }
 
+//appDBOptions 应用数据库的打开参数
+func appDBOptions() []func(*storm.Options) error {
+	return []func(*storm.Options) error{
+		storm.Batch(),
+		storm.BoltOptions(0600, &bolt.Options{Timeout: 3 * time.Second}),
+	}
+}
+
 //CloseDB 关闭应用数据库文件
 func (wm *WalletManager) CloseDB(appID string) error {
 
@@ -215,8 +317,8 @@ func (wm *WalletManager) loadAllAppIDs() ([]string, error) {
 	return apps, nil
 }
 
-// initBlockScanner 初始化区块链扫描器
-func (wm *WalletManager) initSupportAssetsAdapter() error {
+//reloadAddressForBlockScan 重新加载全部应用的扫描地址
+func (wm *WalletManager) reloadAddressForBlockScan() error {
 
 	//加载已存在所有app
 	appIDs, err := wm.loadAllAppIDs()
@@ -228,19 +330,23 @@ func (wm *WalletManager) initSupportAssetsAdapter() error {
 
 	for _, appID := range appIDs {
 
-		wrapper, err := wm.NewWalletWrapper(appID, "")
+		//停用的应用不加入扫描
+		err = wm.loadAppAddressForBlockScan(appID)
 		if err != nil {
 			log.Error("wallet manager init unexpected error:", err)
 			continue
 		}
 
-		addrs, err := wrapper.GetAddressList(0, -1)
+	}
 
-		for _, address := range addrs {
-			key := wm.encodeSourceKey(appID, address.AccountID)
-			wm.AddAddressForBlockScan(address.Address, key)
-		}
+	return nil
+}
+
+// initBlockScanner 初始化区块链扫描器
+func (wm *WalletManager) initSupportAssetsAdapter() error {
 
+	if err := wm.reloadAddressForBlockScan(); err != nil {
+		return err
 	}
 
 	for _, symbol := range wm.cfg.SupportAssets {
@@ -249,16 +355,26 @@ func (wm *WalletManager) initSupportAssetsAdapter() error {
 			log.Error(symbol, "is not support")
 			continue
 		}
+
+		//账户模型适配器使用共享的nonce管理器预留nonce
+		if setter, ok := assetsMgr.(openwallet.NonceDAISetter); ok {
+			setter.SetNonceDAI(wm.nonceManager)
+		}
+
 		//读取配置
-		absFile := filepath.Join(wm.cfg.ConfigDir, symbol+".ini")
-		//log.Debug("absFile:", absFile)
-		c, err := config.NewConfig("ini", absFile)
+		c, err := wm.cfg.assetsConfig(symbol)
 		if err != nil {
 			continue
 		}
 		assetsMgr.LoadAssetsConfig(c)
 		//log.Debug("c:", c)
-		if !wm.cfg.EnableBlockScan {
+
+		//智能合约解析器使用代币合约注册表读写ABI
+		if setter, ok := assetsMgr.GetSmartContractDecoder().(openwallet.ABIDAISetter); ok {
+			setter.SetABIDAI(wm.TokenABIDAI(symbol))
+		}
+
+		if !wm.cfg.IsBlockScanEnabled(symbol) {
 			//不加载区块扫描
 			continue
 		}
@@ -284,7 +400,13 @@ func (wm *WalletManager) initSupportAssetsAdapter() error {
 		//设置查找地址算法
 		scanner.SetBlockScanAddressFunc(wm.GetSourceKeyByAddressForBlockScan)
 
-		scanner.Run()
+		//不能运行的扫描器不计入扫描指标及健康检查
+		if err = scanner.Run(); err != nil {
+			log.Errorf("%s block scanner can not run, unexpected error: %v", symbol, err)
+			continue
+		}
+
+		trackScanner(symbol, scanner)
 	}
 
 	return nil
@@ -303,7 +425,7 @@ func (wm *WalletManager) NewWalletWrapper(appID, walletID string) (*WalletWrappe
 
 	dbFile := WalletDBFile(wm.DBFile(appID))
 	wrapperAppID := WalletDBFile(appID)
-	wrapper := NewAppWrapper(wrapperAppID, dbFile, db)
+	wrapper := NewAppWrapper(wrapperAppID, dbFile, db, wm.nonceManager)
 
 	if len(walletID) > 0 {
 
@@ -0,0 +1,227 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	txOperationCreate = "create"
+	txOperationSign   = "sign"
+	txOperationSubmit = "submit"
+)
+
+//MetricsPath 指标服务的路径
+const MetricsPath = "/metrics"
+
+//scannerStatusTTL 扫描器状态缓存时间，同一次采集的多个指标只查询一次节点
+const scannerStatusTTL = time.Second
+
+//scannerStatus 扫描器在某一时刻的状态
+type scannerStatus struct {
+	Symbol        string
+	ScannedHeight uint64
+	ChainHeight   uint64
+	UnscanRecords int
+	HasUnscanDAI  bool
+}
+
+//Lag 扫描落后区块数
+func (s *scannerStatus) Lag() uint64 {
+	if s.ChainHeight > s.ScannedHeight {
+		return s.ChainHeight - s.ScannedHeight
+	}
+	return 0
+}
+
+//blockchainDAIGetter 可以获取区块链数据访问接口的扫描器，BlockScannerBase已实现
+type blockchainDAIGetter interface {
+	GetBlockchainDAI() openwallet.BlockchainDAI
+}
+
+var (
+	scannersMu       sync.Mutex
+	runningScanners  = make(map[string]openwallet.BlockScanner)
+	scannerStatuses  []*scannerStatus
+	scannerCheckTime time.Time
+	scannersVersion  uint64 //扫描器列表变更后递增，查询期间列表变更的结果不缓存
+)
+
+func init() {
+	metrics.MustRegister(
+		metrics.NewCollectorFunc("openw_scanner_scanned_height", "Block height scanned by the block scanner.",
+			metrics.TypeGauge, []string{"symbol"}, func(emit func(float64, ...string)) {
+				for _, s := range getScannerStatuses() {
+					emit(float64(s.ScannedHeight), s.Symbol)
+				}
+			}),
+		metrics.NewCollectorFunc("openw_scanner_chain_height", "Max block height of the blockchain network.",
+			metrics.TypeGauge, []string{"symbol"}, func(emit func(float64, ...string)) {
+				for _, s := range getScannerStatuses() {
+					emit(float64(s.ChainHeight), s.Symbol)
+				}
+			}),
+		metrics.NewCollectorFunc("openw_scanner_lag_blocks", "Blocks that the block scanner is behind the chain.",
+			metrics.TypeGauge, []string{"symbol"}, func(emit func(float64, ...string)) {
+				for _, s := range getScannerStatuses() {
+					emit(float64(s.Lag()), s.Symbol)
+				}
+			}),
+		metrics.NewCollectorFunc("openw_scanner_unscan_records", "Blocks or transactions that failed to be scanned.",
+			metrics.TypeGauge, []string{"symbol"}, func(emit func(float64, ...string)) {
+				for _, s := range getScannerStatuses() {
+					if s.HasUnscanDAI {
+						emit(float64(s.UnscanRecords), s.Symbol)
+					}
+				}
+			}),
+	)
+}
+
+//trackScanner 记录运行中的扫描器，用于输出扫描指标
+func trackScanner(symbol string, scanner openwallet.BlockScanner) {
+	scannersMu.Lock()
+	defer scannersMu.Unlock()
+	runningScanners[strings.ToUpper(symbol)] = scanner
+	scannerCheckTime = time.Time{}
+	scannersVersion++
+}
+
+//isScannerTracked 币种的扫描器是否已运行
+func isScannerTracked(symbol string) bool {
+	scannersMu.Lock()
+	defer scannersMu.Unlock()
+	_, ok := runningScanners[strings.ToUpper(symbol)]
+	return ok
+}
+
+//getScannerStatuses 获取全部运行中扫描器的状态，按币种排序
+//查询节点不持有锁，复制扫描器列表后再逐个查询
+func getScannerStatuses() []*scannerStatus {
+
+	scannersMu.Lock()
+	if time.Since(scannerCheckTime) < scannerStatusTTL {
+		statuses := scannerStatuses
+		scannersMu.Unlock()
+		return statuses
+	}
+	version := scannersVersion
+	scanners := make(map[string]openwallet.BlockScanner, len(runningScanners))
+	for symbol, scanner := range runningScanners {
+		scanners[symbol] = scanner
+	}
+	scannersMu.Unlock()
+
+	symbols := make([]string, 0, len(scanners))
+	for symbol := range scanners {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	statuses := make([]*scannerStatus, 0, len(symbols))
+	for _, symbol := range symbols {
+		scanner := scanners[symbol]
+		status := &scannerStatus{
+			Symbol:        symbol,
+			ScannedHeight: scanner.GetScannedBlockHeight(),
+			ChainHeight:   scanner.GetGlobalMaxBlockHeight(),
+		}
+		if getter, ok := scanner.(blockchainDAIGetter); ok && getter.GetBlockchainDAI() != nil {
+			records, err := getter.GetBlockchainDAI().GetUnscanRecords(symbol)
+			if err == nil {
+				status.UnscanRecords = len(records)
+				status.HasUnscanDAI = true
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	scannersMu.Lock()
+	if version == scannersVersion {
+		scannerStatuses = statuses
+		scannerCheckTime = time.Now()
+	}
+	scannersMu.Unlock()
+
+	return statuses
+}
+
+//StartMetricsServer 启动HTTP服务，在/metrics输出Prometheus文本格式的指标
+//同时提供/health就绪检查及/health/live存活检查
+func (wm *WalletManager) StartMetricsServer(addr string) error {
+
+	wm.StopMetricsServer()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics server listen failed, unexpected error: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, metrics.Handler())
+	mux.Handle(HealthPath, healthHandler(wm.CheckHealth))
+	mux.Handle(LivenessPath, healthHandler(wm.CheckLiveness))
+	server := &http.Server{Handler: mux}
+
+	wm.mu.Lock()
+	wm.metricsServer = server
+	wm.metricsListener = ln
+	wm.mu.Unlock()
+
+	go func() {
+		if serveErr := server.Serve(ln); serveErr != nil && serveErr != http.ErrServerClosed {
+			log.Errorf("metrics server stopped, unexpected error: %v", serveErr)
+		}
+	}()
+
+	log.Infof("metrics server is listening on %s%s", ln.Addr().String(), MetricsPath)
+
+	return nil
+}
+
+//MetricsAddr 指标服务的监听地址，未启动返回空值
+func (wm *WalletManager) MetricsAddr() string {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	if wm.metricsListener == nil {
+		return ""
+	}
+	return wm.metricsListener.Addr().String()
+}
+
+//StopMetricsServer 停止指标服务
+func (wm *WalletManager) StopMetricsServer() {
+	wm.mu.Lock()
+	server := wm.metricsServer
+	wm.metricsServer = nil
+	wm.metricsListener = nil
+	wm.mu.Unlock()
+
+	if server != nil {
+		server.Close()
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type metricsTestScanner struct {
+	*openwallet.BlockScannerBase
+}
+
+func (bs *metricsTestScanner) GetScannedBlockHeight() uint64 {
+	return 90
+}
+
+func (bs *metricsTestScanner) GetGlobalMaxBlockHeight() uint64 {
+	return 100
+}
+
+//lockingTestScanner 查询链高度时登记另一个扫描器，查询期间持有锁会死锁
+type lockingTestScanner struct {
+	*openwallet.BlockScannerBase
+}
+
+func (bs *lockingTestScanner) GetGlobalMaxBlockHeight() uint64 {
+	trackScanner("lock2", &metricsTestScanner{BlockScannerBase: openwallet.NewBlockScannerBase()})
+	return 100
+}
+
+func TestGetScannerStatuses_QueryWithoutLock(t *testing.T) {
+
+	trackScanner("lock1", &lockingTestScanner{BlockScannerBase: openwallet.NewBlockScannerBase()})
+
+	done := make(chan []*scannerStatus)
+	go func() {
+		done <- getScannerStatuses()
+	}()
+
+	select {
+	case statuses := <-done:
+		if len(statuses) == 0 {
+			t.Errorf("scanner statuses is empty")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("getScannerStatuses holds the lock while querying scanners")
+	}
+}
+
+func TestWalletManager_StartMetricsServer(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_metrics")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.SupportAssets = nil
+	cfg.MetricsAddr = "127.0.0.1:0"
+	wm := NewWalletManager(cfg)
+	defer wm.StopMetricsServer()
+
+	trackScanner("mtrc", &metricsTestScanner{BlockScannerBase: openwallet.NewBlockScannerBase()})
+
+	resp, err := http.Get("http://" + wm.MetricsAddr() + MetricsPath)
+	if err != nil {
+		t.Errorf("Get metrics failed, unexpected error: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	for _, want := range []string{
+		`openw_scanner_scanned_height{symbol="MTRC"} 90`,
+		`openw_scanner_chain_height{symbol="MTRC"} 100`,
+		`openw_scanner_lag_blocks{symbol="MTRC"} 10`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics output does not contain: %s", want)
+		}
+	}
+}
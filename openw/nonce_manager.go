@@ -0,0 +1,285 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/common/file"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//jobNonceStore nonce预留记录保存在后台任务数据库，地址在同一条链上唯一，不区分应用
+type jobNonceStore struct {
+	wm *WalletManager
+}
+
+func (s *jobNonceStore) SaveNonceReservation(reservation *openwallet.NonceReservation) error {
+	db, err := s.wm.openJobDB()
+	if err != nil {
+		return err
+	}
+	return db.Save(reservation)
+}
+
+func (s *jobNonceStore) DeleteNonceReservation(reservation *openwallet.NonceReservation) error {
+	db, err := s.wm.openJobDB()
+	if err != nil {
+		return err
+	}
+	err = db.DeleteStruct(reservation)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func (s *jobNonceStore) GetNonceReservations(symbol, address string) ([]*openwallet.NonceReservation, error) {
+	db, err := s.wm.openJobDB()
+	if err != nil {
+		return nil, err
+	}
+
+	reservations := make([]*openwallet.NonceReservation, 0)
+	err = db.Select(q.Eq("Symbol", symbol), q.Eq("Address", address)).Find(&reservations)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+//GetNonceReservations 获取地址未上链的nonce预留记录
+func (wm *WalletManager) GetNonceReservations(symbol, address string) []*openwallet.NonceReservation {
+	return wm.nonceManager.GetNonceReservations(symbol, address)
+}
+
+//getNonceSource 获取适配器提供的链上nonce查询，适配器未实现NonceSourceProvider返回nil
+func getNonceSource(symbol string) openwallet.NonceSource {
+	assetsMgr, err := GetAssetsAdapter(symbol)
+	if err != nil {
+		return nil
+	}
+	provider, ok := assetsMgr.(openwallet.NonceSourceProvider)
+	if !ok {
+		return nil
+	}
+	return provider.GetNonceSource()
+}
+
+//reconcileNonceReservations 启动时加载全部预留记录，按地址与链上nonce对账，清除已上链及上次运行未广播的记录
+func (wm *WalletManager) reconcileNonceReservations() {
+
+	//后台任务数据库不存在时没有预留记录，不创建数据库
+	if !file.Exists(wm.JobDBFile()) {
+		return
+	}
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		log.Errorf("open job db failed, unexpected error: %v", err)
+		return
+	}
+
+	reservations := make([]*openwallet.NonceReservation, 0)
+	err = db.All(&reservations)
+	if err != nil && err != storm.ErrNotFound {
+		log.Errorf("load nonce reservations failed, unexpected error: %v", err)
+		return
+	}
+
+	addresses := make(map[string]*openwallet.NonceReservation)
+	keys := make([]string, 0)
+	for _, r := range reservations {
+		if wm.dropMissingNonceReservation(r) {
+			continue
+		}
+		key := r.Symbol + ":" + r.Address
+		if _, ok := addresses[key]; !ok {
+			addresses[key] = r
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		r := addresses[key]
+		source := getNonceSource(r.Symbol)
+		if source == nil {
+			log.Warningf("[%s] not support nonce source, reservations of address[%s] will be reconciled on next reserve", r.Symbol, r.Address)
+			continue
+		}
+		if err = wm.nonceManager.ReconcileNonce(r.Symbol, r.Address, source); err != nil {
+			log.Errorf("reconcile nonce of address[%s] failed, unexpected error: %v", r.Address, err)
+		}
+	}
+}
+
+//dropMissingNonceReservation 已广播的交易在全节点不存在时释放预留nonce，适配器不支持查询交易状态返回false
+func (wm *WalletManager) dropMissingNonceReservation(reservation *openwallet.NonceReservation) bool {
+
+	if reservation.Status != openwallet.NonceStatusSubmitted || len(reservation.TxID) == 0 {
+		return false
+	}
+
+	assetsMgr, err := GetAssetsAdapter(reservation.Symbol)
+	if err != nil {
+		return false
+	}
+	checker, ok := assetsMgr.GetTransactionDecoder().(openwallet.TransactionPresenceChecker)
+	if !ok {
+		return false
+	}
+
+	presence, _, err := checker.GetTransactionPresence(nil, reservation.TxID)
+	if err != nil || presence != openwallet.TxPresenceNotFound {
+		return false
+	}
+
+	if err = wm.nonceManager.ReleaseNonce(reservation); err != nil {
+		log.Errorf("release nonce %d of address[%s] failed, unexpected error: %v", reservation.Nonce, reservation.Address, err)
+		return false
+	}
+	log.Infof("[%s] transaction[%s] is not found in node, release nonce %d of address[%s]", reservation.Symbol, reservation.TxID, reservation.Nonce, reservation.Address)
+
+	return true
+}
+
+//releaseTxNonceReservation 交易过期或被节点丢弃，释放交易占用的预留nonce
+//过期的交易仍可能上链，适配器提供链上nonce查询时再对账，清除已使用的nonce
+func (wm *WalletManager) releaseTxNonceReservation(lifecycle *TxLifecycle) {
+
+	reservation := wm.findNonceReservationByTxID(lifecycle.Symbol, lifecycle.TxID)
+	if reservation == nil {
+		return
+	}
+
+	if err := wm.nonceManager.ReleaseNonce(reservation); err != nil {
+		log.Errorf("release nonce %d of address[%s] failed, unexpected error: %v", reservation.Nonce, reservation.Address, err)
+		return
+	}
+
+	if source := getNonceSource(reservation.Symbol); source != nil {
+		if err := wm.nonceManager.ReconcileNonce(reservation.Symbol, reservation.Address, source); err != nil {
+			log.Errorf("reconcile nonce of address[%s] failed, unexpected error: %v", reservation.Address, err)
+		}
+	}
+}
+
+//commitNonceReservation 交易单广播成功，提交交易单记录的预留nonce
+func (wm *WalletManager) commitNonceReservation(rawTx *openwallet.RawTransaction, txid string) {
+	reservation := rawTx.GetNonceReservation()
+	if reservation == nil {
+		return
+	}
+	if err := wm.nonceManager.CommitNonce(reservation, txid); err != nil {
+		log.Errorf("commit nonce %d of address[%s] failed, unexpected error: %v", reservation.Nonce, reservation.Address, err)
+	}
+}
+
+//failNonceReservation 交易单签名或广播失败，适配器提供链上nonce查询时对账，否则释放未广播的预留nonce
+func (wm *WalletManager) failNonceReservation(rawTx *openwallet.RawTransaction) {
+	reservation := rawTx.GetNonceReservation()
+	if reservation == nil {
+		return
+	}
+
+	if source := getNonceSource(reservation.Symbol); source != nil {
+		//广播失败时交易可能已被节点接受，对账前先释放仍未广播的预留
+		if reservation.Status == openwallet.NonceStatusReserved {
+			wm.nonceManager.ReleaseNonce(reservation)
+		}
+		if err := wm.nonceManager.ReconcileNonce(reservation.Symbol, reservation.Address, source); err != nil {
+			log.Errorf("reconcile nonce of address[%s] failed, unexpected error: %v", reservation.Address, err)
+		}
+		return
+	}
+
+	//已广播的预留属于被替换的原交易，不能释放
+	if reservation.Status != openwallet.NonceStatusReserved {
+		return
+	}
+	if err := wm.nonceManager.ReleaseNonce(reservation); err != nil {
+		log.Errorf("release nonce %d of address[%s] failed, unexpected error: %v", reservation.Nonce, reservation.Address, err)
+	}
+}
+
+//findNonceReservationByTxID 查找交易占用的预留nonce，替换交易沿用原交易的nonce
+func (wm *WalletManager) findNonceReservationByTxID(symbol, txid string) *openwallet.NonceReservation {
+
+	//后台任务数据库不存在时没有预留记录，不创建数据库
+	if !file.Exists(wm.JobDBFile()) {
+		return nil
+	}
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		return nil
+	}
+
+	var reservation openwallet.NonceReservation
+	err = db.Select(q.Eq("Symbol", strings.ToUpper(symbol)), q.Eq("TxID", txid)).First(&reservation)
+	if err != nil {
+		return nil
+	}
+
+	return &reservation
+}
+
+//ReserveNonce 预留账户模型地址的nonce，同一地址的并发交易不会重复
+func (wrapper *Wrapper) ReserveNonce(symbol, address string, source openwallet.NonceSource) (*openwallet.NonceReservation, error) {
+	if wrapper.nonceManager == nil {
+		return nil, fmt.Errorf("nonce manager is not set")
+	}
+	return wrapper.nonceManager.ReserveNonce(symbol, address, source)
+}
+
+//ReserveNonces 预留n个连续的nonce
+func (wrapper *Wrapper) ReserveNonces(symbol, address string, n int, source openwallet.NonceSource) ([]*openwallet.NonceReservation, error) {
+	if wrapper.nonceManager == nil {
+		return nil, fmt.Errorf("nonce manager is not set")
+	}
+	return wrapper.nonceManager.ReserveNonces(symbol, address, n, source)
+}
+
+//CommitNonce 交易单广播成功，记录nonce对应的交易
+func (wrapper *Wrapper) CommitNonce(reservation *openwallet.NonceReservation, txid string) error {
+	if wrapper.nonceManager == nil {
+		return fmt.Errorf("nonce manager is not set")
+	}
+	return wrapper.nonceManager.CommitNonce(reservation, txid)
+}
+
+//ReleaseNonce 交易单创建或广播失败，释放预留的nonce
+func (wrapper *Wrapper) ReleaseNonce(reservation *openwallet.NonceReservation) error {
+	if wrapper.nonceManager == nil {
+		return fmt.Errorf("nonce manager is not set")
+	}
+	return wrapper.nonceManager.ReleaseNonce(reservation)
+}
+
+//ReconcileNonce 与链上nonce对账
+func (wrapper *Wrapper) ReconcileNonce(symbol, address string, source openwallet.NonceSource) error {
+	if wrapper.nonceManager == nil {
+		return fmt.Errorf("nonce manager is not set")
+	}
+	return wrapper.nonceManager.ReconcileNonce(symbol, address, source)
+}
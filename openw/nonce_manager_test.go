@@ -0,0 +1,386 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/assets"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type nonceTestTxDecoder struct {
+	openwallet.TransactionDecoderBase
+	submitted int
+	fail      bool
+	source    openwallet.NonceSource
+}
+
+func (d *nonceTestTxDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	nonces, ok := wrapper.(openwallet.NonceDAI)
+	if !ok {
+		return fmt.Errorf("wrapper is not support nonce")
+	}
+	reservation, err := nonces.ReserveNonce(rawTx.Coin.Symbol, "0xAbC", d.source)
+	if err != nil {
+		return err
+	}
+	rawTx.RawHex = fmt.Sprintf("nonce%d", reservation.Nonce)
+	return rawTx.SetNonceReservation(reservation)
+}
+
+func (d *nonceTestTxDecoder) CreateFeeBumpRawTransaction(wrapper openwallet.WalletDAI, original *openwallet.Transaction, rawTx *openwallet.RawTransaction) (string, error) {
+	rawTx.RawHex = "bump"
+	return openwallet.FeeBumpMethodReplace, nil
+}
+
+func (d *nonceTestTxDecoder) SignRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	rawTx.IsCompleted = true
+	return nil
+}
+
+func (d *nonceTestTxDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+	if d.fail {
+		return nil, fmt.Errorf("broadcast failed")
+	}
+	d.submitted++
+	tx := &openwallet.Transaction{TxID: fmt.Sprintf("nonce_tx%d", d.submitted), Coin: rawTx.Coin}
+	tx.WxID = openwallet.GenTransactionWxID(tx)
+	return tx, nil
+}
+
+type nonceTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	txDecoder *nonceTestTxDecoder
+}
+
+func (a *nonceTestAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	return a.txDecoder
+}
+
+func (a *nonceTestAdapter) GetNonceSource() openwallet.NonceSource {
+	return a.txDecoder.source
+}
+
+type noncePresenceTestTxDecoder struct {
+	*nonceTestTxDecoder
+	pending map[string]bool
+}
+
+func (d *noncePresenceTestTxDecoder) GetTransactionPresence(wrapper openwallet.WalletDAI, txid string) (string, uint64, error) {
+	if d.pending[txid] {
+		return openwallet.TxPresencePending, 0, nil
+	}
+	return openwallet.TxPresenceNotFound, 0, nil
+}
+
+type noncePresenceTestAdapter struct {
+	nonceTestAdapter
+	presence *noncePresenceTestTxDecoder
+}
+
+func (a *noncePresenceTestAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	return a.presence
+}
+
+func TestWalletWrapper_ReserveNonce(t *testing.T) {
+
+	wm, cleanup := newTestManager(t, nil)
+	defer cleanup()
+
+	wrapper, err := wm.NewWalletWrapper("app1", "")
+	if err != nil {
+		t.Errorf("NewWalletWrapper failed, unexpected error: %v", err)
+		return
+	}
+
+	//适配器通过类型断言使用nonce管理器
+	var dai openwallet.WalletDAI = wrapper
+	nonces, ok := dai.(openwallet.NonceDAI)
+	if !ok {
+		t.Errorf("wrapper should implement NonceDAI")
+		return
+	}
+	source := func(address string) (uint64, error) {
+		return 3, nil
+	}
+
+	r1, err := nonces.ReserveNonce("xtz", "tz1", source)
+	if err != nil {
+		t.Errorf("ReserveNonce failed, unexpected error: %v", err)
+		return
+	}
+	r2, _ := nonces.ReserveNonce("XTZ", "tz1", source)
+	if r1.Nonce != 3 || r2.Nonce != 4 {
+		t.Errorf("reserved nonce = %d, %d, want 3, 4", r1.Nonce, r2.Nonce)
+	}
+
+	if err = nonces.CommitNonce(r1, "op1"); err != nil {
+		t.Errorf("CommitNonce failed, unexpected error: %v", err)
+	}
+	if err = nonces.ReleaseNonce(r2); err != nil {
+		t.Errorf("ReleaseNonce failed, unexpected error: %v", err)
+	}
+
+	//预留记录保存在后台任务数据库
+	store := &jobNonceStore{wm: wm}
+	saved, err := store.GetNonceReservations("XTZ", "tz1")
+	if err != nil || len(saved) != 1 || saved[0].TxID != "op1" || saved[0].Status != openwallet.NonceStatusSubmitted {
+		t.Errorf("saved reservations = %d, err: %v", len(saved), err)
+	}
+
+	r3, _ := nonces.ReserveNonce("XTZ", "tz1", source)
+	if r3.Nonce != 4 {
+		t.Errorf("reserved nonce after release = %d, want 4", r3.Nonce)
+	}
+}
+
+func TestWalletManager_SubmitTransactionNonce(t *testing.T) {
+
+	chainNonce := uint64(5)
+	decoder := &nonceTestTxDecoder{source: func(address string) (uint64, error) {
+		return chainNonce, nil
+	}}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"NNCE": &nonceTestAdapter{txDecoder: decoder}})
+	defer cleanup()
+
+	wallet := newTestAccount(t, wm, "NNCE", "account1")
+
+	send := func(rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+		rawTx, signErr := wm.SignTransaction("app1", wallet.WalletID, "account1", testWalletPassword, rawTx)
+		if signErr != nil {
+			return nil, signErr
+		}
+		return wm.SubmitTransaction("app1", wallet.WalletID, "account1", rawTx)
+	}
+
+	transfer := func() (*openwallet.Transaction, error) {
+		rawTx, createErr := wm.CreateTransaction("app1", wallet.WalletID, "account1", "1", "addr1", "0.001", "", nil)
+		if createErr != nil {
+			return nil, createErr
+		}
+		return send(rawTx)
+	}
+
+	reservations := func() []*openwallet.NonceReservation {
+		return wm.GetNonceReservations("NNCE", "0xabc")
+	}
+
+	//广播成功提交预留的nonce
+	tx1, err := transfer()
+	if err != nil {
+		t.Errorf("transfer failed, unexpected error: %v", err)
+		return
+	}
+	list := reservations()
+	if len(list) != 1 || list[0].Nonce != 5 || list[0].TxID != tx1.TxID || list[0].Status != openwallet.NonceStatusSubmitted {
+		t.Errorf("reservations after submit = %+v", list)
+		return
+	}
+
+	//替换交易沿用原交易的nonce，预留记录更新为新的交易单ID
+	rawTx, err := wm.CreateFeeBumpTransaction("app1", wallet.WalletID, "account1", tx1.TxID, "0.01")
+	if err != nil {
+		t.Errorf("CreateFeeBumpTransaction failed, unexpected error: %v", err)
+		return
+	}
+	if r := rawTx.GetNonceReservation(); r == nil || r.Nonce != 5 {
+		t.Errorf("bump transaction nonce reservation = %+v, want 5", r)
+	}
+	tx2, err := send(rawTx)
+	if err != nil {
+		t.Errorf("send bump transaction failed, unexpected error: %v", err)
+		return
+	}
+	list = reservations()
+	if len(list) != 1 || list[0].TxID != tx2.TxID {
+		t.Errorf("reservations after bump = %+v, want txid %s", list, tx2.TxID)
+	}
+
+	//广播失败对账后nonce留给下一笔交易
+	decoder.fail = true
+	if _, err = transfer(); err == nil {
+		t.Errorf("transfer should failed")
+	}
+	decoder.fail = false
+	if len(reservations()) != 1 {
+		t.Errorf("failed reservation should be released, got %+v", reservations())
+	}
+	tx3, err := transfer()
+	if err != nil {
+		t.Errorf("transfer failed, unexpected error: %v", err)
+		return
+	}
+	list = reservations()
+	if len(list) != 2 || list[1].Nonce != 6 || list[1].TxID != tx3.TxID {
+		t.Errorf("reservations after release = %+v", list)
+	}
+
+	//重启后与链上对账，清除已上链的预留记录
+	chainNonce = 7
+	wm.nonceManager = openwallet.NewNonceManager(&jobNonceStore{wm: wm})
+	wm.reconcileNonceReservations()
+	store := &jobNonceStore{wm: wm}
+	saved, err := store.GetNonceReservations("NNCE", "0xabc")
+	if err != nil || len(saved) != 0 {
+		t.Errorf("saved reservations after startup reconcile = %d, err: %v", len(saved), err)
+	}
+}
+
+func TestWalletManager_ExpiredTransactionNonce(t *testing.T) {
+
+	decoder := &nonceTestTxDecoder{source: func(address string) (uint64, error) {
+		return 5, nil
+	}}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"NNCE": &nonceTestAdapter{txDecoder: decoder}})
+	defer cleanup()
+
+	wallet := newTestAccount(t, wm, "NNCE", "account1")
+
+	transfer := func() (*openwallet.Transaction, error) {
+		rawTx, err := wm.CreateTransaction("app1", wallet.WalletID, "account1", "1", "addr1", "0.001", "", nil)
+		if err != nil {
+			return nil, err
+		}
+		rawTx, err = wm.SignTransaction("app1", wallet.WalletID, "account1", testWalletPassword, rawTx)
+		if err != nil {
+			return nil, err
+		}
+		return wm.SubmitTransaction("app1", wallet.WalletID, "account1", rawTx)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := transfer(); err != nil {
+			t.Errorf("transfer failed, unexpected error: %v", err)
+			return
+		}
+	}
+	if list := wm.GetNonceReservations("NNCE", "0xabc"); len(list) != 2 {
+		t.Errorf("reservations after submit = %d, want 2", len(list))
+		return
+	}
+
+	//交易过期未上链，释放占用的nonce，下一笔交易重新使用
+	wm.cfg.RebroadcastExpireSymbols = map[string]time.Duration{"NNCE": time.Nanosecond}
+	if _, err := wm.CheckUnconfirmedTransactions("app1"); err != nil {
+		t.Errorf("CheckUnconfirmedTransactions failed, unexpected error: %v", err)
+		return
+	}
+	if list := wm.GetNonceReservations("NNCE", "0xabc"); len(list) != 0 {
+		t.Errorf("reservations after expired = %+v, want none", list)
+		return
+	}
+
+	wm.cfg.RebroadcastExpireSymbols = nil
+	tx, err := transfer()
+	if err != nil {
+		t.Errorf("transfer failed, unexpected error: %v", err)
+		return
+	}
+	if list := wm.GetNonceReservations("NNCE", "0xabc"); len(list) != 1 || list[0].Nonce != 5 || list[0].TxID != tx.TxID {
+		t.Errorf("reservations after reuse = %+v, want nonce 5", list)
+	}
+}
+
+func TestWalletManager_ReconcileDroppedNonce(t *testing.T) {
+
+	decoder := &noncePresenceTestTxDecoder{
+		nonceTestTxDecoder: &nonceTestTxDecoder{source: func(address string) (uint64, error) {
+			return 5, nil
+		}},
+		pending: make(map[string]bool),
+	}
+	adapter := &noncePresenceTestAdapter{nonceTestAdapter: nonceTestAdapter{txDecoder: decoder.nonceTestTxDecoder}, presence: decoder}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"NNCE": adapter})
+	defer cleanup()
+
+	wrapper, err := wm.NewWalletWrapper("app1", "")
+	if err != nil {
+		t.Errorf("NewWalletWrapper failed, unexpected error: %v", err)
+		return
+	}
+
+	r1, _ := wrapper.ReserveNonce("NNCE", "0xabc", decoder.source)
+	r2, _ := wrapper.ReserveNonce("NNCE", "0xabc", decoder.source)
+	wrapper.CommitNonce(r1, "pending_tx")
+	wrapper.CommitNonce(r2, "dropped_tx")
+	decoder.pending["pending_tx"] = true
+
+	//重启对账，全节点已没有的交易释放nonce
+	wm.nonceManager = openwallet.NewNonceManager(&jobNonceStore{wm: wm})
+	wm.reconcileNonceReservations()
+
+	list := wm.GetNonceReservations("NNCE", "0xabc")
+	if len(list) != 1 || list[0].TxID != "pending_tx" {
+		t.Errorf("reservations after reconcile = %+v, want pending_tx only", list)
+		return
+	}
+	r, _ := wm.nonceManager.ReserveNonce("NNCE", "0xabc", decoder.source)
+	if r.Nonce != 6 {
+		t.Errorf("reserved nonce = %d, want released 6", r.Nonce)
+	}
+}
+
+type nonceDAITestAdapter struct {
+	openwallet.AssetsAdapterBase
+	nonces openwallet.NonceDAI
+}
+
+func (a *nonceDAITestAdapter) SetNonceDAI(dai openwallet.NonceDAI) {
+	a.nonces = dai
+}
+
+func TestNewWalletManager_SetNonceDAI(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_test")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	adapter := &nonceDAITestAdapter{}
+	RegAssets("NDAI", adapter)
+	defer assets.UnregAssets("NDAI")
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.JobDBFile = filepath.Join(dir, "jobs.db")
+	cfg.SupportAssets = []string{"NDAI"}
+	wm := NewWalletManager(cfg)
+
+	//初始化时适配器获得共享的nonce管理器
+	if adapter.nonces == nil {
+		t.Errorf("nonce manager should be set to adapter")
+		return
+	}
+	r, err := adapter.nonces.ReserveNonce("NDAI", "addr1", func(address string) (uint64, error) {
+		return 2, nil
+	})
+	if err != nil {
+		t.Errorf("ReserveNonce failed, unexpected error: %v", err)
+		return
+	}
+	if list := wm.GetNonceReservations("NDAI", "addr1"); len(list) != 1 || list[0].Nonce != r.Nonce {
+		t.Errorf("reservations = %+v, want nonce %d", list, r.Nonce)
+	}
+}
@@ -0,0 +1,579 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/pborman/uuid"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	PayoutRowStatusInvalid    = "invalid"    //地址或数量校验失败，不会发送
+	PayoutRowStatusPending    = "pending"    //等待发送
+	PayoutRowStatusSubmitting = "submitting" //广播中，广播结果确定前不会重发
+	PayoutRowStatusSubmitted  = "submitted"  //已广播，等待区块确认
+	PayoutRowStatusConfirmed  = "confirmed"  //已确认
+	PayoutRowStatusFailed     = "failed"     //创建或签名失败，交易未广播，可以重试
+	PayoutRowStatusUnknown    = "unknown"    //广播返回错误或交易过期未确认，交易可能已上链，需要通过ResolvePayoutRows人工确认
+
+	//地址模型链单笔交易单默认的最多接收地址数量
+	defaultPayoutMaxOutputs = 100
+)
+
+//PayoutRequest 批量转账的一行
+type PayoutRequest struct {
+	Reference string `json:"reference"` //业务单号，批次内唯一
+	Address   string `json:"address"`
+	Amount    string `json:"amount"`
+}
+
+//PayoutBatch 批量转账批次
+type PayoutBatch struct {
+	ID         string                    `json:"id" storm:"id"`
+	WalletID   string                    `json:"walletID"`
+	AccountID  string                    `json:"accountID" storm:"index"`
+	Symbol     string                    `json:"symbol"`
+	Contract   *openwallet.SmartContract `json:"contract"`
+	FeeRate    string                    `json:"feeRate"`
+	Memo       string                    `json:"memo"`
+	RowCount   int                       `json:"rowCount"`
+	CreateTime int64                     `json:"createTime"`
+	UpdateTime int64                     `json:"updateTime"`
+}
+
+//PayoutRow 批量转账每一行的发送状态
+type PayoutRow struct {
+	ID         string `json:"id" storm:"id"` //批次ID:业务单号
+	BatchID    string `json:"batchID" storm:"index"`
+	Reference  string `json:"reference"`
+	Address    string `json:"address"`
+	Amount     string `json:"amount"`
+	Status     string `json:"status" storm:"index"`
+	TxID       string `json:"txid" storm:"index"`
+	Attempts   int    `json:"attempts"` //发送次数
+	Error      string `json:"error"`
+	UpdateTime int64  `json:"updateTime"`
+}
+
+func payoutRowID(batchID, reference string) string {
+	return batchID + ":" + reference
+}
+
+//CreatePayoutBatch 创建批量转账批次，校验每一行的地址及数量，校验失败的行标记为invalid
+//业务单号为空或重复时整个批次创建失败
+func (wm *WalletManager) CreatePayoutBatch(appID, walletID, accountID string, requests []*PayoutRequest, contract *openwallet.SmartContract, feeRate, memo string) (*PayoutBatch, []*PayoutRow, error) {
+
+	if len(requests) == 0 {
+		return nil, nil, fmt.Errorf("payout requests is empty")
+	}
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	assetsMgr, err := GetAssetsAdapter(account.Symbol)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addrDecoder := assetsMgr.GetAddressDecoderV2()
+	if addrDecoder == nil {
+		return nil, nil, fmt.Errorf("[%s] is not support address verify", account.Symbol)
+	}
+
+	wm.fillSmartContract(account.Symbol, contract)
+
+	now := time.Now().Unix()
+	batch := &PayoutBatch{
+		ID:         uuid.New(),
+		WalletID:   walletID,
+		AccountID:  accountID,
+		Symbol:     account.Symbol,
+		Contract:   contract,
+		FeeRate:    feeRate,
+		Memo:       memo,
+		RowCount:   len(requests),
+		CreateTime: now,
+		UpdateTime: now,
+	}
+
+	references := make(map[string]bool, len(requests))
+	rows := make([]*PayoutRow, 0, len(requests))
+	for _, r := range requests {
+		if len(r.Reference) == 0 {
+			return nil, nil, fmt.Errorf("payout reference is empty")
+		}
+		if references[r.Reference] {
+			return nil, nil, fmt.Errorf("payout reference[%s] is duplicated", r.Reference)
+		}
+		references[r.Reference] = true
+
+		row := &PayoutRow{
+			ID:         payoutRowID(batch.ID, r.Reference),
+			BatchID:    batch.ID,
+			Reference:  r.Reference,
+			Address:    r.Address,
+			Amount:     r.Amount,
+			Status:     PayoutRowStatusPending,
+			UpdateTime: now,
+		}
+
+		amount, amountErr := decimal.NewFromString(r.Amount)
+		if amountErr != nil || !amount.IsPositive() {
+			row.Status = PayoutRowStatusInvalid
+			row.Error = fmt.Sprintf("amount[%s] is invalid", r.Amount)
+		} else if !addrDecoder.AddressVerify(r.Address) {
+			row.Status = PayoutRowStatusInvalid
+			row.Error = fmt.Sprintf("address[%s] is invalid", r.Address)
+		}
+
+		rows = append(rows, row)
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wrapper.CloseDB()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if err = tx.Save(batch); err != nil {
+		return nil, nil, err
+	}
+	for _, row := range rows {
+		if err = tx.Save(row); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return batch, rows, nil
+}
+
+//ExecutePayoutBatch 发送批次中等待发送及失败的行，按链的限制拆分交易单
+//广播结果未知的行不会重发，需要先通过ResolvePayoutRows确认
+func (wm *WalletManager) ExecutePayoutBatch(appID, batchID, password string) ([]*PayoutRow, error) {
+
+	batch, err := wm.GetPayoutBatch(appID, batchID)
+	if err != nil {
+		return nil, err
+	}
+
+	//同一批次不并发执行，否则广播中的行会被重复发送或误标记为unknown
+	runningKey := payoutRowID(appID, batchID)
+	wm.payoutMu.Lock()
+	if wm.payoutRunning[runningKey] {
+		wm.payoutMu.Unlock()
+		return nil, fmt.Errorf("payout batch[%s] is running", batchID)
+	}
+	wm.payoutRunning[runningKey] = true
+	wm.payoutMu.Unlock()
+
+	defer func() {
+		wm.payoutMu.Lock()
+		delete(wm.payoutRunning, runningKey)
+		wm.payoutMu.Unlock()
+	}()
+
+	assetsMgr, err := GetAssetsAdapter(batch.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := wm.GetPayoutRows(appID, batchID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sendable := make([]*PayoutRow, 0, len(rows))
+	for _, row := range rows {
+		switch row.Status {
+		case PayoutRowStatusPending, PayoutRowStatusFailed:
+			sendable = append(sendable, row)
+		case PayoutRowStatusSubmitting:
+			//上次广播过程中中断，无法确定是否已上链
+			row.Error = "payout was interrupted while submitting"
+			wm.savePayoutRows(appID, PayoutRowStatusUnknown, "", []*PayoutRow{row})
+		}
+	}
+
+	maxOutputs, maxSize := payoutLimits(assetsMgr, batch.Contract != nil)
+
+	for _, chunk := range chunkPayoutRows(sendable, maxOutputs) {
+		wm.sendPayoutChunk(appID, batch, chunk, password, maxSize)
+	}
+
+	return wm.GetPayoutRows(appID, batchID, "")
+}
+
+//payoutLimits 单笔交易单的最多接收地址数量及大小，账户模型或代币转账默认每笔一个接收地址
+func payoutLimits(assetsMgr openwallet.AssetsAdapter, isContract bool) (maxOutputs, maxSize int) {
+
+	if limiter, ok := assetsMgr.GetTransactionDecoder().(openwallet.TransactionLimiter); ok {
+		maxOutputs, maxSize = limiter.MaxTransactionOutputs(), limiter.MaxTransactionSize()
+	}
+
+	if maxOutputs <= 0 {
+		if isContract || assetsMgr.BalanceModelType() == openwallet.BalanceModelTypeAccount {
+			maxOutputs = 1
+		} else {
+			maxOutputs = defaultPayoutMaxOutputs
+		}
+	}
+
+	return maxOutputs, maxSize
+}
+
+//chunkPayoutRows 按最多接收地址数量拆分，同一交易单内的地址不重复
+func chunkPayoutRows(rows []*PayoutRow, maxOutputs int) [][]*PayoutRow {
+
+	chunks := make([][]*PayoutRow, 0)
+	remain := rows
+
+	for len(remain) > 0 {
+		var (
+			chunk = make([]*PayoutRow, 0, maxOutputs)
+			addrs = make(map[string]bool)
+			next  = make([]*PayoutRow, 0)
+		)
+		for _, row := range remain {
+			if len(chunk) < maxOutputs && !addrs[row.Address] {
+				addrs[row.Address] = true
+				chunk = append(chunk, row)
+			} else {
+				next = append(next, row)
+			}
+		}
+		chunks = append(chunks, chunk)
+		remain = next
+	}
+
+	return chunks
+}
+
+//sendPayoutChunk 创建、签名并广播一笔交易单，超过大小限制时对半拆分
+func (wm *WalletManager) sendPayoutChunk(appID string, batch *PayoutBatch, rows []*PayoutRow, password string, maxSize int) {
+
+	to := make(map[string]string, len(rows))
+	for _, row := range rows {
+		to[row.Address] = row.Amount
+	}
+
+	var contract *openwallet.SmartContract
+	if batch.Contract != nil {
+		c := *batch.Contract
+		contract = &c
+	}
+
+	rawTx, err := wm.createRawTransaction(appID, batch.AccountID, to, batch.FeeRate, batch.Memo, contract)
+	if err != nil {
+		wm.failPayoutRows(appID, rows, err)
+		return
+	}
+
+	if maxSize > 0 && len(rawTx.RawHex)/2 > maxSize {
+		if len(rows) == 1 {
+			wm.failPayoutRows(appID, rows, fmt.Errorf("transaction size exceeds %d bytes", maxSize))
+			return
+		}
+		half := len(rows) / 2
+		wm.sendPayoutChunk(appID, batch, rows[:half], password, maxSize)
+		wm.sendPayoutChunk(appID, batch, rows[half:], password, maxSize)
+		return
+	}
+
+	rawTx, err = wm.SignTransaction(appID, batch.WalletID, batch.AccountID, password, rawTx)
+	if err != nil {
+		wm.failPayoutRows(appID, rows, err)
+		return
+	}
+
+	//广播前先记录状态，进程中断后不会重复发送
+	for _, row := range rows {
+		row.Attempts++
+		row.Error = ""
+	}
+	if err = wm.savePayoutRows(appID, PayoutRowStatusSubmitting, "", rows); err != nil {
+		log.Errorf("payout batch[%s] save rows failed, unexpected error: %v", batch.ID, err)
+		return
+	}
+
+	tx, err := wm.SubmitTransaction(appID, batch.WalletID, batch.AccountID, rawTx)
+	if err != nil {
+		for _, row := range rows {
+			row.Error = err.Error()
+		}
+		log.Warningf("payout batch[%s] submit transaction failed, rows need to be resolved manually: %v", batch.ID, err)
+		wm.savePayoutRows(appID, PayoutRowStatusUnknown, "", rows)
+		return
+	}
+
+	wm.savePayoutRows(appID, PayoutRowStatusSubmitted, tx.TxID, rows)
+}
+
+//failPayoutRows 交易未广播，下次执行批次时重试
+func (wm *WalletManager) failPayoutRows(appID string, rows []*PayoutRow, err error) {
+	for _, row := range rows {
+		row.Attempts++
+		row.Error = err.Error()
+	}
+	wm.savePayoutRows(appID, PayoutRowStatusFailed, "", rows)
+}
+
+func (wm *WalletManager) savePayoutRows(appID, status, txid string, rows []*PayoutRow) error {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return err
+	}
+	defer wrapper.CloseDB()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	for _, row := range rows {
+		row.Status = status
+		if len(txid) > 0 {
+			row.TxID = txid
+		}
+		row.UpdateTime = now
+		if err = tx.Save(row); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//ResolvePayoutRows 人工确认广播结果未知的行，paid为true标记为已确认，否则标记为失败等待重试
+func (wm *WalletManager) ResolvePayoutRows(appID, batchID string, references []string, paid bool) ([]*PayoutRow, error) {
+
+	rows := make([]*PayoutRow, 0, len(references))
+	for _, reference := range references {
+		row, err := wm.getPayoutRow(appID, batchID, reference)
+		if err != nil {
+			return nil, err
+		}
+		if row.Status != PayoutRowStatusUnknown {
+			return nil, fmt.Errorf("payout row[%s] status is %s, can not resolve", reference, row.Status)
+		}
+		rows = append(rows, row)
+	}
+
+	status := PayoutRowStatusFailed
+	if paid {
+		status = PayoutRowStatusConfirmed
+	}
+
+	if err := wm.savePayoutRows(appID, status, "", rows); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+//GetPayoutBatch 获取批量转账批次
+func (wm *WalletManager) GetPayoutBatch(appID, batchID string) (*PayoutBatch, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	var batch PayoutBatch
+	err = db.One("ID", batchID, &batch)
+	if err != nil {
+		return nil, fmt.Errorf("payout batch[%s] is not found", batchID)
+	}
+
+	return &batch, nil
+}
+
+//GetPayoutRows 获取批次的发送状态，status为空时返回全部
+func (wm *WalletManager) GetPayoutRows(appID, batchID, status string) ([]*PayoutRow, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	matchers := []q.Matcher{q.Eq("BatchID", batchID)}
+	if len(status) > 0 {
+		matchers = append(matchers, q.Eq("Status", status))
+	}
+
+	rows := make([]*PayoutRow, 0)
+	err = db.Select(matchers...).Find(&rows)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (wm *WalletManager) getPayoutRow(appID, batchID, reference string) (*PayoutRow, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	var row PayoutRow
+	err = db.One("ID", payoutRowID(batchID, reference), &row)
+	if err != nil {
+		return nil, fmt.Errorf("payout row[%s] is not found", reference)
+	}
+
+	return &row, nil
+}
+
+//confirmPayoutRows 区块提取到批量转账的交易，标记相关行为已确认
+func (wm *WalletManager) confirmPayoutRows(appID string, tx *openwallet.Transaction) {
+
+	//内存池中的交易未上链，不标记为已确认
+	if tx == nil || len(tx.TxID) == 0 || tx.BlockHeight == 0 {
+		return
+	}
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return
+	}
+
+	var rows []*PayoutRow
+	db.Select(q.Eq("TxID", tx.TxID), q.Eq("Status", PayoutRowStatusSubmitted)).Find(&rows)
+	wrapper.CloseDB()
+
+	if len(rows) == 0 {
+		return
+	}
+
+	if err = wm.savePayoutRows(appID, PayoutRowStatusConfirmed, "", rows); err != nil {
+		log.Errorf("confirm payout rows of transaction[%s] failed, unexpected error: %v", tx.TxID, err)
+	}
+}
+
+//unknownPayoutRows 已广播的交易过期或被节点丢弃，相关行标记为unknown等待人工确认
+func (wm *WalletManager) unknownPayoutRows(appID string, lifecycle *TxLifecycle) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return
+	}
+
+	var rows []*PayoutRow
+	db.Select(q.Eq("TxID", lifecycle.TxID), q.Eq("Status", PayoutRowStatusSubmitted)).Find(&rows)
+	wrapper.CloseDB()
+
+	if len(rows) == 0 {
+		return
+	}
+
+	for _, row := range rows {
+		row.Error = fmt.Sprintf("transaction is %s: %s", lifecycle.Status, lifecycle.Reason)
+	}
+	if err = wm.savePayoutRows(appID, PayoutRowStatusUnknown, "", rows); err != nil {
+		log.Errorf("mark payout rows of transaction[%s] unknown failed, unexpected error: %v", lifecycle.TxID, err)
+	}
+}
+
+//revertPayoutRows 交易所在区块因分叉被回滚，已确认的行恢复为submitted等待新分支确认
+func (wm *WalletManager) revertPayoutRows(appID string, txids []string) {
+
+	if len(txids) == 0 {
+		return
+	}
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return
+	}
+
+	var rows []*PayoutRow
+	db.Select(q.In("TxID", txids), q.Eq("Status", PayoutRowStatusConfirmed)).Find(&rows)
+	wrapper.CloseDB()
+
+	if len(rows) == 0 {
+		return
+	}
+
+	if err = wm.savePayoutRows(appID, PayoutRowStatusSubmitted, "", rows); err != nil {
+		log.Errorf("revert payout rows failed, unexpected error: %v", err)
+	}
+}
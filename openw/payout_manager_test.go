@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type payoutTestAddressDecoder struct {
+	openwallet.AddressDecoderV2Base
+}
+
+func (d *payoutTestAddressDecoder) AddressVerify(address string, opts ...interface{}) bool {
+	return strings.HasPrefix(address, "ok")
+}
+
+type payoutTestTxDecoder struct {
+	openwallet.TransactionDecoderBase
+	retryFailed bool
+	failSubmit  bool
+	submitted   []map[string]string
+}
+
+func (d *payoutTestTxDecoder) MaxTransactionOutputs() int {
+	return 3
+}
+
+func (d *payoutTestTxDecoder) MaxTransactionSize() int {
+	return 5
+}
+
+func (d *payoutTestTxDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	if _, ok := rawTx.To["okretry"]; ok && !d.retryFailed {
+		d.retryFailed = true
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "node is busy")
+	}
+	//每个接收地址2个字节
+	rawTx.RawHex = strings.Repeat("aabb", len(rawTx.To))
+	return nil
+}
+
+func (d *payoutTestTxDecoder) SignRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	rawTx.IsCompleted = true
+	return nil
+}
+
+func (d *payoutTestTxDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+	if d.failSubmit {
+		return nil, fmt.Errorf("connection reset")
+	}
+	d.submitted = append(d.submitted, rawTx.To)
+	tx := &openwallet.Transaction{TxID: fmt.Sprintf("payout_tx%d", len(d.submitted)), Coin: rawTx.Coin}
+	tx.WxID = openwallet.GenTransactionWxID(tx)
+	return tx, nil
+}
+
+type payoutTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	txDecoder *payoutTestTxDecoder
+}
+
+func (a *payoutTestAdapter) GetAddressDecoderV2() openwallet.AddressDecoderV2 {
+	return &payoutTestAddressDecoder{}
+}
+
+func (a *payoutTestAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	return a.txDecoder
+}
+
+func payoutRowsByReference(rows []*PayoutRow) map[string]*PayoutRow {
+	m := make(map[string]*PayoutRow)
+	for _, row := range rows {
+		m[row.Reference] = row
+	}
+	return m
+}
+
+func TestWalletManager_ExecutePayoutBatch(t *testing.T) {
+
+	adapter := &payoutTestAdapter{txDecoder: &payoutTestTxDecoder{}}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"PAYT": adapter})
+	defer cleanup()
+
+	wallet := newTestAccount(t, wm, "PAYT", "account1")
+
+	requests := []*PayoutRequest{
+		{Reference: "r1", Address: "ok1", Amount: "1"},
+		{Reference: "r2", Address: "ok2", Amount: "2"},
+		{Reference: "r3", Address: "ok3", Amount: "3"},
+		{Reference: "r4", Address: "bad", Amount: "4"},
+		{Reference: "r5", Address: "ok1", Amount: "5"},
+		{Reference: "r6", Address: "okretry", Amount: "6"},
+		{Reference: "r7", Address: "ok7", Amount: "0"},
+	}
+
+	_, _, err := wm.CreatePayoutBatch("app1", wallet.WalletID, "account1", append(requests, &PayoutRequest{Reference: "r1", Address: "ok8", Amount: "1"}), nil, "", "")
+	if err == nil {
+		t.Errorf("duplicated reference should be rejected")
+	}
+
+	batch, rows, err := wm.CreatePayoutBatch("app1", wallet.WalletID, "account1", requests, nil, "", "")
+	if err != nil {
+		t.Errorf("CreatePayoutBatch failed, unexpected error: %v", err)
+		return
+	}
+	byRef := payoutRowsByReference(rows)
+	if byRef["r4"].Status != PayoutRowStatusInvalid || byRef["r7"].Status != PayoutRowStatusInvalid {
+		t.Errorf("invalid rows status = %s, %s", byRef["r4"].Status, byRef["r7"].Status)
+	}
+
+	rows, err = wm.ExecutePayoutBatch("app1", batch.ID, testWalletPassword)
+	if err != nil {
+		t.Errorf("ExecutePayoutBatch failed, unexpected error: %v", err)
+		return
+	}
+	byRef = payoutRowsByReference(rows)
+
+	//r1,r2,r3超过大小限制拆分为两笔，r5与r1地址相同放在下一笔，与r6一起创建失败
+	if len(adapter.txDecoder.submitted) != 2 {
+		t.Errorf("submitted transactions = %d, want 2", len(adapter.txDecoder.submitted))
+	}
+	for _, ref := range []string{"r1", "r2", "r3"} {
+		if byRef[ref].Status != PayoutRowStatusSubmitted {
+			t.Errorf("row[%s] status = %s, want submitted", ref, byRef[ref].Status)
+		}
+	}
+	for _, ref := range []string{"r5", "r6"} {
+		if byRef[ref].Status != PayoutRowStatusFailed {
+			t.Errorf("row[%s] status = %s, want failed", ref, byRef[ref].Status)
+		}
+	}
+
+	//重试只发送失败的行
+	rows, _ = wm.ExecutePayoutBatch("app1", batch.ID, testWalletPassword)
+	byRef = payoutRowsByReference(rows)
+	if len(adapter.txDecoder.submitted) != 3 || byRef["r5"].Status != PayoutRowStatusSubmitted || byRef["r5"].Attempts != 2 {
+		t.Errorf("retry submitted = %d, r5 status = %s", len(adapter.txDecoder.submitted), byRef["r5"].Status)
+	}
+
+	//内存池中的交易不标记为已确认
+	wm.confirmPayoutRows("app1", &openwallet.Transaction{TxID: byRef["r5"].TxID, Coin: openwallet.Coin{Symbol: "PAYT"}})
+	confirmed, _ := wm.GetPayoutRows("app1", batch.ID, PayoutRowStatusConfirmed)
+	if len(confirmed) != 0 {
+		t.Errorf("confirmed rows after mempool extraction = %d, want 0", len(confirmed))
+	}
+
+	tx := &openwallet.Transaction{TxID: byRef["r5"].TxID, Coin: openwallet.Coin{Symbol: "PAYT"}, BlockHash: "hash1", BlockHeight: 1}
+	tx.WxID = openwallet.GenTransactionWxID(tx)
+	wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "account1"), &openwallet.TxExtractData{Transaction: tx})
+
+	confirmed, _ = wm.GetPayoutRows("app1", batch.ID, PayoutRowStatusConfirmed)
+	if len(confirmed) != 2 {
+		t.Errorf("confirmed rows = %d, want 2", len(confirmed))
+	}
+
+	//区块分叉回滚，已确认的行恢复为submitted
+	if err = wm.RollbackBlockData("PAYT", 1); err != nil {
+		t.Errorf("RollbackBlockData failed, unexpected error: %v", err)
+		return
+	}
+	confirmed, _ = wm.GetPayoutRows("app1", batch.ID, PayoutRowStatusConfirmed)
+	r5, _ := wm.getPayoutRow("app1", batch.ID, "r5")
+	if len(confirmed) != 0 || r5 == nil || r5.Status != PayoutRowStatusSubmitted {
+		t.Errorf("confirmed rows after rollback = %d, want 0", len(confirmed))
+	}
+
+	//广播结果未知的行需要人工确认后才会重发
+	adapter.txDecoder.failSubmit = true
+	batch2, _, _ := wm.CreatePayoutBatch("app1", wallet.WalletID, "account1", []*PayoutRequest{{Reference: "x1", Address: "okx", Amount: "1"}}, nil, "", "")
+	wm.ExecutePayoutBatch("app1", batch2.ID, testWalletPassword)
+	adapter.txDecoder.failSubmit = false
+
+	rows, _ = wm.ExecutePayoutBatch("app1", batch2.ID, testWalletPassword)
+	if rows[0].Status != PayoutRowStatusUnknown {
+		t.Errorf("row status = %s, want unknown", rows[0].Status)
+		return
+	}
+
+	if _, err = wm.ResolvePayoutRows("app1", batch2.ID, []string{"x1"}, false); err != nil {
+		t.Errorf("ResolvePayoutRows failed, unexpected error: %v", err)
+		return
+	}
+	rows, _ = wm.ExecutePayoutBatch("app1", batch2.ID, testWalletPassword)
+	if rows[0].Status != PayoutRowStatusSubmitted {
+		t.Errorf("resolved row status = %s, want submitted", rows[0].Status)
+		return
+	}
+
+	//同一批次执行中不能再次执行
+	wm.payoutRunning[payoutRowID("app1", batch2.ID)] = true
+	if _, err = wm.ExecutePayoutBatch("app1", batch2.ID, testWalletPassword); err == nil {
+		t.Errorf("execute running batch should failed")
+	}
+	delete(wm.payoutRunning, payoutRowID("app1", batch2.ID))
+
+	//交易过期未确认，已广播的行标记为unknown
+	wm.cfg.RebroadcastExpireAfter = time.Nanosecond
+	if _, err = wm.CheckUnconfirmedTransactions("app1"); err != nil {
+		t.Errorf("CheckUnconfirmedTransactions failed, unexpected error: %v", err)
+		return
+	}
+	rows, _ = wm.GetPayoutRows("app1", batch2.ID, "")
+	if rows[0].Status != PayoutRowStatusUnknown || len(rows[0].Error) == 0 {
+		t.Errorf("expired row status = %s, want unknown", rows[0].Status)
+	}
+}
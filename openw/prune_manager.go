@@ -0,0 +1,465 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/common"
+	"github.com/blocktree/openwallet/v2/crypto"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/blocktree/openwallet/v2/timer"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	//每个事务清理的记录数
+	pruneBatchSize = 1000
+)
+
+//PrunedBalance 被清理的出入账记录累计的地址余额，保证清理后仍可按本地记录对账
+type PrunedBalance struct {
+	ID           string `json:"id" storm:"id"`
+	AccountID    string `json:"accountID" storm:"index"`
+	Address      string `json:"address"`
+	Symbol       string `json:"symbol"`
+	ContractID   string `json:"contractID"`
+	Balance      string `json:"balance"`      //被清理记录的累计余额
+	PrunedHeight uint64 `json:"prunedHeight"` //已清理到的区块高度，低于该高度的记录已删除
+}
+
+//genPrunedBalanceID 生成被清理余额的ID
+func genPrunedBalanceID(address, symbol, contractID string) string {
+	plain := fmt.Sprintf("pruned_%s_%s_%s", address, symbol, contractID)
+	return common.Bytes2Hex(crypto.SHA256([]byte(plain)))
+}
+
+//PruneReport 清理报告
+type PruneReport struct {
+	AppID               string `json:"appID"`
+	DeletedTxInputs     int    `json:"deletedTxInputs"`
+	DeletedTxOutputs    int    `json:"deletedTxOutputs"`
+	DeletedTransactions int    `json:"deletedTransactions"`
+	SizeBefore          int64  `json:"sizeBefore"` //压缩前文件大小
+	SizeAfter           int64  `json:"sizeAfter"`  //压缩后文件大小
+	Reclaimed           int64  `json:"reclaimed"`  //回收的空间
+	CreateTime          int64  `json:"createTime"`
+}
+
+//coinSymbolMatcher 匹配记录的币种
+type coinSymbolMatcher string
+
+func (m coinSymbolMatcher) MatchField(v interface{}) (bool, error) {
+	coin, ok := v.(openwallet.Coin)
+	if !ok {
+		return false, nil
+	}
+	return strings.EqualFold(coin.Symbol, string(m)), nil
+}
+
+//prunedRecordMatcher 查询低于高度的指定币种记录
+func prunedRecordMatcher(symbol string, height uint64) q.Matcher {
+	return q.And(
+		q.Lt("BlockHeight", height),
+		q.NewFieldMatcher("Coin", coinSymbolMatcher(symbol)),
+	)
+}
+
+//addPrunedBalance 累计被清理记录的余额
+func addPrunedBalance(tx storm.Node, cache map[string]*PrunedBalance, r *openwallet.Recharge, amount decimal.Decimal, height uint64) {
+
+	id := genPrunedBalanceID(r.Address, r.Coin.Symbol, r.Coin.ContractID)
+	pb, ok := cache[id]
+	if !ok {
+		pb = &PrunedBalance{}
+		err := tx.One("ID", id, pb)
+		if err != nil {
+			pb = &PrunedBalance{
+				ID:         id,
+				AccountID:  r.AccountID,
+				Address:    r.Address,
+				Symbol:     r.Coin.Symbol,
+				ContractID: r.Coin.ContractID,
+				Balance:    "0",
+			}
+		}
+		cache[id] = pb
+	}
+
+	balance, _ := decimal.NewFromString(pb.Balance)
+	pb.Balance = balance.Add(amount).String()
+	if height > pb.PrunedHeight {
+		pb.PrunedHeight = height
+	}
+}
+
+//PruneTxInputs 删除低于指定高度的币种出账记录，返回删除数量
+func (wrapper *TransactionWrapper) PruneTxInputs(symbol string, height uint64) (int, error) {
+
+	//打开数据库
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return 0, err
+	}
+	defer wrapper.CloseDB()
+
+	total := 0
+	for {
+		var inputs []*openwallet.TxInput
+		err = db.Select(prunedRecordMatcher(symbol, height)).Limit(pruneBatchSize).Find(&inputs)
+		if err != nil && err != storm.ErrNotFound {
+			return total, err
+		}
+		if len(inputs) == 0 {
+			break
+		}
+
+		tx, err := db.Begin(true)
+		if err != nil {
+			return total, err
+		}
+
+		cache := make(map[string]*PrunedBalance)
+		for _, input := range inputs {
+			amount, _ := decimal.NewFromString(input.Amount)
+			addPrunedBalance(tx, cache, &input.Recharge, amount.Neg(), height)
+			err = tx.DeleteStruct(input)
+			if err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+
+		for _, pb := range cache {
+			err = tx.Save(pb)
+			if err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return total, err
+		}
+		total += len(inputs)
+	}
+
+	return total, nil
+}
+
+//PruneTxOutputs 删除低于指定高度的币种入账记录，返回删除数量
+func (wrapper *TransactionWrapper) PruneTxOutputs(symbol string, height uint64) (int, error) {
+
+	//打开数据库
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return 0, err
+	}
+	defer wrapper.CloseDB()
+
+	total := 0
+	for {
+		var outputs []*openwallet.TxOutPut
+		err = db.Select(prunedRecordMatcher(symbol, height)).Limit(pruneBatchSize).Find(&outputs)
+		if err != nil && err != storm.ErrNotFound {
+			return total, err
+		}
+		if len(outputs) == 0 {
+			break
+		}
+
+		tx, err := db.Begin(true)
+		if err != nil {
+			return total, err
+		}
+
+		cache := make(map[string]*PrunedBalance)
+		for _, output := range outputs {
+			amount, _ := decimal.NewFromString(output.Amount)
+			addPrunedBalance(tx, cache, &output.Recharge, amount, height)
+			err = tx.DeleteStruct(output)
+			if err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+
+		for _, pb := range cache {
+			err = tx.Save(pb)
+			if err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return total, err
+		}
+		total += len(outputs)
+	}
+
+	return total, nil
+}
+
+//PruneTransactions 删除低于指定高度的币种交易记录，返回删除数量
+func (wrapper *TransactionWrapper) PruneTransactions(symbol string, height uint64) (int, error) {
+
+	//打开数据库
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return 0, err
+	}
+	defer wrapper.CloseDB()
+
+	total := 0
+	for {
+		var trxs []*openwallet.Transaction
+		err = db.Select(prunedRecordMatcher(symbol, height)).Limit(pruneBatchSize).Find(&trxs)
+		if err != nil && err != storm.ErrNotFound {
+			return total, err
+		}
+		if len(trxs) == 0 {
+			break
+		}
+
+		tx, err := db.Begin(true)
+		if err != nil {
+			return total, err
+		}
+
+		for _, trx := range trxs {
+			err = tx.DeleteStruct(trx)
+			if err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return total, err
+		}
+		total += len(trxs)
+	}
+
+	return total, nil
+}
+
+//GetPrunedBalances 获取账户被清理记录累计的地址余额
+func (wrapper *WalletWrapper) GetPrunedBalances(accountID string) ([]*PrunedBalance, error) {
+	balances := make([]*PrunedBalance, 0)
+	err := wrapper.findRecords(&balances, 0, -1, "AccountID", accountID)
+	if err != nil {
+		return nil, err
+	}
+	return balances, nil
+}
+
+//pruneHeight 计算保留区块数对应的清理高度，0为不清理
+func pruneHeight(scannedHeight, keepBlocks uint64) uint64 {
+	if keepBlocks == 0 || scannedHeight <= keepBlocks {
+		return 0
+	}
+	return scannedHeight - keepBlocks
+}
+
+//PruneAppData 根据保留策略清理应用过期的区块提取数据，并压缩数据库文件
+func (wm *WalletManager) PruneAppData(appID string) (*PruneReport, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := wrapper.GetAssetsAccountList(0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PruneReport{
+		AppID:      appID,
+		CreateTime: time.Now().Unix(),
+	}
+
+	//应用内的全部币种
+	symbols := make(map[string]bool)
+	for _, account := range accounts {
+		symbols[strings.ToUpper(account.Symbol)] = true
+	}
+
+	txWrapper := NewTransactionWrapper(wrapper)
+
+	for symbol := range symbols {
+
+		policy := wm.cfg.GetRetentionPolicy(appID, symbol)
+		if policy == nil {
+			continue
+		}
+
+		assetsMgr, err := GetAssetsAdapter(symbol)
+		if err != nil {
+			continue
+		}
+
+		scanner := assetsMgr.GetBlockScanner()
+		if scanner == nil {
+			continue
+		}
+
+		scannedHeight := scanner.GetScannedBlockHeight()
+
+		if height := pruneHeight(scannedHeight, policy.KeepTxInputBlocks); height > 0 {
+			n, pruneErr := txWrapper.PruneTxInputs(symbol, height)
+			report.DeletedTxInputs += n
+			if pruneErr != nil {
+				return report, pruneErr
+			}
+		}
+
+		if height := pruneHeight(scannedHeight, policy.KeepTxOutputBlocks); height > 0 {
+			n, pruneErr := txWrapper.PruneTxOutputs(symbol, height)
+			report.DeletedTxOutputs += n
+			if pruneErr != nil {
+				return report, pruneErr
+			}
+		}
+
+		if height := pruneHeight(scannedHeight, policy.KeepTransactionBlocks); height > 0 {
+			n, pruneErr := txWrapper.PruneTransactions(symbol, height)
+			report.DeletedTransactions += n
+			if pruneErr != nil {
+				return report, pruneErr
+			}
+		}
+	}
+
+	//空闲空间超过阈值才压缩数据库文件，压缩期间应用数据库不可用
+	if wm.cfg.CompactFreeRatio <= 0 {
+		return report, nil
+	}
+
+	db, err := wm.OpenDB(appID)
+	if err != nil {
+		return report, err
+	}
+
+	ratio, err := BoltFreeRatio(db)
+	if err != nil {
+		return report, err
+	}
+
+	if ratio < wm.cfg.CompactFreeRatio {
+		return report, nil
+	}
+
+	before, after, err := wm.CompactDB(appID)
+	if err != nil {
+		return report, err
+	}
+
+	report.SizeBefore = before
+	report.SizeAfter = after
+	report.Reclaimed = before - after
+
+	return report, nil
+}
+
+//CompactDB 压缩应用数据库文件
+//@return 压缩前文件大小，压缩后文件大小
+func (wm *WalletManager) CompactDB(appID string) (int64, int64, error) {
+
+	if err := checkAppID(appID); err != nil {
+		return 0, 0, err
+	}
+
+	//压缩期间不允许打开数据库，关闭并移除已打开的数据库，压缩后由OpenDB重新打开
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	if db, ok := wm.appDB[appID]; ok {
+		delete(wm.appDB, appID)
+		if db.Opened {
+			if err := db.Close(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	return CompactStormDB(wm.DBFile(appID))
+}
+
+//PruneAllApps 清理全部应用过期的区块提取数据
+func (wm *WalletManager) PruneAllApps() ([]*PruneReport, error) {
+
+	appIDs, err := wm.loadAllAppIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*PruneReport, 0)
+	for _, appID := range appIDs {
+		report, pruneErr := wm.PruneAppData(appID)
+		if pruneErr != nil {
+			log.Errorf("app[%s] prune data failed, unexpected error: %v", appID, pruneErr)
+		}
+		if report != nil {
+			reports = append(reports, report)
+		}
+	}
+
+	return reports, nil
+}
+
+//StartPruneTask 启动定时清理过期数据任务
+func (wm *WalletManager) StartPruneTask(period time.Duration) {
+
+	wm.StopPruneTask()
+
+	task := timer.NewTask(period, func() {
+		reports, err := wm.PruneAllApps()
+		if err != nil {
+			log.Error("prune task failed, unexpected error:", err)
+			return
+		}
+		for _, r := range reports {
+			log.Infof("app[%s] pruned txInputs: %d, txOutputs: %d, transactions: %d, reclaimed: %d bytes",
+				r.AppID, r.DeletedTxInputs, r.DeletedTxOutputs, r.DeletedTransactions, r.Reclaimed)
+		}
+	})
+
+	wm.mu.Lock()
+	wm.pruneTask = task
+	wm.mu.Unlock()
+
+	task.Start()
+}
+
+//StopPruneTask 停止定时清理过期数据任务
+func (wm *WalletManager) StopPruneTask() {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.pruneTask != nil {
+		wm.pruneTask.Stop()
+		wm.pruneTask = nil
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestTransactionWrapper_PruneTxOutputs(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_prune")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenStormDB(filepath.Join(dir, "prune.db"), appDBOptions()...)
+	if err != nil {
+		t.Errorf("OpenStormDB failed, unexpected error: %v", err)
+		return
+	}
+	defer func() {
+		db.Close()
+	}()
+
+	for i := uint64(1); i <= 100; i++ {
+		output := &openwallet.TxOutPut{}
+		output.TxID = fmt.Sprintf("tx%d", i)
+		output.Sid = openwallet.GenTxOutPutSID(output.TxID, "BTC", "", 0)
+		output.Address = "addr1"
+		output.AccountID = "account1"
+		output.Amount = "1"
+		output.BlockHeight = i
+		output.Coin = openwallet.Coin{Symbol: "BTC"}
+		err = db.Save(output)
+		if err != nil {
+			t.Errorf("Save failed, unexpected error: %v", err)
+			return
+		}
+	}
+
+	txWrapper := NewTransactionWrapper(NewWalletWrapper(NewAppWrapper(db)))
+
+	n, err := txWrapper.PruneTxOutputs("BTC", 61)
+	if err != nil {
+		t.Errorf("PruneTxOutputs failed, unexpected error: %v", err)
+		return
+	}
+	if n != 60 {
+		t.Errorf("pruned outputs = %d, want 60", n)
+	}
+
+	outputs, err := txWrapper.GetTxOutputs(0, -1, "AccountID", "account1")
+	if err != nil || len(outputs) != 40 {
+		t.Errorf("remain outputs = %d, want 40", len(outputs))
+	}
+
+	pruned, err := txWrapper.GetPrunedBalances("account1")
+	if err != nil || len(pruned) != 1 {
+		t.Errorf("pruned balances not found")
+		return
+	}
+	if pruned[0].Balance != "60" || pruned[0].PrunedHeight != 61 {
+		t.Errorf("pruned balance = %s at %d, want 60 at 61", pruned[0].Balance, pruned[0].PrunedHeight)
+	}
+
+	ratio, err := BoltFreeRatio(db)
+	if err != nil || ratio <= 0 {
+		t.Errorf("free ratio after prune = %v, err: %v", ratio, err)
+	}
+
+	db.Close()
+	before, after, err := CompactStormDB(db.FileName)
+	if err != nil {
+		t.Errorf("CompactStormDB failed, unexpected error: %v", err)
+		return
+	}
+	log.Infof("compact db: %d -> %d", before, after)
+
+	db, err = OpenStormDB(db.FileName, appDBOptions()...)
+	if err != nil {
+		t.Errorf("OpenStormDB failed, unexpected error: %v", err)
+		return
+	}
+	txWrapper = NewTransactionWrapper(NewWalletWrapper(NewAppWrapper(db)))
+	outputs, err = txWrapper.GetTxOutputs(0, -1, "AccountID", "account1")
+	if err != nil || len(outputs) != 40 {
+		t.Errorf("remain outputs after compact = %d, want 40", len(outputs))
+	}
+}
+
+func TestWalletManager_CompactDB(t *testing.T) {
+
+	wm, cleanup := newTestManager(t, nil)
+	defer cleanup()
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", Symbol: "BTC"})
+
+	if _, _, err = wm.CompactDB("app1"); err != nil {
+		t.Errorf("CompactDB failed, unexpected error: %v", err)
+		return
+	}
+
+	//压缩时关闭并移除原数据库，重新打开的是新的数据库对象
+	if db.Opened {
+		t.Errorf("db should be closed after compaction")
+	}
+	reopen, err := wm.OpenDB("app1")
+	if err != nil || reopen == db {
+		t.Errorf("OpenDB after compaction failed, unexpected error: %v", err)
+		return
+	}
+	var account openwallet.AssetsAccount
+	if err = reopen.One("AccountID", "account1", &account); err != nil {
+		t.Errorf("account lost after compaction, unexpected error: %v", err)
+	}
+}
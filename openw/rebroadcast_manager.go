@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/blocktree/openwallet/v2/timer"
+)
+
+//TxWatchdogNotificationObject 可选的观察者接口，未确认的交易过期或被丢弃时通知，需要人工介入
+type TxWatchdogNotificationObject interface {
+
+	//TxWatchdogNotify lifecycle.Status为expired或dropped
+	TxWatchdogNotify(account *openwallet.AssetsAccount, lifecycle *TxLifecycle) error
+}
+
+//CheckUnconfirmedTransactions 检查应用已广播未上链的交易
+//从全节点消失的交易重新广播已签名的交易单，全节点查询到已上链的标记为confirmed
+//超过币种过期时间未上链的标记为expired或dropped
+//返回本次有变化的交易生命周期
+func (wm *WalletManager) CheckUnconfirmedTransactions(appID string) ([]*TxLifecycle, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]*TxLifecycle, 0)
+	err = wrapper.findRecords(&pending, 0, -1, "Status", TxLifecycleStatusSubmitted)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	changed := make([]*TxLifecycle, 0)
+	for _, lifecycle := range pending {
+		result, checkErr := wm.checkUnconfirmedTransaction(appID, lifecycle)
+		if checkErr != nil {
+			log.Errorf("[%s] check unconfirmed transaction[%s] failed, unexpected error: %v", lifecycle.Symbol, lifecycle.TxID, checkErr)
+			continue
+		}
+		if result != nil {
+			changed = append(changed, result)
+		}
+	}
+
+	return changed, nil
+}
+
+func (wm *WalletManager) checkUnconfirmedTransaction(appID string, lifecycle *TxLifecycle) (*TxLifecycle, error) {
+
+	//被替换交易加速后，只跟踪最新的替换交易
+	if len(lifecycle.BumpedByTxID) > 0 {
+		bump, err := wm.GetTxLifecycle(appID, lifecycle.Symbol, lifecycle.BumpedByTxID)
+		if err == nil && bump.BumpMethod == openwallet.FeeBumpMethodReplace && bump.Status == TxLifecycleStatusSubmitted {
+			return nil, nil
+		}
+	}
+
+	assetsMgr, err := GetAssetsAdapter(lifecycle.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	txDecoder := assetsMgr.GetTransactionDecoder()
+	if txDecoder == nil {
+		return nil, fmt.Errorf("[%s] transaction decoder is not support", lifecycle.Symbol)
+	}
+
+	wrapper, err := wm.NewWalletWrapper(appID, lifecycle.WalletID)
+	if err != nil {
+		return nil, err
+	}
+
+	presence, checkable := "", false
+	if checker, ok := txDecoder.(openwallet.TransactionPresenceChecker); ok {
+		checkable = true
+		var blockHeight uint64
+		presence, blockHeight, err = checker.GetTransactionPresence(wrapper, lifecycle.TxID)
+		if err != nil {
+			return nil, err
+		}
+
+		//已上链但区块扫描没有推送，以全节点数据为准，不会标记为过期
+		if presence == openwallet.TxPresenceMined {
+			tx := &openwallet.Transaction{TxID: lifecycle.TxID, Coin: openwallet.Coin{Symbol: lifecycle.Symbol}, BlockHeight: blockHeight}
+			wm.confirmTxLifecycle(appID, tx)
+			log.Infof("[%s] transaction[%s] is mined at height %d", lifecycle.Symbol, lifecycle.TxID, blockHeight)
+			return wm.GetTxLifecycle(appID, lifecycle.Symbol, lifecycle.TxID)
+		}
+	}
+
+	now := time.Now()
+	expire := wm.cfg.RebroadcastExpireThreshold(lifecycle.Symbol)
+	if expire > 0 && now.Sub(time.Unix(lifecycle.SubmitTime, 0)) >= expire {
+		status := TxLifecycleStatusExpired
+		if checkable && presence == openwallet.TxPresenceNotFound {
+			status = TxLifecycleStatusDropped
+		}
+		result, updated, updateErr := wm.updateSubmittedTxLifecycle(appID, lifecycle, func(lc *TxLifecycle) {
+			lc.Status = status
+			lc.Reason = fmt.Sprintf("not confirmed after %v", expire)
+		})
+		if updateErr != nil || !updated {
+			return nil, updateErr
+		}
+		log.Warningf("[%s] transaction[%s] is %s, not confirmed after %v", result.Symbol, result.TxID, result.Status, expire)
+		wm.unknownPayoutRows(appID, result)
+		wm.unknownSponsoredTransfers(appID, result)
+		wm.releaseTxNonceReservation(result)
+		wm.notifyTxWatchdog(appID, result)
+		return result, nil
+	}
+
+	if presence == openwallet.TxPresencePending {
+		return nil, nil
+	}
+
+	//不支持查询的币种无法判断交易是否已被节点丢弃，开启后才按间隔直接广播
+	if !checkable && !wm.cfg.RebroadcastBlind(lifecycle.Symbol) {
+		return nil, nil
+	}
+
+	if now.Sub(time.Unix(lifecycle.LastBroadcastTime, 0)) < wm.cfg.RebroadcastInterval {
+		return nil, nil
+	}
+
+	//旧版本记录没有保存交易单，无法重新广播
+	if lifecycle.RawTx == nil || len(lifecycle.RawTx.RawHex) == 0 {
+		return nil, nil
+	}
+
+	_, submitErr := txDecoder.SubmitRawTransaction(wrapper, lifecycle.RawTx)
+	metrics.ObserveTxOperation(lifecycle.Symbol, txOperationSubmit, submitErr)
+	if submitErr != nil {
+		log.Warningf("[%s] rebroadcast transaction[%s] failed, unexpected error: %v", lifecycle.Symbol, lifecycle.TxID, submitErr)
+	} else {
+		log.Infof("[%s] transaction[%s] is not found in node, rebroadcast successfully", lifecycle.Symbol, lifecycle.TxID)
+	}
+
+	result, updated, err := wm.updateSubmittedTxLifecycle(appID, lifecycle, func(lc *TxLifecycle) {
+		lc.Rebroadcasts++
+		lc.LastBroadcastTime = now.Unix()
+		lc.Reason = ""
+		if submitErr != nil {
+			lc.Reason = submitErr.Error()
+		}
+	})
+	if err != nil || !updated {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (wm *WalletManager) notifyTxWatchdog(appID string, lifecycle *TxLifecycle) {
+
+	account, err := wm.GetAssetsAccountInfo(appID, "", lifecycle.AccountID)
+	if err != nil {
+		return
+	}
+
+	for o, _ := range wm.observers {
+		if wo, ok := o.(TxWatchdogNotificationObject); ok {
+			wo.TxWatchdogNotify(account, lifecycle)
+		}
+	}
+}
+
+//StartRebroadcastService 启动未确认交易检查服务，每个周期检查全部应用及等待回执的合约部署
+func (wm *WalletManager) StartRebroadcastService(period time.Duration) {
+
+	wm.StopRebroadcastService()
+
+	task := timer.NewTask(period, func() {
+		appIDs, err := wm.loadAllAppIDs()
+		if err != nil {
+			log.Error("rebroadcast service load apps failed, unexpected error:", err)
+			return
+		}
+		for _, appID := range appIDs {
+			if _, checkErr := wm.CheckUnconfirmedTransactions(appID); checkErr != nil {
+				log.Errorf("app[%s] check unconfirmed transactions failed, unexpected error: %v", appID, checkErr)
+			}
+		}
+		if _, checkErr := wm.CheckPendingContractDeployments(); checkErr != nil {
+			log.Error("check pending contract deployments failed, unexpected error:", checkErr)
+		}
+	})
+
+	wm.mu.Lock()
+	wm.rebroadcastTask = task
+	wm.mu.Unlock()
+
+	task.Start()
+}
+
+//StopRebroadcastService 停止未确认交易检查服务
+func (wm *WalletManager) StopRebroadcastService() {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.rebroadcastTask != nil {
+		wm.rebroadcastTask.Stop()
+		wm.rebroadcastTask = nil
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type rebroadcastTestTxDecoder struct {
+	openwallet.TransactionDecoderBase
+	presence  map[string]string
+	submitted []string
+}
+
+func (d *rebroadcastTestTxDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	rawTx.RawHex = fmt.Sprintf("raw%d", len(d.submitted)+1)
+	return nil
+}
+
+func (d *rebroadcastTestTxDecoder) SignRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	rawTx.IsCompleted = true
+	return nil
+}
+
+func (d *rebroadcastTestTxDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+	d.submitted = append(d.submitted, rawTx.RawHex)
+	tx := &openwallet.Transaction{TxID: "watch_" + rawTx.RawHex, Coin: rawTx.Coin}
+	tx.WxID = openwallet.GenTransactionWxID(tx)
+	return tx, nil
+}
+
+type rebroadcastPresenceTxDecoder struct {
+	*rebroadcastTestTxDecoder
+}
+
+func (d *rebroadcastPresenceTxDecoder) GetTransactionPresence(wrapper openwallet.WalletDAI, txid string) (string, uint64, error) {
+	presence, ok := d.presence[txid]
+	if !ok {
+		return openwallet.TxPresenceNotFound, 0, nil
+	}
+	if presence == openwallet.TxPresenceMined {
+		return presence, 5, nil
+	}
+	return presence, 0, nil
+}
+
+type rebroadcastTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	txDecoder *rebroadcastTestTxDecoder
+	checkable bool
+}
+
+func (a *rebroadcastTestAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	if a.checkable {
+		return &rebroadcastPresenceTxDecoder{a.txDecoder}
+	}
+	return a.txDecoder
+}
+
+type rebroadcastTestObserver struct {
+	rollbackTestObserver
+	alerted []*TxLifecycle
+}
+
+func (o *rebroadcastTestObserver) TxWatchdogNotify(account *openwallet.AssetsAccount, lifecycle *TxLifecycle) error {
+	o.alerted = append(o.alerted, lifecycle)
+	return nil
+}
+
+func TestWalletManager_CheckUnconfirmedTransactions(t *testing.T) {
+
+	adapter := &rebroadcastTestAdapter{txDecoder: &rebroadcastTestTxDecoder{presence: make(map[string]string)}, checkable: true}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"WTCH": adapter})
+	defer cleanup()
+
+	wm.cfg.RebroadcastInterval = 0
+	wm.cfg.RebroadcastExpireAfter = 0
+
+	observer := &rebroadcastTestObserver{}
+	wm.AddObserver(observer)
+
+	wallet := newTestAccount(t, wm, "WTCH", "account1")
+
+	transfer := func() *openwallet.Transaction {
+		rawTx, createErr := wm.CreateTransaction("app1", wallet.WalletID, "account1", "1", "addr1", "", "", nil)
+		if createErr != nil {
+			t.Fatalf("CreateTransaction failed, unexpected error: %v", createErr)
+		}
+		rawTx, createErr = wm.SignTransaction("app1", wallet.WalletID, "account1", testWalletPassword, rawTx)
+		if createErr != nil {
+			t.Fatalf("SignTransaction failed, unexpected error: %v", createErr)
+		}
+		tx, createErr := wm.SubmitTransaction("app1", wallet.WalletID, "account1", rawTx)
+		if createErr != nil {
+			t.Fatalf("SubmitTransaction failed, unexpected error: %v", createErr)
+		}
+		return tx
+	}
+
+	//全节点没有该交易，重新广播已签名的交易单
+	tx1 := transfer()
+	changed, err := wm.CheckUnconfirmedTransactions("app1")
+	if err != nil {
+		t.Errorf("CheckUnconfirmedTransactions failed, unexpected error: %v", err)
+		return
+	}
+	if len(changed) != 1 || changed[0].Rebroadcasts != 1 || len(adapter.txDecoder.submitted) != 2 || adapter.txDecoder.submitted[1] != "raw1" {
+		t.Errorf("rebroadcast changed = %d, submitted = %v", len(changed), adapter.txDecoder.submitted)
+	}
+
+	//全节点有该交易，不需要重新广播
+	adapter.txDecoder.presence[tx1.TxID] = openwallet.TxPresencePending
+	changed, _ = wm.CheckUnconfirmedTransactions("app1")
+	if len(changed) != 0 || len(adapter.txDecoder.submitted) != 2 {
+		t.Errorf("present transaction should not be rebroadcast, submitted = %v", adapter.txDecoder.submitted)
+	}
+
+	//超过过期时间，仍在全节点的标记为expired，已消失的标记为dropped
+	tx2 := transfer()
+	wm.cfg.RebroadcastExpireSymbols = map[string]time.Duration{"WTCH": time.Nanosecond}
+	changed, _ = wm.CheckUnconfirmedTransactions("app1")
+	if len(changed) != 2 || len(observer.alerted) != 2 {
+		t.Errorf("expired changed = %d, alerted = %d, want 2", len(changed), len(observer.alerted))
+	}
+	lifecycle1, _ := wm.GetTxLifecycle("app1", "WTCH", tx1.TxID)
+	lifecycle2, _ := wm.GetTxLifecycle("app1", "WTCH", tx2.TxID)
+	if lifecycle1.Status != TxLifecycleStatusExpired || lifecycle2.Status != TxLifecycleStatusDropped {
+		t.Errorf("status = %s, %s, want expired, dropped", lifecycle1.Status, lifecycle2.Status)
+	}
+
+	//过期的交易仍可能上链
+	confirmed := &openwallet.Transaction{TxID: tx1.TxID, Coin: openwallet.Coin{Symbol: "WTCH"}, BlockHash: "hash1", BlockHeight: 1}
+	confirmed.WxID = openwallet.GenTransactionWxID(confirmed)
+	wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "account1"), &openwallet.TxExtractData{Transaction: confirmed})
+	lifecycle1, _ = wm.GetTxLifecycle("app1", "WTCH", tx1.TxID)
+	if lifecycle1.Status != TxLifecycleStatusConfirmed {
+		t.Errorf("status = %s, want confirmed", lifecycle1.Status)
+	}
+
+	//全节点查询到已上链，过期前标记为confirmed
+	tx3 := transfer()
+	adapter.txDecoder.presence[tx3.TxID] = openwallet.TxPresenceMined
+	changed, _ = wm.CheckUnconfirmedTransactions("app1")
+	lifecycle3, _ := wm.GetTxLifecycle("app1", "WTCH", tx3.TxID)
+	if len(changed) != 1 || lifecycle3.Status != TxLifecycleStatusConfirmed || lifecycle3.BlockHeight != 5 {
+		t.Errorf("mined transaction status = %s, height = %d, want confirmed at 5", lifecycle3.Status, lifecycle3.BlockHeight)
+	}
+}
+
+func TestWalletManager_CheckUnconfirmedTransactions_Blind(t *testing.T) {
+
+	adapter := &rebroadcastTestAdapter{txDecoder: &rebroadcastTestTxDecoder{}}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"WTCH": adapter})
+	defer cleanup()
+
+	wm.cfg.RebroadcastInterval = 0
+	wm.cfg.RebroadcastExpireAfter = 0
+
+	wallet := newTestAccount(t, wm, "WTCH", "account1")
+
+	rawTx, err := wm.CreateTransaction("app1", wallet.WalletID, "account1", "1", "addr1", "", "", nil)
+	if err != nil {
+		t.Errorf("CreateTransaction failed, unexpected error: %v", err)
+		return
+	}
+	rawTx, _ = wm.SignTransaction("app1", wallet.WalletID, "account1", testWalletPassword, rawTx)
+	if _, err = wm.SubmitTransaction("app1", wallet.WalletID, "account1", rawTx); err != nil {
+		t.Errorf("SubmitTransaction failed, unexpected error: %v", err)
+		return
+	}
+
+	//不支持查询交易状态的币种默认不重新广播
+	wm.CheckUnconfirmedTransactions("app1")
+	if len(adapter.txDecoder.submitted) != 1 {
+		t.Errorf("submitted = %v, want no rebroadcast", adapter.txDecoder.submitted)
+	}
+
+	wm.cfg.RebroadcastBlindSymbols = []string{"wtch"}
+	wm.CheckUnconfirmedTransactions("app1")
+	if len(adapter.txDecoder.submitted) != 2 {
+		t.Errorf("submitted = %v, want blind rebroadcast", adapter.txDecoder.submitted)
+	}
+}
@@ -0,0 +1,405 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/common/file"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+//SmartContractReceiptNotificationObject 可选的观察者接口，接收与应用账户相关的合约交易回执
+type SmartContractReceiptNotificationObject interface {
+
+	//BlockSmartContractReceiptNotify 合约交易回执通知，例如代币转入账户地址
+	BlockSmartContractReceiptNotify(account *openwallet.AssetsAccount, receipt *openwallet.SmartContractReceipt) error
+}
+
+//SmartContractReceiptRecord 合约交易回执记录
+type SmartContractReceiptRecord struct {
+	WxID        string                           `json:"wxid" storm:"id"`
+	TxID        string                           `json:"txid" storm:"index"`
+	Symbol      string                           `json:"symbol" storm:"index"`
+	ContractID  string                           `json:"contractID" storm:"index"`
+	BlockHeight uint64                           `json:"blockHeight" storm:"index"`
+	Receipt     *openwallet.SmartContractReceipt `json:"receipt"`
+}
+
+//SmartContractEventRecord 合约事件记录，按合约查询回执
+type SmartContractEventRecord struct {
+	ID          string `json:"id" storm:"id"` //{wxid}_{序号}
+	WxID        string `json:"wxid" storm:"index"`
+	ContractID  string `json:"contractID" storm:"index"`
+	Symbol      string `json:"symbol" storm:"index"`
+	Event       string `json:"event"`
+	Value       string `json:"value"`
+	BlockHeight uint64 `json:"blockHeight"`
+}
+
+//SmartContractReceiptLink 合约交易回执关联的应用账户
+type SmartContractReceiptLink struct {
+	ID          string `json:"id" storm:"id"` //{wxid}_{appID}_{accountID}
+	WxID        string `json:"wxid" storm:"index"`
+	AppID       string `json:"appID" storm:"index"`
+	AccountID   string `json:"accountID" storm:"index"`
+	Symbol      string `json:"symbol" storm:"index"`
+	BlockHeight uint64 `json:"blockHeight"`
+}
+
+//receiptAddresses 回执涉及的地址，包括调用者及事件参数中的from、to
+func receiptAddresses(receipt *openwallet.SmartContractReceipt) []string {
+	addrs := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(address string) {
+		if len(address) > 0 && !seen[address] {
+			seen[address] = true
+			addrs = append(addrs, address)
+		}
+	}
+	add(receipt.From)
+	add(receipt.To)
+	for _, event := range receipt.Events {
+		if event == nil || len(event.Value) == 0 {
+			continue
+		}
+		value := gjson.Parse(event.Value)
+		add(value.Get("from").String())
+		add(value.Get("to").String())
+	}
+	return addrs
+}
+
+//receiptContractIDs 回执中事件合约及交易币种的合约ID
+func receiptContractIDs(receipt *openwallet.SmartContractReceipt) []string {
+	ids := make([]string, 0)
+	seen := make(map[string]bool)
+	if len(receipt.Coin.ContractID) > 0 {
+		seen[receipt.Coin.ContractID] = true
+		ids = append(ids, receipt.Coin.ContractID)
+	}
+	for _, event := range receipt.Events {
+		if event == nil || event.Contract == nil {
+			continue
+		}
+		id := event.Contract.ContractID
+		if len(id) == 0 && len(event.Contract.Address) > 0 {
+			symbol := event.Contract.Symbol
+			if len(symbol) == 0 {
+				symbol = receipt.Coin.Symbol
+			}
+			id = openwallet.GenContractID(strings.ToUpper(symbol), event.Contract.Address)
+		}
+		if len(id) > 0 && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+//saveSmartContractReceipt 保存合约交易回执、事件及关联账户，已保存过的回执返回duplicated
+func (wm *WalletManager) saveSmartContractReceipt(receipt *openwallet.SmartContractReceipt) (links []*SmartContractReceiptLink, duplicated bool, err error) {
+
+	if len(receipt.WxID) == 0 {
+		receipt.GenWxID()
+	}
+
+	symbol := strings.ToUpper(receipt.Coin.Symbol)
+
+	//关联回执地址所属的应用账户
+	links = make([]*SmartContractReceiptLink, 0)
+	for _, address := range receiptAddresses(receipt) {
+		sourceKey, ok := wm.GetSourceKeyByAddressForBlockScan(address)
+		if !ok {
+			continue
+		}
+		appID, accountID := wm.decodeSourceKey(sourceKey)
+		if len(appID) == 0 || len(accountID) == 0 {
+			continue
+		}
+		links = append(links, &SmartContractReceiptLink{
+			ID:          fmt.Sprintf("%s_%s_%s", receipt.WxID, appID, accountID),
+			WxID:        receipt.WxID,
+			AppID:       appID,
+			AccountID:   accountID,
+			Symbol:      symbol,
+			BlockHeight: receipt.BlockHeight,
+		})
+	}
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var exist SmartContractReceiptRecord
+	duplicated = db.One("WxID", receipt.WxID, &exist) == nil
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	record := &SmartContractReceiptRecord{
+		WxID:        receipt.WxID,
+		TxID:        receipt.TxID,
+		Symbol:      symbol,
+		ContractID:  receipt.Coin.ContractID,
+		BlockHeight: receipt.BlockHeight,
+		Receipt:     receipt,
+	}
+	if err = tx.Save(record); err != nil {
+		return nil, false, err
+	}
+
+	//重扫时可能事件有变化，先删除旧的事件
+	var oldEvents []*SmartContractEventRecord
+	if tx.Find("WxID", receipt.WxID, &oldEvents) == nil {
+		for _, e := range oldEvents {
+			tx.DeleteStruct(e)
+		}
+	}
+
+	contractIDs := receiptContractIDs(receipt)
+	for i, event := range receipt.Events {
+		if event == nil {
+			continue
+		}
+		eventRecord := &SmartContractEventRecord{
+			ID:          fmt.Sprintf("%s_%d", receipt.WxID, i),
+			WxID:        receipt.WxID,
+			Symbol:      symbol,
+			Event:       event.Event,
+			Value:       event.Value,
+			BlockHeight: receipt.BlockHeight,
+		}
+		if event.Contract != nil {
+			eventRecord.ContractID = event.Contract.ContractID
+			if len(eventRecord.ContractID) == 0 && len(event.Contract.Address) > 0 {
+				eventRecord.ContractID = openwallet.GenContractID(symbol, event.Contract.Address)
+			}
+		}
+		if err = tx.Save(eventRecord); err != nil {
+			return nil, false, err
+		}
+	}
+
+	//交易币种是合约但没有事件时，仍然可以按合约查询
+	if len(receipt.Events) == 0 && len(contractIDs) > 0 {
+		if err = tx.Save(&SmartContractEventRecord{
+			ID:          fmt.Sprintf("%s_%d", receipt.WxID, 0),
+			WxID:        receipt.WxID,
+			Symbol:      symbol,
+			ContractID:  contractIDs[0],
+			BlockHeight: receipt.BlockHeight,
+		}); err != nil {
+			return nil, false, err
+		}
+	}
+
+	for _, link := range links {
+		if err = tx.Save(link); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	return links, duplicated, nil
+}
+
+//notifySmartContractReceipt 向观察者推送与应用账户相关的合约交易回执
+func (wm *WalletManager) notifySmartContractReceipt(links []*SmartContractReceiptLink, receipt *openwallet.SmartContractReceipt) {
+
+	for _, link := range links {
+
+		if !wm.isAppScanEnabled(link.AppID, receipt.Coin.Symbol) {
+			continue
+		}
+
+		wrapper, err := wm.NewWalletWrapper(link.AppID, "")
+		if err != nil {
+			log.Errorf("receipt[%s] can not open app[%s]: %v", receipt.TxID, link.AppID, err)
+			continue
+		}
+
+		account, err := wrapper.GetAssetsAccountInfo(link.AccountID)
+		if err != nil {
+			log.Errorf("receipt[%s] can not find account: %s", receipt.TxID, link.AccountID)
+			continue
+		}
+
+		for o, _ := range wm.observers {
+			if ro, ok := o.(SmartContractReceiptNotificationObject); ok {
+				ro.BlockSmartContractReceiptNotify(account, receipt)
+			}
+		}
+	}
+}
+
+//getSmartContractReceipts 按WxID读取回执，保持传入顺序
+func (wm *WalletManager) getSmartContractReceipts(db *StormDB, wxIDs []string) ([]*openwallet.SmartContractReceipt, error) {
+	receipts := make([]*openwallet.SmartContractReceipt, 0, len(wxIDs))
+	for _, wxID := range wxIDs {
+		var record SmartContractReceiptRecord
+		if err := db.One("WxID", wxID, &record); err != nil {
+			if err == storm.ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		receipts = append(receipts, record.Receipt)
+	}
+	return receipts, nil
+}
+
+//GetSmartContractReceiptsByTxID 通过交易单ID查询合约交易回执，同一交易可能有多个合约的回执
+func (wm *WalletManager) GetSmartContractReceiptsByTxID(symbol, txid string) ([]*openwallet.SmartContractReceipt, error) {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*SmartContractReceiptRecord
+	err = db.Select(q.Eq("TxID", txid), q.Eq("Symbol", strings.ToUpper(symbol))).Find(&records)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	receipts := make([]*openwallet.SmartContractReceipt, 0, len(records))
+	for _, record := range records {
+		receipts = append(receipts, record.Receipt)
+	}
+	return receipts, nil
+}
+
+//GetSmartContractReceiptsByContract 查询合约相关的交易回执，按区块高度倒序，limit为-1时不限制
+func (wm *WalletManager) GetSmartContractReceiptsByContract(contractID string, offset, limit int) ([]*openwallet.SmartContractReceipt, error) {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*SmartContractEventRecord
+	err = db.Select(q.Eq("ContractID", contractID)).OrderBy("BlockHeight").Reverse().Find(&events)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	wxIDs := make([]string, 0, len(events))
+	seen := make(map[string]bool)
+	for _, e := range events {
+		if !seen[e.WxID] {
+			seen[e.WxID] = true
+			wxIDs = append(wxIDs, e.WxID)
+		}
+	}
+
+	return wm.getSmartContractReceipts(db, pageStrings(wxIDs, offset, limit))
+}
+
+//GetSmartContractReceiptsByAccount 查询应用账户相关的合约交易回执，按区块高度倒序，limit为-1时不限制
+func (wm *WalletManager) GetSmartContractReceiptsByAccount(appID, accountID string, offset, limit int) ([]*openwallet.SmartContractReceipt, error) {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var links []*SmartContractReceiptLink
+	err = db.Select(q.Eq("AppID", appID), q.Eq("AccountID", accountID)).OrderBy("BlockHeight").Reverse().Find(&links)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	wxIDs := make([]string, 0, len(links))
+	for _, link := range links {
+		wxIDs = append(wxIDs, link.WxID)
+	}
+
+	return wm.getSmartContractReceipts(db, pageStrings(wxIDs, offset, limit))
+}
+
+//rollbackSmartContractReceipts 删除分叉高度及以上的合约交易回执
+func (wm *WalletManager) rollbackSmartContractReceipts(symbol string, height uint64) error {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	//没有保存过回执
+	if wm.tokenDB == nil && !file.Exists(wm.TokenDBFile()) {
+		return nil
+	}
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return err
+	}
+
+	symbol = strings.ToUpper(symbol)
+	matcher := q.And(q.Eq("Symbol", symbol), q.Gte("BlockHeight", height))
+
+	for _, data := range []interface{}{
+		&SmartContractReceiptRecord{},
+		&SmartContractEventRecord{},
+		&SmartContractReceiptLink{},
+	} {
+		err = db.Select(matcher).Delete(data)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//pageStrings 分页截取
+func pageStrings(list []string, offset, limit int) []string {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(list) {
+		return []string{}
+	}
+	list = list[offset:]
+	if limit >= 0 && limit < len(list) {
+		list = list[:limit]
+	}
+	return list
+}
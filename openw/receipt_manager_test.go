@@ -0,0 +1,113 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type receiptTestObserver struct {
+	rollbackTestObserver
+	receipts []*openwallet.SmartContractReceipt
+}
+
+func (o *receiptTestObserver) BlockSmartContractReceiptNotify(account *openwallet.AssetsAccount, receipt *openwallet.SmartContractReceipt) error {
+	o.receipts = append(o.receipts, receipt)
+	return nil
+}
+
+func TestWalletManager_BlockExtractSmartContractDataNotify(t *testing.T) {
+
+	wm, cleanup := newTestManager(t, nil)
+	defer cleanup()
+
+	observer := &receiptTestObserver{}
+	wm.AddObserver(observer)
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", Symbol: "ETH"})
+	wm.AddAddressForBlockScan("0xuser", wm.encodeSourceKey("app1", "account1"))
+
+	contract := &openwallet.SmartContract{Symbol: "ETH", Address: "0xtoken"}
+	contractID := openwallet.GenContractID("ETH", "0xtoken")
+
+	newReceipt := func(height uint64, to string) *openwallet.SmartContractReceipt {
+		receipt := &openwallet.SmartContractReceipt{
+			Coin:        openwallet.Coin{Symbol: "ETH", ContractID: contractID, IsContract: true},
+			TxID:        fmt.Sprintf("tx%d", height),
+			From:        "0xother",
+			To:          "0xtoken",
+			BlockHeight: height,
+			Events: []*openwallet.SmartContractEvent{
+				{Contract: contract, Event: "Transfer", Value: fmt.Sprintf(`{"from":"0xother","to":"%s","value":"1"}`, to)},
+			},
+		}
+		receipt.GenWxID()
+		return receipt
+	}
+
+	for h := uint64(8); h <= 12; h++ {
+		to := "0xuser"
+		if h%2 == 1 {
+			to = "0xstranger"
+		}
+		if err = wm.BlockExtractSmartContractDataNotify(contractID, newReceipt(h, to)); err != nil {
+			t.Errorf("BlockExtractSmartContractDataNotify failed, unexpected error: %v", err)
+			return
+		}
+	}
+
+	//重复的回执不再推送
+	wm.BlockExtractSmartContractDataNotify(contractID, newReceipt(10, "0xuser"))
+
+	if len(observer.receipts) != 3 {
+		t.Errorf("notified receipts = %d, want 3", len(observer.receipts))
+	}
+
+	receipts, _ := wm.GetSmartContractReceiptsByContract(contractID, 0, -1)
+	if len(receipts) != 5 || receipts[0].BlockHeight != 12 {
+		t.Errorf("receipts by contract = %d, want 5", len(receipts))
+	}
+
+	receipts, _ = wm.GetSmartContractReceiptsByAccount("app1", "account1", 1, 1)
+	if len(receipts) != 1 || receipts[0].BlockHeight != 10 {
+		t.Errorf("receipts by account = %+v", receipts)
+	}
+
+	receipts, _ = wm.GetSmartContractReceiptsByTxID("eth", "tx9")
+	if len(receipts) != 1 || receipts[0].Events[0].Event != "Transfer" {
+		t.Errorf("receipts by txid = %+v", receipts)
+	}
+
+	//分叉点为10，10及以上的回执被删除
+	wm.BlockScanNotify(&openwallet.BlockHeader{Height: 10, Symbol: "ETH", Fork: true})
+
+	receipts, _ = wm.GetSmartContractReceiptsByContract(contractID, 0, -1)
+	if len(receipts) != 2 {
+		t.Errorf("receipts after rollback = %d, want 2", len(receipts))
+	}
+	receipts, _ = wm.GetSmartContractReceiptsByAccount("app1", "account1", 0, -1)
+	if len(receipts) != 1 {
+		t.Errorf("account receipts after rollback = %d, want 1", len(receipts))
+	}
+}
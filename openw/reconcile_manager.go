@@ -0,0 +1,379 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/blocktree/openwallet/v2/timer"
+	"github.com/pborman/uuid"
+	"github.com/shopspring/decimal"
+)
+
+//AddressBalanceDrift 地址本地余额与链上余额的偏差
+type AddressBalanceDrift struct {
+	Address      string `json:"address"`
+	LocalBalance string `json:"localBalance"` //本地记录计算的余额
+	ChainBalance string `json:"chainBalance"` //链上查询的余额
+	Drift        string `json:"drift"`        //偏差 = 链上余额 - 本地余额
+	StartHeight  uint64 `json:"startHeight"`  //本地记录涉及的最低区块高度
+	EndHeight    uint64 `json:"endHeight"`    //本地记录涉及的最高区块高度
+}
+
+//ReconcileReport 资产账户对账报告
+type ReconcileReport struct {
+	ID                string                 `json:"id" storm:"id"` //报告ID
+	AppID             string                 `json:"appID"`
+	AccountID         string                 `json:"accountID" storm:"index"`
+	Symbol            string                 `json:"symbol"`
+	LocalBalance      string                 `json:"localBalance"`      //本地记录计算的账户余额
+	ChainBalance      string                 `json:"chainBalance"`      //链上查询的账户余额
+	IsMatched         bool                   `json:"isMatched"`         //全部地址是否一致
+	AddressCount      int                    `json:"addressCount"`      //对账地址数量
+	Drifts            []*AddressBalanceDrift `json:"drifts"`            //存在偏差的地址
+	ScannedHeight     uint64                 `json:"scannedHeight"`     //对账时已扫描高度
+	RescanStartHeight uint64                 `json:"rescanStartHeight"` //触发重扫的开始高度，0为未重扫
+	RescanEndHeight   uint64                 `json:"rescanEndHeight"`   //触发重扫的结束高度
+	RescanJobID       string                 `json:"rescanJobID"`       //后台重扫任务ID
+	CreateTime        int64                  `json:"createTime" storm:"index"`
+}
+
+//newReconcileReport 创建对账报告
+func newReconcileReport(appID string, account *openwallet.AssetsAccount) *ReconcileReport {
+	report := &ReconcileReport{
+		ID:         uuid.New(),
+		AppID:      appID,
+		AccountID:  account.AccountID,
+		Symbol:     account.Symbol,
+		Drifts:     make([]*AddressBalanceDrift, 0),
+		CreateTime: time.Now().Unix(),
+	}
+	return report
+}
+
+//localAddressBalance 本地记录统计的地址余额
+type localAddressBalance struct {
+	balance     decimal.Decimal
+	startHeight uint64
+	endHeight   uint64
+}
+
+//sumLocalBalanceByAddress 根据本地出入账记录及已清理的累计余额计算各地址的主币余额，合约代币记录不参与计算
+func sumLocalBalanceByAddress(inputs []*openwallet.TxInput, outputs []*openwallet.TxOutPut, pruned []*PrunedBalance) map[string]*localAddressBalance {
+
+	result := make(map[string]*localAddressBalance)
+
+	add := func(address string, amount decimal.Decimal, height uint64) {
+		b, ok := result[address]
+		if !ok {
+			b = &localAddressBalance{balance: decimal.Zero, startHeight: height, endHeight: height}
+			result[address] = b
+		}
+		b.balance = b.balance.Add(amount)
+		if height < b.startHeight {
+			b.startHeight = height
+		}
+		if height > b.endHeight {
+			b.endHeight = height
+		}
+	}
+
+	for _, output := range outputs {
+		if output.Coin.IsContract {
+			continue
+		}
+		amount, _ := decimal.NewFromString(output.Amount)
+		add(output.Address, amount, output.BlockHeight)
+	}
+
+	for _, input := range inputs {
+		if input.Coin.IsContract {
+			continue
+		}
+		amount, _ := decimal.NewFromString(input.Amount)
+		add(input.Address, amount.Neg(), input.BlockHeight)
+	}
+
+	//已清理的记录无法重扫，高度范围从清理高度开始
+	for _, pb := range pruned {
+		if len(pb.ContractID) > 0 {
+			continue
+		}
+		amount, _ := decimal.NewFromString(pb.Balance)
+		add(pb.Address, amount, pb.PrunedHeight)
+		if b := result[pb.Address]; b.startHeight < pb.PrunedHeight {
+			b.startHeight = pb.PrunedHeight
+		}
+	}
+
+	return result
+}
+
+//reconcileRescanRange 根据偏差地址的本地记录计算重扫范围，最多重扫已扫描高度之前的maxBlocks个区块，0为不限制
+//没有本地记录的地址无法确定范围，只能从限制的最低高度开始
+func reconcileRescanRange(drifts []*AddressBalanceDrift, scannedHeight, maxBlocks uint64) (uint64, uint64, bool) {
+
+	if len(drifts) == 0 || scannedHeight == 0 {
+		return 0, 0, false
+	}
+
+	start := drifts[0].StartHeight
+	for _, drift := range drifts {
+		if drift.StartHeight < start {
+			start = drift.StartHeight
+		}
+	}
+
+	floor := uint64(1)
+	if maxBlocks > 0 && scannedHeight >= maxBlocks {
+		floor = scannedHeight - maxBlocks + 1
+	}
+	if start < floor {
+		start = floor
+	}
+	if start > scannedHeight {
+		return 0, 0, false
+	}
+
+	return start, scannedHeight, true
+}
+
+//ReconcileAssetsAccount 对比资产账户本地记录余额与链上余额，生成对账报告
+//@param rescan 存在偏差时，是否创建后台任务重扫偏差地址涉及的区块高度范围
+func (wm *WalletManager) ReconcileAssetsAccount(appID, accountID string, rescan bool) (*ReconcileReport, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	assetsMgr, err := GetAssetsAdapter(account.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := assetsMgr.GetBlockScanner()
+	if scanner == nil {
+		return nil, fmt.Errorf("[%s] not support block scan", account.Symbol)
+	}
+
+	searchAddrs := make([]string, 0)
+	if assetsMgr.BalanceModelType() == openwallet.BalanceModelTypeAccount {
+		//账户模型，以账户别名作为地址
+		searchAddrs = append(searchAddrs, account.Alias)
+	} else {
+		addresses, addrErr := wrapper.GetAddressList(0, -1, "AccountID", accountID)
+		if addrErr != nil {
+			return nil, addrErr
+		}
+		for _, address := range addresses {
+			searchAddrs = append(searchAddrs, address.Address)
+		}
+	}
+
+	inputs, err := wrapper.GetTxInputs(0, -1, "AccountID", accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs, err := wrapper.GetTxOutputs(0, -1, "AccountID", accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned, err := wrapper.GetPrunedBalances(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	localBalances := sumLocalBalanceByAddress(inputs, outputs, pruned)
+
+	chainBalances := make(map[string]decimal.Decimal)
+	if len(searchAddrs) > 0 {
+		balances, balErr := scanner.GetBalanceByAddress(searchAddrs...)
+		if balErr != nil {
+			return nil, balErr
+		}
+		for _, b := range balances {
+			chainBalance, _ := decimal.NewFromString(b.Balance)
+			chainBalances[b.Address] = chainBalance
+		}
+	}
+
+	var (
+		dec           = assetsMgr.Decimal()
+		accountLocal  = decimal.Zero
+		accountChain  = decimal.Zero
+		report        = newReconcileReport(appID, account)
+		scannedHeight = scanner.GetScannedBlockHeight()
+	)
+
+	for _, address := range searchAddrs {
+
+		local := decimal.Zero
+		var startHeight, endHeight uint64
+		if lb, ok := localBalances[address]; ok {
+			local = lb.balance
+			startHeight = lb.startHeight
+			endHeight = lb.endHeight
+		}
+		chain := chainBalances[address]
+
+		accountLocal = accountLocal.Add(local)
+		accountChain = accountChain.Add(chain)
+
+		if local.Equal(chain) {
+			continue
+		}
+
+		report.Drifts = append(report.Drifts, &AddressBalanceDrift{
+			Address:      address,
+			LocalBalance: local.StringFixed(dec),
+			ChainBalance: chain.StringFixed(dec),
+			Drift:        chain.Sub(local).StringFixed(dec),
+			StartHeight:  startHeight,
+			EndHeight:    endHeight,
+		})
+	}
+
+	report.AddressCount = len(searchAddrs)
+	report.LocalBalance = accountLocal.StringFixed(dec)
+	report.ChainBalance = accountChain.StringFixed(dec)
+	report.IsMatched = len(report.Drifts) == 0
+	report.ScannedHeight = scannedHeight
+
+	if rescan {
+		rescanStart, rescanEnd, needRescan := reconcileRescanRange(report.Drifts, scannedHeight, wm.cfg.ReconcileRescanMaxBlocks)
+		if needRescan {
+			log.Infof("account[%s] balance drift found, rescan block height from %d to %d", accountID, rescanStart, rescanEnd)
+			job, jobErr := wm.StartRescanJob(account.Symbol, rescanStart, rescanEnd)
+			if jobErr != nil {
+				log.Errorf("account[%s] start rescan job failed, unexpected error: %v", accountID, jobErr)
+			} else {
+				report.RescanStartHeight = rescanStart
+				report.RescanEndHeight = rescanEnd
+				report.RescanJobID = job.ID
+			}
+		}
+	}
+
+	//保存对账报告
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	err = db.Save(report)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+//ReconcileApp 对应用全部资产账户进行对账
+func (wm *WalletManager) ReconcileApp(appID string, rescan bool) ([]*ReconcileReport, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := wrapper.GetAssetsAccountList(0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*ReconcileReport, 0)
+	for _, account := range accounts {
+		report, recErr := wm.ReconcileAssetsAccount(appID, account.AccountID, rescan)
+		if recErr != nil {
+			log.Errorf("app[%s] account[%s] reconcile failed, unexpected error: %v", appID, account.AccountID, recErr)
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+//GetReconcileReports 查询对账报告
+func (wm *WalletManager) GetReconcileReports(appID string, offset, limit int, cols ...interface{}) ([]*ReconcileReport, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*ReconcileReport, 0)
+	err = wrapper.findRecords(&reports, offset, limit, cols...)
+	if err != nil {
+		return nil, fmt.Errorf("can not find reconcile reports")
+	}
+
+	return reports, nil
+}
+
+//StartReconcileTask 启动定时对账任务，对全部应用进行对账
+func (wm *WalletManager) StartReconcileTask(period time.Duration, rescan bool) {
+
+	wm.StopReconcileTask()
+
+	task := timer.NewTask(period, func() {
+		appIDs, err := wm.loadAllAppIDs()
+		if err != nil {
+			log.Error("reconcile task load apps failed, unexpected error:", err)
+			return
+		}
+		for _, appID := range appIDs {
+			reports, recErr := wm.ReconcileApp(appID, rescan)
+			if recErr != nil {
+				log.Errorf("app[%s] reconcile failed, unexpected error: %v", appID, recErr)
+				continue
+			}
+			for _, r := range reports {
+				if !r.IsMatched {
+					log.Warningf("app[%s] account[%s] balance drift: local = %s, chain = %s", appID, r.AccountID, r.LocalBalance, r.ChainBalance)
+				}
+			}
+		}
+	})
+
+	wm.mu.Lock()
+	wm.reconcileTask = task
+	wm.mu.Unlock()
+
+	task.Start()
+}
+
+//StopReconcileTask 停止定时对账任务
+func (wm *WalletManager) StopReconcileTask() {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.reconcileTask != nil {
+		wm.reconcileTask.Stop()
+		wm.reconcileTask = nil
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestSumLocalBalanceByAddress(t *testing.T) {
+
+	newOutput := func(address, amount string, height uint64, isContract bool) *openwallet.TxOutPut {
+		output := &openwallet.TxOutPut{}
+		output.Address = address
+		output.Amount = amount
+		output.BlockHeight = height
+		output.Coin.IsContract = isContract
+		return output
+	}
+
+	newInput := func(address, amount string, height uint64) *openwallet.TxInput {
+		input := &openwallet.TxInput{}
+		input.Address = address
+		input.Amount = amount
+		input.BlockHeight = height
+		return input
+	}
+
+	outputs := []*openwallet.TxOutPut{
+		newOutput("addr1", "1.5", 100, false),
+		newOutput("addr1", "0.5", 120, false),
+		newOutput("addr1", "99", 130, true),
+		newOutput("addr2", "3", 90, false),
+	}
+
+	inputs := []*openwallet.TxInput{
+		newInput("addr1", "0.25", 150),
+	}
+
+	pruned := []*PrunedBalance{
+		{Address: "addr2", Balance: "2", PrunedHeight: 80},
+		{Address: "addr2", ContractID: "token", Balance: "50", PrunedHeight: 80},
+	}
+
+	balances := sumLocalBalanceByAddress(inputs, outputs, pruned)
+
+	addr1 := balances["addr1"]
+	if addr1 == nil {
+		t.Errorf("addr1 balance not found")
+		return
+	}
+	if addr1.balance.String() != "1.75" {
+		t.Errorf("addr1 balance = %s, want 1.75", addr1.balance.String())
+	}
+	if addr1.startHeight != 100 || addr1.endHeight != 150 {
+		t.Errorf("addr1 height range = [%d, %d], want [100, 150]", addr1.startHeight, addr1.endHeight)
+	}
+
+	addr2 := balances["addr2"]
+	if addr2 == nil || addr2.balance.String() != "5" {
+		t.Errorf("addr2 balance is not correct")
+		return
+	}
+	if addr2.startHeight != 80 {
+		t.Errorf("addr2 start height = %d, want 80", addr2.startHeight)
+	}
+
+	log.Infof("balances: %+v", balances)
+}
+
+func TestReconcileRescanRange(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		drifts    []*AddressBalanceDrift
+		scanned   uint64
+		maxBlocks uint64
+		start     uint64
+		end       uint64
+		rescan    bool
+	}{
+		{"matched", nil, 1000, 100, 0, 0, false},
+		{"earliest record", []*AddressBalanceDrift{{StartHeight: 950}, {StartHeight: 920}}, 1000, 100, 920, 1000, true},
+		{"capped window", []*AddressBalanceDrift{{StartHeight: 10}}, 1000, 100, 901, 1000, true},
+		{"no local records", []*AddressBalanceDrift{{StartHeight: 0}}, 1000, 100, 901, 1000, true},
+		{"no local records unlimited", []*AddressBalanceDrift{{StartHeight: 0}}, 1000, 0, 1, 1000, true},
+		{"short chain", []*AddressBalanceDrift{{StartHeight: 0}}, 50, 100, 1, 50, true},
+		{"not scanned", []*AddressBalanceDrift{{StartHeight: 0}}, 0, 100, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		start, end, rescan := reconcileRescanRange(tt.drifts, tt.scanned, tt.maxBlocks)
+		if start != tt.start || end != tt.end || rescan != tt.rescan {
+			t.Errorf("%s: range = [%d, %d] %v, want [%d, %d] %v", tt.name, start, end, rescan, tt.start, tt.end, tt.rescan)
+		}
+	}
+}
+
+func TestNewReconcileReport(t *testing.T) {
+
+	account := &openwallet.AssetsAccount{AccountID: "account1", Symbol: "ETH"}
+
+	//同一秒内多次对账的报告ID不重复
+	report1 := newReconcileReport("app1", account)
+	report2 := newReconcileReport("app1", account)
+	if len(report1.ID) == 0 || report1.ID == report2.ID {
+		t.Errorf("report ID = %s, %s, want unique", report1.ID, report2.ID)
+	}
+}
@@ -0,0 +1,468 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/common/file"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/pborman/uuid"
+)
+
+const (
+	RescanJobStatusRunning   = "running"
+	RescanJobStatusPaused    = "paused"
+	RescanJobStatusCanceled  = "canceled"
+	RescanJobStatusCompleted = "completed"
+
+	//每扫描多少个区块保存一次进度
+	rescanJobSaveInterval = 100
+	//最多记录的失败区块高度
+	rescanJobMaxFailedHeights = 100
+)
+
+//RescanJob 区块范围重扫任务
+type RescanJob struct {
+	ID                string   `json:"id" storm:"id"`
+	Symbol            string   `json:"symbol" storm:"index"`
+	StartHeight       uint64   `json:"startHeight"`
+	EndHeight         uint64   `json:"endHeight"`
+	CurrentHeight     uint64   `json:"currentHeight"` //下一个待扫描的高度
+	ScannedBlocks     uint64   `json:"scannedBlocks"`
+	FoundTransactions uint64   `json:"foundTransactions"` //新发现的交易数，已保存过的交易不计算
+	Errors            uint64   `json:"errors"`
+	LastError         string   `json:"lastError"`
+	FailedHeights     []uint64 `json:"failedHeights"`
+	Status            string   `json:"status" storm:"index"`
+	CreateTime        int64    `json:"createTime"`
+	UpdateTime        int64    `json:"updateTime"`
+}
+
+//Progress 完成的百分比
+func (job *RescanJob) Progress() float64 {
+	total := job.EndHeight - job.StartHeight + 1
+	return float64(job.CurrentHeight-job.StartHeight) / float64(total) * 100
+}
+
+//IsFinished 任务是否已结束
+func (job *RescanJob) IsFinished() bool {
+	return job.Status == RescanJobStatusCompleted || job.Status == RescanJobStatusCanceled
+}
+
+//rescanJobRunner 运行中的重扫任务
+type rescanJobRunner struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	job  *RescanJob
+}
+
+func newRescanJobRunner(job *RescanJob) *rescanJobRunner {
+	runner := &rescanJobRunner{job: job}
+	runner.cond = sync.NewCond(&runner.mu)
+	return runner
+}
+
+//snapshot 复制任务状态
+func (runner *rescanJobRunner) snapshot() *RescanJob {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	job := *runner.job
+	job.FailedHeights = append([]uint64{}, runner.job.FailedHeights...)
+	return &job
+}
+
+//setStatus 修改任务状态并唤醒等待中的任务
+func (runner *rescanJobRunner) setStatus(status string) *RescanJob {
+	runner.mu.Lock()
+	runner.job.Status = status
+	runner.job.UpdateTime = time.Now().Unix()
+	runner.mu.Unlock()
+	runner.cond.Broadcast()
+	return runner.snapshot()
+}
+
+//JobDBFile 后台任务数据库文件
+func (wm *WalletManager) JobDBFile() string {
+	if len(wm.cfg.JobDBFile) > 0 {
+		return wm.cfg.JobDBFile
+	}
+	return filepath.Join(filepath.Dir(wm.cfg.DBPath), "jobs.db")
+}
+
+//openJobDB 打开后台任务数据库，首次打开时把上次未结束的任务标记为暂停
+func (wm *WalletManager) openJobDB() (*StormDB, error) {
+
+	wm.rescanMu.Lock()
+	defer wm.rescanMu.Unlock()
+
+	if wm.jobDB != nil && wm.jobDB.Opened {
+		return wm.jobDB, nil
+	}
+
+	file.MkdirAll(filepath.Dir(wm.JobDBFile()))
+	db, err := OpenStormDB(wm.JobDBFile(), appDBOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	var interrupted []*RescanJob
+	err = db.Find("Status", RescanJobStatusRunning, &interrupted)
+	if err != nil && err != storm.ErrNotFound {
+		db.Close()
+		return nil, err
+	}
+	for _, job := range interrupted {
+		if _, running := wm.rescanJobs[job.ID]; running {
+			continue
+		}
+		job.Status = RescanJobStatusPaused
+		job.UpdateTime = time.Now().Unix()
+		db.Save(job)
+		log.Warningf("rescan job[%s] was interrupted at height %d, resume it manually", job.ID, job.CurrentHeight)
+	}
+
+	wm.jobDB = db
+	return db, nil
+}
+
+func (wm *WalletManager) saveRescanJob(job *RescanJob) error {
+	db, err := wm.openJobDB()
+	if err != nil {
+		return err
+	}
+	return db.Save(job)
+}
+
+//StartRescanJob 创建后台重扫任务，与实时扫描并行运行
+func (wm *WalletManager) StartRescanJob(symbol string, startHeight, endHeight uint64) (*RescanJob, error) {
+
+	if startHeight > endHeight {
+		return nil, fmt.Errorf("start block height: %d is greater than end block height: %d", startHeight, endHeight)
+	}
+
+	scanner, err := wm.getBlockScanner(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	job := &RescanJob{
+		ID:            uuid.New(),
+		Symbol:        strings.ToUpper(symbol),
+		StartHeight:   startHeight,
+		EndHeight:     endHeight,
+		CurrentHeight: startHeight,
+		FailedHeights: make([]uint64, 0),
+		Status:        RescanJobStatusRunning,
+		CreateTime:    now,
+		UpdateTime:    now,
+	}
+
+	if err = wm.saveRescanJob(job); err != nil {
+		return nil, err
+	}
+
+	runner := newRescanJobRunner(job)
+	wm.rescanMu.Lock()
+	wm.rescanJobs[job.ID] = runner
+	wm.rescanMu.Unlock()
+
+	go wm.runRescanJob(runner, scanner)
+
+	log.Infof("rescan job[%s] started, %s [%d, %d]", job.ID, job.Symbol, startHeight, endHeight)
+
+	return runner.snapshot(), nil
+}
+
+func (wm *WalletManager) getBlockScanner(symbol string) (openwallet.BlockScanner, error) {
+	assetsMgr, err := GetAssetsAdapter(symbol)
+	if err != nil {
+		return nil, err
+	}
+	scanner := assetsMgr.GetBlockScanner()
+	if scanner == nil {
+		return nil, fmt.Errorf("%s is not support block scan", symbol)
+	}
+	return scanner, nil
+}
+
+//runRescanJob 逐个区块扫描，每次扫描前检查暂停及取消
+func (wm *WalletManager) runRescanJob(runner *rescanJobRunner, scanner openwallet.BlockScanner) {
+
+	defer func() {
+		wm.rescanMu.Lock()
+		delete(wm.rescanJobs, runner.job.ID)
+		wm.rescanMu.Unlock()
+	}()
+
+	for {
+		runner.mu.Lock()
+		for runner.job.Status == RescanJobStatusPaused {
+			runner.mu.Unlock()
+			wm.saveRescanJob(runner.snapshot())
+			runner.mu.Lock()
+			if runner.job.Status == RescanJobStatusPaused {
+				runner.cond.Wait()
+			}
+		}
+		if runner.job.Status == RescanJobStatusCanceled {
+			runner.mu.Unlock()
+			break
+		}
+		if runner.job.CurrentHeight > runner.job.EndHeight {
+			runner.job.Status = RescanJobStatusCompleted
+			runner.mu.Unlock()
+			break
+		}
+		height := runner.job.CurrentHeight
+		runner.mu.Unlock()
+
+		start := time.Now()
+		wm.beginRescanBlock(runner.job.Symbol, height, runner.job.ID)
+		err := scanner.ScanBlock(height)
+		wm.endRescanBlock(runner.job.Symbol, height, runner.job.ID)
+		metrics.ObserveBlockExtract(runner.job.Symbol, metrics.ExtractModeRescan, start)
+
+		runner.mu.Lock()
+		if err != nil {
+			runner.job.Errors++
+			runner.job.LastError = fmt.Sprintf("height %d: %v", height, err)
+			if len(runner.job.FailedHeights) < rescanJobMaxFailedHeights {
+				runner.job.FailedHeights = append(runner.job.FailedHeights, height)
+			}
+		}
+		runner.job.ScannedBlocks++
+		runner.job.CurrentHeight = height + 1
+		runner.job.UpdateTime = time.Now().Unix()
+		save := runner.job.ScannedBlocks%rescanJobSaveInterval == 0
+		runner.mu.Unlock()
+
+		if save {
+			wm.saveRescanJob(runner.snapshot())
+		}
+	}
+
+	job := runner.snapshot()
+	job.UpdateTime = time.Now().Unix()
+	if err := wm.saveRescanJob(job); err != nil {
+		log.Errorf("rescan job[%s] save failed, unexpected error: %v", job.ID, err)
+	}
+
+	log.Infof("rescan job[%s] %s, scanned: %d, found: %d, errors: %d",
+		job.ID, job.Status, job.ScannedBlocks, job.FoundTransactions, job.Errors)
+}
+
+func rescanBlockKey(symbol string, height uint64) string {
+	return fmt.Sprintf("%s_%d", strings.ToUpper(symbol), height)
+}
+
+//beginRescanBlock 标记区块正在被重扫，jobID为空是同步重扫
+func (wm *WalletManager) beginRescanBlock(symbol string, height uint64, jobID string) {
+	wm.rescanMu.Lock()
+	defer wm.rescanMu.Unlock()
+	key := rescanBlockKey(symbol, height)
+	wm.rescanBlocks[key] = append(wm.rescanBlocks[key], jobID)
+}
+
+//endRescanBlock 区块重扫完成
+func (wm *WalletManager) endRescanBlock(symbol string, height uint64, jobID string) {
+	wm.rescanMu.Lock()
+	defer wm.rescanMu.Unlock()
+	key := rescanBlockKey(symbol, height)
+	jobIDs := wm.rescanBlocks[key]
+	for i, id := range jobIDs {
+		if id == jobID {
+			jobIDs = append(jobIDs[:i], jobIDs[i+1:]...)
+			break
+		}
+	}
+	if len(jobIDs) == 0 {
+		delete(wm.rescanBlocks, key)
+	} else {
+		wm.rescanBlocks[key] = jobIDs
+	}
+}
+
+//rescanningBlock 区块是否正在被重扫，返回最先开始扫描该区块的重扫任务ID
+func (wm *WalletManager) rescanningBlock(symbol string, height uint64) (string, bool) {
+	wm.rescanMu.Lock()
+	defer wm.rescanMu.Unlock()
+	jobIDs, ok := wm.rescanBlocks[rescanBlockKey(symbol, height)]
+	if !ok {
+		return "", false
+	}
+	return jobIDs[0], true
+}
+
+//recordRescanFound 重扫提取到新交易时，计入该重扫任务
+func (wm *WalletManager) recordRescanFound(jobID string) {
+	wm.rescanMu.Lock()
+	runner, ok := wm.rescanJobs[jobID]
+	wm.rescanMu.Unlock()
+	if !ok {
+		return
+	}
+	runner.mu.Lock()
+	runner.job.FoundTransactions++
+	runner.mu.Unlock()
+}
+
+//PauseRescanJob 暂停重扫任务，当前区块扫描完成后暂停
+func (wm *WalletManager) PauseRescanJob(jobID string) (*RescanJob, error) {
+
+	wm.rescanMu.Lock()
+	runner, ok := wm.rescanJobs[jobID]
+	wm.rescanMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("rescan job[%s] is not running", jobID)
+	}
+
+	job := runner.setStatus(RescanJobStatusPaused)
+	return job, wm.saveRescanJob(job)
+}
+
+//ResumeRescanJob 继续已暂停的重扫任务，包括程序重启前未完成的任务
+func (wm *WalletManager) ResumeRescanJob(jobID string) (*RescanJob, error) {
+
+	wm.rescanMu.Lock()
+	runner, ok := wm.rescanJobs[jobID]
+	wm.rescanMu.Unlock()
+
+	if ok {
+		job := runner.setStatus(RescanJobStatusRunning)
+		return job, wm.saveRescanJob(job)
+	}
+
+	job, err := wm.GetRescanJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.IsFinished() {
+		return nil, fmt.Errorf("rescan job[%s] is %s", jobID, job.Status)
+	}
+
+	scanner, err := wm.getBlockScanner(job.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Status = RescanJobStatusRunning
+	job.UpdateTime = time.Now().Unix()
+	if err = wm.saveRescanJob(job); err != nil {
+		return nil, err
+	}
+
+	runner = newRescanJobRunner(job)
+	wm.rescanMu.Lock()
+	wm.rescanJobs[job.ID] = runner
+	wm.rescanMu.Unlock()
+
+	go wm.runRescanJob(runner, scanner)
+
+	return runner.snapshot(), nil
+}
+
+//CancelRescanJob 取消重扫任务
+func (wm *WalletManager) CancelRescanJob(jobID string) (*RescanJob, error) {
+
+	wm.rescanMu.Lock()
+	runner, ok := wm.rescanJobs[jobID]
+	wm.rescanMu.Unlock()
+
+	if ok {
+		job := runner.setStatus(RescanJobStatusCanceled)
+		return job, wm.saveRescanJob(job)
+	}
+
+	job, err := wm.GetRescanJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.IsFinished() {
+		return job, nil
+	}
+
+	job.Status = RescanJobStatusCanceled
+	job.UpdateTime = time.Now().Unix()
+	return job, wm.saveRescanJob(job)
+}
+
+//GetRescanJob 获取重扫任务，运行中的任务返回实时进度
+func (wm *WalletManager) GetRescanJob(jobID string) (*RescanJob, error) {
+
+	wm.rescanMu.Lock()
+	runner, ok := wm.rescanJobs[jobID]
+	wm.rescanMu.Unlock()
+
+	if ok {
+		return runner.snapshot(), nil
+	}
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var job RescanJob
+	err = db.One("ID", jobID, &job)
+	if err != nil {
+		return nil, fmt.Errorf("rescan job[%s] not found", jobID)
+	}
+
+	return &job, nil
+}
+
+//GetRescanJobs 获取重扫任务列表，按创建时间倒序
+func (wm *WalletManager) GetRescanJobs(offset, limit int) ([]*RescanJob, error) {
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*RescanJob, 0)
+	query := db.Select(q.True()).OrderBy("CreateTime").Reverse().Skip(offset)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err = query.Find(&jobs)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	//运行中的任务使用实时进度
+	wm.rescanMu.Lock()
+	for i, job := range jobs {
+		if runner, ok := wm.rescanJobs[job.ID]; ok {
+			jobs[i] = runner.snapshot()
+		}
+	}
+	wm.rescanMu.Unlock()
+
+	return jobs, nil
+}
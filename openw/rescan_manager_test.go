@@ -0,0 +1,194 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type rescanTestScanner struct {
+	*openwallet.BlockScannerBase
+	wm        *WalletManager
+	sourceKey string
+}
+
+func newRescanTestExtractData(height uint64) *openwallet.TxExtractData {
+	data := &openwallet.TxExtractData{
+		Transaction: &openwallet.Transaction{
+			TxID:        fmt.Sprintf("tx%d", height),
+			Coin:        openwallet.Coin{Symbol: "RSCN"},
+			BlockHash:   fmt.Sprintf("hash%d", height),
+			BlockHeight: height,
+		},
+	}
+	data.Transaction.WxID = openwallet.GenTransactionWxID(data.Transaction)
+	return data
+}
+
+//ScanBlock 每个区块耗时2毫秒，高度5提取到一笔交易，并重复通知一次
+func (bs *rescanTestScanner) ScanBlock(height uint64) error {
+	time.Sleep(2 * time.Millisecond)
+	if height == 5 {
+		data := newRescanTestExtractData(height)
+		bs.wm.BlockExtractDataNotify(bs.sourceKey, data)
+		bs.wm.BlockExtractDataNotify(bs.sourceKey, data)
+	}
+	if height == 7 {
+		return fmt.Errorf("node is busy")
+	}
+	return nil
+}
+
+type rescanTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	scanner *rescanTestScanner
+}
+
+func (a *rescanTestAdapter) GetBlockScanner() openwallet.BlockScanner {
+	return a.scanner
+}
+
+func waitRescanJob(wm *WalletManager, jobID string, done func(job *RescanJob) bool) *RescanJob {
+	for i := 0; i < 500; i++ {
+		job, _ := wm.GetRescanJob(jobID)
+		if job != nil && done(job) {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	job, _ := wm.GetRescanJob(jobID)
+	return job
+}
+
+func TestWalletManager_RescanJob(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_rescan")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.JobDBFile = filepath.Join(dir, "jobs.db")
+	cfg.SupportAssets = nil
+	wm := NewWalletManager(cfg)
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", Symbol: "RSCN"})
+
+	observer := &rollbackTestObserver{}
+	wm.AddObserver(observer)
+
+	RegAssets("RSCN", &rescanTestAdapter{scanner: &rescanTestScanner{
+		BlockScannerBase: openwallet.NewBlockScannerBase(),
+		wm:               wm,
+		sourceKey:        wm.encodeSourceKey("app1", "account1"),
+	}})
+
+	job, err := wm.StartRescanJob("RSCN", 1, 100)
+	if err != nil {
+		t.Errorf("StartRescanJob failed, unexpected error: %v", err)
+		return
+	}
+
+	job = waitRescanJob(wm, job.ID, func(job *RescanJob) bool { return job.CurrentHeight > 10 })
+	job, err = wm.PauseRescanJob(job.ID)
+	if err != nil {
+		t.Errorf("PauseRescanJob failed, unexpected error: %v", err)
+		return
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	paused, _ := wm.GetRescanJob(job.ID)
+	time.Sleep(20 * time.Millisecond)
+	pausedLater, _ := wm.GetRescanJob(job.ID)
+	if paused.CurrentHeight != pausedLater.CurrentHeight || pausedLater.Status != RescanJobStatusPaused {
+		t.Errorf("paused job is still scanning: %d -> %d", paused.CurrentHeight, pausedLater.CurrentHeight)
+	}
+
+	if _, err = wm.ResumeRescanJob(job.ID); err != nil {
+		t.Errorf("ResumeRescanJob failed, unexpected error: %v", err)
+		return
+	}
+
+	job = waitRescanJob(wm, job.ID, func(job *RescanJob) bool { return job.IsFinished() })
+	if job.Status != RescanJobStatusCompleted || job.ScannedBlocks != 100 {
+		t.Errorf("job = %s, scanned %d, want completed 100", job.Status, job.ScannedBlocks)
+	}
+	if job.FoundTransactions != 1 {
+		t.Errorf("found transactions = %d, want 1", job.FoundTransactions)
+	}
+	if job.Errors != 1 || len(job.FailedHeights) != 1 || job.FailedHeights[0] != 7 {
+		t.Errorf("job errors = %d, failed heights = %v, want [7]", job.Errors, job.FailedHeights)
+	}
+
+	//已保存的交易不再推送，重扫及实时扫描都只推送一次
+	if len(observer.extracted) != 1 {
+		t.Errorf("rescan pushed = %d, want 1", len(observer.extracted))
+	}
+	wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "account1"), newRescanTestExtractData(5))
+	if len(observer.extracted) != 1 {
+		t.Errorf("live duplicated pushed = %d, want 1", len(observer.extracted))
+	}
+	wm.RescanBlockHeight("RSCN", 5, 5)
+	if len(observer.extracted) != 1 {
+		t.Errorf("RescanBlockHeight pushed = %d, want 1", len(observer.extracted))
+	}
+
+	//没有交易的提取数据不处理
+	if err = wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "account1"), &openwallet.TxExtractData{}); err != nil {
+		t.Errorf("BlockExtractDataNotify without transaction, unexpected error: %v", err)
+	}
+
+	//取消任务
+	job, _ = wm.StartRescanJob("RSCN", 1, 1000)
+	job, err = wm.CancelRescanJob(job.ID)
+	if err != nil {
+		t.Errorf("CancelRescanJob failed, unexpected error: %v", err)
+		return
+	}
+	job = waitRescanJob(wm, job.ID, func(job *RescanJob) bool {
+		wm.rescanMu.Lock()
+		defer wm.rescanMu.Unlock()
+		_, running := wm.rescanJobs[job.ID]
+		return !running
+	})
+	if job.Status != RescanJobStatusCanceled || job.CurrentHeight > 10 {
+		t.Errorf("job = %s at %d, want canceled", job.Status, job.CurrentHeight)
+	}
+
+	jobs, err := wm.GetRescanJobs(0, -1)
+	if err != nil || len(jobs) != 2 {
+		t.Errorf("rescan jobs = %d, want 2, err: %v", len(jobs), err)
+	}
+
+	log.Infof("rescan job: %+v", job)
+}
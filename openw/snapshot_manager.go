@@ -0,0 +1,429 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	//SnapshotKindBlock 按区块间隔记录的快照
+	SnapshotKindBlock = "block"
+	//SnapshotKindDaily 每天记录的快照
+	SnapshotKindDaily = "daily"
+	//SnapshotKindComputed 查询时根据交易记录即时计算，不保存
+	SnapshotKindComputed = "computed"
+)
+
+//BalanceSnapshot 资产账户在某个区块高度的余额快照，ContractID为空是主币余额
+type BalanceSnapshot struct {
+	ID         string `json:"id" storm:"id"`
+	AccountID  string `json:"accountID" storm:"index"`
+	Symbol     string `json:"symbol"`
+	ContractID string `json:"contractID"`
+	Balance    string `json:"balance"`
+	Height     uint64 `json:"height" storm:"index"`
+	Time       int64  `json:"time" storm:"index"` //区块时间
+	Kind       string `json:"kind"`
+	CreateTime int64  `json:"createTime"`
+}
+
+func genBalanceSnapshotID(accountID, contractID string, height uint64) string {
+	return fmt.Sprintf("%s_%s_%d", accountID, contractID, height)
+}
+
+//ErrBalancePruned 查询高度的记录已被清理，无法根据交易记录计算余额
+var ErrBalancePruned = fmt.Errorf("records below the height have been pruned")
+
+//ComputeAccountBalances 根据本地出入账记录计算账户在某高度(包含)的余额，key为ContractID，空值是主币
+func (wrapper *WalletWrapper) ComputeAccountBalances(accountID string, height uint64) (map[string]decimal.Decimal, error) {
+
+	pruned, err := wrapper.GetPrunedBalances(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := map[string]decimal.Decimal{"": decimal.Zero}
+
+	for _, pb := range pruned {
+		//已清理记录只有低于清理高度的累计值，查询高度必须覆盖全部已清理记录
+		if pb.PrunedHeight > height+1 {
+			return nil, ErrBalancePruned
+		}
+		amount, _ := decimal.NewFromString(pb.Balance)
+		balances[pb.ContractID] = balances[pb.ContractID].Add(amount)
+	}
+
+	return wrapper.sumAccountRecords(balances, q.And(q.Eq("AccountID", accountID), q.Lte("BlockHeight", height)))
+}
+
+//ComputeAccountBalancesAtTime 根据本地已上链的出入账记录计算账户在某区块时间(包含)的余额，key为ContractID，空值是主币
+func (wrapper *WalletWrapper) ComputeAccountBalancesAtTime(accountID string, blockTime int64) (map[string]decimal.Decimal, error) {
+
+	pruned, err := wrapper.GetPrunedBalances(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	//已清理的累计值没有区块时间，无法判断是否早于查询时间
+	if len(pruned) > 0 {
+		return nil, ErrBalancePruned
+	}
+
+	balances := map[string]decimal.Decimal{"": decimal.Zero}
+
+	return wrapper.sumAccountRecords(balances, q.And(q.Eq("AccountID", accountID), q.Gt("BlockHeight", uint64(0)), q.Lte("CreateAt", blockTime)))
+}
+
+//sumAccountRecords 把满足条件的出入账记录累加到余额
+func (wrapper *WalletWrapper) sumAccountRecords(balances map[string]decimal.Decimal, matcher q.Matcher) (map[string]decimal.Decimal, error) {
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	err = db.Select(matcher).Each(new(openwallet.TxOutPut), func(record interface{}) error {
+		r := record.(*openwallet.TxOutPut)
+		amount, _ := decimal.NewFromString(r.Amount)
+		balances[r.Coin.ContractID] = balances[r.Coin.ContractID].Add(amount)
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	err = db.Select(matcher).Each(new(openwallet.TxInput), func(record interface{}) error {
+		r := record.(*openwallet.TxInput)
+		amount, _ := decimal.NewFromString(r.Amount)
+		balances[r.Coin.ContractID] = balances[r.Coin.ContractID].Sub(amount)
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return balances, nil
+}
+
+//newBalanceSnapshots 把计算结果转为快照，按ContractID排序
+func newBalanceSnapshots(account *openwallet.AssetsAccount, balances map[string]decimal.Decimal, height uint64, blockTime int64, kind string) []*BalanceSnapshot {
+
+	now := time.Now().Unix()
+	snapshots := make([]*BalanceSnapshot, 0, len(balances))
+	for contractID, balance := range balances {
+		snapshots = append(snapshots, &BalanceSnapshot{
+			ID:         genBalanceSnapshotID(account.AccountID, contractID, height),
+			AccountID:  account.AccountID,
+			Symbol:     account.Symbol,
+			ContractID: contractID,
+			Balance:    balance.String(),
+			Height:     height,
+			Time:       blockTime,
+			Kind:       kind,
+			CreateTime: now,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ContractID < snapshots[j].ContractID
+	})
+
+	return snapshots
+}
+
+//TakeBalanceSnapshot 记录账户在区块高度的余额快照
+func (wrapper *WalletWrapper) TakeBalanceSnapshot(accountID string, height uint64, blockTime int64, kind string) ([]*BalanceSnapshot, error) {
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	balances, err := wrapper.ComputeAccountBalances(accountID, height)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := newBalanceSnapshots(account, balances, height, blockTime, kind)
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, s := range snapshots {
+		if err = tx.Save(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return snapshots, tx.Commit()
+}
+
+//GetBalanceSnapshots 获取账户的余额快照记录
+func (wrapper *WalletWrapper) GetBalanceSnapshots(offset, limit int, cols ...interface{}) ([]*BalanceSnapshot, error) {
+	snapshots := make([]*BalanceSnapshot, 0)
+	err := wrapper.findRecords(&snapshots, offset, limit, cols...)
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+//latestBalanceSnapshots 查询满足条件的最近一次快照，返回该高度全部币种的快照
+func (wrapper *WalletWrapper) latestBalanceSnapshots(accountID string, matcher q.Matcher) ([]*BalanceSnapshot, error) {
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	var latest BalanceSnapshot
+	err = db.Select(q.Eq("AccountID", accountID), matcher).OrderBy("Height").Reverse().First(&latest)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			return nil, fmt.Errorf("no balance snapshot of account: %s", accountID)
+		}
+		return nil, err
+	}
+
+	snapshots := make([]*BalanceSnapshot, 0)
+	err = db.Select(q.Eq("AccountID", accountID), q.Eq("Height", latest.Height)).Find(&snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ContractID < snapshots[j].ContractID
+	})
+
+	return snapshots, nil
+}
+
+//GetBalanceSnapshots 获取资产账户的余额快照记录
+func (wm *WalletManager) GetBalanceSnapshots(appID, accountID string, offset, limit int) ([]*BalanceSnapshot, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapper.GetBalanceSnapshots(offset, limit, "AccountID", accountID)
+}
+
+//GetAccountBalanceAtHeight 查询资产账户在某区块高度的余额
+//优先根据本地交易记录计算，记录已被清理时使用不高于该高度的最近一次快照
+func (wm *WalletManager) GetAccountBalanceAtHeight(appID, accountID string, height uint64) ([]*BalanceSnapshot, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	balances, err := wrapper.ComputeAccountBalances(accountID, height)
+	if err == nil {
+		return newBalanceSnapshots(account, balances, height, 0, SnapshotKindComputed), nil
+	}
+	if err != ErrBalancePruned {
+		return nil, err
+	}
+
+	return wrapper.latestBalanceSnapshots(accountID, q.Lte("Height", height))
+}
+
+//GetAccountBalanceAtTime 查询资产账户在某时间的余额
+//优先根据区块时间不晚于该时间的已上链记录计算，记录已被清理时使用区块时间不晚于该时间的最近一次快照，
+//快照的Height及Time是余额实际对应的区块，精度取决于Config.SnapshotBlockInterval及Config.SnapshotDaily
+func (wm *WalletManager) GetAccountBalanceAtTime(appID, accountID string, t time.Time) ([]*BalanceSnapshot, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	balances, err := wrapper.ComputeAccountBalancesAtTime(accountID, t.Unix())
+	if err == nil {
+		return newBalanceSnapshots(account, balances, 0, t.Unix(), SnapshotKindComputed), nil
+	}
+	if err != ErrBalancePruned {
+		return nil, err
+	}
+
+	return wrapper.latestBalanceSnapshots(accountID, q.Lte("Time", t.Unix()))
+}
+
+//balanceSnapshotKind 判断新区块是否需要记录快照，返回快照类型，空值为不记录
+func (wm *WalletManager) balanceSnapshotKind(header *openwallet.BlockHeader) string {
+
+	kind := ""
+
+	if wm.cfg.SnapshotBlockInterval > 0 && header.Height%wm.cfg.SnapshotBlockInterval == 0 {
+		kind = SnapshotKindBlock
+	}
+
+	if wm.cfg.SnapshotDaily && header.Time > 0 {
+		day := time.Unix(int64(header.Time), 0).UTC().Format("20060102")
+		symbol := strings.ToUpper(header.Symbol)
+		wm.snapshotMu.Lock()
+		if wm.snapshotDays[symbol] != day {
+			//首次运行或跨日时记录
+			wm.snapshotDays[symbol] = day
+			kind = SnapshotKindDaily
+		}
+		wm.snapshotMu.Unlock()
+	}
+
+	return kind
+}
+
+//balanceSnapshotTask 待执行的快照任务
+type balanceSnapshotTask struct {
+	header openwallet.BlockHeader
+	kind   string
+}
+
+//enqueueBalanceSnapshots 新区块需要记录快照时加入该币种的队列，由后台协程按区块顺序执行
+func (wm *WalletManager) enqueueBalanceSnapshots(header *openwallet.BlockHeader) {
+
+	kind := wm.balanceSnapshotKind(header)
+	if len(kind) == 0 {
+		return
+	}
+
+	symbol := strings.ToUpper(header.Symbol)
+
+	wm.snapshotMu.Lock()
+	defer wm.snapshotMu.Unlock()
+
+	wm.snapshotQueue[symbol] = append(wm.snapshotQueue[symbol], &balanceSnapshotTask{header: *header, kind: kind})
+	if wm.snapshotRunning[symbol] {
+		return
+	}
+	wm.snapshotRunning[symbol] = true
+	wm.snapshotWG.Add(1)
+	go wm.runBalanceSnapshots(symbol)
+}
+
+//runBalanceSnapshots 执行币种队列中的快照任务，队列为空时退出
+func (wm *WalletManager) runBalanceSnapshots(symbol string) {
+
+	defer wm.snapshotWG.Done()
+
+	for {
+		wm.snapshotMu.Lock()
+		queue := wm.snapshotQueue[symbol]
+		if len(queue) == 0 {
+			delete(wm.snapshotQueue, symbol)
+			delete(wm.snapshotRunning, symbol)
+			wm.snapshotMu.Unlock()
+			return
+		}
+		task := queue[0]
+		wm.snapshotQueue[symbol] = queue[1:]
+		wm.snapshotMu.Unlock()
+
+		wm.takeBalanceSnapshots(&task.header, task.kind)
+	}
+}
+
+//dropBalanceSnapshots 分叉回滚时删除队列中该高度及以上未执行的快照任务
+func (wm *WalletManager) dropBalanceSnapshots(symbol string, height uint64) {
+
+	symbol = strings.ToUpper(symbol)
+
+	wm.snapshotMu.Lock()
+	defer wm.snapshotMu.Unlock()
+
+	queue := make([]*balanceSnapshotTask, 0, len(wm.snapshotQueue[symbol]))
+	for _, task := range wm.snapshotQueue[symbol] {
+		if task.header.Height < height {
+			queue = append(queue, task)
+		}
+	}
+	wm.snapshotQueue[symbol] = queue
+}
+
+//waitBalanceSnapshots 等待全部快照任务执行完成
+func (wm *WalletManager) waitBalanceSnapshots() {
+	wm.snapshotWG.Wait()
+}
+
+//takeBalanceSnapshots 为该币种的全部资产账户记录区块高度的余额快照
+func (wm *WalletManager) takeBalanceSnapshots(header *openwallet.BlockHeader, kind string) {
+
+	appIDs, err := wm.loadAllAppIDs()
+	if err != nil {
+		log.Errorf("balance snapshot load apps failed, unexpected error: %v", err)
+		return
+	}
+
+	for _, appID := range appIDs {
+
+		if !wm.isAppScanEnabled(appID, header.Symbol) {
+			continue
+		}
+
+		wrapper, err := wm.NewWalletWrapper(appID, "")
+		if err != nil {
+			log.Errorf("balance snapshot app[%s] failed, unexpected error: %v", appID, err)
+			continue
+		}
+
+		accounts, err := wrapper.GetAssetsAccountList(0, -1)
+		if err != nil {
+			continue
+		}
+
+		for _, account := range accounts {
+			if !strings.EqualFold(account.Symbol, header.Symbol) {
+				continue
+			}
+			_, err = wrapper.TakeBalanceSnapshot(account.AccountID, header.Height, int64(header.Time), kind)
+			if err != nil {
+				log.Errorf("balance snapshot account[%s] at height %d failed, unexpected error: %v", account.AccountID, header.Height, err)
+			}
+		}
+	}
+}
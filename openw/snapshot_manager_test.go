@@ -0,0 +1,133 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestWalletManager_BalanceSnapshot(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_snapshot")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.SupportAssets = nil
+	cfg.SnapshotBlockInterval = 10
+	wm := NewWalletManager(cfg)
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", Symbol: "ETH"})
+
+	blockTime := time.Date(2020, 1, 31, 23, 0, 0, 0, time.UTC)
+
+	//每个区块入账1，合约代币入账2，偶数区块出账0.5
+	for i := uint64(1); i <= 20; i++ {
+		output := &openwallet.TxOutPut{}
+		output.Sid = fmt.Sprintf("out%d", i)
+		output.AccountID = "account1"
+		output.Amount = "1"
+		output.BlockHeight = i
+		output.CreateAt = blockTime.Unix() + int64(i)
+		output.Coin = openwallet.Coin{Symbol: "ETH"}
+		db.Save(output)
+
+		token := &openwallet.TxOutPut{}
+		token.Sid = fmt.Sprintf("token%d", i)
+		token.AccountID = "account1"
+		token.Amount = "2"
+		token.BlockHeight = i
+		token.CreateAt = blockTime.Unix() + int64(i)
+		token.Coin = openwallet.Coin{Symbol: "ETH", IsContract: true, ContractID: "usdt"}
+		db.Save(token)
+
+		if i%2 == 0 {
+			input := &openwallet.TxInput{}
+			input.Sid = fmt.Sprintf("in%d", i)
+			input.AccountID = "account1"
+			input.Amount = "0.5"
+			input.BlockHeight = i
+			input.CreateAt = blockTime.Unix() + int64(i)
+			input.Coin = openwallet.Coin{Symbol: "ETH"}
+			db.Save(input)
+		}
+	}
+
+	for i := uint64(1); i <= 20; i++ {
+		wm.BlockScanNotify(&openwallet.BlockHeader{Height: i, Symbol: "ETH", Time: uint64(blockTime.Unix()) + i})
+	}
+	wm.waitBalanceSnapshots()
+
+	snapshots, err := wm.GetBalanceSnapshots("app1", "account1", 0, -1)
+	if err != nil || len(snapshots) != 4 {
+		t.Errorf("snapshots = %d, want 4, err: %v", len(snapshots), err)
+		return
+	}
+
+	balances, err := wm.GetAccountBalanceAtHeight("app1", "account1", 15)
+	if err != nil || len(balances) != 2 {
+		t.Errorf("GetAccountBalanceAtHeight failed, unexpected error: %v", err)
+		return
+	}
+	if balances[0].Balance != "11.5" || balances[1].Balance != "30" {
+		t.Errorf("balance at 15 = %s, %s, want 11.5, 30", balances[0].Balance, balances[1].Balance)
+	}
+
+	balances, err = wm.GetAccountBalanceAtTime("app1", "account1", blockTime.Add(15*time.Second))
+	if err != nil || len(balances) != 2 {
+		t.Errorf("GetAccountBalanceAtTime failed, unexpected error: %v", err)
+		return
+	}
+	if balances[0].Kind != SnapshotKindComputed || balances[0].Balance != "11.5" || balances[1].Balance != "30" {
+		t.Errorf("balance at time = %s, %s (%s), want computed 11.5, 30", balances[0].Balance, balances[1].Balance, balances[0].Kind)
+	}
+
+	//记录已被清理时使用最近一次快照，返回快照对应的区块
+	db.Save(&PrunedBalance{ID: "pruned1", AccountID: "account1", Symbol: "ETH", Balance: "0", PrunedHeight: 1})
+	balances, err = wm.GetAccountBalanceAtTime("app1", "account1", blockTime.Add(15*time.Second))
+	if err != nil || len(balances) != 2 {
+		t.Errorf("GetAccountBalanceAtTime failed, unexpected error: %v", err)
+		return
+	}
+	if balances[0].Kind != SnapshotKindBlock || balances[0].Height != 10 || balances[0].Time != blockTime.Unix()+10 || balances[0].Balance != "7.5" {
+		t.Errorf("balance at time = %s at %d (%d), want 7.5 at 10", balances[0].Balance, balances[0].Height, balances[0].Time)
+	}
+
+	//没有早于查询时间的快照
+	if _, err = wm.GetAccountBalanceAtTime("app1", "account1", blockTime); err == nil {
+		t.Errorf("GetAccountBalanceAtTime before any snapshot should fail")
+	}
+
+	log.Infof("balances: %+v", balances[0])
+}
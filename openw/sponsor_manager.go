@@ -0,0 +1,468 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/pborman/uuid"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	SponsoredTransferStatusFunding   = "funding"   //已广播手续费充值，等待确认
+	SponsoredTransferStatusReady     = "ready"     //代币转账交易单已创建，等待签名广播
+	SponsoredTransferStatusSubmitted = "submitted" //代币转账已广播，等待确认
+	SponsoredTransferStatusCompleted = "completed" //代币转账已确认
+	SponsoredTransferStatusFailed    = "failed"    //创建代币转账失败，或发送地址不是被充值的地址
+	SponsoredTransferStatusUnknown   = "unknown"   //手续费充值或代币转账超时未上链，需要人工确认，之后上链仍会推进
+)
+
+//SponsoredTransferNotificationObject 可选的观察者接口，接收代付手续费转账的状态变化
+type SponsoredTransferNotificationObject interface {
+
+	//SponsoredTransferNotify 状态变为ready时，需要调用方签名RawTx后通过SubmitSponsoredTransfer广播
+	SponsoredTransferNotify(transfer *SponsoredTransfer) error
+}
+
+//SponsoredTransfer 代付手续费的代币转账，手续费充值和代币转账作为一个操作跟踪
+type SponsoredTransfer struct {
+	ID              string                     `json:"id" storm:"id"`
+	WalletID        string                     `json:"walletID"`
+	AccountID       string                     `json:"accountID"`
+	Symbol          string                     `json:"symbol"`
+	Contract        openwallet.SmartContract   `json:"contract"`
+	Amount          string                     `json:"amount"`
+	To              string                     `json:"to"`
+	FeeRate         string                     `json:"feeRate"`
+	Memo            string                     `json:"memo"`
+	FeePayerAccount string                     `json:"feePayerAccount"` //提供手续费的账户
+	FeePayerAddress string                     `json:"feePayerAddress"` //被充值手续费的发送地址
+	TopUpAmount     string                     `json:"topUpAmount"`     //充值的主币数量，0为不需要充值
+	TopUpTxID       string                     `json:"topUpTxID" storm:"index"`
+	TransferTxID    string                     `json:"transferTxID" storm:"index"`
+	RawTx           *openwallet.RawTransaction `json:"rawTx"` //代币转账交易单
+	Status          string                     `json:"status" storm:"index"`
+	Reason          string                     `json:"reason"`
+	CreateTime      int64                      `json:"createTime"`
+	UpdateTime      int64                      `json:"updateTime"`
+}
+
+//CreateSponsoredTransaction 创建代币转账，发送地址主币不足支付手续费时，由sponsor账户充值手续费
+//充值交易自动签名广播，确认后创建代币转账交易单并推送SponsoredTransferNotify
+//@param sponsor 提供手续费的账户，FixSupportAmount为每次充值的主币数量
+//@param sponsorPassword 提供手续费账户所在钱包的密码
+func (wm *WalletManager) CreateSponsoredTransaction(appID, walletID, accountID, amount, address, feeRate, memo string, contract *openwallet.SmartContract, sponsor *openwallet.FeesSupportAccount, sponsorPassword string) (*SponsoredTransfer, error) {
+
+	if contract == nil {
+		return nil, openwallet.Errorf(openwallet.ErrContractCallMsgInvalid, "sponsored transfer need token contract")
+	}
+
+	if sponsor == nil || len(sponsor.AccountID) == 0 {
+		return nil, fmt.Errorf("fees support account is empty")
+	}
+
+	topUpAmount, _ := decimal.NewFromString(sponsor.FixSupportAmount)
+	if !topUpAmount.IsPositive() {
+		return nil, fmt.Errorf("fees support account fixSupportAmount is invalid")
+	}
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	sponsorAccount, err := wrapper.GetAssetsAccountInfo(sponsor.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	if sponsorAccount.Symbol != account.Symbol {
+		return nil, fmt.Errorf("fees support account symbol[%s] is not match [%s]", sponsorAccount.Symbol, account.Symbol)
+	}
+
+	wm.fillSmartContract(account.Symbol, contract)
+
+	now := time.Now().Unix()
+	transfer := &SponsoredTransfer{
+		ID:              uuid.New(),
+		WalletID:        walletID,
+		AccountID:       accountID,
+		Symbol:          account.Symbol,
+		Contract:        *contract,
+		Amount:          amount,
+		To:              address,
+		FeeRate:         feeRate,
+		Memo:            memo,
+		FeePayerAccount: sponsor.AccountID,
+		TopUpAmount:     "0",
+		CreateTime:      now,
+		UpdateTime:      now,
+	}
+
+	//主币足够支付手续费，直接创建代币转账
+	rawTx, err := wm.CreateTransaction(appID, walletID, accountID, amount, address, feeRate, memo, contract)
+	if err == nil {
+		transfer.RawTx = rawTx
+		transfer.Status = SponsoredTransferStatusReady
+		if err = wm.saveSponsoredTransfer(appID, transfer); err != nil {
+			return nil, err
+		}
+		return transfer, nil
+	}
+
+	if openwallet.ConvertError(err).Code() != openwallet.ErrInsufficientFees {
+		return nil, err
+	}
+
+	//找出持有足够代币的发送地址，由提供手续费的账户充值
+	feeAddress, err := wm.sponsoredFeeAddress(wrapper, account, contract, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	topUpTx, err := wm.CreateTransaction(appID, sponsorAccount.WalletID, sponsorAccount.AccountID, topUpAmount.String(), feeAddress, feeRate, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	topUpTx, err = wm.SignTransaction(appID, sponsorAccount.WalletID, sponsorAccount.AccountID, sponsorPassword, topUpTx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := wm.SubmitTransaction(appID, sponsorAccount.WalletID, sponsorAccount.AccountID, topUpTx)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer.FeePayerAddress = feeAddress
+	transfer.TopUpAmount = topUpAmount.String()
+	transfer.TopUpTxID = tx.TxID
+	transfer.Status = SponsoredTransferStatusFunding
+
+	if err = wm.saveSponsoredTransfer(appID, transfer); err != nil {
+		return nil, err
+	}
+
+	log.Infof("[%s] fees top up[%s] for address[%s] has been submitted", account.Symbol, tx.TxID, feeAddress)
+
+	return transfer, nil
+}
+
+//SubmitSponsoredTransfer 广播已签名的代币转账交易单
+func (wm *WalletManager) SubmitSponsoredTransfer(appID, transferID string, rawTx *openwallet.RawTransaction) (*SponsoredTransfer, error) {
+
+	transfer, err := wm.GetSponsoredTransfer(appID, transferID)
+	if err != nil {
+		return nil, err
+	}
+
+	if transfer.Status != SponsoredTransferStatusReady {
+		return nil, fmt.Errorf("sponsored transfer[%s] status is %s, can not submit", transferID, transfer.Status)
+	}
+
+	tx, err := wm.SubmitTransaction(appID, transfer.WalletID, transfer.AccountID, rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer.RawTx = rawTx
+	transfer.TransferTxID = tx.TxID
+	transfer.Status = SponsoredTransferStatusSubmitted
+	transfer.UpdateTime = time.Now().Unix()
+
+	if err = wm.saveSponsoredTransfer(appID, transfer); err != nil {
+		return nil, err
+	}
+
+	return transfer, nil
+}
+
+//GetSponsoredTransfer 获取代付手续费的代币转账
+func (wm *WalletManager) GetSponsoredTransfer(appID, transferID string) (*SponsoredTransfer, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	var transfer SponsoredTransfer
+	err = db.One("ID", transferID, &transfer)
+	if err != nil {
+		return nil, fmt.Errorf("sponsored transfer[%s] is not found", transferID)
+	}
+
+	return &transfer, nil
+}
+
+//GetSponsoredTransfers 获取应用的代付手续费转账，status为空时返回全部
+func (wm *WalletManager) GetSponsoredTransfers(appID, status string) ([]*SponsoredTransfer, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	var transfers []*SponsoredTransfer
+	if len(status) > 0 {
+		err = db.Find("Status", status, &transfers)
+	} else {
+		err = db.All(&transfers)
+	}
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return transfers, nil
+}
+
+func (wm *WalletManager) saveSponsoredTransfer(appID string, transfer *SponsoredTransfer) error {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return err
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return err
+	}
+	defer wrapper.CloseDB()
+
+	return db.Save(transfer)
+}
+
+//sponsoredFeeAddress 账户中代币余额足够转账的地址，账户模型使用账户别名
+func (wm *WalletManager) sponsoredFeeAddress(wrapper *WalletWrapper, account *openwallet.AssetsAccount, contract *openwallet.SmartContract, amount string) (string, error) {
+
+	assetsMgr, err := GetAssetsAdapter(account.Symbol)
+	if err != nil {
+		return "", err
+	}
+
+	if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilitySmartContract); capErr != nil {
+		return "", capErr
+	}
+
+	decoder := assetsMgr.GetSmartContractDecoder()
+	if decoder == nil {
+		return "", openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] is not support %s", account.Symbol, openwallet.CapabilitySmartContract)
+	}
+
+	addrs, err := wm.tokenBalanceAddresses(wrapper, assetsMgr, account)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", openwallet.Errorf(openwallet.ErrAddressNotFound, "account[%s] has no address", account.AccountID)
+	}
+
+	balances, err := decoder.GetTokenBalanceByAddress(*contract, addrs...)
+	if err != nil {
+		return "", err
+	}
+
+	need, _ := decimal.NewFromString(amount)
+	for _, b := range balances {
+		if b == nil || b.Balance == nil {
+			continue
+		}
+		balance, _ := decimal.NewFromString(b.Balance.Balance)
+		if balance.GreaterThanOrEqual(need) {
+			return b.Balance.Address, nil
+		}
+	}
+
+	return "", openwallet.Errorf(openwallet.ErrInsufficientTokenBalanceOfAddress, "account[%s] has no address with enough token balance", account.AccountID)
+}
+
+//advanceSponsoredTransfers 区块提取到手续费充值或代币转账时，推进代付转账的状态
+func (wm *WalletManager) advanceSponsoredTransfers(appID string, tx *openwallet.Transaction) {
+
+	if tx == nil || len(tx.TxID) == 0 {
+		return
+	}
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return
+	}
+
+	var funding, submitted []*SponsoredTransfer
+	db.Find("TopUpTxID", tx.TxID, &funding)
+	db.Find("TransferTxID", tx.TxID, &submitted)
+	wrapper.CloseDB()
+
+	//内存池中的交易不推进状态，等待上链
+	if tx.BlockHeight == 0 {
+		return
+	}
+
+	//超时标记为unknown的交易仍可能上链，以区块数据为准
+	for _, transfer := range submitted {
+		if transfer.Status != SponsoredTransferStatusSubmitted && transfer.Status != SponsoredTransferStatusUnknown {
+			continue
+		}
+		transfer.Status = SponsoredTransferStatusCompleted
+		transfer.Reason = ""
+		wm.updateSponsoredTransfer(appID, transfer)
+	}
+
+	for _, transfer := range funding {
+		if transfer.Status != SponsoredTransferStatusFunding &&
+			!(transfer.Status == SponsoredTransferStatusUnknown && len(transfer.TransferTxID) == 0) {
+			continue
+		}
+		transfer.Reason = ""
+
+		//手续费已到账，创建代币转账交易单
+		contract := transfer.Contract
+		rawTx, createErr := wm.CreateTransaction(appID, transfer.WalletID, transfer.AccountID, transfer.Amount, transfer.To, transfer.FeeRate, transfer.Memo, &contract)
+		if createErr == nil && !rawTxSentFrom(rawTx, transfer.FeePayerAddress) {
+			createErr = fmt.Errorf("token transaction is not sent from fee payer address[%s], txFrom: %v", transfer.FeePayerAddress, rawTx.TxFrom)
+		}
+		if createErr != nil {
+			log.Errorf("sponsored transfer[%s] create token transaction failed, unexpected error: %v", transfer.ID, createErr)
+			transfer.Status = SponsoredTransferStatusFailed
+			transfer.Reason = createErr.Error()
+		} else {
+			transfer.RawTx = rawTx
+			transfer.Status = SponsoredTransferStatusReady
+		}
+		wm.updateSponsoredTransfer(appID, transfer)
+	}
+}
+
+//unknownSponsoredTransfers 手续费充值或代币转账超时未上链，相关代付转账标记为unknown
+func (wm *WalletManager) unknownSponsoredTransfers(appID string, lifecycle *TxLifecycle) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return
+	}
+
+	var funding, submitted []*SponsoredTransfer
+	db.Select(q.Eq("TopUpTxID", lifecycle.TxID), q.Eq("Status", SponsoredTransferStatusFunding)).Find(&funding)
+	db.Select(q.Eq("TransferTxID", lifecycle.TxID), q.Eq("Status", SponsoredTransferStatusSubmitted)).Find(&submitted)
+	wrapper.CloseDB()
+
+	for _, transfer := range append(funding, submitted...) {
+		transfer.Status = SponsoredTransferStatusUnknown
+		transfer.Reason = fmt.Sprintf("transaction[%s] is %s: %s", lifecycle.TxID, lifecycle.Status, lifecycle.Reason)
+		wm.updateSponsoredTransfer(appID, transfer)
+	}
+}
+
+//revertSponsoredTransfers 交易所在区块因分叉被回滚，已完成的代币转账恢复为submitted
+//手续费充值被回滚且代币转账未广播的恢复为funding，等待充值重新确认
+func (wm *WalletManager) revertSponsoredTransfers(appID string, txids []string) {
+
+	if len(txids) == 0 {
+		return
+	}
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return
+	}
+
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return
+	}
+
+	var completed, ready []*SponsoredTransfer
+	db.Select(q.In("TransferTxID", txids), q.Eq("Status", SponsoredTransferStatusCompleted)).Find(&completed)
+	db.Select(q.In("TopUpTxID", txids), q.Eq("Status", SponsoredTransferStatusReady)).Find(&ready)
+	wrapper.CloseDB()
+
+	for _, transfer := range completed {
+		transfer.Status = SponsoredTransferStatusSubmitted
+		wm.updateSponsoredTransfer(appID, transfer)
+	}
+
+	for _, transfer := range ready {
+		transfer.Status = SponsoredTransferStatusFunding
+		transfer.RawTx = nil
+		wm.updateSponsoredTransfer(appID, transfer)
+	}
+}
+
+//rawTxSentFrom 交易单的发送地址是否都是指定地址，TxFrom格式为"地址:数量"
+func rawTxSentFrom(rawTx *openwallet.RawTransaction, address string) bool {
+	if rawTx == nil || len(rawTx.TxFrom) == 0 {
+		return false
+	}
+	for _, from := range rawTx.TxFrom {
+		if i := strings.LastIndex(from, ":"); i >= 0 {
+			from = from[:i]
+		}
+		if !strings.EqualFold(from, address) {
+			return false
+		}
+	}
+	return true
+}
+
+//updateSponsoredTransfer 保存状态变化并推送给观察者
+func (wm *WalletManager) updateSponsoredTransfer(appID string, transfer *SponsoredTransfer) {
+
+	transfer.UpdateTime = time.Now().Unix()
+	if err := wm.saveSponsoredTransfer(appID, transfer); err != nil {
+		log.Errorf("save sponsored transfer[%s] failed, unexpected error: %v", transfer.ID, err)
+		return
+	}
+
+	for o, _ := range wm.observers {
+		if so, ok := o.(SponsoredTransferNotificationObject); ok {
+			so.SponsoredTransferNotify(transfer)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type sponsorTestTxDecoder struct {
+	openwallet.TransactionDecoderBase
+	funded    bool
+	from      string
+	submitted []*openwallet.RawTransaction
+}
+
+func (d *sponsorTestTxDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	if rawTx.Coin.IsContract && !d.funded {
+		return openwallet.Errorf(openwallet.ErrInsufficientFees, "insufficient fees")
+	}
+	rawTx.RawHex = "raw"
+	if rawTx.Coin.IsContract {
+		for _, amount := range rawTx.To {
+			rawTx.TxFrom = []string{d.from + ":" + amount}
+		}
+	}
+	return nil
+}
+
+func (d *sponsorTestTxDecoder) SignRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	rawTx.IsCompleted = true
+	return nil
+}
+
+func (d *sponsorTestTxDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+	d.submitted = append(d.submitted, rawTx)
+	txid := "topup_tx"
+	if rawTx.Coin.IsContract {
+		txid = "transfer_tx"
+	}
+	tx := &openwallet.Transaction{TxID: txid, Coin: rawTx.Coin}
+	tx.WxID = openwallet.GenTransactionWxID(tx)
+	return tx, nil
+}
+
+type sponsorTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	txDecoder *sponsorTestTxDecoder
+	scDecoder *tokenBalanceTestDecoder
+}
+
+func (a *sponsorTestAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	return a.txDecoder
+}
+
+func (a *sponsorTestAdapter) GetSmartContractDecoder() openwallet.SmartContractDecoder {
+	return a.scDecoder
+}
+
+type sponsorTestObserver struct {
+	rollbackTestObserver
+	transfers []*SponsoredTransfer
+}
+
+func (o *sponsorTestObserver) SponsoredTransferNotify(transfer *SponsoredTransfer) error {
+	o.transfers = append(o.transfers, transfer)
+	return nil
+}
+
+func TestWalletManager_CreateSponsoredTransaction(t *testing.T) {
+
+	adapter := &sponsorTestAdapter{
+		txDecoder: &sponsorTestTxDecoder{},
+		scDecoder: &tokenBalanceTestDecoder{
+			balances: map[string]string{"0xtoken:addr2": "50"},
+		},
+	}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"SPNS": adapter})
+	defer cleanup()
+
+	observer := &sponsorTestObserver{}
+	wm.AddObserver(observer)
+
+	newTestAccount(t, wm, "SPNS", "payer")
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "sender", WalletID: "w2", Symbol: "SPNS"})
+	db.Save(&openwallet.Address{Address: "addr1", AccountID: "sender", Symbol: "SPNS"})
+	db.Save(&openwallet.Address{Address: "addr2", AccountID: "sender", Symbol: "SPNS"})
+
+	contract := &openwallet.SmartContract{Symbol: "SPNS", Address: "0xtoken", Decimals: 2}
+	sponsor := &openwallet.FeesSupportAccount{AccountID: "payer", FixSupportAmount: "0.01"}
+
+	transfer, err := wm.CreateSponsoredTransaction("app1", "w2", "sender", "10", "receiver", "", "", contract, sponsor, testWalletPassword)
+	if err != nil {
+		t.Errorf("CreateSponsoredTransaction failed, unexpected error: %v", err)
+		return
+	}
+
+	if transfer.Status != SponsoredTransferStatusFunding || transfer.TopUpTxID != "topup_tx" {
+		t.Errorf("transfer status = %s, topUpTxID = %s", transfer.Status, transfer.TopUpTxID)
+		return
+	}
+	if transfer.FeePayerAddress != "addr2" {
+		t.Errorf("fee payer address = %s, want addr2", transfer.FeePayerAddress)
+	}
+	if len(adapter.txDecoder.submitted) != 1 || adapter.txDecoder.submitted[0].To["addr2"] != "0.01" {
+		t.Errorf("top up transaction is not submitted")
+		return
+	}
+
+	//充值在内存池中不推进状态
+	adapter.txDecoder.funded = true
+	adapter.txDecoder.from = "addr2"
+	pendingTopUp := &openwallet.Transaction{TxID: "topup_tx", Coin: openwallet.Coin{Symbol: "SPNS"}}
+	pendingTopUp.WxID = openwallet.GenTransactionWxID(pendingTopUp)
+	wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "sender"), &openwallet.TxExtractData{Transaction: pendingTopUp})
+	if transfer, _ = wm.GetSponsoredTransfer("app1", transfer.ID); transfer.Status != SponsoredTransferStatusFunding {
+		t.Errorf("transfer status = %s before top up confirmed, want funding", transfer.Status)
+		return
+	}
+
+	//充值确认后创建代币转账
+	topUp := &openwallet.Transaction{TxID: "topup_tx", Coin: openwallet.Coin{Symbol: "SPNS"}, BlockHash: "hash10", BlockHeight: 10}
+	topUp.WxID = openwallet.GenTransactionWxID(topUp)
+	wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "sender"), &openwallet.TxExtractData{Transaction: topUp})
+
+	transfer, err = wm.GetSponsoredTransfer("app1", transfer.ID)
+	if err != nil {
+		t.Errorf("GetSponsoredTransfer failed, unexpected error: %v", err)
+		return
+	}
+	if transfer.Status != SponsoredTransferStatusReady || transfer.RawTx == nil {
+		t.Errorf("transfer status = %s, want ready", transfer.Status)
+		return
+	}
+	if len(observer.transfers) != 1 {
+		t.Errorf("observer notified = %d, want 1", len(observer.transfers))
+	}
+
+	//充值所在区块被回滚，未广播的代币转账恢复为funding，新分支确认后重新创建
+	if err = wm.RollbackBlockData("SPNS", 10); err != nil {
+		t.Errorf("RollbackBlockData failed, unexpected error: %v", err)
+		return
+	}
+	if transfer, _ = wm.GetSponsoredTransfer("app1", transfer.ID); transfer.Status != SponsoredTransferStatusFunding || transfer.RawTx != nil {
+		t.Errorf("transfer status = %s after rollback, want funding", transfer.Status)
+		return
+	}
+	wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "sender"), &openwallet.TxExtractData{Transaction: topUp})
+	if transfer, _ = wm.GetSponsoredTransfer("app1", transfer.ID); transfer.Status != SponsoredTransferStatusReady {
+		t.Errorf("transfer status = %s, want ready", transfer.Status)
+		return
+	}
+
+	transfer, err = wm.SubmitSponsoredTransfer("app1", transfer.ID, transfer.RawTx)
+	if err != nil {
+		t.Errorf("SubmitSponsoredTransfer failed, unexpected error: %v", err)
+		return
+	}
+
+	tokenTx := &openwallet.Transaction{TxID: "transfer_tx", Coin: transfer.RawTx.Coin, BlockHash: "hash11", BlockHeight: 11}
+	tokenTx.WxID = openwallet.GenTransactionWxID(tokenTx)
+	wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "sender"), &openwallet.TxExtractData{Transaction: tokenTx})
+
+	completed, err := wm.GetSponsoredTransfers("app1", SponsoredTransferStatusCompleted)
+	if err != nil {
+		t.Errorf("GetSponsoredTransfers failed, unexpected error: %v", err)
+		return
+	}
+	if len(completed) != 1 || completed[0].TransferTxID != "transfer_tx" {
+		t.Errorf("completed transfers = %d", len(completed))
+		return
+	}
+
+	//代币转账所在区块被回滚，恢复为submitted
+	if err = wm.RollbackBlockData("SPNS", 11); err != nil {
+		t.Errorf("RollbackBlockData failed, unexpected error: %v", err)
+		return
+	}
+	if transfer, _ = wm.GetSponsoredTransfer("app1", transfer.ID); transfer.Status != SponsoredTransferStatusSubmitted {
+		t.Errorf("transfer status = %s after rollback, want submitted", transfer.Status)
+	}
+}
+
+func TestWalletManager_SponsoredTransferFromOtherAddress(t *testing.T) {
+
+	adapter := &sponsorTestAdapter{txDecoder: &sponsorTestTxDecoder{}, scDecoder: &tokenBalanceTestDecoder{}}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"SPNS": adapter})
+	defer cleanup()
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "sender", WalletID: "w2", Symbol: "SPNS"})
+
+	wm.saveSponsoredTransfer("app1", &SponsoredTransfer{
+		ID:              "transfer1",
+		WalletID:        "w2",
+		AccountID:       "sender",
+		Symbol:          "SPNS",
+		Contract:        openwallet.SmartContract{Symbol: "SPNS", Address: "0xtoken"},
+		Amount:          "10",
+		To:              "receiver",
+		FeePayerAddress: "addr2",
+		TopUpTxID:       "topup_tx",
+		Status:          SponsoredTransferStatusFunding,
+	})
+
+	//代币转账选择了没有充值手续费的地址
+	adapter.txDecoder.funded = true
+	adapter.txDecoder.from = "addr1"
+	topUp := &openwallet.Transaction{TxID: "topup_tx", Coin: openwallet.Coin{Symbol: "SPNS"}, BlockHash: "hash10", BlockHeight: 10}
+	wm.advanceSponsoredTransfers("app1", topUp)
+
+	transfer, err := wm.GetSponsoredTransfer("app1", "transfer1")
+	if err != nil {
+		t.Errorf("GetSponsoredTransfer failed, unexpected error: %v", err)
+		return
+	}
+	if transfer.Status != SponsoredTransferStatusFailed || transfer.RawTx != nil {
+		t.Errorf("transfer status = %s, want failed", transfer.Status)
+	}
+}
+
+func TestWalletManager_SponsoredTransferTopUpExpired(t *testing.T) {
+
+	adapter := &sponsorTestAdapter{
+		txDecoder: &sponsorTestTxDecoder{},
+		scDecoder: &tokenBalanceTestDecoder{
+			balances: map[string]string{"0xtoken:addr2": "50"},
+		},
+	}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"SPNS": adapter})
+	defer cleanup()
+
+	newTestAccount(t, wm, "SPNS", "payer")
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "sender", WalletID: "w2", Symbol: "SPNS"})
+	db.Save(&openwallet.Address{Address: "addr2", AccountID: "sender", Symbol: "SPNS"})
+
+	contract := &openwallet.SmartContract{Symbol: "SPNS", Address: "0xtoken", Decimals: 2}
+	sponsor := &openwallet.FeesSupportAccount{AccountID: "payer", FixSupportAmount: "0.01"}
+
+	transfer, err := wm.CreateSponsoredTransaction("app1", "w2", "sender", "10", "receiver", "", "", contract, sponsor, testWalletPassword)
+	if err != nil {
+		t.Errorf("CreateSponsoredTransaction failed, unexpected error: %v", err)
+		return
+	}
+
+	//手续费充值超时未上链，代付转账标记为unknown
+	wm.cfg.RebroadcastExpireSymbols = map[string]time.Duration{"SPNS": time.Nanosecond}
+	if _, err = wm.CheckUnconfirmedTransactions("app1"); err != nil {
+		t.Errorf("CheckUnconfirmedTransactions failed, unexpected error: %v", err)
+		return
+	}
+	if transfer, _ = wm.GetSponsoredTransfer("app1", transfer.ID); transfer.Status != SponsoredTransferStatusUnknown {
+		t.Errorf("transfer status = %s after top up expired, want unknown", transfer.Status)
+		return
+	}
+
+	//之后充值上链仍会推进
+	adapter.txDecoder.funded = true
+	adapter.txDecoder.from = "addr2"
+	topUp := &openwallet.Transaction{TxID: "topup_tx", Coin: openwallet.Coin{Symbol: "SPNS"}, BlockHash: "hash10", BlockHeight: 10}
+	topUp.WxID = openwallet.GenTransactionWxID(topUp)
+	wm.BlockExtractDataNotify(wm.encodeSourceKey("app1", "sender"), &openwallet.TxExtractData{Transaction: topUp})
+	if transfer, _ = wm.GetSponsoredTransfer("app1", transfer.ID); transfer.Status != SponsoredTransferStatusReady {
+		t.Errorf("transfer status = %s after top up confirmed, want ready", transfer.Status)
+	}
+}
@@ -16,6 +16,8 @@
 package openw
 
 import (
+	"fmt"
+
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
 )
@@ -23,30 +25,11 @@ import (
 //blockScanNotify 区块扫描结果通知
 func (wm *WalletManager) BlockScanNotify(header *openwallet.BlockHeader) error {
 	//log.Debug("NewBlock:", header)
-	if header.Fork {
-
-		//加载已存在所有app
-		appIDs, err := wm.loadAllAppIDs()
-		if err != nil {
-			return err
-		}
+	wm.recordBlockScanTime(header.Symbol)
 
-		//分叉的区块，删除提出记录
-		for _, appID := range appIDs {
-
-			wrapper, err := wm.NewWalletWrapper(appID, "")
-			if err != nil {
-				return err
-			}
-
-			txWrapper := NewTransactionWrapper(wrapper)
-			err = txWrapper.DeleteBlockDataByHeight(header.Height)
-			if err != nil {
-				return err
-			}
-
-		}
-		return nil
+	if header.Fork {
+		//分叉的区块，回滚该高度及以上的提取记录
+		return wm.RollbackBlockData(header.Symbol, header.Height)
 	}
 
 	//推送数据
@@ -54,8 +37,10 @@ func (wm *WalletManager) BlockScanNotify(header *openwallet.BlockHeader) error {
 		o.BlockScanNotify(header)
 	}
 
-	//TODO:定时删除过时的记录，保证数据库不会无限增加
-	//可以由配置，自定义删除超过例如1000个块之前的记录
+	//记录账户余额快照，在后台执行，不阻塞区块扫描
+	wm.enqueueBalanceSnapshots(header)
+
+	//过时的记录由定时清理任务根据Config.RetentionPolicies删除，见PruneAppData
 
 	return nil
 }
@@ -68,17 +53,54 @@ func (wm *WalletManager) BlockExtractDataNotify(sourceKey string, data *openwall
 
 	log.Debug("NewBlockExtractData:", appID, accountID)
 
+	//没有交易的提取数据不处理
+	if data == nil || data.Transaction == nil {
+		return nil
+	}
+
+	//停用的应用或未启用的币种不处理
+	if !wm.isAppScanEnabled(appID, data.Transaction.Coin.Symbol) {
+		return nil
+	}
+
 	wrapper, err := wm.NewWalletWrapper(appID, "")
 	if err != nil {
 		return err
 	}
 
 	txWrapper := NewTransactionWrapper(wrapper)
+
+	//重扫及实时扫描可能提取到同一笔交易，已保存过的交易不再推送
+	duplicated := txWrapper.IsBlockExtractDataSaved(data)
+
 	err = txWrapper.SaveBlockExtractData(accountID, data)
 	if err != nil {
 		return err
 	}
 
+	if duplicated {
+		return nil
+	}
+
+	//重扫提取到的新交易计入重扫任务
+	if jobID, rescanning := wm.rescanningBlock(data.Transaction.Coin.Symbol, data.Transaction.BlockHeight); rescanning {
+		wm.recordRescanFound(jobID)
+	}
+
+	//代币交易变动了地址余额
+	if data.Transaction.Coin.IsContract {
+		wm.invalidateTokenBalances([]string{data.Transaction.Coin.ContractID}, extractDataAddresses(data))
+	}
+
+	//代付手续费的充值或代币转账已确认
+	wm.advanceSponsoredTransfers(appID, data.Transaction)
+
+	//批量转账的交易已确认
+	wm.confirmPayoutRows(appID, data.Transaction)
+
+	//已广播的交易上链，被替换的交易标记为replaced
+	wm.confirmTxLifecycle(appID, data.Transaction)
+
 	//更新账户余额
 	//err = wm.RefreshAssetsAccountBalance(appID, accountID)
 	//if err != nil {
@@ -97,11 +119,122 @@ func (wm *WalletManager) BlockExtractDataNotify(sourceKey string, data *openwall
 	return nil
 }
 
-//BlockExtractSmartContractDataNotify 区块提取智能合约交易结果通知
+//BlockExtractSmartContractDataNotify 区块提取智能合约交易结果通知，保存回执并推送给相关账户的观察者
 //@param sourceKey: 为contractID
 //@param data: 合约交易回执
 //@required
 func (wm *WalletManager) BlockExtractSmartContractDataNotify(sourceKey string, data *openwallet.SmartContractReceipt) error {
+
+	if data == nil {
+		return nil
+	}
+
+	//部署合约的回执，确认后登记合约地址
+	if _, err := wm.confirmContractDeployment(data); err != nil {
+		log.Errorf("confirm contract deployment[%s] failed, unexpected error: %v", data.TxID, err)
+	}
+
+	//登记回执事件中未知的代币合约
+	wm.registerUnverifiedTokens(data)
+
+	//保存回执并关联应用账户
+	links, duplicated, err := wm.saveSmartContractReceipt(data)
+	if err != nil {
+		return err
+	}
+
+	//回执涉及的地址余额已变动
+	wm.invalidateTokenBalances(receiptContractIDs(data), receiptAddresses(data))
+
+	//重扫及实时扫描可能提取到同一笔回执，已保存过的回执不再推送
+	if duplicated {
+		return nil
+	}
+
+	wm.notifySmartContractReceipt(links, data)
+
+	return nil
+}
+
+//RollbackBlockData 回滚全部应用中分叉高度及以上的区块提取数据，并向观察者推送被撤销的交易
+func (wm *WalletManager) RollbackBlockData(symbol string, height uint64) error {
+
+	//区块高度只在同一条链内有意义，不能按一条链的高度回滚全部币种
+	if len(symbol) == 0 {
+		return fmt.Errorf("fork block at height %d has no symbol, rollback skipped", height)
+	}
+
+	//加载已存在所有app
+	appIDs, err := wm.loadAllAppIDs()
+	if err != nil {
+		return err
+	}
+
+	//未执行的快照任务已失效
+	wm.dropBalanceSnapshots(symbol, height)
+
+	//合约交易回执
+	if err = wm.rollbackSmartContractReceipts(symbol, height); err != nil {
+		return err
+	}
+
+	for _, appID := range appIDs {
+
+		wrapper, err := wm.NewWalletWrapper(appID, "")
+		if err != nil {
+			return err
+		}
+
+		txWrapper := NewTransactionWrapper(wrapper)
+		reverted, err := txWrapper.RollbackBlockData(symbol, height)
+		if err != nil {
+			return err
+		}
+
+		if len(reverted) > 0 {
+			log.Infof("app[%s] rollback %d transactions of %s from height %d", appID, len(reverted), symbol, height)
+		}
+
+		lifecycles, err := wm.revertTxLifecycles(appID, symbol, height)
+		if err != nil {
+			return err
+		}
+
+		//批量转账及代付转账按交易单ID恢复状态
+		txids := make([]string, 0, len(reverted)+len(lifecycles))
+		for _, tx := range reverted {
+			txids = append(txids, tx.TxID)
+		}
+		for _, lifecycle := range lifecycles {
+			txids = append(txids, lifecycle.TxID)
+		}
+		wm.revertPayoutRows(appID, txids)
+		wm.revertSponsoredTransfers(appID, txids)
+
+		if !wm.isAppScanEnabled(appID, symbol) {
+			continue
+		}
+
+		accounts := make(map[string]*openwallet.AssetsAccount)
+		for _, tx := range reverted {
+			account, ok := accounts[tx.AccountID]
+			if !ok {
+				account, err = wrapper.GetAssetsAccountInfo(tx.AccountID)
+				if err != nil {
+					log.Errorf("rollback transaction[%s] can not find account: %s", tx.TxID, tx.AccountID)
+					continue
+				}
+				accounts[tx.AccountID] = account
+			}
+
+			for o, _ := range wm.observers {
+				if ro, ok := o.(TxRevertedNotificationObject); ok {
+					ro.BlockTxRevertedNotify(account, tx)
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
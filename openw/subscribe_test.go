@@ -0,0 +1,136 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type rollbackTestObserver struct {
+	extracted []*openwallet.Transaction
+	reverted  []*openwallet.Transaction
+}
+
+func (o *rollbackTestObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	return nil
+}
+
+func (o *rollbackTestObserver) BlockTxExtractDataNotify(account *openwallet.AssetsAccount, data *openwallet.TxExtractData) error {
+	o.extracted = append(o.extracted, data.Transaction)
+	return nil
+}
+
+func (o *rollbackTestObserver) BlockTxRevertedNotify(account *openwallet.AssetsAccount, tx *openwallet.Transaction) error {
+	o.reverted = append(o.reverted, tx)
+	return nil
+}
+
+func TestWalletManager_RollbackBlockData(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "openw_rollback")
+	if err != nil {
+		t.Errorf("TempDir failed, unexpected error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewConfig()
+	cfg.DBPath = filepath.Join(dir, "db")
+	cfg.KeyDir = filepath.Join(dir, "key")
+	cfg.SupportAssets = nil
+	wm := NewWalletManager(cfg)
+
+	observer := &rollbackTestObserver{}
+	wm.AddObserver(observer)
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", Symbol: "ETH"})
+	db.Save(&openwallet.Address{Address: "addr1", AccountID: "account1", Symbol: "ETH"})
+
+	sourceKey := wm.encodeSourceKey("app1", "account1")
+	newExtractData := func(symbol string, height uint64, hash string) *openwallet.TxExtractData {
+		output := &openwallet.TxOutPut{}
+		output.TxID = fmt.Sprintf("%s_tx%d", symbol, height)
+		output.Sid = openwallet.GenTxOutPutSID(output.TxID, symbol, "", 0)
+		output.Address = "addr1"
+		output.Amount = "1"
+		output.BlockHeight = height
+		output.Coin = openwallet.Coin{Symbol: symbol}
+		tx := &openwallet.Transaction{
+			TxID:        output.TxID,
+			Coin:        openwallet.Coin{Symbol: symbol},
+			BlockHash:   hash,
+			BlockHeight: height,
+		}
+		tx.WxID = openwallet.GenTransactionWxID(tx)
+		return &openwallet.TxExtractData{Transaction: tx, TxOutputs: []*openwallet.TxOutPut{output}}
+	}
+
+	for h := uint64(8); h <= 12; h++ {
+		wm.BlockExtractDataNotify(sourceKey, newExtractData("ETH", h, "old"))
+	}
+	wm.BlockExtractDataNotify(sourceKey, newExtractData("BTC", 11, "old"))
+
+	//分叉区块没有币种时不回滚，其他链的记录不受影响
+	if err = wm.BlockScanNotify(&openwallet.BlockHeader{Height: 1, Fork: true}); err == nil {
+		t.Errorf("fork block without symbol should not rollback")
+	}
+	if txs, _ := wm.GetTransactions("app1", 0, -1); len(txs) != 6 {
+		t.Errorf("transactions after rollback without symbol = %d, want 6", len(txs))
+	}
+
+	//分叉点为10，10及以上的ETH记录被回滚
+	err = wm.BlockScanNotify(&openwallet.BlockHeader{Height: 10, Symbol: "ETH", Fork: true})
+	if err != nil {
+		t.Errorf("BlockScanNotify failed, unexpected error: %v", err)
+		return
+	}
+
+	if len(observer.reverted) != 3 {
+		t.Errorf("reverted = %d, want 3", len(observer.reverted))
+	}
+
+	txs, _ := wm.GetTransactions("app1", 0, -1)
+	if len(txs) != 3 {
+		t.Errorf("remain transactions = %d, want 3", len(txs))
+	}
+
+	wrapper, _ := wm.NewWalletWrapper("app1", "")
+	outputs, _ := wrapper.GetTxOutputs(0, -1)
+	if len(outputs) != 3 {
+		t.Errorf("remain outputs = %d, want 3", len(outputs))
+	}
+
+	//新分支重扫后重新推送
+	extracted := len(observer.extracted)
+	wm.BlockExtractDataNotify(sourceKey, newExtractData("ETH", 10, "new"))
+	if len(observer.extracted) != extracted+1 {
+		t.Errorf("new branch transaction is not notified")
+	}
+
+	log.Infof("reverted: %d", len(observer.reverted))
+}
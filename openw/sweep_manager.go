@@ -0,0 +1,537 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/blocktree/openwallet/v2/timer"
+	"github.com/pborman/uuid"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	SweepRunStatusCompleted = "completed" //全部交易单已广播
+	SweepRunStatusPartial   = "partial"   //部分交易单被跳过或失败，或后续批次创建失败
+	SweepRunStatusFailed    = "failed"    //第一批创建汇总交易单失败
+
+	SweepTxStatusDryRun    = "dryRun"    //演练，未签名广播
+	SweepTxStatusSubmitted = "submitted" //已广播
+	SweepTxStatusSkipped   = "skipped"   //余额不足等可忽略的错误，跳过
+	SweepTxStatusAlerted   = "alerted"   //需要人工处理的错误，已告警
+	SweepTxStatusFailed    = "failed"    //签名或广播失败
+
+	//默认每批汇总的地址数量
+	defaultSweepAddressBatchSize = 100
+)
+
+//SweepAlertNotificationObject 可选的观察者接口，接收汇总过程中需要人工处理的错误
+type SweepAlertNotificationObject interface {
+
+	//SweepAlertNotify 汇总交易单创建、签名或广播失败
+	SweepAlertNotify(run *SweepRun, result *SweepTxResult) error
+}
+
+//SweepRule 资产账户的定时汇总规则
+type SweepRule struct {
+	ID                 string                         `json:"id" storm:"id"`
+	AppID              string                         `json:"appID" storm:"index"`
+	WalletID           string                         `json:"walletID"`
+	AccountID          string                         `json:"accountID" storm:"index"`
+	Contract           *openwallet.SmartContract      `json:"contract"` //汇总的代币合约，空值汇总主币
+	SummaryAddress     string                         `json:"summaryAddress"`
+	MinTransfer        string                         `json:"minTransfer"`
+	RetainedBalance    string                         `json:"retainedBalance"`
+	FeeRate            string                         `json:"feeRate"`
+	Confirms           uint64                         `json:"confirms"`         //汇总的未花交易大于确认数
+	Period             time.Duration                  `json:"period"`           //执行周期
+	AddressBatchSize   int                            `json:"addressBatchSize"` //每批汇总的地址数量
+	FeesSupportAccount *openwallet.FeesSupportAccount `json:"feesSupportAccount"`
+	Disabled           bool                           `json:"disabled"`
+	LastRunTime        int64                          `json:"lastRunTime"`
+	CreateTime         int64                          `json:"createTime"`
+	UpdateTime         int64                          `json:"updateTime"`
+}
+
+//SweepTxResult 一笔汇总交易单的处理结果
+type SweepTxResult struct {
+	TxID      string   `json:"txid"`
+	AccountID string   `json:"accountID"` //创建交易单的账户，手续费充值交易为手续费支持账户
+	From      []string `json:"from"`
+	To        []string `json:"to"`
+	Amount    string   `json:"amount"`
+	Fees      string   `json:"fees"`
+	Status    string   `json:"status"`
+	ErrorCode uint64   `json:"errorCode"`
+	Error     string   `json:"error"`
+}
+
+//SweepRun 汇总规则的一次执行记录
+type SweepRun struct {
+	ID          string           `json:"id" storm:"id"`
+	RuleID      string           `json:"ruleID" storm:"index"`
+	AppID       string           `json:"appID"`
+	AccountID   string           `json:"accountID"`
+	Symbol      string           `json:"symbol"`
+	DryRun      bool             `json:"dryRun"`
+	Status      string           `json:"status"`
+	Results     []*SweepTxResult `json:"results"`
+	TotalAmount string           `json:"totalAmount"` //已广播或演练的汇总数量
+	TotalFees   string           `json:"totalFees"`
+	Error       string           `json:"error"`
+	StartTime   int64            `json:"startTime" storm:"index"`
+	EndTime     int64            `json:"endTime"`
+}
+
+//SaveSweepRule 新增或修改汇总规则
+func (wm *WalletManager) SaveSweepRule(rule *SweepRule) (*SweepRule, error) {
+
+	if rule == nil {
+		return nil, fmt.Errorf("sweep rule is nil")
+	}
+
+	if len(rule.SummaryAddress) == 0 {
+		return nil, fmt.Errorf("sweep rule summary address is empty")
+	}
+
+	if rule.Period <= 0 {
+		return nil, fmt.Errorf("sweep rule period is invalid")
+	}
+
+	account, err := wm.GetAssetsAccountInfo(rule.AppID, "", rule.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rule.WalletID) == 0 {
+		rule.WalletID = account.WalletID
+	} else if rule.WalletID != account.WalletID {
+		return nil, fmt.Errorf("account[%s] does not belong to wallet[%s]", rule.AccountID, rule.WalletID)
+	}
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if len(rule.ID) == 0 {
+		rule.ID = uuid.New()
+		rule.CreateTime = now
+	} else {
+		//修改规则保留创建及执行时间
+		var old SweepRule
+		if db.One("ID", rule.ID, &old) == nil {
+			rule.CreateTime = old.CreateTime
+			rule.LastRunTime = old.LastRunTime
+		}
+	}
+	rule.UpdateTime = now
+
+	if err = db.Save(rule); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+//GetSweepRule 获取汇总规则
+func (wm *WalletManager) GetSweepRule(ruleID string) (*SweepRule, error) {
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var rule SweepRule
+	err = db.One("ID", ruleID, &rule)
+	if err != nil {
+		return nil, fmt.Errorf("sweep rule[%s] is not found", ruleID)
+	}
+
+	return &rule, nil
+}
+
+//GetSweepRules 获取应用的汇总规则，appID为空时返回全部
+func (wm *WalletManager) GetSweepRules(appID string) ([]*SweepRule, error) {
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*SweepRule
+	if len(appID) > 0 {
+		err = db.Find("AppID", appID, &rules)
+	} else {
+		err = db.All(&rules)
+	}
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+//RemoveSweepRule 删除汇总规则，执行记录保留
+func (wm *WalletManager) RemoveSweepRule(ruleID string) error {
+
+	rule, err := wm.GetSweepRule(ruleID)
+	if err != nil {
+		return err
+	}
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		return err
+	}
+
+	return db.DeleteStruct(rule)
+}
+
+//GetSweepRuns 查询汇总规则的执行记录，按时间倒序
+func (wm *WalletManager) GetSweepRuns(ruleID string, offset, limit int) ([]*SweepRun, error) {
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]*SweepRun, 0)
+	query := db.Select(q.Eq("RuleID", ruleID)).OrderBy("StartTime").Reverse().Skip(offset)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err = query.Find(&runs)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+//SetSweepWalletPassword 设置汇总时解锁钱包的密码，只保存在内存中
+//手续费支持账户所在的钱包也需要设置
+func (wm *WalletManager) SetSweepWalletPassword(appID, walletID, password string) {
+	wm.sweepMu.Lock()
+	defer wm.sweepMu.Unlock()
+	wm.sweepPasswords[appID+":"+walletID] = password
+}
+
+func (wm *WalletManager) sweepWalletPassword(appID, walletID string) (string, bool) {
+	wm.sweepMu.Lock()
+	defer wm.sweepMu.Unlock()
+	password, ok := wm.sweepPasswords[appID+":"+walletID]
+	return password, ok
+}
+
+//RunSweepRule 执行汇总规则，dryRun只创建交易单生成报告，不签名广播
+//执行记录保存到后台任务数据库
+func (wm *WalletManager) RunSweepRule(ruleID string, dryRun bool) (*SweepRun, error) {
+
+	rule, err := wm.GetSweepRule(ruleID)
+	if err != nil {
+		return nil, err
+	}
+
+	//同一规则不并发执行
+	wm.sweepMu.Lock()
+	if wm.sweepRunning[rule.ID] {
+		wm.sweepMu.Unlock()
+		return nil, fmt.Errorf("sweep rule[%s] is running", rule.ID)
+	}
+	wm.sweepRunning[rule.ID] = true
+	wm.sweepMu.Unlock()
+
+	defer func() {
+		wm.sweepMu.Lock()
+		delete(wm.sweepRunning, rule.ID)
+		wm.sweepMu.Unlock()
+	}()
+
+	run := wm.runSweepRule(rule, dryRun)
+
+	db, err := wm.openJobDB()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.Save(run); err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		rule.LastRunTime = run.StartTime
+		if err = db.Save(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return run, nil
+}
+
+func (wm *WalletManager) runSweepRule(rule *SweepRule, dryRun bool) *SweepRun {
+
+	run := &SweepRun{
+		ID:        uuid.New(),
+		RuleID:    rule.ID,
+		AppID:     rule.AppID,
+		AccountID: rule.AccountID,
+		DryRun:    dryRun,
+		Results:   make([]*SweepTxResult, 0),
+		StartTime: time.Now().Unix(),
+	}
+
+	defer func() {
+		run.EndTime = time.Now().Unix()
+	}()
+
+	wrapper, err := wm.NewWalletWrapper(rule.AppID, "")
+	if err != nil {
+		run.Status = SweepRunStatusFailed
+		run.Error = err.Error()
+		return run
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(rule.AccountID)
+	if err != nil {
+		run.Status = SweepRunStatusFailed
+		run.Error = err.Error()
+		return run
+	}
+	run.Symbol = account.Symbol
+
+	batchSize := rule.AddressBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultSweepAddressBatchSize
+	}
+
+	addresses, err := wrapper.GetAddressList(0, -1, "AccountID", rule.AccountID)
+	if err != nil {
+		run.Status = SweepRunStatusFailed
+		run.Error = err.Error()
+		return run
+	}
+
+	var (
+		totalAmount = decimal.Zero
+		totalFees   = decimal.Zero
+	)
+
+	//没有地址的账户也执行一次，由适配器决定是否有可汇总的余额
+	for start := 0; start < len(addresses) || start == 0; start += batchSize {
+
+		var contract *openwallet.SmartContract
+		if rule.Contract != nil {
+			c := *rule.Contract
+			contract = &c
+		}
+
+		sumTx := openwallet.SummaryRawTransaction{
+			FeeRate:            rule.FeeRate,
+			SummaryAddress:     rule.SummaryAddress,
+			MinTransfer:        rule.MinTransfer,
+			RetainedBalance:    rule.RetainedBalance,
+			AddressStartIndex:  start,
+			AddressLimit:       batchSize,
+			Confirms:           rule.Confirms,
+			FeesSupportAccount: rule.FeesSupportAccount,
+		}
+
+		rawTxs, createErr := wm.createSummaryRawTransactionWithError(rule.AppID, rule.AccountID, contract, &sumTx)
+		if createErr != nil {
+			log.Errorf("sweep rule[%s] create summary transaction failed, unexpected error: %v", rule.ID, createErr)
+			if start == 0 {
+				run.Status = SweepRunStatusFailed
+				run.Error = createErr.Error()
+				return run
+			}
+			//前面批次的交易单已广播，记录失败的批次并保留已汇总的数量
+			result := &SweepTxResult{
+				AccountID: rule.AccountID,
+				ErrorCode: openwallet.ConvertError(createErr).Code(),
+				Error:     fmt.Sprintf("address batch[%d] create summary transaction failed: %v", start, createErr),
+			}
+			wm.alertSweep(run, result, SweepTxStatusFailed)
+			run.Results = append(run.Results, result)
+			run.Error = result.Error
+			break
+		}
+
+		for _, rawTxWithErr := range rawTxs {
+			result := wm.sweepRawTransaction(rule, run, rawTxWithErr, dryRun)
+			run.Results = append(run.Results, result)
+
+			if result.Status == SweepTxStatusSubmitted || result.Status == SweepTxStatusDryRun {
+				amount, _ := decimal.NewFromString(result.Amount)
+				fees, _ := decimal.NewFromString(result.Fees)
+				totalAmount = totalAmount.Add(amount.Abs())
+				totalFees = totalFees.Add(fees)
+			}
+		}
+	}
+
+	run.TotalAmount = totalAmount.String()
+	run.TotalFees = totalFees.String()
+	run.Status = SweepRunStatusCompleted
+	for _, result := range run.Results {
+		if result.Status != SweepTxStatusSubmitted && result.Status != SweepTxStatusDryRun {
+			run.Status = SweepRunStatusPartial
+			break
+		}
+	}
+
+	return run
+}
+
+//sweepRawTransaction 签名广播一笔汇总交易单，带错误的交易单跳过或告警
+func (wm *WalletManager) sweepRawTransaction(rule *SweepRule, run *SweepRun, rawTxWithErr *openwallet.RawTransactionWithError, dryRun bool) *SweepTxResult {
+
+	result := &SweepTxResult{}
+
+	rawTx := rawTxWithErr.RawTx
+	if rawTx != nil {
+		result.Amount = rawTx.TxAmount
+		result.Fees = rawTx.Fees
+		result.From = rawTx.TxFrom
+		result.To = rawTx.TxTo
+		if rawTx.Account != nil {
+			result.AccountID = rawTx.Account.AccountID
+		}
+	}
+
+	if rawTxWithErr.Error != nil {
+		result.ErrorCode = rawTxWithErr.Error.Code()
+		result.Error = rawTxWithErr.Error.Error()
+		if isSweepSkippableError(result.ErrorCode) {
+			result.Status = SweepTxStatusSkipped
+		} else {
+			wm.alertSweep(run, result, SweepTxStatusAlerted)
+		}
+		return result
+	}
+
+	if rawTx == nil || rawTx.Account == nil {
+		result.Error = "summary raw transaction is empty"
+		wm.alertSweep(run, result, SweepTxStatusAlerted)
+		return result
+	}
+
+	if dryRun {
+		result.Status = SweepTxStatusDryRun
+		return result
+	}
+
+	walletID := rawTx.Account.WalletID
+	password, ok := wm.sweepWalletPassword(rule.AppID, walletID)
+	if !ok {
+		result.Error = fmt.Sprintf("wallet[%s] password is not set", walletID)
+		wm.alertSweep(run, result, SweepTxStatusFailed)
+		return result
+	}
+
+	signedTx, err := wm.SignTransaction(rule.AppID, walletID, rawTx.Account.AccountID, password, rawTx)
+	if err != nil {
+		result.ErrorCode = openwallet.ConvertError(err).Code()
+		result.Error = err.Error()
+		wm.alertSweep(run, result, SweepTxStatusFailed)
+		return result
+	}
+
+	tx, err := wm.SubmitTransaction(rule.AppID, walletID, rawTx.Account.AccountID, signedTx)
+	if err != nil {
+		result.ErrorCode = openwallet.ConvertError(err).Code()
+		result.Error = err.Error()
+		wm.alertSweep(run, result, SweepTxStatusFailed)
+		return result
+	}
+
+	result.TxID = tx.TxID
+	result.Status = SweepTxStatusSubmitted
+
+	return result
+}
+
+//isSweepSkippableError 地址余额不足等错误在下一轮汇总会自然恢复，不需要告警
+func isSweepSkippableError(code uint64) bool {
+	switch code {
+	case openwallet.ErrInsufficientBalanceOfAddress, openwallet.ErrDustLimit:
+		return true
+	}
+	return false
+}
+
+func (wm *WalletManager) alertSweep(run *SweepRun, result *SweepTxResult, status string) {
+
+	result.Status = status
+	log.Warningf("sweep rule[%s] account[%s] %s: %s", run.RuleID, run.AccountID, status, result.Error)
+
+	for o, _ := range wm.observers {
+		if so, ok := o.(SweepAlertNotificationObject); ok {
+			so.SweepAlertNotify(run, result)
+		}
+	}
+}
+
+//StartSweepService 启动定时汇总服务，每个周期检查到期的规则并执行
+func (wm *WalletManager) StartSweepService(period time.Duration) {
+
+	wm.StopSweepService()
+
+	task := timer.NewTask(period, func() {
+		rules, err := wm.GetSweepRules("")
+		if err != nil {
+			log.Error("sweep service load rules failed, unexpected error:", err)
+			return
+		}
+		now := time.Now()
+		for _, rule := range rules {
+			if rule.Disabled {
+				continue
+			}
+			if now.Before(time.Unix(rule.LastRunTime, 0).Add(rule.Period)) {
+				continue
+			}
+			run, runErr := wm.RunSweepRule(rule.ID, false)
+			if runErr != nil {
+				log.Errorf("sweep rule[%s] run failed, unexpected error: %v", rule.ID, runErr)
+				continue
+			}
+			log.Infof("sweep rule[%s] account[%s] %s, amount: %s, fees: %s", rule.ID, rule.AccountID, run.Status, run.TotalAmount, run.TotalFees)
+		}
+	})
+
+	wm.mu.Lock()
+	wm.sweepTask = task
+	wm.mu.Unlock()
+
+	task.Start()
+}
+
+//StopSweepService 停止定时汇总服务
+func (wm *WalletManager) StopSweepService() {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.sweepTask != nil {
+		wm.sweepTask.Stop()
+		wm.sweepTask = nil
+	}
+}
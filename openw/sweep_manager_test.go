@@ -0,0 +1,187 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type sweepTestTxDecoder struct {
+	openwallet.TransactionDecoderBase
+	confirms  []uint64
+	submitted int
+	batchErr  error
+}
+
+func (d *sweepTestTxDecoder) CreateSummaryRawTransactionWithError(wrapper openwallet.WalletDAI, sumRawTx *openwallet.SummaryRawTransaction) ([]*openwallet.RawTransactionWithError, error) {
+	d.confirms = append(d.confirms, sumRawTx.Confirms)
+	if sumRawTx.AddressStartIndex == 0 {
+		return []*openwallet.RawTransactionWithError{
+			{RawTx: &openwallet.RawTransaction{Coin: sumRawTx.Coin, Account: sumRawTx.Account, TxAmount: "-1.5", Fees: "0.1"}},
+			{Error: openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAddress, "balance is too low")},
+		}, nil
+	}
+	if d.batchErr != nil {
+		return nil, d.batchErr
+	}
+	return []*openwallet.RawTransactionWithError{
+		{Error: openwallet.Errorf(openwallet.ErrInsufficientFees, "fees support account is empty")},
+	}, nil
+}
+
+func (d *sweepTestTxDecoder) SignRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	rawTx.IsCompleted = true
+	return nil
+}
+
+func (d *sweepTestTxDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
+	d.submitted++
+	tx := &openwallet.Transaction{TxID: fmt.Sprintf("sweep_tx%d", d.submitted), Coin: rawTx.Coin}
+	tx.WxID = openwallet.GenTransactionWxID(tx)
+	return tx, nil
+}
+
+type sweepTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	decoder *sweepTestTxDecoder
+}
+
+func (a *sweepTestAdapter) GetTransactionDecoder() openwallet.TransactionDecoder {
+	return a.decoder
+}
+
+type sweepTestObserver struct {
+	rollbackTestObserver
+	alerts []*SweepTxResult
+}
+
+func (o *sweepTestObserver) SweepAlertNotify(run *SweepRun, result *SweepTxResult) error {
+	o.alerts = append(o.alerts, result)
+	return nil
+}
+
+func TestWalletManager_RunSweepRule(t *testing.T) {
+
+	adapter := &sweepTestAdapter{decoder: &sweepTestTxDecoder{}}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"SWEP": adapter})
+	defer cleanup()
+
+	observer := &sweepTestObserver{}
+	wm.AddObserver(observer)
+
+	wallet := newTestAccount(t, wm, "SWEP", "account1")
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		db.Save(&openwallet.Address{Address: fmt.Sprintf("addr%d", i), AccountID: "account1", Symbol: "SWEP"})
+	}
+
+	rule, err := wm.SaveSweepRule(&SweepRule{
+		AppID:            "app1",
+		AccountID:        "account1",
+		SummaryAddress:   "summary",
+		MinTransfer:      "1",
+		Confirms:         6,
+		Period:           time.Hour,
+		AddressBatchSize: 2,
+	})
+	if err != nil {
+		t.Errorf("SaveSweepRule failed, unexpected error: %v", err)
+		return
+	}
+
+	//演练不签名广播
+	run, err := wm.RunSweepRule(rule.ID, true)
+	if err != nil {
+		t.Errorf("RunSweepRule failed, unexpected error: %v", err)
+		return
+	}
+	if len(adapter.decoder.confirms) != 2 || adapter.decoder.confirms[0] != 6 {
+		t.Errorf("summary batches = %v, want 2 batches with confirms 6", adapter.decoder.confirms)
+	}
+	if len(run.Results) != 3 || run.Status != SweepRunStatusPartial || run.TotalAmount != "1.5" {
+		t.Errorf("dry run results = %d, status = %s, amount = %s", len(run.Results), run.Status, run.TotalAmount)
+		return
+	}
+	if run.Results[0].Status != SweepTxStatusDryRun || run.Results[1].Status != SweepTxStatusSkipped || run.Results[2].Status != SweepTxStatusAlerted {
+		t.Errorf("dry run result status = %s, %s, %s", run.Results[0].Status, run.Results[1].Status, run.Results[2].Status)
+	}
+	if adapter.decoder.submitted != 0 {
+		t.Errorf("dry run submitted transactions")
+	}
+
+	//未设置密码，签名失败
+	run, _ = wm.RunSweepRule(rule.ID, false)
+	if run.Results[0].Status != SweepTxStatusFailed {
+		t.Errorf("run without password status = %s, want failed", run.Results[0].Status)
+	}
+
+	wm.SetSweepWalletPassword("app1", wallet.WalletID, testWalletPassword)
+	run, _ = wm.RunSweepRule(rule.ID, false)
+	if run.Results[0].Status != SweepTxStatusSubmitted || run.Results[0].TxID != "sweep_tx1" {
+		t.Errorf("run result status = %s, txid = %s", run.Results[0].Status, run.Results[0].TxID)
+	}
+
+	//告警：演练1次(手续费不足)，未设置密码执行2次，设置密码后执行1次
+	if len(observer.alerts) != 4 {
+		t.Errorf("alerts = %d, want 4", len(observer.alerts))
+	}
+
+	runs, err := wm.GetSweepRuns(rule.ID, 0, 0)
+	if err != nil {
+		t.Errorf("GetSweepRuns failed, unexpected error: %v", err)
+		return
+	}
+	if len(runs) != 3 {
+		t.Errorf("sweep runs = %d, want 3", len(runs))
+	}
+
+	rule, _ = wm.GetSweepRule(rule.ID)
+	if rule.LastRunTime == 0 {
+		t.Errorf("rule last run time is not updated")
+	}
+
+	//第二批创建失败，保留第一批的结果
+	adapter.decoder.batchErr = fmt.Errorf("node is unavailable")
+	run, _ = wm.RunSweepRule(rule.ID, false)
+	if run.Status != SweepRunStatusPartial || run.TotalAmount != "1.5" || run.TotalFees != "0.1" || len(run.Results) != 3 {
+		t.Errorf("batch failed run status = %s, amount = %s, fees = %s, results = %d", run.Status, run.TotalAmount, run.TotalFees, len(run.Results))
+		return
+	}
+	if run.Results[2].Status != SweepTxStatusFailed || len(run.Error) == 0 {
+		t.Errorf("failed batch result status = %s, error = %s", run.Results[2].Status, run.Error)
+	}
+
+	//账户不属于规则的钱包
+	_, err = wm.SaveSweepRule(&SweepRule{
+		AppID:          "app1",
+		WalletID:       "other",
+		AccountID:      "account1",
+		SummaryAddress: "summary",
+		Period:         time.Hour,
+	})
+	if err == nil {
+		t.Errorf("SaveSweepRule with other wallet should failed")
+	}
+}
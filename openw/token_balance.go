@@ -0,0 +1,418 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+//AccountTokenBalance 资产账户持有的代币余额
+type AccountTokenBalance struct {
+	WalletID  string `json:"walletID"`
+	AccountID string `json:"accountID"`
+	Balance   string `json:"balance"`
+}
+
+//TokenBalanceSummary 按币种及合约汇总的代币余额
+type TokenBalanceSummary struct {
+	Symbol     string                    `json:"symbol"`
+	ContractID string                    `json:"contractID"`
+	Contract   *openwallet.SmartContract `json:"contract"`
+	Balance    string                    `json:"balance"`  //全部账户的合计
+	Accounts   []*AccountTokenBalance    `json:"accounts"` //余额不为0的账户
+	Error      string                    `json:"error"`    //部分地址查询失败时的错误，合计只包含查询成功的地址
+}
+
+//cachedTokenBalance 地址代币余额的缓存
+type cachedTokenBalance struct {
+	balance  string
+	expireAt time.Time
+}
+
+//tokenBalanceQuery 一次GetTokenBalanceByAddress批量查询
+type tokenBalanceQuery struct {
+	decoder   openwallet.SmartContractDecoder
+	contract  *openwallet.SmartContract
+	addresses []string
+	err       error
+}
+
+func tokenBalanceKey(contractID, address string) string {
+	return contractID + ":" + address
+}
+
+//GetAccountTokenBalances 汇总资产账户全部已登记代币的余额
+func (wm *WalletManager) GetAccountTokenBalances(appID, accountID string) ([]*TokenBalanceSummary, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	return wm.aggregateTokenBalances(wrapper, []*openwallet.AssetsAccount{account})
+}
+
+//GetWalletTokenBalances 汇总钱包下全部资产账户的代币余额
+func (wm *WalletManager) GetWalletTokenBalances(appID, walletID string) ([]*TokenBalanceSummary, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := wrapper.GetAssetsAccountList(0, -1, "WalletID", walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	return wm.aggregateTokenBalances(wrapper, accounts)
+}
+
+//GetAppTokenBalances 汇总应用全部资产账户的代币余额
+func (wm *WalletManager) GetAppTokenBalances(appID string) ([]*TokenBalanceSummary, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := wrapper.GetAssetsAccountList(0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	return wm.aggregateTokenBalances(wrapper, accounts)
+}
+
+//aggregateTokenBalances 查询账户在已登记合约上的余额，按币种及合约汇总
+//同一合约的地址合并后分批查询，缓存未过期的地址不再请求全节点
+func (wm *WalletManager) aggregateTokenBalances(wrapper *WalletWrapper, accounts []*openwallet.AssetsAccount) ([]*TokenBalanceSummary, error) {
+
+	var (
+		summaries        = make([]*TokenBalanceSummary, 0)
+		queries          = make([]*tokenBalanceQuery, 0)
+		accountsBySymbol = make(map[string][]*openwallet.AssetsAccount)
+		accountAddrs     = make(map[string][]string) //各账户的查询地址
+		results          = make(map[string]string)   //本次查询结果，缓存关闭时也能汇总
+		resultsMu        sync.Mutex
+	)
+
+	for _, account := range accounts {
+		symbol := strings.ToUpper(account.Symbol)
+		accountsBySymbol[symbol] = append(accountsBySymbol[symbol], account)
+	}
+
+	batchSize := wm.cfg.TokenBalanceBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultTokenBalanceBatchSize
+	}
+
+	type summaryAccounts struct {
+		summary  *TokenBalanceSummary
+		accounts []*openwallet.AssetsAccount
+	}
+	pending := make([]*summaryAccounts, 0)
+
+	for symbol, symbolAccounts := range accountsBySymbol {
+
+		assetsMgr, err := GetAssetsAdapter(symbol)
+		if err != nil {
+			log.Warningf("[%s] is not support, skip token balance", symbol)
+			continue
+		}
+
+		if capErr := checkCapability(symbol, assetsMgr, openwallet.CapabilitySmartContract); capErr != nil {
+			continue
+		}
+
+		decoder := assetsMgr.GetSmartContractDecoder()
+		if decoder == nil {
+			continue
+		}
+
+		tokens, err := wm.ListTokens(symbol)
+		if err != nil {
+			return nil, err
+		}
+
+		//只汇总已登记的合约，区块扫描自动发现的合约可能是垃圾代币
+		verified := make([]*TokenContract, 0, len(tokens))
+		for _, token := range tokens {
+			if token.IsVerified() {
+				verified = append(verified, token)
+			}
+		}
+		if len(verified) == 0 {
+			continue
+		}
+
+		symbolAddrs := make([]string, 0)
+		for _, account := range symbolAccounts {
+			addrs, err := wm.tokenBalanceAddresses(wrapper, assetsMgr, account)
+			if err != nil {
+				return nil, err
+			}
+			accountAddrs[account.AccountID] = addrs
+			symbolAddrs = append(symbolAddrs, addrs...)
+		}
+
+		for _, token := range verified {
+
+			contract := token.SmartContract()
+
+			//缓存命中的地址不再查询
+			uncached := make([]string, 0, len(symbolAddrs))
+			for _, addr := range symbolAddrs {
+				key := tokenBalanceKey(token.ContractID, addr)
+				if balance, ok := wm.getCachedTokenBalance(key); ok {
+					results[key] = balance
+				} else {
+					uncached = append(uncached, addr)
+				}
+			}
+
+			summary := &TokenBalanceSummary{
+				Symbol:     symbol,
+				ContractID: token.ContractID,
+				Contract:   contract,
+				Accounts:   make([]*AccountTokenBalance, 0),
+			}
+
+			for start := 0; start < len(uncached); start += batchSize {
+				end := start + batchSize
+				if end > len(uncached) {
+					end = len(uncached)
+				}
+				queries = append(queries, &tokenBalanceQuery{
+					decoder:   decoder,
+					contract:  contract,
+					addresses: uncached[start:end],
+				})
+			}
+
+			summaries = append(summaries, summary)
+			pending = append(pending, &summaryAccounts{summary: summary, accounts: symbolAccounts})
+		}
+	}
+
+	wm.runTokenBalanceQueries(queries, func(query *tokenBalanceQuery, balances map[string]string) {
+		resultsMu.Lock()
+		for addr, balance := range balances {
+			results[tokenBalanceKey(query.contract.ContractID, addr)] = balance
+		}
+		resultsMu.Unlock()
+	})
+
+	queryErrs := make(map[string]string)
+	for _, query := range queries {
+		if query.err != nil {
+			if _, exist := queryErrs[query.contract.ContractID]; !exist {
+				queryErrs[query.contract.ContractID] = query.err.Error()
+			}
+		}
+	}
+
+	for _, p := range pending {
+		summary := p.summary
+		total := decimal.Zero
+		decimals := int32(summary.Contract.Decimals)
+		for _, account := range p.accounts {
+			accountTotal := decimal.Zero
+			for _, addr := range accountAddrs[account.AccountID] {
+				balance, ok := results[tokenBalanceKey(summary.ContractID, addr)]
+				if !ok {
+					continue
+				}
+				b, _ := decimal.NewFromString(balance)
+				accountTotal = accountTotal.Add(b)
+			}
+			if accountTotal.IsZero() {
+				continue
+			}
+			total = total.Add(accountTotal)
+			summary.Accounts = append(summary.Accounts, &AccountTokenBalance{
+				WalletID:  account.WalletID,
+				AccountID: account.AccountID,
+				Balance:   accountTotal.StringFixed(decimals),
+			})
+		}
+		summary.Balance = total.StringFixed(decimals)
+		summary.Error = queryErrs[summary.ContractID]
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Symbol != summaries[j].Symbol {
+			return summaries[i].Symbol < summaries[j].Symbol
+		}
+		return summaries[i].ContractID < summaries[j].ContractID
+	})
+
+	return summaries, nil
+}
+
+//tokenBalanceAddresses 账户查询代币余额使用的地址，账户模型使用账户别名
+func (wm *WalletManager) tokenBalanceAddresses(wrapper *WalletWrapper, assetsMgr openwallet.AssetsAdapter, account *openwallet.AssetsAccount) ([]string, error) {
+
+	if assetsMgr.BalanceModelType() == openwallet.BalanceModelTypeAccount {
+		if len(account.Alias) == 0 {
+			return []string{}, nil
+		}
+		return []string{account.Alias}, nil
+	}
+
+	addresses, err := wrapper.GetAddressList(0, -1, "AccountID", account.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		addrs = append(addrs, address.Address)
+	}
+	return addrs, nil
+}
+
+//runTokenBalanceQueries 按并发上限执行批量查询，查询成功的地址写入缓存
+//全节点没有返回的地址视为余额为0
+func (wm *WalletManager) runTokenBalanceQueries(queries []*tokenBalanceQuery, done func(query *tokenBalanceQuery, balances map[string]string)) {
+
+	concurrency := wm.cfg.TokenBalanceConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultTokenBalanceConcurrency
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, concurrency)
+	)
+
+	for _, query := range queries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(query *tokenBalanceQuery) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			tokenBalances, err := query.decoder.GetTokenBalanceByAddress(*query.contract, query.addresses...)
+			if err != nil {
+				log.Errorf("[%s] get token[%s] balance failed, unexpected error: %v", query.contract.Symbol, query.contract.Address, err)
+				query.err = err
+				return
+			}
+
+			//全节点返回的地址大小写可能与查询的不同，如EIP-55校验和地址，按查询的地址记录
+			balances := make(map[string]string, len(query.addresses))
+			queried := make(map[string]string, len(query.addresses))
+			for _, addr := range query.addresses {
+				balances[addr] = "0"
+				queried[strings.ToLower(addr)] = addr
+			}
+			for _, tb := range tokenBalances {
+				if tb == nil || tb.Balance == nil {
+					continue
+				}
+				addr, ok := queried[strings.ToLower(tb.Balance.Address)]
+				if !ok {
+					continue
+				}
+				balances[addr] = tb.Balance.Balance
+			}
+
+			for addr, balance := range balances {
+				wm.setCachedTokenBalance(tokenBalanceKey(query.contract.ContractID, addr), balance)
+			}
+
+			done(query, balances)
+		}(query)
+	}
+
+	wg.Wait()
+}
+
+func (wm *WalletManager) getCachedTokenBalance(key string) (string, bool) {
+	wm.tokenBalanceMu.Lock()
+	defer wm.tokenBalanceMu.Unlock()
+
+	cached, ok := wm.tokenBalances[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(cached.expireAt) {
+		delete(wm.tokenBalances, key)
+		return "", false
+	}
+	return cached.balance, true
+}
+
+func (wm *WalletManager) setCachedTokenBalance(key, balance string) {
+	if wm.cfg.TokenBalanceCacheTTL <= 0 {
+		return
+	}
+
+	wm.tokenBalanceMu.Lock()
+	defer wm.tokenBalanceMu.Unlock()
+
+	wm.tokenBalances[key] = &cachedTokenBalance{
+		balance:  balance,
+		expireAt: time.Now().Add(wm.cfg.TokenBalanceCacheTTL),
+	}
+}
+
+//invalidateTokenBalances 合约交易变动了地址余额，清除对应的缓存
+func (wm *WalletManager) invalidateTokenBalances(contractIDs []string, addresses []string) {
+	wm.tokenBalanceMu.Lock()
+	defer wm.tokenBalanceMu.Unlock()
+
+	for _, contractID := range contractIDs {
+		for _, addr := range addresses {
+			delete(wm.tokenBalances, tokenBalanceKey(contractID, addr))
+		}
+	}
+}
+
+//extractDataAddresses 区块提取数据涉及的地址
+func extractDataAddresses(data *openwallet.TxExtractData) []string {
+	addrs := make([]string, 0, len(data.TxInputs)+len(data.TxOutputs))
+	for _, input := range data.TxInputs {
+		addrs = append(addrs, input.Address)
+	}
+	for _, output := range data.TxOutputs {
+		addrs = append(addrs, output.Address)
+	}
+	return addrs
+}
+
+//ClearTokenBalanceCache 清空代币余额缓存
+func (wm *WalletManager) ClearTokenBalanceCache() {
+	wm.tokenBalanceMu.Lock()
+	defer wm.tokenBalanceMu.Unlock()
+
+	wm.tokenBalances = make(map[string]*cachedTokenBalance)
+}
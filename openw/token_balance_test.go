@@ -0,0 +1,180 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+type tokenBalanceTestDecoder struct {
+	openwallet.SmartContractDecoderBase
+	mu       sync.Mutex
+	calls    int
+	balances map[string]string
+	checksum bool //返回大写的地址
+}
+
+func (d *tokenBalanceTestDecoder) GetTokenBalanceByAddress(contract openwallet.SmartContract, address ...string) ([]*openwallet.TokenBalance, error) {
+	d.mu.Lock()
+	d.calls++
+	d.mu.Unlock()
+
+	list := make([]*openwallet.TokenBalance, 0)
+	for _, addr := range address {
+		balance, ok := d.balances[contract.Address+":"+addr]
+		if !ok {
+			continue
+		}
+		if d.checksum {
+			addr = strings.ToUpper(addr)
+		}
+		list = append(list, &openwallet.TokenBalance{
+			Contract: &contract,
+			Balance:  &openwallet.Balance{Symbol: contract.Symbol, Address: addr, Balance: balance},
+		})
+	}
+	return list, nil
+}
+
+type tokenBalanceTestAdapter struct {
+	openwallet.AssetsAdapterBase
+	decoder *tokenBalanceTestDecoder
+}
+
+func (a *tokenBalanceTestAdapter) GetSmartContractDecoder() openwallet.SmartContractDecoder {
+	return a.decoder
+}
+
+func TestWalletManager_GetAppTokenBalances(t *testing.T) {
+
+	decoder := &tokenBalanceTestDecoder{
+		balances: map[string]string{
+			"0xtokenA:addr1": "1.5",
+			"0xtokenA:addr2": "2",
+			"0xtokenA:addr3": "0.25",
+			"0xtokenB:addr3": "10",
+		},
+	}
+	wm, cleanup := newTestManager(t, map[string]interface{}{"TBAL": &tokenBalanceTestAdapter{decoder: decoder}})
+	defer cleanup()
+	wm.cfg.TokenBalanceBatchSize = 2
+
+	wm.RegisterToken(&openwallet.SmartContract{Symbol: "TBAL", Address: "0xtokenA", Token: "AAA", Decimals: 2})
+	wm.RegisterToken(&openwallet.SmartContract{Symbol: "TBAL", Address: "0xtokenB", Token: "BBB", Decimals: 0})
+
+	db, err := wm.OpenDB("app1")
+	if err != nil {
+		t.Errorf("OpenDB failed, unexpected error: %v", err)
+		return
+	}
+	db.Save(&openwallet.AssetsAccount{AccountID: "account1", WalletID: "w1", Symbol: "TBAL"})
+	db.Save(&openwallet.AssetsAccount{AccountID: "account2", WalletID: "w2", Symbol: "TBAL"})
+	db.Save(&openwallet.Address{Address: "addr1", AccountID: "account1", Symbol: "TBAL"})
+	db.Save(&openwallet.Address{Address: "addr2", AccountID: "account1", Symbol: "TBAL"})
+	db.Save(&openwallet.Address{Address: "addr3", AccountID: "account2", Symbol: "TBAL"})
+
+	summaries, err := wm.GetAppTokenBalances("app1")
+	if err != nil {
+		t.Errorf("GetAppTokenBalances failed, unexpected error: %v", err)
+		return
+	}
+
+	if len(summaries) != 2 {
+		t.Errorf("summaries count = %d, want 2", len(summaries))
+		return
+	}
+
+	//3个地址每批2个，每个合约查询2次
+	if decoder.calls != 4 {
+		t.Errorf("decoder calls = %d, want 4", decoder.calls)
+	}
+
+	want := map[string]string{
+		openwallet.GenContractID("TBAL", "0xtokenA"): "3.75",
+		openwallet.GenContractID("TBAL", "0xtokenB"): "10",
+	}
+	for _, s := range summaries {
+		if s.Balance != want[s.ContractID] {
+			t.Errorf("contract[%s] balance = %s, want %s", s.Contract.Address, s.Balance, want[s.ContractID])
+		}
+		if s.Contract.Address == "0xtokenB" && len(s.Accounts) != 1 {
+			t.Errorf("contract[%s] accounts = %d, want 1", s.Contract.Address, len(s.Accounts))
+		}
+	}
+
+	//缓存命中不再查询
+	walletSummaries, err := wm.GetWalletTokenBalances("app1", "w1")
+	if err != nil {
+		t.Errorf("GetWalletTokenBalances failed, unexpected error: %v", err)
+		return
+	}
+	if decoder.calls != 4 {
+		t.Errorf("decoder calls after cached = %d, want 4", decoder.calls)
+	}
+	for _, s := range walletSummaries {
+		if s.Contract.Address == "0xtokenA" && s.Balance != "3.50" {
+			t.Errorf("wallet token balance = %s, want 3.50", s.Balance)
+		}
+	}
+
+	//合约回执清除相关地址的缓存
+	decoder.balances["0xtokenB:addr3"] = "7"
+	receipt := &openwallet.SmartContractReceipt{
+		Coin: openwallet.Coin{Symbol: "TBAL", ContractID: openwallet.GenContractID("TBAL", "0xtokenB"), IsContract: true},
+		TxID: "tx1",
+		From: "addr3",
+		To:   "0xtokenB",
+	}
+	receipt.GenWxID()
+	wm.BlockExtractSmartContractDataNotify("", receipt)
+
+	accountSummaries, err := wm.GetAccountTokenBalances("app1", "account2")
+	if err != nil {
+		t.Errorf("GetAccountTokenBalances failed, unexpected error: %v", err)
+		return
+	}
+	if decoder.calls != 5 {
+		t.Errorf("decoder calls after invalidated = %d, want 5", decoder.calls)
+	}
+	for _, s := range accountSummaries {
+		if s.Contract.Address == "0xtokenB" && s.Balance != "7" {
+			t.Errorf("account token balance = %s, want 7", s.Balance)
+		}
+	}
+}
+
+func TestWalletManager_RunTokenBalanceQueries_AddressCase(t *testing.T) {
+
+	wm, cleanup := newTestManager(t, nil)
+	defer cleanup()
+
+	contract := &openwallet.SmartContract{Symbol: "TBAL", Address: "0xtokenA", ContractID: "tokenA"}
+	decoder := &tokenBalanceTestDecoder{checksum: true, balances: map[string]string{"0xtokenA:0xabc": "5"}}
+	query := &tokenBalanceQuery{decoder: decoder, contract: contract, addresses: []string{"0xabc", "0xdef"}}
+
+	//全节点返回的地址大小写不同，余额仍记在查询的地址上
+	var result map[string]string
+	wm.runTokenBalanceQueries([]*tokenBalanceQuery{query}, func(query *tokenBalanceQuery, balances map[string]string) {
+		result = balances
+	})
+	if len(result) != 2 || result["0xabc"] != "5" || result["0xdef"] != "0" {
+		t.Errorf("balances = %v, want 0xabc: 5, 0xdef: 0", result)
+	}
+}
@@ -0,0 +1,415 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/v2/common/file"
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	TokenStatusVerified   = "verified"   //人工登记的合约
+	TokenStatusUnverified = "unverified" //扫块发现的未知合约
+)
+
+//TokenContract 代币合约注册记录
+type TokenContract struct {
+	ContractID string `json:"contractID" storm:"id"` //GenContractID计算
+	Symbol     string `json:"symbol" storm:"index"`  //主链币种
+	Address    string `json:"address"`
+	AddressKey string `json:"addressKey" storm:"index"` //tokenAddressKey计算，按地址查找使用
+	Token      string `json:"token"`                    //合约的symbol
+	Protocol   string `json:"protocol"`
+	Name       string `json:"name"`
+	Decimals   uint64 `json:"decimals"`
+	ABI        string `json:"abi"` //abi json
+	Status     string `json:"status" storm:"index"`
+	CreateTime int64  `json:"createTime"`
+	UpdateTime int64  `json:"updateTime"`
+}
+
+//NewTokenContract 从SmartContract创建注册记录
+func NewTokenContract(contract *openwallet.SmartContract, status string) *TokenContract {
+	token := &TokenContract{
+		ContractID: contract.ContractID,
+		Symbol:     strings.ToUpper(contract.Symbol),
+		Address:    contract.Address,
+		Token:      contract.Token,
+		Protocol:   contract.Protocol,
+		Name:       contract.Name,
+		Decimals:   contract.Decimals,
+		ABI:        contract.GetABI(),
+		Status:     status,
+	}
+	if len(token.ContractID) == 0 {
+		token.ContractID = openwallet.GenContractID(token.Symbol, token.Address)
+	}
+	token.AddressKey = tokenAddressKey(token.Symbol, token.Address)
+	return token
+}
+
+//tokenAddressKey 币种及小写的合约地址，按地址查找不区分大小写
+func tokenAddressKey(symbol, address string) string {
+	return strings.ToUpper(symbol) + "_" + strings.ToLower(address)
+}
+
+//SmartContract 转为SmartContract
+func (token *TokenContract) SmartContract() *openwallet.SmartContract {
+	contract := &openwallet.SmartContract{
+		ContractID: token.ContractID,
+		Symbol:     token.Symbol,
+		Address:    token.Address,
+		Token:      token.Token,
+		Protocol:   token.Protocol,
+		Name:       token.Name,
+		Decimals:   token.Decimals,
+	}
+	contract.SetABI(token.ABI)
+	return contract
+}
+
+//IsVerified 是否已人工登记
+func (token *TokenContract) IsVerified() bool {
+	return token.Status == TokenStatusVerified
+}
+
+//TokenDBFile 代币合约注册表及合约交易回执数据库文件
+func (wm *WalletManager) TokenDBFile() string {
+	if len(wm.cfg.TokenDBFile) > 0 {
+		return wm.cfg.TokenDBFile
+	}
+	return filepath.Join(filepath.Dir(wm.cfg.DBPath), "tokens.db")
+}
+
+//openTokenDB 打开代币合约注册表及合约交易回执数据库，调用方持有tokenMu
+func (wm *WalletManager) openTokenDB() (*StormDB, error) {
+
+	if wm.tokenDB != nil && wm.tokenDB.Opened {
+		return wm.tokenDB, nil
+	}
+
+	file.MkdirAll(filepath.Dir(wm.TokenDBFile()))
+	db, err := OpenStormDB(wm.TokenDBFile(), appDBOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	wm.tokenDB = db
+
+	return db, nil
+}
+
+//RegisterToken 登记代币合约，已存在的合约更新信息并标记为已登记
+func (wm *WalletManager) RegisterToken(contract *openwallet.SmartContract) (*TokenContract, error) {
+
+	if contract == nil || len(contract.Symbol) == 0 || len(contract.Address) == 0 {
+		return nil, openwallet.Errorf(openwallet.ErrContractCallMsgInvalid, "contract symbol and address are required")
+	}
+
+	token := NewTokenContract(contract, TokenStatusVerified)
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var exist TokenContract
+	if db.One("ContractID", token.ContractID, &exist) == nil {
+		token.CreateTime = exist.CreateTime
+		if len(token.ABI) == 0 {
+			token.ABI = exist.ABI
+		}
+	} else {
+		token.CreateTime = time.Now().Unix()
+	}
+	token.UpdateTime = time.Now().Unix()
+
+	if err = db.Save(token); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+//RemoveToken 删除代币合约
+func (wm *WalletManager) RemoveToken(contractID string) error {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return err
+	}
+
+	var token TokenContract
+	if err = db.One("ContractID", contractID, &token); err != nil {
+		return openwallet.Errorf(openwallet.ErrContractNotFound, "contract[%s] is not found", contractID)
+	}
+
+	return db.DeleteStruct(&token)
+}
+
+//GetTokenByID 通过ContractID查找代币合约
+func (wm *WalletManager) GetTokenByID(contractID string) (*TokenContract, error) {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var token TokenContract
+	if err = db.One("ContractID", contractID, &token); err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrContractNotFound, "contract[%s] is not found", contractID)
+	}
+
+	return &token, nil
+}
+
+//GetTokenByAddress 通过合约地址查找代币合约，地址不区分大小写
+func (wm *WalletManager) GetTokenByAddress(symbol, address string) (*TokenContract, error) {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*TokenContract
+	err = db.Find("AddressKey", tokenAddressKey(symbol, address), &tokens)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			return nil, openwallet.Errorf(openwallet.ErrContractNotFound, "[%s] contract address[%s] is not found", symbol, address)
+		}
+		return nil, err
+	}
+
+	//地址大小写不同时ContractID不同，可能有多条记录，优先使用已登记的合约
+	for _, token := range tokens {
+		if token.IsVerified() {
+			return token, nil
+		}
+	}
+
+	return tokens[0], nil
+}
+
+//ListTokens 列出币种的全部代币合约，包括未登记的合约
+func (wm *WalletManager) ListTokens(symbol string) ([]*TokenContract, error) {
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	db, err := wm.openTokenDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*TokenContract
+	err = db.Find("Symbol", strings.ToUpper(symbol), &tokens)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+//LookupToken 通过ContractID或合约地址查找代币合约
+func (wm *WalletManager) LookupToken(symbol, idOrAddress string) (*TokenContract, error) {
+	token, err := wm.GetTokenByID(idOrAddress)
+	if err == nil && strings.EqualFold(token.Symbol, symbol) {
+		return token, nil
+	}
+	return wm.GetTokenByAddress(symbol, idOrAddress)
+}
+
+//fillSmartContract 调用方只传入ContractID或地址时，从注册表补全合约信息
+//只使用已登记的合约，扫块发现的未登记合约的信息不可信
+func (wm *WalletManager) fillSmartContract(symbol string, contract *openwallet.SmartContract) {
+
+	if contract == nil {
+		return
+	}
+
+	var (
+		token *TokenContract
+		err   error
+	)
+	if len(contract.ContractID) > 0 {
+		token, err = wm.GetTokenByID(contract.ContractID)
+	} else if len(contract.Address) > 0 {
+		token, err = wm.GetTokenByAddress(symbol, contract.Address)
+	} else {
+		return
+	}
+	if err != nil || !token.IsVerified() {
+		return
+	}
+
+	if len(contract.ContractID) == 0 {
+		contract.ContractID = token.ContractID
+	}
+	if len(contract.Symbol) == 0 {
+		contract.Symbol = token.Symbol
+	}
+	if len(contract.Address) == 0 {
+		contract.Address = token.Address
+	}
+	if len(contract.Token) == 0 {
+		contract.Token = token.Token
+	}
+	if len(contract.Protocol) == 0 {
+		contract.Protocol = token.Protocol
+	}
+	if len(contract.Name) == 0 {
+		contract.Name = token.Name
+	}
+	if contract.Decimals == 0 {
+		contract.Decimals = token.Decimals
+	}
+	if len(contract.GetABI()) == 0 {
+		contract.SetABI(token.ABI)
+	}
+}
+
+//registerUnverifiedTokens 扫块发现的未知合约登记为未登记状态
+func (wm *WalletManager) registerUnverifiedTokens(receipt *openwallet.SmartContractReceipt) {
+
+	if receipt == nil {
+		return
+	}
+
+	wm.tokenMu.Lock()
+	defer wm.tokenMu.Unlock()
+
+	var db *StormDB
+
+	for _, event := range receipt.Events {
+		if event == nil || event.Contract == nil || len(event.Contract.Address) == 0 {
+			continue
+		}
+
+		contract := *event.Contract
+		if len(contract.Symbol) == 0 {
+			contract.Symbol = receipt.Coin.Symbol
+		}
+		token := NewTokenContract(&contract, TokenStatusUnverified)
+
+		if db == nil {
+			var err error
+			db, err = wm.openTokenDB()
+			if err != nil {
+				log.Errorf("open token db failed, unexpected error: %v", err)
+				return
+			}
+		}
+
+		var exist TokenContract
+		if db.One("ContractID", token.ContractID, &exist) == nil {
+			continue
+		}
+
+		token.CreateTime = time.Now().Unix()
+		token.UpdateTime = token.CreateTime
+		if err := db.Save(token); err != nil {
+			log.Errorf("save unverified token[%s] failed, unexpected error: %v", token.Address, err)
+			continue
+		}
+		log.Infof("[%s] found unverified token contract: %s", token.Symbol, token.Address)
+	}
+}
+
+//tokenABIDAI 基于代币合约注册表的ABI数据访问接口
+type tokenABIDAI struct {
+	wm     *WalletManager
+	symbol string
+}
+
+//TokenABIDAI 获取币种的ABI数据访问接口，提供给智能合约解析器
+func (wm *WalletManager) TokenABIDAI(symbol string) openwallet.ABIDAI {
+	return &tokenABIDAI{wm: wm, symbol: strings.ToUpper(symbol)}
+}
+
+//GetABIInfo 获取合约ABI
+func (dai *tokenABIDAI) GetABIInfo(address string) (*openwallet.ABIInfo, error) {
+
+	token, err := dai.wm.GetTokenByAddress(dai.symbol, address)
+	if err != nil {
+		return nil, err
+	}
+	if len(token.ABI) == 0 {
+		return nil, fmt.Errorf("[%s] contract address[%s] has no abi", dai.symbol, address)
+	}
+
+	var abi interface{}
+	if err = json.Unmarshal([]byte(token.ABI), &abi); err != nil {
+		return nil, fmt.Errorf("[%s] contract address[%s] abi is invalid: %v", dai.symbol, address, err)
+	}
+
+	return &openwallet.ABIInfo{Address: token.Address, ABI: abi}, nil
+}
+
+//SetABIInfo 保存合约ABI，合约未注册时登记为未登记状态
+func (dai *tokenABIDAI) SetABIInfo(address string, abi openwallet.ABIInfo) error {
+
+	var abiJSON string
+	switch v := abi.ABI.(type) {
+	case string:
+		abiJSON = v
+	case []byte:
+		abiJSON = string(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		abiJSON = string(b)
+	}
+
+	token, err := dai.wm.GetTokenByAddress(dai.symbol, address)
+	if err != nil {
+		token = NewTokenContract(&openwallet.SmartContract{Symbol: dai.symbol, Address: address}, TokenStatusUnverified)
+		token.CreateTime = time.Now().Unix()
+	}
+	token.ABI = abiJSON
+	token.UpdateTime = time.Now().Unix()
+
+	dai.wm.tokenMu.Lock()
+	defer dai.wm.tokenMu.Unlock()
+
+	db, err := dai.wm.openTokenDB()
+	if err != nil {
+		return err
+	}
+
+	return db.Save(token)
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openw
+
+import (
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestWalletManager_RegisterToken(t *testing.T) {
+
+	wm, cleanup := newTestManager(t, nil)
+	defer cleanup()
+
+	contract := &openwallet.SmartContract{
+		Symbol:   "eth",
+		Address:  "0xAbCdEf",
+		Token:    "USDT",
+		Protocol: "erc20",
+		Decimals: 6,
+	}
+	contract.SetABI(`[{"name":"transfer","type":"function"}]`)
+
+	token, err := wm.RegisterToken(contract)
+	if err != nil {
+		t.Errorf("RegisterToken failed, unexpected error: %v", err)
+		return
+	}
+	if token.ContractID != openwallet.GenContractID("ETH", "0xAbCdEf") || !token.IsVerified() {
+		t.Errorf("token = %+v", token)
+	}
+
+	found, err := wm.LookupToken("ETH", "0xabcdef")
+	if err != nil || found.ContractID != token.ContractID {
+		t.Errorf("LookupToken by address = %+v, %v", found, err)
+	}
+	found, err = wm.LookupToken("ETH", token.ContractID)
+	if err != nil || found.Token != "USDT" {
+		t.Errorf("LookupToken by id = %+v, %v", found, err)
+	}
+
+	//只传入ContractID时补全合约信息
+	partial := &openwallet.SmartContract{ContractID: token.ContractID}
+	wm.fillSmartContract("ETH", partial)
+	if partial.Decimals != 6 || partial.Address != "0xAbCdEf" || len(partial.GetABI()) == 0 {
+		t.Errorf("fillSmartContract = %+v", partial)
+	}
+
+	//ABIDAI
+	dai := wm.TokenABIDAI("ETH")
+	abi, err := dai.GetABIInfo("0xabcdef")
+	if err != nil {
+		t.Errorf("GetABIInfo failed, unexpected error: %v", err)
+		return
+	}
+	if list, ok := abi.ABI.([]interface{}); !ok || len(list) != 1 {
+		t.Errorf("abi = %+v", abi.ABI)
+	}
+	err = dai.SetABIInfo("0x123456", openwallet.ABIInfo{ABI: []map[string]string{{"name": "approve"}}})
+	if err != nil {
+		t.Errorf("SetABIInfo failed, unexpected error: %v", err)
+	}
+
+	//扫块发现未知合约
+	wm.BlockExtractSmartContractDataNotify("", &openwallet.SmartContractReceipt{
+		Coin: openwallet.Coin{Symbol: "ETH"},
+		Events: []*openwallet.SmartContractEvent{
+			{Contract: &openwallet.SmartContract{Address: "0x999999"}, Event: "Transfer"},
+			{Contract: &openwallet.SmartContract{Symbol: "ETH", Address: "0xAbCdEf"}, Event: "Transfer"},
+		},
+	})
+
+	tokens, err := wm.ListTokens("ETH")
+	if err != nil || len(tokens) != 3 {
+		t.Errorf("ListTokens = %d, %v, want 3", len(tokens), err)
+	}
+	unknown, err := wm.GetTokenByAddress("ETH", "0x999999")
+	if err != nil || unknown.Status != TokenStatusUnverified {
+		t.Errorf("unverified token = %+v, %v", unknown, err)
+	}
+	if found, _ = wm.GetTokenByID(token.ContractID); found == nil || !found.IsVerified() {
+		t.Errorf("registered token should stay verified")
+	}
+
+	//未登记的合约不用于补全合约信息
+	partial = &openwallet.SmartContract{Address: "0x999999"}
+	wm.fillSmartContract("ETH", partial)
+	if len(partial.ContractID) > 0 {
+		t.Errorf("fillSmartContract with unverified token = %+v", partial)
+	}
+
+	if err = wm.RemoveToken(unknown.ContractID); err != nil {
+		t.Errorf("RemoveToken failed, unexpected error: %v", err)
+	}
+	if _, err = wm.GetTokenByID(unknown.ContractID); openwallet.ConvertError(err).Code() != openwallet.ErrContractNotFound {
+		t.Errorf("removed token should not be found, got: %v", err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	"github.com/shopspring/decimal"
 )
@@ -66,6 +67,7 @@ func (wm *WalletManager) CreateErc20TokenTransaction(appID, walletID, accountID,
 		return nil, fmt.Errorf("[%s] is not support transaction. ", account.Symbol)
 	}
 	err = txdecoder.CreateRawTransaction(wrapper, &rawTx)
+	metrics.ObserveTxOperation(account.Symbol, txOperationCreate, err)
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +120,7 @@ func (wm *WalletManager) CreateQrc20TokenTransaction(appID, walletID, accountID,
 		return nil, fmt.Errorf("[%s] is not support transaction. ", account.Symbol)
 	}
 	err = txdecoder.CreateRawTransaction(wrapper, &rawTx)
+	metrics.ObserveTxOperation(account.Symbol, txOperationCreate, err)
 	if err != nil {
 		return nil, err
 	}
@@ -129,6 +132,11 @@ func (wm *WalletManager) CreateQrc20TokenTransaction(appID, walletID, accountID,
 
 // CreateTransaction
 func (wm *WalletManager) CreateTransaction(appID, walletID, accountID, amount, address, feeRate, memo string, contract *openwallet.SmartContract) (*openwallet.RawTransaction, error) {
+	return wm.createRawTransaction(appID, accountID, map[string]string{address: amount}, feeRate, memo, contract)
+}
+
+//createRawTransaction 创建交易单，to为目的地址:转账数量
+func (wm *WalletManager) createRawTransaction(appID, accountID string, to map[string]string, feeRate, memo string, contract *openwallet.SmartContract) (*openwallet.RawTransaction, error) {
 
 	var (
 		coin openwallet.Coin
@@ -149,6 +157,7 @@ func (wm *WalletManager) CreateTransaction(appID, walletID, accountID, amount, a
 		return nil, err
 	}
 	//fmt.Println("contract:", contract)
+	wm.fillSmartContract(account.Symbol, contract)
 	if contract != nil {
 		coin = openwallet.Coin{
 			Symbol:     account.Symbol,
@@ -168,7 +177,7 @@ func (wm *WalletManager) CreateTransaction(appID, walletID, accountID, amount, a
 		Coin:     coin,
 		Account:  account,
 		FeeRate:  feeRate,
-		To:       map[string]string{address: amount},
+		To:       to,
 		Required: 1,
 	}
 
@@ -182,6 +191,7 @@ func (wm *WalletManager) CreateTransaction(appID, walletID, accountID, amount, a
 	}
 
 	err = txdecoder.CreateRawTransaction(wrapper, &rawTx)
+	metrics.ObserveTxOperation(account.Symbol, txOperationCreate, err)
 	if err != nil {
 		return nil, err
 	}
@@ -221,7 +231,9 @@ func (wm *WalletManager) SignTransaction(appID, walletID, accountID, password st
 	}
 
 	err = txdecoder.SignRawTransaction(wrapper, rawTx)
+	metrics.ObserveTxOperation(account.Symbol, txOperationSign, err)
 	if err != nil {
+		wm.failNonceReservation(rawTx)
 		return nil, err
 	}
 
@@ -287,10 +299,15 @@ func (wm *WalletManager) SubmitTransaction(appID, walletID, accountID string, ra
 	}
 
 	tx, err := txdecoder.SubmitRawTransaction(wrapper, rawTx)
+	metrics.ObserveTxOperation(account.Symbol, txOperationSubmit, err)
 	if err != nil {
+		wm.failNonceReservation(rawTx)
 		return nil, err
 	}
 
+	//记录预留nonce对应的交易，替换交易更新为新的交易单ID
+	wm.commitNonceReservation(rawTx, tx.TxID)
+
 	log.Debug("transaction has been submitted successfully")
 
 	log.Info("Save new transaction data successfully")
@@ -306,6 +323,12 @@ func (wm *WalletManager) SubmitTransaction(appID, walletID, accountID string, ra
 		return tx, nil
 	}
 
+	//记录交易的生命周期，加速交易关联原交易
+	err = wm.recordTxLifecycle(appID, account, rawTx, tx)
+	if err != nil {
+		log.Errorf("record transaction[%s] lifecycle failed, unexpected error: %v", tx.TxID, err)
+	}
+
 	return tx, nil
 	//return perfectTx, nil
 }
@@ -406,10 +429,15 @@ func (wm *WalletManager) GetAssetsAccountTokenBalance(appID, walletID, accountID
 		return nil, err
 	}
 
+	wm.fillSmartContract(account.Symbol, &contract)
+
 	//提取交易单
+	if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilitySmartContract); capErr != nil {
+		return nil, capErr
+	}
 	smartContractDecoder := assetsMgr.GetSmartContractDecoder()
 	if smartContractDecoder == nil {
-		return nil, fmt.Errorf("[%s] not support smart contract", account.Symbol)
+		return nil, openwallet.Errorf(openwallet.ErrUnsupportedCapability, "[%s] is not support %s", account.Symbol, openwallet.CapabilitySmartContract)
 	}
 
 	accountBalanceDec := decimal.New(0, 0)
@@ -535,6 +563,10 @@ func (wm *WalletManager) GetEstimateFeeRate(coin openwallet.Coin) (feeRate strin
 		return "", "", err
 	}
 
+	if capErr := checkCapability(coin.Symbol, assetsMgr, openwallet.CapabilityEstimateFee); capErr != nil {
+		return "", "", capErr
+	}
+
 	txDecoder := assetsMgr.GetTransactionDecoder()
 	if txDecoder == nil {
 		return "", "", fmt.Errorf("[%s] is not support transaction. ", coin.Symbol)
@@ -544,6 +576,42 @@ func (wm *WalletManager) GetEstimateFeeRate(coin openwallet.Coin) (feeRate strin
 
 }
 
+//EstimateTransactionFee 预估交易单的手续费，结果填充到rawTx的Fees及FeeRate
+func (wm *WalletManager) EstimateTransactionFee(appID, walletID, accountID string, rawTx *openwallet.RawTransaction) (*openwallet.RawTransaction, error) {
+
+	wrapper, err := wm.NewWalletWrapper(appID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	assetsMgr, err := GetAssetsAdapter(account.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilityEstimateFee); capErr != nil {
+		return nil, capErr
+	}
+
+	txdecoder := assetsMgr.GetTransactionDecoder()
+	if txdecoder == nil {
+		return nil, fmt.Errorf("[%s] is not support transaction. ", account.Symbol)
+	}
+
+	rawTx.Account = account
+	err = txdecoder.EstimateRawTransactionFee(wrapper, rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	return rawTx, nil
+}
+
 // CreateSummaryTransaction
 func (wm *WalletManager) CreateSummaryTransaction(
 	appID, walletID, accountID, summaryAddress, minTransfer, retainedBalance, feeRate string,
@@ -569,6 +637,7 @@ func (wm *WalletManager) CreateSummaryTransaction(
 		return nil, err
 	}
 
+	wm.fillSmartContract(account.Symbol, contract)
 	if contract != nil {
 		coin = openwallet.Coin{
 			Symbol:     account.Symbol,
@@ -601,6 +670,7 @@ func (wm *WalletManager) CreateSummaryTransaction(
 	}
 
 	rawTxArray, err := txdecoder.CreateSummaryRawTransaction(wrapper, &sumTx)
+	metrics.ObserveTxOperation(account.Symbol, txOperationCreate, err)
 	if err != nil {
 		return nil, err
 	}
@@ -618,6 +688,22 @@ func (wm *WalletManager) CreateSummaryRawTransactionWithError(
 	feeSupportAccount *openwallet.FeesSupportAccount,
 ) ([]*openwallet.RawTransactionWithError, error) {
 
+	sumTx := openwallet.SummaryRawTransaction{
+		FeeRate:            feeRate,
+		SummaryAddress:     summaryAddress,
+		MinTransfer:        minTransfer,
+		RetainedBalance:    retainedBalance,
+		AddressStartIndex:  start,
+		AddressLimit:       limit,
+		FeesSupportAccount: feeSupportAccount,
+	}
+
+	return wm.createSummaryRawTransactionWithError(appID, accountID, contract, &sumTx)
+}
+
+//createSummaryRawTransactionWithError 创建汇总交易单，sumTx的Coin及Account由账户信息填充
+func (wm *WalletManager) createSummaryRawTransactionWithError(appID, accountID string, contract *openwallet.SmartContract, sumTx *openwallet.SummaryRawTransaction) ([]*openwallet.RawTransactionWithError, error) {
+
 	var (
 		coin openwallet.Coin
 	)
@@ -637,6 +723,13 @@ func (wm *WalletManager) CreateSummaryRawTransactionWithError(
 		return nil, err
 	}
 
+	if sumTx.FeesSupportAccount != nil {
+		if capErr := checkCapability(account.Symbol, assetsMgr, openwallet.CapabilitySummaryWithFee); capErr != nil {
+			return nil, capErr
+		}
+	}
+
+	wm.fillSmartContract(account.Symbol, contract)
 	if contract != nil {
 		coin = openwallet.Coin{
 			Symbol:     account.Symbol,
@@ -652,24 +745,16 @@ func (wm *WalletManager) CreateSummaryRawTransactionWithError(
 		}
 	}
 
-	sumTx := openwallet.SummaryRawTransaction{
-		Coin:               coin,
-		Account:            account,
-		FeeRate:            feeRate,
-		SummaryAddress:     summaryAddress,
-		MinTransfer:        minTransfer,
-		RetainedBalance:    retainedBalance,
-		AddressStartIndex:  start,
-		AddressLimit:       limit,
-		FeesSupportAccount: feeSupportAccount,
-	}
+	sumTx.Coin = coin
+	sumTx.Account = account
 
 	txdecoder := assetsMgr.GetTransactionDecoder()
 	if txdecoder == nil {
 		return nil, fmt.Errorf("[%s] is not support transaction. ", account.Symbol)
 	}
 
-	rawTxArray, err := txdecoder.CreateSummaryRawTransactionWithError(wrapper, &sumTx)
+	rawTxArray, err := txdecoder.CreateSummaryRawTransactionWithError(wrapper, sumTx)
+	metrics.ObserveTxOperation(account.Symbol, txOperationCreate, err)
 	if err != nil {
 		return nil, err
 	}
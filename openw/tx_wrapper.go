@@ -17,6 +17,9 @@ package openw
 
 import (
 	"fmt"
+	"strings"
+
+	"github.com/asdine/storm"
 	"github.com/asdine/storm/q"
 	"github.com/blocktree/openwallet/v2/common"
 	"github.com/blocktree/openwallet/v2/openwallet"
@@ -258,6 +261,34 @@ func (wrapper *TransactionWrapper) SaveBlockExtractData(accountID string, data *
 	return nil
 }
 
+//IsBlockExtractDataSaved 区块提取的交易是否已在同一区块保存过
+func (wrapper *TransactionWrapper) IsBlockExtractDataSaved(data *openwallet.TxExtractData) bool {
+
+	if data == nil || data.Transaction == nil {
+		return false
+	}
+
+	wxID := data.Transaction.WxID
+	if len(wxID) == 0 {
+		wxID = openwallet.GenTransactionWxID(data.Transaction)
+	}
+
+	//打开数据库
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return false
+	}
+	defer wrapper.CloseDB()
+
+	var saved openwallet.Transaction
+	err = db.One("WxID", wxID, &saved)
+	if err != nil {
+		return false
+	}
+
+	return saved.BlockHash == data.Transaction.BlockHash && saved.Status == data.Transaction.Status
+}
+
 //DeleteBlockDataByHeight 删除钱包中指定区块高度相关的交易记录
 func (wrapper *TransactionWrapper) DeleteBlockDataByHeight(height uint64) error {
 
@@ -275,37 +306,40 @@ func (wrapper *TransactionWrapper) DeleteBlockDataByHeight(height uint64) error
 
 	defer tx.Rollback()
 
-	trxs, err := wrapper.GetTransactions(0, -1, "BlockHeight", height)
-	if err != nil {
+	var trxs []*openwallet.Transaction
+	err = tx.Find("BlockHeight", height, &trxs)
+	if err != nil && err != storm.ErrNotFound {
 		return err
 	}
 
 	for _, obj := range trxs {
-		err = db.DeleteStruct(&obj)
+		err = tx.DeleteStruct(obj)
 		if err != nil {
 			return err
 		}
 	}
 
-	inputs, err := wrapper.GetTxInputs(0, -1, "BlockHeight", height)
-	if err != nil {
+	var inputs []*openwallet.TxInput
+	err = tx.Find("BlockHeight", height, &inputs)
+	if err != nil && err != storm.ErrNotFound {
 		return err
 	}
 
 	for _, obj := range inputs {
-		err = db.DeleteStruct(&obj)
+		err = tx.DeleteStruct(obj)
 		if err != nil {
 			return err
 		}
 	}
 
-	outputs, err := wrapper.GetTxOutputs(0, -1, "BlockHeight", height)
-	if err != nil {
+	var outputs []*openwallet.TxOutPut
+	err = tx.Find("BlockHeight", height, &outputs)
+	if err != nil && err != storm.ErrNotFound {
 		return err
 	}
 
 	for _, obj := range outputs {
-		err = db.DeleteStruct(&obj)
+		err = tx.DeleteStruct(obj)
 		if err != nil {
 			return err
 		}
@@ -313,3 +347,75 @@ func (wrapper *TransactionWrapper) DeleteBlockDataByHeight(height uint64) error
 
 	return tx.Commit()
 }
+
+//symbolFieldMatcher 不区分大小写匹配币种字段
+type symbolFieldMatcher string
+
+func (m symbolFieldMatcher) MatchField(v interface{}) (bool, error) {
+	symbol, ok := v.(string)
+	if !ok {
+		return false, nil
+	}
+	return strings.EqualFold(symbol, string(m)), nil
+}
+
+//RollbackBlockData 回滚分叉高度(包含)以上指定币种的全部区块提取数据及余额快照
+//区块高度只在同一条链内有意义，symbol不能为空，返回被删除的交易单，用于通知观察者
+func (wrapper *TransactionWrapper) RollbackBlockData(symbol string, height uint64) ([]*openwallet.Transaction, error) {
+
+	if len(symbol) == 0 {
+		return nil, fmt.Errorf("rollback block data requires symbol")
+	}
+
+	recordMatcher := q.And(q.Gte("BlockHeight", height), q.NewFieldMatcher("Coin", coinSymbolMatcher(symbol)))
+	snapshotMatcher := q.And(q.Gte("Height", height), q.NewFieldMatcher("Symbol", symbolFieldMatcher(symbol)))
+
+	//打开数据库
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return nil, err
+	}
+	defer wrapper.CloseDB()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var trxs []*openwallet.Transaction
+	err = tx.Select(recordMatcher).Find(&trxs)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	for _, obj := range trxs {
+		err = tx.DeleteStruct(obj)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Select(recordMatcher).Delete(new(openwallet.TxInput))
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	err = tx.Select(recordMatcher).Delete(new(openwallet.TxOutPut))
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	err = tx.Select(snapshotMatcher).Delete(new(BalanceSnapshot))
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return trxs, nil
+}
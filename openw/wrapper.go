@@ -16,11 +16,14 @@
 package openw
 
 import (
+	"fmt"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	"sync"
 	"time"
 
 	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/common"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -29,10 +32,11 @@ type WrapperSourceFile string
 // Wrapper 基于OpenWallet钱包体系模型，专门处理钱包的持久化问题，关系数据查询
 type Wrapper struct {
 	openwallet.WalletDAIBase
-	sourceDB     *StormDB     //存储钱包相关数据的数据库，目前使用boltdb作为持久方案
-	mu           sync.RWMutex //锁
-	isExternalDB bool         //是否外部加载的数据库，非内部打开，内部打开需要关闭
-	sourceFile   string       //钱包数据库文件路径，用于内部打开
+	sourceDB     *StormDB                 //存储钱包相关数据的数据库，目前使用boltdb作为持久方案
+	mu           sync.RWMutex             //锁
+	isExternalDB bool                     //是否外部加载的数据库，非内部打开，内部打开需要关闭
+	sourceFile   string                   //钱包数据库文件路径，用于内部打开
+	nonceManager *openwallet.NonceManager //账户模型链的nonce管理器
 }
 
 func NewWrapper(args ...interface{}) *Wrapper {
@@ -52,6 +56,8 @@ func NewWrapper(args ...interface{}) *Wrapper {
 			}
 		case WrapperSourceFile:
 			wrapper.sourceFile = string(obj)
+		case *openwallet.NonceManager:
+			wrapper.nonceManager = obj
 		}
 	}
 
@@ -120,3 +126,42 @@ func (wrapper *Wrapper) CloseDB() {
 		}
 	}
 }
+
+//findRecords 根据条件查询记录，to为记录数组指针，cols为字段与值成对的条件
+func (wrapper *Wrapper) findRecords(to interface{}, offset, limit int, cols ...interface{}) error {
+
+	//打开数据库
+	db, err := wrapper.OpenStormDB()
+	if err != nil {
+		return err
+	}
+	defer wrapper.CloseDB()
+
+	query := make([]q.Matcher, 0)
+
+	if len(cols)%2 != 0 {
+		return fmt.Errorf("condition param is not pair")
+	}
+
+	for i := 0; i < len(cols); i = i + 2 {
+		field := common.NewString(cols[i])
+		val := cols[i+1]
+		query = append(query, q.Eq(field.String(), val))
+	}
+
+	if limit > 0 {
+		err = db.Select(q.And(
+			query...,
+		)).Limit(limit).Skip(offset).Find(to)
+	} else {
+		err = db.Select(q.And(
+			query...,
+		)).Skip(offset).Find(to)
+	}
+
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package abi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/crypto/sha3"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	MethodTypeFunction    = "function"
+	MethodTypeConstructor = "constructor"
+	MethodTypeEvent       = "event"
+	MethodTypeFallback    = "fallback"
+	MethodTypeReceive     = "receive"
+)
+
+//Argument 方法参数或返回值
+type Argument struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Indexed    bool       `json:"indexed"` //事件参数是否在topics中
+	Components []Argument `json:"components"`
+	typ        *Type
+}
+
+//Method ABI中的方法、构造函数或事件
+type Method struct {
+	Name            string     `json:"name"`
+	Type            string     `json:"type"`
+	Inputs          []Argument `json:"inputs"`
+	Outputs         []Argument `json:"outputs"`
+	StateMutability string     `json:"stateMutability"`
+	Constant        bool       `json:"constant"`
+	Payable         bool       `json:"payable"`
+	Anonymous       bool       `json:"anonymous"`
+
+	Sig string `json:"-"` //方法签名，例如：transfer(address,uint256)
+	ID  []byte `json:"-"` //方法选择器为签名哈希前4字节，事件为签名哈希
+}
+
+//IsConstant 是否只读方法，调用不产生交易
+func (m *Method) IsConstant() bool {
+	return m.Constant || m.StateMutability == "view" || m.StateMutability == "pure"
+}
+
+func (m *Method) inputTypes() []*Type {
+	types := make([]*Type, len(m.Inputs))
+	for i := range m.Inputs {
+		types[i] = m.Inputs[i].typ
+	}
+	return types
+}
+
+func (m *Method) outputTypes() []*Type {
+	types := make([]*Type, len(m.Outputs))
+	for i := range m.Outputs {
+		types[i] = m.Outputs[i].typ
+	}
+	return types
+}
+
+//ABI 合约接口定义
+type ABI struct {
+	Constructor *Method
+	Methods     []*Method
+	Events      []*Method
+}
+
+//Keccak256 计算keccak256哈希
+func Keccak256(data []byte) []byte {
+	h := sha3.NewKeccak256()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func resolveArguments(args []Argument) error {
+	for i := range args {
+		t, err := NewType(args[i].Type, args[i].Components)
+		if err != nil {
+			return err
+		}
+		args[i].typ = t
+	}
+	return nil
+}
+
+//Parse 解析ABI JSON
+func Parse(abiJSON string) (*ABI, error) {
+
+	var methods []*Method
+	if err := json.Unmarshal([]byte(abiJSON), &methods); err != nil {
+		return nil, fmt.Errorf("abi: invalid abi json: %v", err)
+	}
+
+	abi := &ABI{}
+	for _, m := range methods {
+		if len(m.Type) == 0 {
+			m.Type = MethodTypeFunction
+		}
+		if err := resolveArguments(m.Inputs); err != nil {
+			return nil, err
+		}
+		if err := resolveArguments(m.Outputs); err != nil {
+			return nil, err
+		}
+
+		types := make([]string, len(m.Inputs))
+		for i, input := range m.Inputs {
+			types[i] = input.typ.String()
+		}
+		m.Sig = fmt.Sprintf("%s(%s)", m.Name, strings.Join(types, ","))
+
+		switch m.Type {
+		case MethodTypeFunction:
+			m.ID = Keccak256([]byte(m.Sig))[:4]
+			abi.Methods = append(abi.Methods, m)
+		case MethodTypeEvent:
+			m.ID = Keccak256([]byte(m.Sig))
+			abi.Events = append(abi.Events, m)
+		case MethodTypeConstructor:
+			abi.Constructor = m
+		}
+	}
+
+	return abi, nil
+}
+
+//FromABIInfo 解析ABIDAI保存的ABI，ABI可以是JSON字符串或已解码的JSON对象
+func FromABIInfo(info *openwallet.ABIInfo) (*ABI, error) {
+	if info == nil || info.ABI == nil {
+		return nil, fmt.Errorf("abi: abi info is empty")
+	}
+	switch v := info.ABI.(type) {
+	case string:
+		return Parse(v)
+	case []byte:
+		return Parse(string(v))
+	}
+	b, err := json.Marshal(info.ABI)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(string(b))
+}
+
+//FromSmartContract 解析合约保存的ABI
+func FromSmartContract(contract *openwallet.SmartContract) (*ABI, error) {
+	if contract == nil || len(contract.GetABI()) == 0 {
+		return nil, fmt.Errorf("abi: contract has no abi")
+	}
+	return Parse(contract.GetABI())
+}
+
+//Method 查找方法，name可以是方法名或完整签名
+//同名的重载方法按参数数量匹配，argc为-1时不检查参数数量
+func (abi *ABI) Method(name string, argc int) (*Method, error) {
+	var matched []*Method
+	for _, m := range abi.Methods {
+		if m.Sig == name {
+			return m, nil
+		}
+		if m.Name == name && (argc < 0 || len(m.Inputs) == argc) {
+			matched = append(matched, m)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return nil, fmt.Errorf("abi: method %q is not found", name)
+	case 1:
+		return matched[0], nil
+	}
+	return nil, fmt.Errorf("abi: method %q is ambiguous, use the full signature", name)
+}
+
+//Event 通过事件名或完整签名查找事件
+func (abi *ABI) Event(name string) (*Method, error) {
+	for _, e := range abi.Events {
+		if e.Name == name || e.Sig == name {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("abi: event %q is not found", name)
+}
+
+//EventByID 通过topics[0]查找事件
+func (abi *ABI) EventByID(topic []byte) (*Method, error) {
+	for _, e := range abi.Events {
+		if !e.Anonymous && string(e.ID) == string(topic) {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("abi: event topic 0x%x is not found", topic)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package abi
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+const testABI = `[
+	{"type":"function","name":"transfer","stateMutability":"nonpayable",
+	 "inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],
+	 "outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"balanceOf","stateMutability":"view",
+	 "inputs":[{"name":"owner","type":"address"}],
+	 "outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"f",
+	 "inputs":[{"name":"a","type":"uint"},{"name":"b","type":"uint32[]"},{"name":"c","type":"bytes10"},{"name":"d","type":"bytes"}],
+	 "outputs":[]},
+	{"type":"function","name":"order",
+	 "inputs":[{"name":"o","type":"tuple","components":[{"name":"id","type":"int64"},{"name":"memo","type":"string"},{"name":"tags","type":"bytes32[2]"}]}],
+	 "outputs":[{"name":"o","type":"tuple","components":[{"name":"id","type":"int64"},{"name":"memo","type":"string"},{"name":"tags","type":"bytes32[2]"}]}]},
+	{"type":"event","name":"Transfer","anonymous":false,
+	 "inputs":[{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true},{"name":"value","type":"uint256","indexed":false}]},
+	{"type":"constructor","inputs":[{"name":"supply","type":"uint256"}]}
+]`
+
+func words(s ...string) string {
+	return strings.Join(s, "")
+}
+
+func TestABI_Pack(t *testing.T) {
+
+	abi, err := Parse(testABI)
+	if err != nil {
+		t.Fatalf("Parse failed, unexpected error: %v", err)
+	}
+
+	m, _ := abi.Method("transfer", -1)
+	if hex.EncodeToString(m.ID) != "a9059cbb" || m.IsConstant() {
+		t.Errorf("transfer id = %x", m.ID)
+	}
+	if m, _ := abi.Method("balanceOf(address)", -1); m == nil || !m.IsConstant() {
+		t.Errorf("balanceOf should be constant")
+	}
+
+	data, err := abi.PackABIParam([]string{"transfer", "0x00000000000000000000000000000000000000ff", "1000"})
+	if err != nil {
+		t.Fatalf("Pack failed, unexpected error: %v", err)
+	}
+	want := words("a9059cbb",
+		"00000000000000000000000000000000000000000000000000000000000000ff",
+		"00000000000000000000000000000000000000000000000000000000000003e8")
+	if hex.EncodeToString(data) != want {
+		t.Errorf("transfer data = %x", data)
+	}
+
+	//solidity文档中的动态类型编码示例
+	data, err = abi.Pack("f", "0x123", "[1110, 1929]", "0x31323334353637383930", "0x48656c6c6f2c20776f726c6421")
+	if err != nil {
+		t.Fatalf("Pack failed, unexpected error: %v", err)
+	}
+	want = words("8be65246",
+		"0000000000000000000000000000000000000000000000000000000000000123",
+		"0000000000000000000000000000000000000000000000000000000000000080",
+		"3132333435363738393000000000000000000000000000000000000000000000",
+		"00000000000000000000000000000000000000000000000000000000000000e0",
+		"0000000000000000000000000000000000000000000000000000000000000002",
+		"0000000000000000000000000000000000000000000000000000000000000456",
+		"0000000000000000000000000000000000000000000000000000000000000789",
+		"000000000000000000000000000000000000000000000000000000000000000d",
+		"48656c6c6f2c20776f726c642100000000000000000000000000000000000000")
+	if hex.EncodeToString(data) != want {
+		t.Errorf("f data = %x", data)
+	}
+
+	if _, err = abi.Pack("transfer", "0xff", "1"); err == nil {
+		t.Errorf("short address should fail")
+	}
+	if _, err = abi.Pack("transfer", "0x00000000000000000000000000000000000000ff", "-1"); err == nil {
+		t.Errorf("negative uint should fail")
+	}
+
+	data, err = abi.PackConstructor("21000000")
+	if err != nil || len(data) != 32 {
+		t.Errorf("PackConstructor = %x, %v", data, err)
+	}
+}
+
+func TestABI_Unpack(t *testing.T) {
+
+	abi, err := Parse(testABI)
+	if err != nil {
+		t.Fatalf("Parse failed, unexpected error: %v", err)
+	}
+
+	values, err := abi.UnpackOutputs("balanceOf", "0x00000000000000000000000000000000000000000000000000000000000003e8")
+	if err != nil || values["0"] != "1000" {
+		t.Errorf("balanceOf outputs = %v, %v", values, err)
+	}
+
+	//元组编码后解码
+	order, _ := abi.Method("order", 1)
+	data, err := order.PackArguments(`{"id":-5,"memo":"hello","tags":["0x01","0x02"]}`)
+	if err != nil {
+		t.Fatalf("Pack tuple failed, unexpected error: %v", err)
+	}
+	values, err = order.UnpackOutputs(data)
+	if err != nil {
+		t.Fatalf("Unpack tuple failed, unexpected error: %v", err)
+	}
+	want := `{"o":{"id":"-5","memo":"hello","tags":["0x0100000000000000000000000000000000000000000000000000000000000000","0x0200000000000000000000000000000000000000000000000000000000000000"]}}`
+	if values.JSON() != want {
+		t.Errorf("tuple json = %s", values.JSON())
+	}
+
+	//调用数据解码
+	call, _ := abi.Pack("transfer", "0x00000000000000000000000000000000000000ff", "1000")
+	m, values, err := abi.UnpackInputs(call)
+	if err != nil || m.Name != "transfer" || values["value"] != "1000" {
+		t.Errorf("UnpackInputs = %v, %v", values, err)
+	}
+
+	//事件日志
+	event, values, err := abi.UnpackLogHex([]string{
+		"0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef",
+		"0x000000000000000000000000000000000000000000000000000000000000000a",
+		"0x000000000000000000000000000000000000000000000000000000000000000b",
+	}, "0x00000000000000000000000000000000000000000000000000000000000003e8")
+	if err != nil {
+		t.Fatalf("UnpackLog failed, unexpected error: %v", err)
+	}
+	if event.Name != "Transfer" || values["from"] != "0x000000000000000000000000000000000000000a" || values["value"] != "1000" {
+		t.Errorf("Transfer event = %s", values.JSON())
+	}
+
+	if _, err = abi.UnpackOutputs("balanceOf", "0x01"); err == nil {
+		t.Errorf("short data should fail")
+	}
+}
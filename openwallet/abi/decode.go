@@ -0,0 +1,271 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package abi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+//Values 解码结果，按参数名称保存，没有名称的参数使用序号
+//整数输出为十进制字符串，address、bytes输出为0x开头的十六进制字符串，元组输出为对象
+type Values map[string]interface{}
+
+//JSON 转为JSON字符串，用于SmartContractCallResult.Value及SmartContractEvent.Value
+func (v Values) JSON() string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func argumentKey(i int, name string) string {
+	if len(name) > 0 {
+		return name
+	}
+	return strconv.Itoa(i)
+}
+
+//UnpackOutputs 解码方法返回数据
+func (m *Method) UnpackOutputs(data []byte) (Values, error) {
+	list, err := unpackTuple(m.outputTypes(), data)
+	if err != nil {
+		return nil, fmt.Errorf("abi: %s: %v", m.Sig, err)
+	}
+	values := make(Values)
+	for i, output := range m.Outputs {
+		values[argumentKey(i, output.Name)] = list[i]
+	}
+	return values, nil
+}
+
+//UnpackOutputs 解码方法返回数据，data为十六进制字符串
+func (abi *ABI) UnpackOutputs(method string, dataHex string) (Values, error) {
+	m, err := abi.Method(method, -1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := toBytes(dataHex)
+	if err != nil {
+		return nil, fmt.Errorf("abi: %v", err)
+	}
+	return m.UnpackOutputs(data)
+}
+
+//UnpackInputs 解码调用数据，用于解析交易中的合约调用，data包括4字节方法选择器
+func (abi *ABI) UnpackInputs(data []byte) (*Method, Values, error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("abi: call data is too short")
+	}
+	for _, m := range abi.Methods {
+		if string(m.ID) != string(data[:4]) {
+			continue
+		}
+		list, err := unpackTuple(m.inputTypes(), data[4:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("abi: %s: %v", m.Sig, err)
+		}
+		values := make(Values)
+		for i, input := range m.Inputs {
+			values[argumentKey(i, input.Name)] = list[i]
+		}
+		return m, values, nil
+	}
+	return nil, nil, fmt.Errorf("abi: method id 0x%x is not found", data[:4])
+}
+
+//UnpackLog 解码事件日志，topics[0]为事件签名哈希
+//indexed参数从topics解码，动态类型的indexed参数只能得到哈希值
+func (abi *ABI) UnpackLog(topics [][]byte, data []byte) (*Method, Values, error) {
+
+	if len(topics) == 0 {
+		return nil, nil, fmt.Errorf("abi: log has no topics")
+	}
+
+	event, err := abi.EventByID(topics[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		values   = make(Values)
+		topicPos = 1
+		dataArgs = make([]Argument, 0)
+	)
+
+	for i, input := range event.Inputs {
+		if !input.Indexed {
+			dataArgs = append(dataArgs, input)
+			continue
+		}
+		if topicPos >= len(topics) {
+			return nil, nil, fmt.Errorf("abi: %s: indexed argument #%d is missing in topics", event.Sig, i)
+		}
+		topic := topics[topicPos]
+		topicPos++
+		if input.typ.IsDynamic() || input.typ.Kind == KindArray || input.typ.Kind == KindTuple {
+			values[argumentKey(i, input.Name)] = "0x" + hex.EncodeToString(topic)
+			continue
+		}
+		v, err := input.typ.unpack(topic)
+		if err != nil {
+			return nil, nil, fmt.Errorf("abi: %s: %v", event.Sig, err)
+		}
+		values[argumentKey(i, input.Name)] = v
+	}
+
+	types := make([]*Type, len(dataArgs))
+	for i := range dataArgs {
+		types[i] = dataArgs[i].typ
+	}
+	list, err := unpackTuple(types, data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("abi: %s: %v", event.Sig, err)
+	}
+
+	j := 0
+	for i, input := range event.Inputs {
+		if !input.Indexed {
+			values[argumentKey(i, input.Name)] = list[j]
+			j++
+		}
+	}
+
+	return event, values, nil
+}
+
+//UnpackLogHex 解码事件日志，topics及data为十六进制字符串
+func (abi *ABI) UnpackLogHex(topics []string, dataHex string) (*Method, Values, error) {
+	topicBytes := make([][]byte, len(topics))
+	for i, topic := range topics {
+		b, err := toBytes(topic)
+		if err != nil {
+			return nil, nil, fmt.Errorf("abi: %v", err)
+		}
+		topicBytes[i] = b
+	}
+	data, err := toBytes(dataHex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("abi: %v", err)
+	}
+	return abi.UnpackLog(topicBytes, data)
+}
+
+//unpackTuple 解码头部及尾部编码的多个值
+func unpackTuple(types []*Type, data []byte) ([]interface{}, error) {
+	values := make([]interface{}, len(types))
+	pos := 0
+	for i, t := range types {
+		if t.IsDynamic() {
+			offset, err := readOffset(data, pos)
+			if err != nil {
+				return nil, err
+			}
+			if values[i], err = t.unpack(data[offset:]); err != nil {
+				return nil, err
+			}
+			pos += wordSize
+			continue
+		}
+		if pos+t.headSize() > len(data) {
+			return nil, fmt.Errorf("data is too short")
+		}
+		v, err := t.unpack(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+		pos += t.headSize()
+	}
+	return values, nil
+}
+
+//readOffset 读取偏移量或长度，不能超出数据长度
+func readOffset(data []byte, pos int) (int, error) {
+	if pos+wordSize > len(data) {
+		return 0, fmt.Errorf("data is too short")
+	}
+	n := new(big.Int).SetBytes(data[pos : pos+wordSize])
+	if !n.IsInt64() || n.Int64() > int64(len(data)) {
+		return 0, fmt.Errorf("offset %s is out of range", n.String())
+	}
+	return int(n.Int64()), nil
+}
+
+//unpack 解码单个值，data从该值的编码开始
+func (t *Type) unpack(data []byte) (interface{}, error) {
+	switch t.Kind {
+	case KindUint, KindInt, KindBool, KindAddress, KindFixedBytes:
+		if len(data) < wordSize {
+			return nil, fmt.Errorf("data is too short")
+		}
+		word := data[:wordSize]
+		switch t.Kind {
+		case KindUint:
+			return new(big.Int).SetBytes(word).String(), nil
+		case KindInt:
+			n := new(big.Int).SetBytes(word)
+			if word[0]&0x80 != 0 {
+				n.Sub(n, tt256)
+			}
+			return n.String(), nil
+		case KindBool:
+			return word[wordSize-1] != 0, nil
+		case KindAddress:
+			return "0x" + hex.EncodeToString(word[wordSize-t.Size:]), nil
+		default:
+			return "0x" + hex.EncodeToString(word[:t.Size]), nil
+		}
+	case KindBytes, KindString:
+		n, err := readOffset(data, 0)
+		if err != nil {
+			return nil, err
+		}
+		if wordSize+n > len(data) {
+			return nil, fmt.Errorf("data is too short")
+		}
+		b := data[wordSize : wordSize+n]
+		if t.Kind == KindString {
+			return string(b), nil
+		}
+		return "0x" + hex.EncodeToString(b), nil
+	case KindSlice:
+		n, err := readOffset(data, 0)
+		if err != nil {
+			return nil, err
+		}
+		return unpackTuple(repeatType(t.Elem, n), data[wordSize:])
+	case KindArray:
+		return unpackTuple(repeatType(t.Elem, t.Size), data)
+	case KindTuple:
+		list, err := unpackTuple(t.Components, data)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]interface{})
+		for i, name := range t.Names {
+			values[argumentKey(i, name)] = list[i]
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", t.String())
+}
+
+//HexToBytes 十六进制字符串转字节，0x前缀可选
+func HexToBytes(s string) ([]byte, error) {
+	return toBytes(strings.TrimSpace(s))
+}
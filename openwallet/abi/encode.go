@@ -0,0 +1,360 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package abi
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var (
+	bigOne   = big.NewInt(1)
+	tt256    = new(big.Int).Lsh(bigOne, 256)
+	wordSize = 32
+)
+
+//Pack 按参数字符串编码方法调用数据，包括4字节方法选择器
+//数组及元组参数使用JSON数组字符串，例如：["0x1234...",100]，元组也可以使用JSON对象按成员名称传入
+func (m *Method) Pack(args ...string) ([]byte, error) {
+	data, err := m.PackArguments(args...)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, m.ID...), data...), nil
+}
+
+//PackArguments 只编码参数，构造函数的参数追加在合约字节码后面
+func (m *Method) PackArguments(args ...string) ([]byte, error) {
+	if len(args) != len(m.Inputs) {
+		return nil, fmt.Errorf("abi: %s expects %d arguments, got %d", m.Sig, len(m.Inputs), len(args))
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	data, err := packTuple(m.inputTypes(), values)
+	if err != nil {
+		return nil, fmt.Errorf("abi: %s: %v", m.Sig, err)
+	}
+	return data, nil
+}
+
+//Pack 编码方法调用数据，method可以是方法名或完整签名
+func (abi *ABI) Pack(method string, args ...string) ([]byte, error) {
+	m, err := abi.Method(method, len(args))
+	if err != nil {
+		return nil, err
+	}
+	return m.Pack(args...)
+}
+
+//PackABIParam 编码SmartContractRawTransaction.ABIParam，格式为[method, arg1, arg2, args...]
+func (abi *ABI) PackABIParam(abiParam []string) ([]byte, error) {
+	if len(abiParam) == 0 {
+		return nil, fmt.Errorf("abi: abi param is empty")
+	}
+	return abi.Pack(abiParam[0], abiParam[1:]...)
+}
+
+//PackConstructor 编码构造函数参数，没有构造函数时不允许传入参数
+func (abi *ABI) PackConstructor(args ...string) ([]byte, error) {
+	if abi.Constructor == nil {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("abi: constructor is not defined")
+		}
+		return []byte{}, nil
+	}
+	return abi.Constructor.PackArguments(args...)
+}
+
+//packTuple 按头部及尾部编码多个值，动态类型在头部保存尾部的偏移量
+func packTuple(types []*Type, values []interface{}) ([]byte, error) {
+
+	if len(types) != len(values) {
+		return nil, fmt.Errorf("expects %d values, got %d", len(types), len(values))
+	}
+
+	headLen := 0
+	for _, t := range types {
+		headLen += t.headSize()
+	}
+
+	var head, tail bytes.Buffer
+	for i, t := range types {
+		data, err := t.pack(values[i])
+		if err != nil {
+			return nil, fmt.Errorf("value #%d(%s): %v", i, t.String(), err)
+		}
+		if t.IsDynamic() {
+			head.Write(packUint(big.NewInt(int64(headLen + tail.Len()))))
+			tail.Write(data)
+		} else {
+			head.Write(data)
+		}
+	}
+
+	return append(head.Bytes(), tail.Bytes()...), nil
+}
+
+//pack 编码单个值，值可以是字符串、JSON解析出来的值或Go的基础类型
+func (t *Type) pack(v interface{}) ([]byte, error) {
+	switch t.Kind {
+	case KindUint, KindInt:
+		n, err := toBigInt(v)
+		if err != nil {
+			return nil, err
+		}
+		if err = t.checkRange(n); err != nil {
+			return nil, err
+		}
+		if n.Sign() < 0 {
+			n = new(big.Int).Add(n, tt256)
+		}
+		return packUint(n), nil
+	case KindBool:
+		b, err := toBool(v)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return packUint(bigOne), nil
+		}
+		return make([]byte, wordSize), nil
+	case KindAddress:
+		b, err := toBytes(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != t.Size {
+			return nil, fmt.Errorf("address must be %d bytes, got %d", t.Size, len(b))
+		}
+		return leftPad(b), nil
+	case KindFixedBytes:
+		b, err := toBytes(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > t.Size {
+			return nil, fmt.Errorf("value is longer than %d bytes", t.Size)
+		}
+		return rightPad(b), nil
+	case KindBytes, KindString:
+		var b []byte
+		if t.Kind == KindString {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("string value expected, got %T", v)
+			}
+			b = []byte(s)
+		} else {
+			var err error
+			if b, err = toBytes(v); err != nil {
+				return nil, err
+			}
+		}
+		data := packUint(big.NewInt(int64(len(b))))
+		if len(b) > 0 {
+			data = append(data, rightPad(b)...)
+		}
+		return data, nil
+	case KindSlice, KindArray:
+		list, err := toList(v)
+		if err != nil {
+			return nil, err
+		}
+		if t.Kind == KindArray && len(list) != t.Size {
+			return nil, fmt.Errorf("array expects %d elements, got %d", t.Size, len(list))
+		}
+		data, err := packTuple(repeatType(t.Elem, len(list)), list)
+		if err != nil {
+			return nil, err
+		}
+		if t.Kind == KindSlice {
+			data = append(packUint(big.NewInt(int64(len(list)))), data...)
+		}
+		return data, nil
+	case KindTuple:
+		list, err := t.tupleValues(v)
+		if err != nil {
+			return nil, err
+		}
+		return packTuple(t.Components, list)
+	}
+	return nil, fmt.Errorf("unsupported type %s", t.String())
+}
+
+//checkRange 检查整数是否超出类型范围
+func (t *Type) checkRange(n *big.Int) error {
+	if t.Kind == KindUint {
+		if n.Sign() < 0 || n.BitLen() > t.Size {
+			return fmt.Errorf("value %s overflows %s", n.String(), t.String())
+		}
+		return nil
+	}
+	max := new(big.Int).Lsh(bigOne, uint(t.Size-1))
+	min := new(big.Int).Neg(max)
+	if n.Cmp(min) < 0 || n.Cmp(max) >= 0 {
+		return fmt.Errorf("value %s overflows %s", n.String(), t.String())
+	}
+	return nil
+}
+
+//tupleValues 元组的值可以是JSON数组，或按成员名称的JSON对象
+func (t *Type) tupleValues(v interface{}) ([]interface{}, error) {
+	if s, ok := v.(string); ok {
+		parsed, err := parseJSONValue(s)
+		if err != nil {
+			return nil, err
+		}
+		v = parsed
+	}
+	switch value := v.(type) {
+	case []interface{}:
+		return value, nil
+	case map[string]interface{}:
+		list := make([]interface{}, len(t.Components))
+		for i, name := range t.Names {
+			item, ok := value[name]
+			if !ok {
+				return nil, fmt.Errorf("tuple member %q is missing", name)
+			}
+			list[i] = item
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("tuple value expected, got %T", v)
+}
+
+func parseJSONValue(s string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid json value %q: %v", s, err)
+	}
+	return v, nil
+}
+
+func toList(v interface{}) ([]interface{}, error) {
+	if s, ok := v.(string); ok {
+		parsed, err := parseJSONValue(s)
+		if err != nil {
+			return nil, err
+		}
+		v = parsed
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("array value expected, got %T", v)
+	}
+	return list, nil
+}
+
+//toBigInt 支持十进制及0x开头的十六进制字符串
+func toBigInt(v interface{}) (*big.Int, error) {
+	var s string
+	switch value := v.(type) {
+	case string:
+		s = value
+	case json.Number:
+		s = value.String()
+	case *big.Int:
+		return value, nil
+	case int:
+		return big.NewInt(int64(value)), nil
+	case int64:
+		return big.NewInt(value), nil
+	case uint64:
+		return new(big.Int).SetUint64(value), nil
+	default:
+		return nil, fmt.Errorf("integer value expected, got %T", v)
+	}
+	s = strings.TrimSpace(s)
+	n := new(big.Int)
+	var ok bool
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		_, ok = n.SetString(s[2:], 16)
+	} else if strings.HasPrefix(s, "-0x") || strings.HasPrefix(s, "-0X") {
+		_, ok = n.SetString(s[3:], 16)
+		n.Neg(n)
+	} else {
+		_, ok = n.SetString(s, 10)
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid integer %q", s)
+	}
+	return n, nil
+}
+
+func toBool(v interface{}) (bool, error) {
+	switch value := v.(type) {
+	case bool:
+		return value, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "true", "1":
+			return true, nil
+		case "false", "0":
+			return false, nil
+		}
+	case json.Number:
+		return toBool(value.String())
+	}
+	return false, fmt.Errorf("invalid bool %v", v)
+}
+
+//toBytes 十六进制字符串转字节，0x前缀可选
+func toBytes(v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case []byte:
+		return value, nil
+	case string:
+		s := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(value), "0x"), "0X")
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex %q", value)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("hex string expected, got %T", v)
+}
+
+func packUint(n *big.Int) []byte {
+	return leftPad(n.Bytes())
+}
+
+func leftPad(b []byte) []byte {
+	size := (len(b) + wordSize - 1) / wordSize * wordSize
+	if size == 0 {
+		size = wordSize
+	}
+	data := make([]byte, size)
+	copy(data[size-len(b):], b)
+	return data
+}
+
+func rightPad(b []byte) []byte {
+	size := (len(b) + wordSize - 1) / wordSize * wordSize
+	if size == 0 {
+		size = wordSize
+	}
+	data := make([]byte, size)
+	copy(data, b)
+	return data
+}
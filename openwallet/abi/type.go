@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package abi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Kind ABI类型类别
+type Kind int
+
+const (
+	KindUint Kind = iota
+	KindInt
+	KindBool
+	KindAddress
+	KindFixedBytes //bytes1 ~ bytes32，function视为bytes24
+	KindBytes
+	KindString
+	KindSlice //T[]
+	KindArray //T[k]
+	KindTuple
+)
+
+//Type ABI类型
+type Type struct {
+	Kind       Kind
+	Size       int      //uint/int的位数，bytesN的字节数，T[k]的长度
+	Elem       *Type    //数组元素类型
+	Components []*Type  //元组成员类型
+	Names      []string //元组成员名称
+}
+
+//NewType 解析类型字符串，tuple需要传入成员定义
+func NewType(typ string, components []Argument) (*Type, error) {
+
+	typ = strings.TrimSpace(typ)
+
+	//数组
+	if strings.HasSuffix(typ, "]") {
+		i := strings.LastIndex(typ, "[")
+		if i < 0 {
+			return nil, fmt.Errorf("abi: invalid type %q", typ)
+		}
+		elem, err := NewType(typ[:i], components)
+		if err != nil {
+			return nil, err
+		}
+		lenStr := typ[i+1 : len(typ)-1]
+		if len(lenStr) == 0 {
+			return &Type{Kind: KindSlice, Elem: elem}, nil
+		}
+		n, err := strconv.Atoi(lenStr)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("abi: invalid array length in %q", typ)
+		}
+		return &Type{Kind: KindArray, Size: n, Elem: elem}, nil
+	}
+
+	switch {
+	case typ == "tuple":
+		t := &Type{Kind: KindTuple}
+		for _, c := range components {
+			ct, err := NewType(c.Type, c.Components)
+			if err != nil {
+				return nil, err
+			}
+			t.Components = append(t.Components, ct)
+			t.Names = append(t.Names, c.Name)
+		}
+		return t, nil
+	case typ == "address":
+		return &Type{Kind: KindAddress, Size: 20}, nil
+	case typ == "bool":
+		return &Type{Kind: KindBool}, nil
+	case typ == "string":
+		return &Type{Kind: KindString}, nil
+	case typ == "bytes":
+		return &Type{Kind: KindBytes}, nil
+	case typ == "function":
+		return &Type{Kind: KindFixedBytes, Size: 24}, nil
+	case strings.HasPrefix(typ, "bytes"):
+		n, err := strconv.Atoi(typ[len("bytes"):])
+		if err != nil || n < 1 || n > 32 {
+			return nil, fmt.Errorf("abi: invalid type %q", typ)
+		}
+		return &Type{Kind: KindFixedBytes, Size: n}, nil
+	case strings.HasPrefix(typ, "uint"), strings.HasPrefix(typ, "int"):
+		kind, prefix := KindUint, "uint"
+		if strings.HasPrefix(typ, "int") {
+			kind, prefix = KindInt, "int"
+		}
+		bits := 256
+		if len(typ) > len(prefix) {
+			n, err := strconv.Atoi(typ[len(prefix):])
+			if err != nil || n < 8 || n > 256 || n%8 != 0 {
+				return nil, fmt.Errorf("abi: invalid type %q", typ)
+			}
+			bits = n
+		}
+		return &Type{Kind: kind, Size: bits}, nil
+	}
+
+	return nil, fmt.Errorf("abi: unsupported type %q", typ)
+}
+
+//String 规范的类型字符串，用于计算方法签名
+func (t *Type) String() string {
+	switch t.Kind {
+	case KindUint:
+		return fmt.Sprintf("uint%d", t.Size)
+	case KindInt:
+		return fmt.Sprintf("int%d", t.Size)
+	case KindBool:
+		return "bool"
+	case KindAddress:
+		return "address"
+	case KindFixedBytes:
+		return fmt.Sprintf("bytes%d", t.Size)
+	case KindBytes:
+		return "bytes"
+	case KindString:
+		return "string"
+	case KindSlice:
+		return t.Elem.String() + "[]"
+	case KindArray:
+		return fmt.Sprintf("%s[%d]", t.Elem.String(), t.Size)
+	case KindTuple:
+		comps := make([]string, len(t.Components))
+		for i, c := range t.Components {
+			comps[i] = c.String()
+		}
+		return "(" + strings.Join(comps, ",") + ")"
+	}
+	return ""
+}
+
+//IsDynamic 是否动态类型，动态类型在编码头部只保存偏移量
+func (t *Type) IsDynamic() bool {
+	switch t.Kind {
+	case KindBytes, KindString, KindSlice:
+		return true
+	case KindArray:
+		return t.Elem.IsDynamic()
+	case KindTuple:
+		for _, c := range t.Components {
+			if c.IsDynamic() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//headSize 在编码头部占用的字节数
+func (t *Type) headSize() int {
+	if t.IsDynamic() {
+		return 32
+	}
+	switch t.Kind {
+	case KindArray:
+		return t.Size * t.Elem.headSize()
+	case KindTuple:
+		size := 0
+		for _, c := range t.Components {
+			size += c.headSize()
+		}
+		return size
+	}
+	return 32
+}
+
+//repeatType 数组元素展开为元组
+func repeatType(t *Type, n int) []*Type {
+	types := make([]*Type, n)
+	for i := range types {
+		types[i] = t
+	}
+	return types
+}
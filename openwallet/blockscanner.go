@@ -395,6 +395,10 @@ func (bs *BlockScannerBase) Stop() error {
 		return fmt.Errorf("block scanner has been closed")
 	}
 
+	if bs.scanTask == nil {
+		return fmt.Errorf("block scanner has not set scan task ")
+	}
+
 	bs.scanTask.Stop()
 	bs.Scanning = false
 	return nil
@@ -407,6 +411,10 @@ func (bs *BlockScannerBase) Pause() error {
 		return fmt.Errorf("block scanner has been closed")
 	}
 
+	if bs.scanTask == nil {
+		return fmt.Errorf("block scanner has not set scan task ")
+	}
+
 	bs.scanTask.Pause()
 	bs.Scanning = false
 	return nil
@@ -419,6 +427,10 @@ func (bs *BlockScannerBase) Restart() error {
 		return fmt.Errorf("block scanner has been closed")
 	}
 
+	if bs.scanTask == nil {
+		return fmt.Errorf("block scanner has not set scan task ")
+	}
+
 	bs.scanTask.Restart()
 	bs.Scanning = true
 	return nil
@@ -497,6 +509,11 @@ func (bs *BlockScannerBase) SetBlockchainDAI(dai BlockchainDAI) error {
 	return nil
 }
 
+//GetBlockchainDAI 获取区块链数据访问接口，未设置返回nil
+func (bs *BlockScannerBase) GetBlockchainDAI() BlockchainDAI {
+	return bs.BlockchainDAI
+}
+
 //NewBlockNotify 获得新区块后，发送到通知通道
 func (bs *BlockScannerBase) NewBlockNotify(block *BlockHeader) error {
 	bs.Mu.RLock()
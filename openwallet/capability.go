@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018 The OpenWallet Authors
+ * This file is part of the OpenWallet library.
+ *
+ * The OpenWallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The OpenWallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openwallet
+
+import "sort"
+
+//Capability 资产适配器的可选功能
+type Capability string
+
+const (
+	CapabilitySmartContract         Capability = "smartContract"         //GetSmartContractDecoder
+	CapabilityTransactionsByAddress Capability = "transactionsByAddress" //BlockScanner.GetTransactionsByAddress
+	CapabilityCustomCreateAddress   Capability = "customCreateAddress"   //AddressDecoderV2.CustomCreateAddress
+	CapabilityBlockchainDAI         Capability = "blockchainDAI"         //BlockScanner.SupportBlockchainDAI
+	CapabilityEstimateFee           Capability = "estimateFee"           //TransactionDecoder.EstimateRawTransactionFee
+	CapabilitySummaryWithFee        Capability = "summaryWithFee"        //汇总交易支持手续费账户
+	CapabilityJsonRPCEndpoint       Capability = "jsonRPCEndpoint"       //GetJsonRPCEndpoint
+	CapabilityContractDeploy        Capability = "contractDeploy"        //SmartContractDeployer
+	CapabilityFeeBump               Capability = "feeBump"               //TransactionFeeBumper
+	CapabilityTxPresence            Capability = "txPresence"            //TransactionPresenceChecker
+)
+
+//AllCapabilities 全部可选功能
+var AllCapabilities = []Capability{
+	CapabilitySmartContract,
+	CapabilityTransactionsByAddress,
+	CapabilityCustomCreateAddress,
+	CapabilityBlockchainDAI,
+	CapabilityEstimateFee,
+	CapabilitySummaryWithFee,
+	CapabilityJsonRPCEndpoint,
+	CapabilityContractDeploy,
+	CapabilityFeeBump,
+	CapabilityTxPresence,
+}
+
+//Capabilities 功能描述，未出现的功能表示未知（既没有声明，也无法探测）
+type Capabilities map[Capability]bool
+
+//Supports 是否支持功能，known为false表示未知
+func (c Capabilities) Supports(capability Capability) (supported bool, known bool) {
+	supported, known = c[capability]
+	return
+}
+
+//Supported 已知支持的功能，按名称排序
+func (c Capabilities) Supported() []Capability {
+	list := make([]Capability, 0, len(c))
+	for capability, supported := range c {
+		if supported {
+			list = append(list, capability)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i] < list[j]
+	})
+	return list
+}
+
+//CapabilityDeclarer 资产适配器可选实现，声明无法探测的功能，声明值优先于探测值
+type CapabilityDeclarer interface {
+	DeclareCapabilities() Capabilities
+}
+
+//GetAssetsCapabilities 获取资产适配器的功能描述
+//可以通过接口判断的功能直接探测，其余的只能由适配器实现CapabilityDeclarer声明
+func GetAssetsCapabilities(adapter AssetsAdapter) Capabilities {
+
+	caps := make(Capabilities)
+	if adapter == nil {
+		return caps
+	}
+
+	scDecoder := adapter.GetSmartContractDecoder()
+	caps[CapabilitySmartContract] = scDecoder != nil
+	_, deployable := scDecoder.(SmartContractDeployer)
+	caps[CapabilityContractDeploy] = deployable
+
+	decoder := adapter.GetAddressDecoderV2()
+	caps[CapabilityCustomCreateAddress] = decoder != nil && decoder.SupportCustomCreateAddressFunction()
+
+	scanner := adapter.GetBlockScanner()
+	caps[CapabilityBlockchainDAI] = scanner != nil && scanner.SupportBlockchainDAI()
+	if scanner == nil {
+		caps[CapabilityTransactionsByAddress] = false
+	}
+
+	txDecoder := adapter.GetTransactionDecoder()
+	if txDecoder == nil {
+		caps[CapabilityEstimateFee] = false
+		caps[CapabilitySummaryWithFee] = false
+	}
+	_, bumpable := txDecoder.(TransactionFeeBumper)
+	caps[CapabilityFeeBump] = bumpable
+	_, checkable := txDecoder.(TransactionPresenceChecker)
+	caps[CapabilityTxPresence] = checkable
+
+	endpoint := adapter.GetJsonRPCEndpoint()
+	caps[CapabilityJsonRPCEndpoint] = endpoint != nil && endpoint.SupportJsonRPCEndpoint()
+
+	if declarer, ok := adapter.(CapabilityDeclarer); ok {
+		for capability, supported := range declarer.DeclareCapabilities() {
+			caps[capability] = supported
+		}
+	}
+
+	return caps
+}
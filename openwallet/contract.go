@@ -150,6 +150,15 @@ type SmartContractDecoder interface {
 	SubmitSmartContractRawTransaction(wrapper WalletDAI, rawTx *SmartContractRawTransaction) (*SmartContractReceipt, *Error)
 }
 
+//SmartContractDeployer 智能合约解析器可选实现，支持部署合约
+type SmartContractDeployer interface {
+	//CreateSmartContractDeployTransaction 创建部署合约的原始交易单
+	//rawTx.Raw为十六进制的字节码及构造参数，rawTx.Coin.Contract.Address为空，需要填充Signatures、Fees及TxFrom
+	CreateSmartContractDeployTransaction(wrapper WalletDAI, rawTx *SmartContractRawTransaction) *Error
+	//EstimateSmartContractDeployFee 预估部署合约的手续费，填充rawTx.Fees及FeeRate，不签名
+	EstimateSmartContractDeployFee(wrapper WalletDAI, rawTx *SmartContractRawTransaction) *Error
+}
+
 type SmartContractDecoderBase struct {
 }
 
@@ -190,6 +199,11 @@ type ABIDAI interface {
 	SetABIInfo(address string, abi ABIInfo) error
 }
 
+// ABIDAISetter 智能合约解析器可选实现，由外部设置ABI数据访问接口，例如openw的代币合约注册表
+type ABIDAISetter interface {
+	SetABIDAI(dai ABIDAI) error
+}
+
 // ABIInfo abi model
 type ABIInfo struct {
 	Address string      `json:"address"`
@@ -51,8 +51,9 @@ const (
 	ErrSubmitRawSmartContractTransactionFailed = 5003 //广播原始合约交易单失败
 
 	/* 其他 */
-	ErrUnknownException = 9001 //未知异常情况
-	ErrSystemException  = 9002 //系统程序异常情况
+	ErrUnknownException      = 9001 //未知异常情况
+	ErrSystemException       = 9002 //系统程序异常情况
+	ErrUnsupportedCapability = 9003 //资产适配器不支持该功能
 )
 
 type Error struct {
@@ -0,0 +1,415 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openwallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NonceStatusReserved  = "reserved"  //已预留，交易单未广播
+	NonceStatusSubmitted = "submitted" //交易单已广播，等待上链
+)
+
+//NonceReservationKey 交易单ExtParam中记录预留nonce的字段
+const NonceReservationKey = "nonceReservation"
+
+//NonceSource 查询地址在链上下一个可用的nonce，例如ICON的nonce，Tezos的counter+1
+type NonceSource func(address string) (uint64, error)
+
+//NonceDAI 账户模型地址的nonce预留，WalletDAI可选实现，适配器通过类型断言使用
+type NonceDAI interface {
+	//预留账户模型地址的nonce，同一地址的并发交易不会重复
+	ReserveNonce(symbol, address string, source NonceSource) (*NonceReservation, error)
+	//预留n个连续的nonce，用于一笔交易包含多个操作，例如Tezos的reveal和transaction
+	ReserveNonces(symbol, address string, n int, source NonceSource) ([]*NonceReservation, error)
+	//交易单广播成功，记录nonce对应的交易
+	CommitNonce(reservation *NonceReservation, txid string) error
+	//交易单创建或广播失败，释放预留的nonce
+	ReleaseNonce(reservation *NonceReservation) error
+	//与链上nonce对账
+	ReconcileNonce(symbol, address string, source NonceSource) error
+}
+
+//NonceDAISetter 账户模型适配器可选实现，由外部设置nonce管理器，例如openw初始化时设置共享的NonceManager
+type NonceDAISetter interface {
+	SetNonceDAI(dai NonceDAI)
+}
+
+//NonceSourceProvider 账户模型适配器可选实现，提供链上nonce查询，用于启动时及广播失败后对账
+type NonceSourceProvider interface {
+	GetNonceSource() NonceSource
+}
+
+//NonceReservation 账户模型地址预留的nonce
+type NonceReservation struct {
+	ID         string `json:"id" storm:"id"` //币种:地址:nonce
+	Symbol     string `json:"symbol" storm:"index"`
+	Address    string `json:"address" storm:"index"`
+	Nonce      uint64 `json:"nonce"`
+	Status     string `json:"status"`
+	TxID       string `json:"txid"` //广播后的交易单ID
+	CreateTime int64  `json:"createTime"`
+	UpdateTime int64  `json:"updateTime"`
+}
+
+//NonceStore nonce预留记录的持久化
+type NonceStore interface {
+	SaveNonceReservation(reservation *NonceReservation) error
+	DeleteNonceReservation(reservation *NonceReservation) error
+	GetNonceReservations(symbol, address string) ([]*NonceReservation, error)
+}
+
+//nonceState 单个地址的nonce状态
+type nonceState struct {
+	mu          sync.Mutex
+	loaded      bool
+	next        uint64                       //下一个新分配的nonce
+	free        []uint64                     //已释放的空缺nonce，优先分配，升序
+	reservation map[uint64]*NonceReservation //未上链的预留记录
+}
+
+//NonceManager 账户模型链的nonce管理器
+//同一地址的并发交易通过预留nonce避免重复，预留记录持久化，启动后及广播失败时与链上对账
+type NonceManager struct {
+	mu        sync.Mutex
+	store     NonceStore
+	states    map[string]*nonceState
+	startTime int64
+}
+
+//NewNonceManager 创建nonce管理器，store为nil时只保存在内存
+func NewNonceManager(store NonceStore) *NonceManager {
+	return &NonceManager{
+		store:     store,
+		states:    make(map[string]*nonceState),
+		startTime: time.Now().Unix(),
+	}
+}
+
+//normalizeNonceAddress 去除首尾空白，十六进制地址统一小写，大小写敏感的base58地址保持不变
+func normalizeNonceAddress(address string) string {
+	address = strings.TrimSpace(address)
+	if strings.HasPrefix(address, "0x") || strings.HasPrefix(address, "0X") {
+		return strings.ToLower(address)
+	}
+	return address
+}
+
+func nonceStateKey(symbol, address string) string {
+	return strings.ToUpper(symbol) + ":" + normalizeNonceAddress(address)
+}
+
+func nonceReservationID(symbol, address string, nonce uint64) string {
+	return fmt.Sprintf("%s:%s:%d", strings.ToUpper(symbol), normalizeNonceAddress(address), nonce)
+}
+
+func (m *NonceManager) state(symbol, address string) *nonceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := nonceStateKey(symbol, address)
+	s, ok := m.states[key]
+	if !ok {
+		s = &nonceState{reservation: make(map[uint64]*NonceReservation)}
+		m.states[key] = s
+	}
+	return s
+}
+
+//ReserveNonce 为地址预留下一个nonce，优先分配已释放的空缺
+//首次使用地址或有已广播未上链的预留记录时，通过source与链上对账，清除已上链的记录
+func (m *NonceManager) ReserveNonce(symbol, address string, source NonceSource) (*NonceReservation, error) {
+	reservations, err := m.ReserveNonces(symbol, address, 1, source)
+	if err != nil {
+		return nil, err
+	}
+	return reservations[0], nil
+}
+
+//ReserveNonces 为地址预留n个连续的nonce，优先分配足够长的连续空缺，否则从末尾分配
+func (m *NonceManager) ReserveNonces(symbol, address string, n int, source NonceSource) ([]*NonceReservation, error) {
+
+	if n <= 0 {
+		return nil, fmt.Errorf("reserve nonce count should be positive")
+	}
+
+	s := m.state(symbol, address)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.loaded || s.hasSubmitted() {
+		if err := m.reconcile(s, symbol, address, source); err != nil {
+			return nil, err
+		}
+	}
+
+	first := s.take(n)
+
+	now := time.Now().Unix()
+	reservations := make([]*NonceReservation, 0, n)
+	for nonce := first; nonce < first+uint64(n); nonce++ {
+		reservations = append(reservations, &NonceReservation{
+			ID:         nonceReservationID(symbol, address, nonce),
+			Symbol:     strings.ToUpper(symbol),
+			Address:    normalizeNonceAddress(address),
+			Nonce:      nonce,
+			Status:     NonceStatusReserved,
+			CreateTime: now,
+			UpdateTime: now,
+		})
+	}
+
+	if m.store != nil {
+		for i, r := range reservations {
+			if err := m.store.SaveNonceReservation(r); err != nil {
+				for _, saved := range reservations[:i] {
+					m.store.DeleteNonceReservation(saved)
+				}
+				for j := len(reservations) - 1; j >= 0; j-- {
+					m.release(s, reservations[j].Nonce)
+				}
+				return nil, err
+			}
+		}
+	}
+
+	for _, r := range reservations {
+		s.reservation[r.Nonce] = r
+	}
+
+	return reservations, nil
+}
+
+//CommitNonce 交易单广播成功，记录nonce对应的交易
+func (m *NonceManager) CommitNonce(reservation *NonceReservation, txid string) error {
+
+	if reservation == nil {
+		return fmt.Errorf("nonce reservation is nil")
+	}
+
+	s := m.state(reservation.Symbol, reservation.Address)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.reservation[reservation.Nonce]
+	if !ok {
+		return fmt.Errorf("nonce %d of address[%s] is not reserved", reservation.Nonce, reservation.Address)
+	}
+
+	current.Status = NonceStatusSubmitted
+	current.TxID = txid
+	current.UpdateTime = time.Now().Unix()
+	*reservation = *current
+
+	if m.store != nil {
+		return m.store.SaveNonceReservation(current)
+	}
+	return nil
+}
+
+//ReleaseNonce 交易单创建或广播失败，释放预留的nonce，留下的空缺优先分配给下一笔交易
+func (m *NonceManager) ReleaseNonce(reservation *NonceReservation) error {
+
+	if reservation == nil {
+		return fmt.Errorf("nonce reservation is nil")
+	}
+
+	s := m.state(reservation.Symbol, reservation.Address)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.reservation[reservation.Nonce]
+	if !ok {
+		//地址还未加载时预留记录只保存在store，加载后释放的nonce计为空缺
+		if !s.loaded && m.store != nil {
+			return m.store.DeleteNonceReservation(reservation)
+		}
+		return nil
+	}
+
+	if m.store != nil {
+		if err := m.store.DeleteNonceReservation(current); err != nil {
+			return err
+		}
+	}
+
+	delete(s.reservation, reservation.Nonce)
+	m.release(s, reservation.Nonce)
+
+	return nil
+}
+
+//ReconcileNonce 与链上nonce对账，清除已上链的预留记录，重新计算空缺
+//广播失败无法确定交易是否被全节点接受时调用
+func (m *NonceManager) ReconcileNonce(symbol, address string, source NonceSource) error {
+
+	s := m.state(symbol, address)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return m.reconcile(s, symbol, address, source)
+}
+
+//take 分配n个连续的nonce，返回第一个，调用者需持有s.mu
+func (s *nonceState) take(n int) uint64 {
+
+	//空缺不会与末尾相连，只在空缺内部查找连续段
+	for i := 0; i+n <= len(s.free); i++ {
+		if s.free[i+n-1]-s.free[i] != uint64(n-1) {
+			continue
+		}
+		first := s.free[i]
+		s.free = append(s.free[:i], s.free[i+n:]...)
+		return first
+	}
+
+	first := s.next
+	s.next += uint64(n)
+	return first
+}
+
+//hasSubmitted 是否有已广播未上链的预留记录，调用者需持有s.mu
+func (s *nonceState) hasSubmitted() bool {
+	for _, r := range s.reservation {
+		if r.Status == NonceStatusSubmitted {
+			return true
+		}
+	}
+	return false
+}
+
+//release 释放nonce，释放的是最后一个nonce时回退，否则记为空缺
+func (m *NonceManager) release(s *nonceState, nonce uint64) {
+
+	if nonce+1 == s.next {
+		s.next = nonce
+		//回退后末尾的空缺也一并回退
+		for len(s.free) > 0 && s.free[len(s.free)-1]+1 == s.next {
+			s.next = s.free[len(s.free)-1]
+			s.free = s.free[:len(s.free)-1]
+		}
+		return
+	}
+
+	if nonce >= s.next {
+		return
+	}
+
+	i := sort.Search(len(s.free), func(i int) bool { return s.free[i] >= nonce })
+	if i < len(s.free) && s.free[i] == nonce {
+		return
+	}
+	s.free = append(s.free, 0)
+	copy(s.free[i+1:], s.free[i:])
+	s.free[i] = nonce
+}
+
+//reconcile 加载预留记录并与链上nonce对账，调用者需持有s.mu
+func (m *NonceManager) reconcile(s *nonceState, symbol, address string, source NonceSource) error {
+
+	if source == nil {
+		return fmt.Errorf("nonce source of [%s] is nil", symbol)
+	}
+
+	chainNonce, err := source(address)
+	if err != nil {
+		return err
+	}
+
+	if !s.loaded && m.store != nil {
+		saved, loadErr := m.store.GetNonceReservations(strings.ToUpper(symbol), normalizeNonceAddress(address))
+		if loadErr != nil {
+			return loadErr
+		}
+		for _, r := range saved {
+			//上次运行预留但未广播的nonce，进程已退出，不会再使用
+			if r.Status == NonceStatusReserved && r.CreateTime < m.startTime {
+				if err = m.store.DeleteNonceReservation(r); err != nil {
+					return err
+				}
+				continue
+			}
+			s.reservation[r.Nonce] = r
+		}
+	}
+
+	//链上已使用的nonce
+	next := chainNonce
+	for nonce, r := range s.reservation {
+		if nonce < chainNonce {
+			if m.store != nil {
+				if err = m.store.DeleteNonceReservation(r); err != nil {
+					return err
+				}
+			}
+			delete(s.reservation, nonce)
+			continue
+		}
+		if nonce+1 > next {
+			next = nonce + 1
+		}
+	}
+
+	s.free = make([]uint64, 0)
+	for nonce := chainNonce; nonce < next; nonce++ {
+		if _, ok := s.reservation[nonce]; !ok {
+			s.free = append(s.free, nonce)
+		}
+	}
+	s.next = next
+	s.loaded = true
+
+	return nil
+}
+
+//GetNonceReservations 获取地址未上链的预留记录，按nonce升序
+func (m *NonceManager) GetNonceReservations(symbol, address string) []*NonceReservation {
+
+	s := m.state(symbol, address)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*NonceReservation, 0, len(s.reservation))
+	for _, r := range s.reservation {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Nonce < list[j].Nonce })
+
+	return list
+}
+
+//SetNonceReservation 交易单记录预留的nonce，广播后由openw提交或释放
+func (rawtx *RawTransaction) SetNonceReservation(reservation *NonceReservation) error {
+	return rawtx.SetExtParam(NonceReservationKey, reservation)
+}
+
+//GetNonceReservation 获取交易单预留的nonce，没有预留返回nil
+func (rawtx *RawTransaction) GetNonceReservation() *NonceReservation {
+	result := rawtx.GetExtParam().Get(NonceReservationKey)
+	if !result.IsObject() {
+		return nil
+	}
+	var reservation NonceReservation
+	if err := json.Unmarshal([]byte(result.Raw), &reservation); err != nil {
+		return nil
+	}
+	return &reservation
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package openwallet
+
+import (
+	"sync"
+	"testing"
+)
+
+type memoryNonceStore struct {
+	mu      sync.Mutex
+	records map[string]NonceReservation
+}
+
+func (s *memoryNonceStore) SaveNonceReservation(reservation *NonceReservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[reservation.ID] = *reservation
+	return nil
+}
+
+func (s *memoryNonceStore) DeleteNonceReservation(reservation *NonceReservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, reservation.ID)
+	return nil
+}
+
+func (s *memoryNonceStore) GetNonceReservations(symbol, address string) ([]*NonceReservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*NonceReservation, 0)
+	for _, r := range s.records {
+		if r.Symbol == symbol && r.Address == address {
+			record := r
+			list = append(list, &record)
+		}
+	}
+	return list, nil
+}
+
+func TestNonceManager_ReserveNonce(t *testing.T) {
+
+	store := &memoryNonceStore{records: make(map[string]NonceReservation)}
+	chainNonce := uint64(5)
+	source := func(address string) (uint64, error) {
+		return chainNonce, nil
+	}
+
+	m := NewNonceManager(store)
+
+	//并发预留的nonce不重复且连续
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		nonces = make(map[uint64]*NonceReservation)
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := m.ReserveNonce("icx", "hx1", source)
+			if err != nil {
+				t.Errorf("ReserveNonce failed, unexpected error: %v", err)
+				return
+			}
+			mu.Lock()
+			nonces[r.Nonce] = r
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for n := uint64(5); n < 25; n++ {
+		if _, ok := nonces[n]; !ok {
+			t.Errorf("nonce %d is not reserved", n)
+		}
+	}
+	if len(store.records) != 20 {
+		t.Errorf("persisted reservations = %d, want 20", len(store.records))
+	}
+
+	//释放中间的nonce留下空缺，优先分配
+	m.ReleaseNonce(nonces[10])
+	m.ReleaseNonce(nonces[24])
+	r, _ := m.ReserveNonce("ICX", "hx1", source)
+	if r.Nonce != 10 {
+		t.Errorf("reserved nonce = %d, want released gap 10", r.Nonce)
+	}
+	r, _ = m.ReserveNonce("ICX", "hx1", source)
+	if r.Nonce != 24 {
+		t.Errorf("reserved nonce = %d, want 24", r.Nonce)
+	}
+
+	//10未广播，其余已广播
+	for n := uint64(5); n < 12; n++ {
+		if n != 10 {
+			m.CommitNonce(nonces[n], "tx")
+		}
+	}
+
+	//重启后，已上链的记录被清除，未广播的预留记录释放为空缺
+	chainNonce = 8
+	restarted := NewNonceManager(store)
+	restarted.startTime = m.startTime + 1
+
+	r, err := restarted.ReserveNonce("ICX", "hx1", source)
+	if err != nil {
+		t.Errorf("ReserveNonce failed, unexpected error: %v", err)
+		return
+	}
+	if r.Nonce != 10 {
+		t.Errorf("reserved nonce after restart = %d, want 10", r.Nonce)
+	}
+	pending := restarted.GetNonceReservations("ICX", "hx1")
+	if len(pending) != 4 || pending[0].Nonce != 8 || pending[len(pending)-1].Nonce != 11 {
+		t.Errorf("pending reservations after restart = %d", len(pending))
+	}
+
+	//广播失败后对账，链上已使用的nonce不再分配
+	chainNonce = 12
+	restarted.ReconcileNonce("ICX", "hx1", source)
+	r, _ = restarted.ReserveNonce("ICX", "hx1", source)
+	if r.Nonce != 12 {
+		t.Errorf("reserved nonce after reconcile = %d, want 12", r.Nonce)
+	}
+}
+
+func TestNonceManager_ReserveNonceReconcile(t *testing.T) {
+
+	store := &memoryNonceStore{records: make(map[string]NonceReservation)}
+	chainNonce := uint64(1)
+	source := func(address string) (uint64, error) {
+		return chainNonce, nil
+	}
+
+	m := NewNonceManager(store)
+
+	//十六进制地址不区分大小写
+	r1, _ := m.ReserveNonce("ETH", "0xAbC", source)
+	r2, _ := m.ReserveNonce("eth", " 0xabc", source)
+	if r1.Nonce != 1 || r2.Nonce != 2 || r2.Address != "0xabc" {
+		t.Errorf("reserved nonce = %d, %d, address: %s, want 1, 2, 0xabc", r1.Nonce, r2.Nonce, r2.Address)
+	}
+
+	m.CommitNonce(r1, "tx1")
+	m.CommitNonce(r2, "tx2")
+
+	//已广播的交易上链后，下次预留时清除记录
+	chainNonce = 3
+	r3, err := m.ReserveNonce("ETH", "0xABC", source)
+	if err != nil || r3.Nonce != 3 {
+		t.Errorf("reserved nonce = %+v, err: %v, want 3", r3, err)
+		return
+	}
+	pending := m.GetNonceReservations("ETH", "0xabc")
+	if len(pending) != 1 || pending[0].Nonce != 3 {
+		t.Errorf("pending reservations = %d, want only 3", len(pending))
+	}
+	if len(store.records) != 1 {
+		t.Errorf("saved reservations = %d, want 1", len(store.records))
+	}
+
+	//交易单记录预留的nonce
+	rawTx := &RawTransaction{}
+	if rawTx.GetNonceReservation() != nil {
+		t.Errorf("raw transaction should not have nonce reservation")
+	}
+	rawTx.SetNonceReservation(r3)
+	if r := rawTx.GetNonceReservation(); r == nil || r.ID != r3.ID || r.Nonce != 3 {
+		t.Errorf("raw transaction nonce reservation = %+v", r)
+	}
+}
+
+func TestNonceManager_ReserveNonces(t *testing.T) {
+
+	store := &memoryNonceStore{records: make(map[string]NonceReservation)}
+	source := func(address string) (uint64, error) {
+		return 1, nil
+	}
+
+	m := NewNonceManager(store)
+
+	//并发预留多个nonce，每次预留的都连续且互不重叠
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		nonces = make(map[uint64]*NonceReservation)
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			list, err := m.ReserveNonces("XTZ", "tz1", 2, source)
+			if err != nil {
+				t.Errorf("ReserveNonces failed, unexpected error: %v", err)
+				return
+			}
+			if len(list) != 2 || list[1].Nonce != list[0].Nonce+1 {
+				t.Errorf("reserved nonces are not continuous")
+				return
+			}
+			mu.Lock()
+			for _, r := range list {
+				nonces[r.Nonce] = r
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(nonces) != 20 || len(store.records) != 20 {
+		t.Errorf("reserved nonces = %d, persisted = %d, want 20", len(nonces), len(store.records))
+		return
+	}
+
+	//单个空缺不满足连续预留，从末尾分配，空缺留给下一笔单个预留
+	m.ReleaseNonce(nonces[5])
+	list, _ := m.ReserveNonces("XTZ", "tz1", 2, source)
+	if list[0].Nonce != 21 {
+		t.Errorf("reserved first nonce = %d, want 21", list[0].Nonce)
+	}
+
+	//连续的空缺优先分配
+	m.ReleaseNonce(nonces[10])
+	m.ReleaseNonce(nonces[11])
+	list, _ = m.ReserveNonces("XTZ", "tz1", 2, source)
+	if list[0].Nonce != 10 {
+		t.Errorf("reserved first nonce = %d, want released gap 10", list[0].Nonce)
+	}
+	if r, _ := m.ReserveNonce("XTZ", "tz1", source); r.Nonce != 5 {
+		t.Errorf("reserved nonce = %d, want released gap 5", r.Nonce)
+	}
+
+	if _, err := m.ReserveNonces("XTZ", "tz1", 0, source); err == nil {
+		t.Errorf("ReserveNonces should fail with zero count")
+	}
+}
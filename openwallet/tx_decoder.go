@@ -39,6 +39,40 @@ type TransactionDecoder interface {
 	CreateSummaryRawTransactionWithError(wrapper WalletDAI, sumRawTx *SummaryRawTransaction) ([]*RawTransactionWithError, error)
 }
 
+//TransactionLimiter 交易单解析器可选实现，声明单笔交易单的限制，批量转账时按限制拆分交易单
+type TransactionLimiter interface {
+	//MaxTransactionOutputs 单笔交易单最多的接收地址数量，0为不限制
+	MaxTransactionOutputs() int
+	//MaxTransactionSize 原始交易单RawHex解码后的最大字节数，0为不限制
+	MaxTransactionSize() int
+}
+
+const (
+	FeeBumpMethodReplace = "replace" //替换原交易，UTXO链使用RBF，账户模型链使用相同的nonce
+	FeeBumpMethodCPFP    = "cpfp"    //创建花费原交易输出的子交易，由子交易支付更高的手续费
+)
+
+//TransactionFeeBumper 交易单解析器可选实现，为未确认的交易提高手续费
+type TransactionFeeBumper interface {
+	//CreateFeeBumpRawTransaction 为未确认的原交易创建加速交易单，rawTx已填充Coin、Account及新的FeeRate
+	//返回加速方式FeeBumpMethodReplace或FeeBumpMethodCPFP
+	CreateFeeBumpRawTransaction(wrapper WalletDAI, original *Transaction, rawTx *RawTransaction) (string, error)
+}
+
+const (
+	TxPresenceNotFound = "notFound" //全节点没有该交易
+	TxPresencePending  = "pending"  //在全节点的交易池中，未上链
+	TxPresenceMined    = "mined"    //已上链
+)
+
+//TransactionPresenceChecker 交易单解析器可选实现，查询已广播的交易在全节点的状态
+type TransactionPresenceChecker interface {
+	//GetTransactionPresence 返回TxPresence状态，已上链时返回所在区块高度
+	//notFound时openw会重新广播原交易单，mined时以全节点数据为准标记为已上链
+	//启动时对账nonce预留记录没有对应的钱包，wrapper为nil
+	GetTransactionPresence(wrapper WalletDAI, txid string) (presence string, blockHeight uint64, err error)
+}
+
 //TransactionDecoderBase 实现TransactionDecoder的基类
 type TransactionDecoderBase struct {
 }
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/blocktree/openwallet/v2/log"
+	"github.com/blocktree/openwallet/v2/metrics"
 	"github.com/bwmarrin/snowflake"
 	"github.com/mr-tron/base58/base58"
 	"math/rand"
@@ -648,9 +649,19 @@ func (node *OWTPNode) Call(
 		}
 	}
 
+	//记录请求往返耗时
+	start := time.Now()
+	callback := reqFunc
+	reqFunc = func(resp Response) {
+		metrics.ObserveOWTPRequest(metrics.OWTPRoleClient, method, resp.Status, start)
+		if callback != nil {
+			callback(resp)
+		}
+	}
+
 	//添加请求队列到Map，处理完成回调方法
 	nonce := uint64(node.nonceGen.Generate().Int64())
-	time := time.Now().Unix()
+	time := start.Unix()
 
 	//封装数据包
 	packet := DataPacket{
@@ -1097,7 +1108,9 @@ func (node *OWTPNode) OnPeerNewDataPacketReceived(peer Peer, packet *DataPacket)
 		//解密后填充到输入参数
 		ctx.inputs = packet.Data
 
+		start := time.Now()
 		node.serveMux.ServeOWTP(peer.PID(), &ctx)
+		metrics.ObserveOWTPRequest(metrics.OWTPRoleServer, ctx.Method, ctx.Resp.Status, start)
 
 		retPacket := node.wrapDataPacketForResponse(peer, &ctx)
 
@@ -1197,6 +1210,7 @@ func (node *OWTPNode) AddOnlinePeer(peer Peer) {
 		node.onlinePeers = make(map[string]Peer)
 	}
 	node.onlinePeers[peer.PID()] = peer
+	metrics.SetOWTPPeers(node.NodeID(), len(node.onlinePeers))
 }
 
 //RemoveOfflinePeer 移除不在线的节点
@@ -1207,6 +1221,7 @@ func (node *OWTPNode) RemoveOfflinePeer(id string) {
 		return
 	}
 	delete(node.onlinePeers, id)
+	metrics.SetOWTPPeers(node.NodeID(), len(node.onlinePeers))
 }
 
 //GenerateRangeNum 生成范围内的随机整数